@@ -19,8 +19,25 @@ along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
 
 package main
 
-import "git.sr.ht/~gbmor/getwtxt/svc"
+import (
+	"os"
+
+	"git.sr.ht/~gbmor/getwtxt/svc"
+)
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			svc.Migrate(os.Args[2:])
+			return
+		case "export":
+			svc.Export(os.Args[2:])
+			return
+		case "import":
+			svc.Import(os.Args[2:])
+			return
+		}
+	}
 	svc.Start()
 }
@@ -0,0 +1,180 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// How many aliases Resolve will follow
+// before giving up on a chain.
+const maxAliasHops = 10
+
+// MovedError is returned by UpdateUser when a user's twtxt
+// file has permanently moved, after the user has been moved
+// to the new URL within the Registry.
+type MovedError struct {
+	From string
+	To   string
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("twtxt file moved permanently from %v to %v", e.From, e.To)
+}
+
+// Returns the URL a response was ultimately served from,
+// if every redirect leading to it was permanent (301 or
+// 308). Otherwise, or if there were no redirects, returns
+// an empty string.
+func permanentLocation(res *http.Response) string {
+	final := res.Request
+	if final == nil || final.Response == nil {
+		return ""
+	}
+
+	for req := final; req.Response != nil; req = req.Response.Request {
+		switch req.Response.StatusCode {
+		case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+		default:
+			return ""
+		}
+	}
+
+	return final.URL.String()
+}
+
+// MoveUser re-keys a user under a new URL, rewriting the URL
+// recorded in each of their statuses. If a user already exists
+// at the new URL, the old user's statuses are merged into it.
+// The old URL is kept as an alias of the new one, so Resolve
+// and QueryMentions still find it.
+func (registry *Registry) MoveUser(from, to string) error {
+	if registry == nil {
+		return fmt.Errorf("can't move user in uninitialized registry")
+	} else if !strings.HasPrefix(from, "http") || !strings.HasPrefix(to, "http") {
+		return fmt.Errorf("invalid URL: %v -> %v", from, to)
+	} else if from == to {
+		return nil
+	}
+
+	registry.Mu.Lock()
+	defer registry.Mu.Unlock()
+
+	user, ok := registry.Users[from]
+	if !ok {
+		return fmt.Errorf("can't move user %v, user doesn't exist", from)
+	}
+
+	user.Mu.Lock()
+	old := snapshot(user.Status)
+	moved := NewTimeMap()
+	for k, v := range user.Status {
+		if v.URL == from {
+			v = v.withURL(to)
+		}
+		moved[k] = v
+	}
+
+	if existing, ok := registry.Users[to]; ok && existing != user {
+		user.Mu.Unlock()
+		existing.Mu.Lock()
+		for k, v := range moved {
+			if _, ok := existing.Status[k]; ok {
+				delete(moved, k)
+				continue
+			}
+			existing.Status[k] = v
+		}
+		existing.Mu.Unlock()
+		registry.index.remove(old)
+		registry.index.insert(to, moved)
+	} else {
+		user.URL = to
+		user.LastModified = ""
+		user.Status = moved
+		user.Mu.Unlock()
+		registry.Users[to] = user
+		registry.index.remove(old)
+		registry.index.insert(to, moved)
+	}
+	delete(registry.Users, from)
+	registry.changes.delUser(from)
+
+	if registry.Aliases == nil {
+		registry.Aliases = make(map[string]string)
+	}
+	for k, v := range registry.Aliases {
+		if v == from {
+			registry.Aliases[k] = to
+			registry.changes.setAlias(k)
+		}
+	}
+	if _, ok := registry.Aliases[to]; ok {
+		// moving back to an old URL, so clear
+		// out the alias stored under it
+		delete(registry.Aliases, to)
+		registry.changes.delUser(to)
+	}
+	registry.Aliases[from] = to
+	registry.changes.setAlias(from)
+	registry.changes.addUser(to)
+
+	return nil
+}
+
+// Resolve follows any aliases left by MoveUser, returning
+// the URL the user is currently kept under. URLs without
+// an alias are returned unchanged.
+func (registry *Registry) Resolve(urlKey string) string {
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+	return registry.resolve(urlKey)
+}
+
+// Does the work of Resolve. Expects the
+// caller to hold the Registry's lock.
+func (registry *Registry) resolve(urlKey string) string {
+	for i := 0; i < maxAliasHops; i++ {
+		to, ok := registry.Aliases[urlKey]
+		if !ok {
+			break
+		}
+		urlKey = to
+	}
+	return urlKey
+}
+
+// Returns the URL along with all of its aliases,
+// after resolving it. Expects the caller to hold
+// the Registry's lock.
+func (registry *Registry) aliasesOf(urlKey string) []string {
+	urlKey = registry.resolve(urlKey)
+	urls := []string{urlKey}
+	for k := range registry.Aliases {
+		if registry.resolve(k) == urlKey {
+			urls = append(urls, k)
+		}
+	}
+	sort.Strings(urls[1:])
+	return urls
+}
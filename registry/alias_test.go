@@ -0,0 +1,157 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Serves a twtxt file at /new, which /old permanently
+// redirects to, and /temp temporarily redirects to.
+func movedServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old/twtxt.txt":
+			http.Redirect(w, r, "/new/twtxt.txt", http.StatusMovedPermanently)
+		case "/temp/twtxt.txt":
+			http.Redirect(w, r, "/new/twtxt.txt", http.StatusFound)
+		case "/new/twtxt.txt":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("2019-09-05T15:19:28Z\thi\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func Test_Registry_FetchUser_Moved(t *testing.T) {
+	srv := movedServer()
+	defer srv.Close()
+	registry := New(srv.Client())
+
+	t.Run("Permanent", func(t *testing.T) {
+		feed, err := registry.FetchUser(srv.URL+"/old/twtxt.txt", "foo")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if feed.MovedTo != srv.URL+"/new/twtxt.txt" {
+			t.Errorf("Expected move to be detected, got %#v\n", feed.MovedTo)
+		}
+	})
+	t.Run("Temporary", func(t *testing.T) {
+		feed, err := registry.FetchUser(srv.URL+"/temp/twtxt.txt", "foo")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if feed.MovedTo != "" {
+			t.Errorf("Temporary redirect treated as a move to %v\n", feed.MovedTo)
+		}
+	})
+}
+
+func Test_Registry_UpdateUser_Moved(t *testing.T) {
+	srv := movedServer()
+	defer srv.Close()
+	registry := New(srv.Client())
+
+	oldURL := srv.URL + "/old/twtxt.txt"
+	newURL := srv.URL + "/new/twtxt.txt"
+	earlier := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	registry.Users[oldURL] = &User{
+		Nick: "foo",
+		URL:  oldURL,
+		Status: TimeMap{
+			earlier: testStatus("foo\t" + oldURL + "\t2019-09-01T00:00:00Z\tolder"),
+		},
+	}
+
+	err := registry.UpdateUser(oldURL)
+	moved, ok := err.(*MovedError)
+	if !ok || moved.To != newURL {
+		t.Fatalf("Expected *MovedError to %v, got %v\n", newURL, err)
+	}
+
+	if _, ok := registry.Users[oldURL]; ok {
+		t.Errorf("User still kept under old URL\n")
+	}
+	user, ok := registry.Users[newURL]
+	if !ok {
+		t.Fatalf("User not moved to new URL\n")
+	}
+	if len(user.Status) != 2 {
+		t.Errorf("Expected 2 statuses after move, got %v\n", len(user.Status))
+	}
+	for _, e := range user.Status {
+		if e.URL == oldURL {
+			t.Errorf("Status still refers to old URL: %v\n", e)
+		}
+	}
+	if got := registry.Resolve(oldURL); got != newURL {
+		t.Errorf("Expected old URL to resolve to %v, got %v\n", newURL, got)
+	}
+	if err := registry.AddUser("foo", oldURL, nil, NewTimeMap()); err == nil {
+		t.Errorf("Re-adding the old URL should fail\n")
+	}
+}
+
+func Test_Registry_MoveUser_Merge(t *testing.T) {
+	registry := New(nil)
+	t1 := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2019, 9, 2, 0, 0, 0, 0, time.UTC)
+
+	registry.Users["https://old.example.com/twtxt.txt"] = &User{
+		Nick:   "foo",
+		URL:    "https://old.example.com/twtxt.txt",
+		Status: TimeMap{t1: testStatus("foo\thttps://old.example.com/twtxt.txt\t2019-09-01T00:00:00Z\tone")},
+	}
+	registry.Users["https://new.example.com/twtxt.txt"] = &User{
+		Nick:   "foo",
+		URL:    "https://new.example.com/twtxt.txt",
+		Status: TimeMap{t2: testStatus("foo\thttps://new.example.com/twtxt.txt\t2019-09-02T00:00:00Z\ttwo")},
+	}
+	registry.Users["https://bar.example.com/twtxt.txt"] = &User{
+		Nick:   "bar",
+		URL:    "https://bar.example.com/twtxt.txt",
+		Status: TimeMap{t2: testStatus("bar\thttps://bar.example.com/twtxt.txt\t2019-09-02T00:00:00Z\they @<foo https://old.example.com/twtxt.txt>")},
+	}
+	registry.Reindex()
+
+	if err := registry.MoveUser("https://old.example.com/twtxt.txt", "https://new.example.com/twtxt.txt"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	if len(registry.Users) != 2 {
+		t.Errorf("Expected duplicate user to be merged, have %v users\n", len(registry.Users))
+	}
+	if n := len(registry.Users["https://new.example.com/twtxt.txt"].Status); n != 2 {
+		t.Errorf("Expected 2 merged statuses, got %v\n", n)
+	}
+
+	mentions, err := registry.QueryMentions("https://new.example.com/twtxt.txt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(mentions) != 1 {
+		t.Errorf("Expected mention of old URL to resolve, got %v\n", mentions)
+	}
+}
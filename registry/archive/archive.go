@@ -0,0 +1,401 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package archive reads and writes a portable copy of a
+// twtxt Registry: its users, their statuses, aliases and
+// remote registries, as JSON lines.
+//
+// The first line is a header holding the format version,
+// when the archive was written and any metadata, such as
+// the version of getwtxt that wrote it:
+//
+//	{"archive":1,"created":"2019-09-01T00:00:00Z","meta":{"getwtxt":"v0.5.0"}}
+//
+// Each line after it holds a single record, one of:
+//
+//	{"user":{"url":"...","nick":"...","ip":"...","date":"...","last_modified":"...","remote_registry":"..."}}
+//	{"status":{"user":"...","nick":"...","url":"...","time":"...","text":"...","edits":[{"text":"...","seen":"..."}]}}
+//	{"alias":{"from":"...","to":"..."}}
+//	{"remote":"..."}
+//
+// A status's user is the URL of the user it's stored under,
+// which may differ from the URL of its author. Its edits, if
+// any, are its earlier versions, oldest first, and when each
+// change was seen. Times are in RFC3339 format, with
+// nanoseconds.
+package archive // import "git.sr.ht/~gbmor/getwtxt/registry/archive"
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+)
+
+// Version is the format written by Write. Archives
+// with a newer version can't be read.
+const Version = 1
+
+// Archive holds a copy of a Registry in memory. It's a
+// registry.Storage, so it's filled with Registry.Export
+// and read back with Registry.Import.
+type Archive struct {
+	// When the archive was written. Write sets
+	// it to the current time if it's zero.
+	Created time.Time
+
+	// Details about where the archive came from,
+	// such as the getwtxt version and instance.
+	Meta map[string]string
+
+	users   map[string]*registry.User
+	aliases map[string]string
+	remotes map[string]bool
+}
+
+var _ registry.PruneStorage = &Archive{}
+
+type header struct {
+	Version int               `json:"archive"`
+	Created time.Time         `json:"created"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// Exactly one field is set.
+type record struct {
+	User   *userRecord   `json:"user,omitempty"`
+	Status *statusRecord `json:"status,omitempty"`
+	Alias  *aliasRecord  `json:"alias,omitempty"`
+	Remote string        `json:"remote,omitempty"`
+}
+
+type userRecord struct {
+	URL            string `json:"url"`
+	Nick           string `json:"nick"`
+	IP             string `json:"ip,omitempty"`
+	Date           string `json:"date,omitempty"`
+	LastModified   string `json:"last_modified,omitempty"`
+	RemoteRegistry string `json:"remote_registry,omitempty"`
+}
+
+type statusRecord struct {
+	User  string       `json:"user"`
+	Nick  string       `json:"nick"`
+	URL   string       `json:"url"`
+	Time  time.Time    `json:"time"`
+	Text  string       `json:"text"`
+	Edits []editRecord `json:"edits,omitempty"`
+}
+
+type editRecord struct {
+	Text string    `json:"text"`
+	Seen time.Time `json:"seen"`
+}
+
+type aliasRecord struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// New returns an empty Archive.
+func New() *Archive {
+	return &Archive{
+		Meta:    make(map[string]string),
+		users:   make(map[string]*registry.User),
+		aliases: make(map[string]string),
+		remotes: make(map[string]bool),
+	}
+}
+
+// Read parses an archive written by Write.
+func Read(r io.Reader) (*Archive, error) {
+	dec := json.NewDecoder(r)
+
+	var head header
+	if err := dec.Decode(&head); err != nil {
+		return nil, fmt.Errorf("couldn't read archive header: %v", err)
+	}
+	if head.Version < 1 {
+		return nil, fmt.Errorf("not a getwtxt archive")
+	} else if head.Version > Version {
+		return nil, fmt.Errorf("archive version %v is newer than this version of getwtxt supports (%v)", head.Version, Version)
+	}
+
+	arc := New()
+	arc.Created = head.Created
+	for k, v := range head.Meta {
+		arc.Meta[k] = v
+	}
+
+	for n := 2; ; n++ {
+		var rec record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		if err := arc.add(&rec); err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+	}
+
+	return arc, nil
+}
+
+// Adds a record read from an archive.
+func (arc *Archive) add(rec *record) error {
+	switch {
+	case rec.User != nil:
+		if rec.User.URL == "" {
+			return fmt.Errorf("user without a URL")
+		}
+		user := arc.user(rec.User.URL)
+		user.Nick = rec.User.Nick
+		user.IP = net.ParseIP(rec.User.IP)
+		user.Date = rec.User.Date
+		user.LastModified = rec.User.LastModified
+		user.RemoteRegistry = rec.User.RemoteRegistry
+
+	case rec.Status != nil:
+		if rec.Status.User == "" || rec.Status.Time.IsZero() {
+			return fmt.Errorf("status without a user or time")
+		}
+		s := rec.Status
+		status := registry.NewStatus(s.Nick, s.URL, s.Time, s.Text)
+		for _, e := range s.Edits {
+			status.Edits = append(status.Edits, registry.Edit{Text: e.Text, Seen: e.Seen})
+		}
+		arc.user(s.User).Status[s.Time] = status
+
+	case rec.Alias != nil:
+		if rec.Alias.From == "" || rec.Alias.To == "" {
+			return fmt.Errorf("incomplete alias")
+		}
+		arc.aliases[rec.Alias.From] = rec.Alias.To
+
+	case rec.Remote != "":
+		arc.remotes[rec.Remote] = true
+
+	default:
+		return fmt.Errorf("unrecognized record")
+	}
+	return nil
+}
+
+// Returns the user at the URL, adding them if needed.
+func (arc *Archive) user(urlKey string) *registry.User {
+	user, ok := arc.users[urlKey]
+	if !ok {
+		user = registry.NewUser()
+		user.URL = urlKey
+		arc.users[urlKey] = user
+	}
+	return user
+}
+
+// Write writes the archive to w. Users are written in order
+// of URL, each followed by their statuses, oldest first, so
+// the same registry is always written the same way.
+func (arc *Archive) Write(w io.Writer) error {
+	if arc.Created.IsZero() {
+		arc.Created = time.Now().UTC()
+	}
+
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(header{Version: Version, Created: arc.Created, Meta: arc.Meta}); err != nil {
+		return err
+	}
+
+	for _, k := range sortedKeys(arc.users) {
+		user := arc.users[k]
+		var ip string
+		if user.IP != nil {
+			ip = user.IP.String()
+		}
+		err := enc.Encode(record{User: &userRecord{
+			URL:            k,
+			Nick:           user.Nick,
+			IP:             ip,
+			Date:           user.Date,
+			LastModified:   user.LastModified,
+			RemoteRegistry: user.RemoteRegistry,
+		}})
+		if err != nil {
+			return err
+		}
+
+		times := make(registry.TimeSlice, 0, len(user.Status))
+		for i := range user.Status {
+			times = append(times, i)
+		}
+		sort.Sort(sort.Reverse(times))
+		for _, i := range times {
+			s := user.Status[i]
+			var edits []editRecord
+			for _, e := range s.Edits {
+				edits = append(edits, editRecord{Text: e.Text, Seen: e.Seen})
+			}
+			err := enc.Encode(record{Status: &statusRecord{
+				User:  k,
+				Nick:  s.Nick,
+				URL:   s.URL,
+				Time:  s.Time,
+				Text:  s.Text,
+				Edits: edits,
+			}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	aliases := make([]string, 0, len(arc.aliases))
+	for k := range arc.aliases {
+		aliases = append(aliases, k)
+	}
+	sort.Strings(aliases)
+	for _, k := range aliases {
+		if err := enc.Encode(record{Alias: &aliasRecord{From: k, To: arc.aliases[k]}}); err != nil {
+			return err
+		}
+	}
+
+	remotes, _ := arc.RemoteRegistries()
+	for _, e := range remotes {
+		if err := enc.Encode(record{Remote: e}); err != nil {
+			return err
+		}
+	}
+
+	return buf.Flush()
+}
+
+func sortedKeys(users map[string]*registry.User) []string {
+	out := make([]string, 0, len(users))
+	for k := range users {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// LoadAll returns copies of the archived users and aliases.
+func (arc *Archive) LoadAll() (map[string]*registry.User, map[string]string, error) {
+	users := make(map[string]*registry.User, len(arc.users))
+	for k, v := range arc.users {
+		user := registry.NewUser()
+		user.Nick = v.Nick
+		user.URL = v.URL
+		user.IP = v.IP
+		user.Date = v.Date
+		user.LastModified = v.LastModified
+		user.RemoteRegistry = v.RemoteRegistry
+		for i, e := range v.Status {
+			user.Status[i] = e
+		}
+		users[k] = user
+	}
+
+	aliases := make(map[string]string, len(arc.aliases))
+	for k, v := range arc.aliases {
+		aliases[k] = v
+	}
+
+	return users, aliases, nil
+}
+
+// PutUser copies the user's information into the archive.
+func (arc *Archive) PutUser(urlKey string, user *registry.User) error {
+	if user == nil {
+		return fmt.Errorf("can't store nil user %v", urlKey)
+	}
+	stored := arc.user(urlKey)
+	stored.Nick = user.Nick
+	stored.IP = user.IP
+	stored.Date = user.Date
+	stored.LastModified = user.LastModified
+	stored.RemoteRegistry = user.RemoteRegistry
+	return nil
+}
+
+// PutStatuses adds the statuses to the user's in the archive.
+func (arc *Archive) PutStatuses(urlKey string, statuses registry.TimeMap) error {
+	user := arc.user(urlKey)
+	for k, v := range statuses {
+		if v != nil {
+			user.Status[k] = v
+		}
+	}
+	return nil
+}
+
+// DelStatuses removes the user's statuses
+// posted at the given times.
+func (arc *Archive) DelStatuses(urlKey string, times []time.Time) error {
+	if user, ok := arc.users[urlKey]; ok {
+		for _, e := range times {
+			delete(user.Status, e)
+		}
+	}
+	return nil
+}
+
+// PutAlias records that the user at one URL moved to another.
+func (arc *Archive) PutAlias(from, to string) error {
+	arc.aliases[from] = to
+	return nil
+}
+
+// DelUser removes the user and any alias for their URL.
+func (arc *Archive) DelUser(urlKey string) error {
+	delete(arc.users, urlKey)
+	delete(arc.aliases, urlKey)
+	return nil
+}
+
+// PutRemoteRegistry adds the remote registry's URL.
+func (arc *Archive) PutRemoteRegistry(urlKey string) error {
+	arc.remotes[urlKey] = true
+	return nil
+}
+
+// RemoteRegistries lists the archived remote registries,
+// sorted.
+func (arc *Archive) RemoteRegistries() ([]string, error) {
+	out := make([]string, 0, len(arc.remotes))
+	for k := range arc.remotes {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Close does nothing, as the archive is held in memory.
+func (arc *Archive) Close() error {
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+)
+
+func mockRegistry() *registry.Registry {
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	later := then.Add(time.Nanosecond)
+	urlKey := "https://example.com/twtxt.txt"
+
+	edited := registry.NewStatus("foo", urlKey, later, "tabs\tand \"quotes\"")
+	edited.Edits = []registry.Edit{{Text: "tabs\tand quotes", Seen: then.Add(time.Hour)}}
+
+	reg := registry.New(nil)
+	reg.AddUser("foo", urlKey, net.ParseIP("127.0.0.1"), registry.TimeMap{
+		then:  registry.NewStatus("foo", urlKey, then, "hello @<bar https://example.org/twtxt.txt>"),
+		later: edited,
+	})
+	reg.AddUser("bar", "https://example.org/twtxt.txt", nil, registry.NewTimeMap())
+	reg.Aliases["https://example.com/old.txt"] = urlKey
+	return reg
+}
+
+func Test_Archive_RoundTrip(t *testing.T) {
+	arc := New()
+	arc.Created = time.Date(2019, 9, 2, 0, 0, 0, 0, time.UTC)
+	arc.Meta["getwtxt"] = "v0.0.0"
+	if err := mockRegistry().Export(arc); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	arc.PutRemoteRegistry("https://twtxt.example.net/api/plain/users")
+
+	var buf bytes.Buffer
+	if err := arc.Write(&buf); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	written := buf.String()
+
+	read, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !read.Created.Equal(arc.Created) || read.Meta["getwtxt"] != "v0.0.0" {
+		t.Errorf("Header not read: %v %v\n", read.Created, read.Meta)
+	}
+
+	reg := registry.New(nil)
+	if err := reg.Import(read, false); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	user, err := reg.Get("https://example.com/twtxt.txt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if user.Nick != "foo" || user.IP.String() != "127.0.0.1" || len(user.Status) != 2 {
+		t.Errorf("User read incorrectly: %v %v %v\n", user.Nick, user.IP, user.Status)
+	}
+	for k, v := range mockRegistry().Users["https://example.com/twtxt.txt"].Status {
+		if got, ok := user.Status[k]; !ok || got.Text != v.Text || len(got.Mentions) != len(v.Mentions) || !reflect.DeepEqual(got.Edits, v.Edits) {
+			t.Errorf("Status at %v read incorrectly: %v\n", k, got)
+		}
+	}
+	if got := reg.Resolve("https://example.com/old.txt"); got != "https://example.com/twtxt.txt" {
+		t.Errorf("Alias not read, got %v\n", got)
+	}
+	if remotes, _ := read.RemoteRegistries(); len(remotes) != 1 {
+		t.Errorf("Remote registry not read: %v\n", remotes)
+	}
+
+	// The same archive should always
+	// be written the same way.
+	var again bytes.Buffer
+	read.Write(&again)
+	if again.String() != written {
+		t.Errorf("Archive written differently the second time:\n%v\n%v\n", written, again.String())
+	}
+}
+
+func Test_Read_Errors(t *testing.T) {
+	cases := map[string]string{
+		"Empty":        "",
+		"No Header":    `{"remote":"https://example.com/api"}` + "\n",
+		"Newer":        `{"archive":99,"created":"2019-09-01T00:00:00Z"}` + "\n",
+		"Unrecognized": `{"archive":1,"created":"2019-09-01T00:00:00Z"}` + "\n" + `{"widget":true}` + "\n",
+		"Bad Status":   `{"archive":1,"created":"2019-09-01T00:00:00Z"}` + "\n" + `{"status":{"user":"https://example.com/twtxt.txt"}}` + "\n",
+		"Truncated":    `{"archive":1,"created":"2019-09-01T00:00:00Z"}` + "\n" + `{"user":{"url":"https://exa`,
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Read(strings.NewReader(data)); err == nil {
+				t.Errorf("Expected error\n")
+			}
+		})
+	}
+}
@@ -0,0 +1,586 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package bolt stores a twtxt Registry in a bbolt database,
+// a single file written with transactions and no cgo.
+package bolt // import "git.sr.ht/~gbmor/getwtxt/registry/bolt"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// Each user has a bucket within the users bucket, keyed
+// by their URL, holding their information, a bucket of
+// their statuses keyed by time, and a bucket of the
+// earlier versions of statuses under the same keys.
+// The timeline bucket has an empty value for every
+// status, keyed by its time then its user's URL, so
+// statuses can be read in order without going through
+// every user. Aliases, remote registries, and statuses
+// that couldn't be read have top-level buckets of
+// their own.
+var (
+	usersBucket      = []byte("users")
+	statusesBucket   = []byte("statuses")
+	editsBucket      = []byte("edits")
+	timelineBucket   = []byte("timeline")
+	aliasesBucket    = []byte("aliases")
+	remotesBucket    = []byte("remote_registries")
+	quarantineBucket = []byte("quarantine")
+)
+
+// Store is a registry.Storage backed by bbolt.
+type Store struct {
+	db *bbolt.DB
+
+	// Set within Batch(), so writes are
+	// committed together.
+	tx *bbolt.Tx
+
+	// Set by OpenReadOnly, so LoadAll leaves
+	// statuses that can't be parsed in place.
+	readOnly bool
+}
+
+var _ registry.BatchStorage = &Store{}
+var _ registry.PruneStorage = &Store{}
+var _ registry.QueryStorage = &Store{}
+
+// Open opens the bbolt database at the provided path,
+// creating it if necessary, and builds the timeline if
+// the database predates it. If another process has the
+// file open, Open gives up after a second.
+func Open(path string) (*Store, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, e := range [][]byte{usersBucket, aliasesBucket, remotesBucket, quarantineBucket} {
+			if _, err := tx.CreateBucketIfNotExists(e); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(timelineBucket) == nil {
+			return buildTimeline(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// OpenReadOnly opens the existing bbolt database at the
+// provided path without writing to it. A database made
+// before the timeline was added can be read, but not
+// queried with QueryStatuses.
+func OpenReadOnly(path string) (*Store, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		for _, e := range [][]byte{usersBucket, aliasesBucket, remotesBucket} {
+			if tx.Bucket(e) == nil {
+				return fmt.Errorf("missing the %v bucket", string(e))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db, readOnly: true}, nil
+}
+
+// Close closes the database.
+func (blt *Store) Close() error {
+	return blt.db.Close()
+}
+
+// Batch runs the function within a single transaction,
+// which is rolled back if it returns an error.
+func (blt *Store) Batch(fn func(registry.Storage) error) error {
+	if blt.tx != nil {
+		return fn(blt)
+	}
+	return blt.db.Update(func(tx *bbolt.Tx) error {
+		return fn(&Store{db: blt.db, tx: tx})
+	})
+}
+
+// Runs the function within the current
+// transaction, or a new one.
+func (blt *Store) update(fn func(*bbolt.Tx) error) error {
+	if blt.tx != nil {
+		return fn(blt.tx)
+	}
+	return blt.db.Update(fn)
+}
+
+func (blt *Store) view(fn func(*bbolt.Tx) error) error {
+	if blt.tx != nil {
+		return fn(blt.tx)
+	}
+	return blt.db.View(fn)
+}
+
+// Sorts the same way as the time it's made from.
+// Flipping the sign bit puts times before 1970
+// ahead of those after.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano())^(1<<63))
+	return key
+}
+
+// Reads back a time made by timeKey, or the
+// zero time if the key isn't one.
+func keyTime(key []byte) time.Time {
+	if len(key) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key)^(1<<63))).UTC()
+}
+
+// The status's key in the timeline bucket.
+func timelineKey(urlKey string, t time.Time) []byte {
+	return append(timeKey(t), urlKey...)
+}
+
+// Creates the timeline bucket, adding every
+// status already stored to it.
+func buildTimeline(tx *bbolt.Tx) error {
+	timeline, err := tx.CreateBucket(timelineBucket)
+	if err != nil {
+		return err
+	}
+	users := tx.Bucket(usersBucket)
+	return users.ForEach(func(k, _ []byte) error {
+		user := users.Bucket(k)
+		if user == nil || user.Bucket(statusesBucket) == nil {
+			return nil
+		}
+		return user.Bucket(statusesBucket).ForEach(func(t, _ []byte) error {
+			// keys read from bbolt can't be appended to
+			key := append(append([]byte{}, t...), k...)
+			return timeline.Put(key, []byte{})
+		})
+	})
+}
+
+// PutUser stores the user's information in their bucket.
+func (blt *Store) PutUser(urlKey string, user *registry.User) error {
+	if user == nil {
+		return fmt.Errorf("can't store nil user %v", urlKey)
+	}
+
+	var ip string
+	if user.IP != nil {
+		ip = user.IP.String()
+	}
+	fields := map[string]string{
+		"nick":            user.Nick,
+		"url":             user.URL,
+		"ip":              ip,
+		"date":            user.Date,
+		"last_modified":   user.LastModified,
+		"remote_registry": user.RemoteRegistry,
+	}
+
+	return blt.update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.Bucket(usersBucket).CreateBucketIfNotExists([]byte(urlKey))
+		if err != nil {
+			return err
+		}
+		for k, v := range fields {
+			if err := bucket.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutStatuses stores each status in the user's
+// statuses bucket, keyed by when it was posted,
+// and its earlier versions in their edits bucket,
+// and adds it to the timeline.
+func (blt *Store) PutStatuses(urlKey string, statuses registry.TimeMap) error {
+	return blt.update(func(tx *bbolt.Tx) error {
+		user, err := tx.Bucket(usersBucket).CreateBucketIfNotExists([]byte(urlKey))
+		if err != nil {
+			return err
+		}
+		bucket, err := user.CreateBucketIfNotExists(statusesBucket)
+		if err != nil {
+			return err
+		}
+		edits, err := user.CreateBucketIfNotExists(editsBucket)
+		if err != nil {
+			return err
+		}
+		timeline := tx.Bucket(timelineBucket)
+		for _, v := range statuses {
+			if v == nil {
+				continue
+			}
+			key := timeKey(v.Time)
+			if err := bucket.Put(key, []byte(v.String())); err != nil {
+				return err
+			}
+			if err := timeline.Put(timelineKey(urlKey, v.Time), []byte{}); err != nil {
+				return err
+			}
+			if len(v.Edits) > 0 {
+				err = edits.Put(key, []byte(registry.FormatEdits(v.Edits)))
+			} else {
+				err = edits.Delete(key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DelStatuses deletes the user's statuses posted
+// at the given times, and their earlier versions.
+func (blt *Store) DelStatuses(urlKey string, times []time.Time) error {
+	return blt.update(func(tx *bbolt.Tx) error {
+		user := tx.Bucket(usersBucket).Bucket([]byte(urlKey))
+		if user == nil {
+			return nil
+		}
+		timeline := tx.Bucket(timelineBucket)
+		for _, e := range times {
+			if err := timeline.Delete(timelineKey(urlKey, e)); err != nil {
+				return err
+			}
+		}
+		for _, name := range [][]byte{statusesBucket, editsBucket} {
+			bucket := user.Bucket(name)
+			if bucket == nil {
+				continue
+			}
+			for _, e := range times {
+				if err := bucket.Delete(timeKey(e)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// PutAlias stores the URL a user moved to
+// under the URL they moved from.
+func (blt *Store) PutAlias(from, to string) error {
+	return blt.update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(aliasesBucket).Put([]byte(from), []byte(to))
+	})
+}
+
+// DelUser deletes the user's bucket and their statuses
+// in the timeline, along with any alias kept for their URL.
+func (blt *Store) DelUser(urlKey string) error {
+	return blt.update(func(tx *bbolt.Tx) error {
+		if user := tx.Bucket(usersBucket).Bucket([]byte(urlKey)); user != nil && user.Bucket(statusesBucket) != nil {
+			timeline := tx.Bucket(timelineBucket)
+			err := user.Bucket(statusesBucket).ForEach(func(k, _ []byte) error {
+				return timeline.Delete(append(append([]byte{}, k...), urlKey...))
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err := tx.Bucket(usersBucket).DeleteBucket([]byte(urlKey))
+		if err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		return tx.Bucket(aliasesBucket).Delete([]byte(urlKey))
+	})
+}
+
+// PutRemoteRegistry stores the remote registry's URL.
+func (blt *Store) PutRemoteRegistry(urlKey string) error {
+	return blt.update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(remotesBucket).Put([]byte(urlKey), []byte{})
+	})
+}
+
+// RemoteRegistries lists the stored remote registries.
+func (blt *Store) RemoteRegistries() ([]string, error) {
+	out := make([]string, 0)
+	err := blt.view(func(tx *bbolt.Tx) error {
+		return tx.Bucket(remotesBucket).ForEach(func(k, _ []byte) error {
+			out = append(out, string(k))
+			return nil
+		})
+	})
+	return out, err
+}
+
+// LoadAll reads every user, status and alias in the database.
+// Statuses that can't be parsed are quarantined. See Quarantined.
+// If the database was opened with OpenReadOnly, they're only
+// skipped.
+func (blt *Store) LoadAll() (map[string]*registry.User, map[string]string, error) {
+	users := make(map[string]*registry.User)
+	aliases := make(map[string]string)
+	var bad []badStatus
+
+	err := blt.view(func(tx *bbolt.Tx) error {
+		err := tx.Bucket(usersBucket).ForEach(func(k, _ []byte) error {
+			bucket := tx.Bucket(usersBucket).Bucket(k)
+			if bucket == nil {
+				return nil
+			}
+			users[string(k)] = readUser(string(k), bucket, &bad)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(aliasesBucket).ForEach(func(k, v []byte) error {
+			aliases[string(k)] = string(v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(bad) > 0 && !blt.readOnly {
+		if err := blt.quarantine(bad); err != nil {
+			return nil, nil, fmt.Errorf("couldn't quarantine %v unreadable statuses: %v", len(bad), err)
+		}
+	}
+
+	return users, aliases, nil
+}
+
+// A stored status that couldn't be parsed.
+type badStatus struct {
+	urlKey string
+	key    []byte
+	val    []byte
+}
+
+// Moves the statuses to the quarantine bucket, keyed
+// by their user's URL and the time they were stored
+// under, separated by a tab.
+func (blt *Store) quarantine(bad []badStatus) error {
+	return blt.update(func(tx *bbolt.Tx) error {
+		quarantined := tx.Bucket(quarantineBucket)
+		timeline := tx.Bucket(timelineBucket)
+		for _, e := range bad {
+			qkey := e.urlKey + "\t" + keyTime(e.key).Format(time.RFC3339Nano)
+			if err := quarantined.Put([]byte(qkey), e.val); err != nil {
+				return err
+			}
+			if err := timeline.Delete(append(append([]byte{}, e.key...), e.urlKey...)); err != nil {
+				return err
+			}
+			user := tx.Bucket(usersBucket).Bucket([]byte(e.urlKey))
+			if err := user.Bucket(statusesBucket).Delete(e.key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Quarantined returns the statuses LoadAll couldn't parse,
+// keyed by their user's URL and the time they were stored
+// under, separated by a tab, for an operator to inspect.
+func (blt *Store) Quarantined() (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	err := blt.view(func(tx *bbolt.Tx) error {
+		if tx.Bucket(quarantineBucket) == nil {
+			return nil
+		}
+		return tx.Bucket(quarantineBucket).ForEach(func(k, v []byte) error {
+			out[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// QueryStatuses walks the timeline from the newest status,
+// or from q.Before, reading only the statuses it needs.
+// Statuses posted at the same time are ordered by URL.
+func (blt *Store) QueryStatuses(q registry.StatusQuery) ([]*registry.Status, error) {
+	substring := strings.ToLower(q.Substring)
+	skip := q.Offset
+	out := make([]*registry.Status, 0)
+	done := func() bool { return q.Limit > 0 && len(out) >= q.Limit }
+
+	matches := func(status *registry.Status) bool {
+		if substring != "" && !strings.Contains(strings.ToLower(status.Text), substring) {
+			return false
+		}
+		if len(q.Mentions) == 0 {
+			return true
+		}
+		for _, m := range status.Mentions {
+			for _, e := range q.Mentions {
+				if m.URL == e {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	// matches sharing a time are held back
+	// until they can be put in order
+	var group []*registry.Status
+	flush := func() {
+		sort.SliceStable(group, func(i, j int) bool { return group[i].URL < group[j].URL })
+		for _, e := range group {
+			if done() {
+				break
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			out = append(out, e)
+		}
+		group = group[:0]
+	}
+
+	err := blt.view(func(tx *bbolt.Tx) error {
+		if tx.Bucket(timelineBucket) == nil {
+			return fmt.Errorf("database has no timeline to query")
+		}
+		users := tx.Bucket(usersBucket)
+		c := tx.Bucket(timelineBucket).Cursor()
+
+		var k []byte
+		if q.Before.IsZero() {
+			k, _ = c.Last()
+		} else if k, _ = c.Seek(timeKey(q.Before)); k != nil {
+			k, _ = c.Prev()
+		} else {
+			k, _ = c.Last()
+		}
+
+		var last []byte
+		for ; k != nil && !done(); k, _ = c.Prev() {
+			if len(k) < 8 {
+				continue
+			}
+			t, urlKey := k[:8], string(k[8:])
+			if last != nil && !bytes.Equal(t, last) {
+				flush()
+			}
+			last = append(last[:0], t...)
+
+			if q.User != "" && urlKey != q.User {
+				continue
+			}
+			user := users.Bucket([]byte(urlKey))
+			if user == nil || user.Bucket(statusesBucket) == nil {
+				continue
+			}
+			status, err := registry.ParseStoredStatus(string(user.Bucket(statusesBucket).Get(t)), keyTime(t))
+			if err != nil || !matches(status) {
+				continue
+			}
+			if edits := user.Bucket(editsBucket); edits != nil {
+				status.Edits, _ = registry.ParseEdits(string(edits.Get(t)))
+			}
+			group = append(group, status)
+		}
+		flush()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Reads a user from their bucket, adding the statuses
+// that can't be parsed to bad. Values read from bbolt
+// are only valid during the transaction, so they're
+// copied by converting them to strings.
+func readUser(urlKey string, bucket *bbolt.Bucket, bad *[]badStatus) *registry.User {
+	user := registry.NewUser()
+	user.URL = urlKey
+	if url := string(bucket.Get([]byte("url"))); url != "" {
+		user.URL = url
+	}
+	user.Nick = string(bucket.Get([]byte("nick")))
+	user.IP = net.ParseIP(string(bucket.Get([]byte("ip"))))
+	user.Date = string(bucket.Get([]byte("date")))
+	user.LastModified = string(bucket.Get([]byte("last_modified")))
+	user.RemoteRegistry = string(bucket.Get([]byte("remote_registry")))
+
+	statuses := bucket.Bucket(statusesBucket)
+	if statuses == nil {
+		return user
+	}
+	edits := bucket.Bucket(editsBucket)
+	statuses.ForEach(func(k, v []byte) error {
+		status, err := registry.ParseStoredStatus(string(v), keyTime(k))
+		if err != nil {
+			*bad = append(*bad, badStatus{
+				urlKey: urlKey,
+				key:    append([]byte{}, k...),
+				val:    append([]byte{}, v...),
+			})
+			return nil
+		}
+		if edits != nil {
+			status.Edits, _ = registry.ParseEdits(string(edits.Get(k)))
+		}
+		user.Status[status.Time] = status
+		return nil
+	})
+
+	return user
+}
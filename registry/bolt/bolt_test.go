@@ -0,0 +1,259 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	"git.sr.ht/~gbmor/getwtxt/registry/storagetest"
+	bbolt "go.etcd.io/bbolt"
+)
+
+func openTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store, err := Open(filepath.Join(dir, "getwtxt.bolt"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("%v\n", err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_Storage(t *testing.T) {
+	storagetest.Run(t, storagetest.Backend{
+		Open: func(t *testing.T) (registry.Storage, func()) {
+			return openTestStore(t)
+		},
+		CountEdits: func(store registry.Storage) (int, error) {
+			var n int
+			err := store.(*Store).view(func(tx *bbolt.Tx) error {
+				users := tx.Bucket(usersBucket)
+				return users.ForEach(func(k, _ []byte) error {
+					if edits := users.Bucket(k).Bucket(editsBucket); edits != nil {
+						n += edits.Stats().KeyN
+					}
+					return nil
+				})
+			})
+			return n, err
+		},
+	})
+}
+
+func Test_timeKey(t *testing.T) {
+	times := []time.Time{
+		time.Date(1969, 7, 20, 20, 17, 0, 0, time.UTC),
+		time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2019, 9, 1, 0, 0, 0, 1, time.UTC),
+		time.Date(2020, 1, 1, 0, 0, 0, 0, time.FixedZone("", 3600)),
+	}
+	for i := 1; i < len(times); i++ {
+		if string(timeKey(times[i-1])) >= string(timeKey(times[i])) {
+			t.Errorf("Key for %v doesn't sort before %v\n", times[i-1], times[i])
+		}
+	}
+}
+
+// Counts the statuses in the timeline.
+func timelineLen(t *testing.T, store *Store) int {
+	var n int
+	err := store.view(func(tx *bbolt.Tx) error {
+		return tx.Bucket(timelineBucket).ForEach(func(_, _ []byte) error {
+			n++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	return n
+}
+
+func Test_Store_Timeline(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	base := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	urls := []string{"https://a.example.com/twtxt.txt", "https://b.example.com/twtxt.txt"}
+	for _, e := range urls {
+		statuses := registry.NewTimeMap()
+		for i := 0; i < 3; i++ {
+			then := base.Add(time.Duration(i) * time.Hour)
+			statuses[then] = registry.NewStatus("foo", e, then, "status")
+		}
+		if err := store.PutStatuses(e, statuses); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	if n := timelineLen(t, store); n != 6 {
+		t.Errorf("Expected 6 statuses in the timeline, got %v\n", n)
+	}
+
+	if err := store.DelStatuses(urls[0], []time.Time{base}); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if n := timelineLen(t, store); n != 5 {
+		t.Errorf("Expected 5 statuses in the timeline after DelStatuses, got %v\n", n)
+	}
+
+	if err := store.DelUser(urls[1]); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if n := timelineLen(t, store); n != 2 {
+		t.Errorf("Expected 2 statuses in the timeline after DelUser, got %v\n", n)
+	}
+
+	t.Run("Built On Open", func(t *testing.T) {
+		path := store.db.Path()
+		err := store.db.Update(func(tx *bbolt.Tx) error {
+			return tx.DeleteBucket(timelineBucket)
+		})
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		store.Close()
+
+		reopened, err := Open(path)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		defer reopened.Close()
+		if n := timelineLen(t, reopened); n != 2 {
+			t.Errorf("Expected 2 statuses in the rebuilt timeline, got %v\n", n)
+		}
+	})
+}
+
+func Test_Store_QueryStatuses(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	reg := registry.New(nil)
+	base := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	for _, e := range []string{"https://a.example.com/twtxt.txt", "https://b.example.com/twtxt.txt"} {
+		statuses := registry.NewTimeMap()
+		for i := 0; i < 3; i++ {
+			then := base.Add(time.Duration(i) * time.Hour)
+			statuses[then] = registry.NewStatus("foo", e, then, "status #twtxt")
+		}
+		statuses[base].Edits = []registry.Edit{{Text: "status", Seen: base.Add(time.Minute)}}
+		reg.AddUser("foo", e, nil, statuses)
+	}
+	if err := reg.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	want, _ := reg.QueryAllStatuses()
+	got, err := store.QueryStatuses(registry.StatusQuery{Substring: "#TWTXT"})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v statuses, got %v\n", len(want), len(got))
+	}
+	for i := range got {
+		if got[i].Key() != want[i].Key() {
+			t.Errorf("Status %v out of order: %v != %v\n", i, got[i], want[i])
+		}
+	}
+
+	paged, err := store.QueryStatuses(registry.StatusQuery{Offset: 1, Limit: 2})
+	if err != nil || len(paged) != 2 || paged[0].Key() != want[1].Key() || paged[1].Key() != want[2].Key() {
+		t.Errorf("Unexpected page: %v, %v\n", paged, err)
+	}
+
+	oldest, err := store.QueryStatuses(registry.StatusQuery{
+		User:   "https://b.example.com/twtxt.txt",
+		Before: base.Add(time.Hour),
+	})
+	if err != nil || len(oldest) != 1 {
+		t.Fatalf("Unexpected result: %v, %v\n", oldest, err)
+	}
+	if edits := oldest[0].Edits; len(edits) != 1 || edits[0].Text != "status" || !edits[0].Seen.Equal(base.Add(time.Minute)) {
+		t.Errorf("Edits not loaded: %v\n", edits)
+	}
+
+	mentions, err := store.QueryStatuses(registry.StatusQuery{Mentions: []string{"https://c.example.com/twtxt.txt"}})
+	if err != nil || len(mentions) != 0 {
+		t.Errorf("Unexpected mentions: %v, %v\n", mentions, err)
+	}
+}
+
+// Statuses stored with the timestamp from the twtxt file
+// are read back, and those that can't be read at all
+// are set aside rather than skipped.
+func Test_Store_LoadAll_StoredTimestamps(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	urlKey := "https://x/twtxt.txt"
+	then := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := store.PutUser(urlKey, registry.NewUser()); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err := store.update(func(tx *bbolt.Tx) error {
+		statuses, err := tx.Bucket(usersBucket).Bucket([]byte(urlKey)).CreateBucketIfNotExists(statusesBucket)
+		if err != nil {
+			return err
+		}
+		if err := statuses.Put(timeKey(then), []byte("foo\thttps://x/twtxt.txt\t2019-05-01T12:00Z\thello")); err != nil {
+			return err
+		}
+		if err := statuses.Put(timeKey(then.Add(time.Hour)), []byte("foo\thttps://x/twtxt.txt\tlater\thi")); err != nil {
+			return err
+		}
+		return statuses.Put(timeKey(then.Add(2*time.Hour)), []byte("garbage"))
+	})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	users, _, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	stored := users[urlKey].Status
+	if status, ok := stored[then]; !ok || status.Text != "hello" {
+		t.Errorf("Status without seconds not loaded: %v\n", stored)
+	}
+	if status, ok := stored[then.Add(time.Hour)]; !ok || status.Text != "hi" {
+		t.Errorf("Status with unreadable timestamp not given its stored time: %v\n", stored)
+	}
+	if len(stored) != 2 {
+		t.Errorf("Expected 2 statuses loaded, got %v\n", stored)
+	}
+
+	quarantined, err := store.Quarantined()
+	qkey := urlKey + "\t" + then.Add(2*time.Hour).Format(time.RFC3339Nano)
+	if err != nil || len(quarantined) != 1 || string(quarantined[qkey]) != "garbage" {
+		t.Errorf("Unreadable status not quarantined: %v, %v\n", quarantined, err)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// DefaultAcceptTypes are the media types accepted as twtxt
+// files when ContentRules.AcceptTypes is empty. Many hosts
+// serve plain text files as application/octet-stream.
+var DefaultAcceptTypes = []string{"text/plain", "application/octet-stream"}
+
+// ContentRules decides which responses are accepted
+// as twtxt files, and how they're decoded.
+type ContentRules struct {
+	// Media types accepted, such as "text/plain". A
+	// subtype of "*" accepts any subtype, and "*/*"
+	// accepts anything. A response without a
+	// Content-Type is treated as
+	// application/octet-stream. If empty,
+	// DefaultAcceptTypes is used.
+	AcceptTypes []string
+
+	// The charset assumed when a response doesn't
+	// declare one. If empty, UTF-8 is assumed.
+	DefaultCharset string
+}
+
+// Describes how a response was decoded.
+type contentInfo struct {
+	mediaType string
+	charset   string
+	bom       bool
+}
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+)
+
+// Reports whether the response's media type is accepted,
+// returning the media type and any declared charset.
+func (rules ContentRules) accepts(header http.Header) (string, string, bool) {
+	mediaType := "application/octet-stream"
+	var charset string
+	if ct := header.Get("Content-Type"); ct != "" {
+		parsed, params, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return ct, "", false
+		}
+		mediaType = parsed
+		charset = params["charset"]
+	}
+
+	accept := rules.AcceptTypes
+	if len(accept) == 0 {
+		accept = DefaultAcceptTypes
+	}
+
+	for _, e := range accept {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch {
+		case e == "*/*" || e == mediaType:
+			return mediaType, charset, true
+		case strings.HasSuffix(e, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(e, "*")):
+			return mediaType, charset, true
+		}
+	}
+
+	return mediaType, charset, false
+}
+
+// Wraps a response body so that it reads as UTF-8. A byte
+// order mark takes precedence over the declared charset,
+// which takes precedence over the default. The BOM itself
+// is stripped.
+func (rules ContentRules) decode(body io.Reader, mediaType, charset string) (io.Reader, contentInfo, error) {
+	info := contentInfo{mediaType: mediaType}
+	buffered := bufio.NewReader(body)
+
+	// Errors are ignored here, as they'll be
+	// encountered again when the body is read.
+	lead, _ := buffered.Peek(3)
+	switch {
+	case bytes.HasPrefix(lead, bomUTF8):
+		charset = "utf-8"
+		info.bom = true
+		buffered.Discard(len(bomUTF8))
+	case bytes.HasPrefix(lead, bomUTF16BE):
+		charset = "utf-16be"
+		info.bom = true
+		buffered.Discard(len(bomUTF16BE))
+	case bytes.HasPrefix(lead, bomUTF16LE):
+		charset = "utf-16le"
+		info.bom = true
+		buffered.Discard(len(bomUTF16LE))
+	}
+
+	if charset == "" {
+		charset = rules.DefaultCharset
+	}
+	if charset == "" {
+		charset = "utf-8"
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, info, fmt.Errorf("unsupported charset: %v", charset)
+	}
+	info.charset, _ = htmlindex.Name(enc)
+
+	if info.charset == "utf-8" {
+		return buffered, info, nil
+	}
+	return transform.NewReader(buffered, enc.NewDecoder()), info, nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var fetchContentCases = []struct {
+	name        string
+	contentType string
+	body        []byte
+	rules       ContentRules
+	wantErr     bool
+	charset     string
+	bom         bool
+}{
+	{
+		name:        "Plain UTF-8",
+		contentType: "text/plain; charset=utf-8",
+		body:        []byte("2019-09-05T15:19:28Z\tcafé\n"),
+		charset:     "utf-8",
+	},
+	{
+		name:        "Octet Stream",
+		contentType: "application/octet-stream",
+		body:        []byte("2019-09-05T15:19:28Z\tcafé\n"),
+		charset:     "utf-8",
+	},
+	{
+		name:        "Latin-1 With CRLF",
+		contentType: "text/plain; charset=iso-8859-1",
+		body:        []byte("2019-09-05T15:19:28Z\tcaf\xe9\r\n"),
+		charset:     "windows-1252",
+	},
+	{
+		name:        "UTF-8 BOM",
+		contentType: "text/plain",
+		body:        []byte("\xef\xbb\xbf2019-09-05T15:19:28Z\tcafé\n"),
+		charset:     "utf-8",
+		bom:         true,
+	},
+	{
+		name:        "UTF-16 BOM",
+		contentType: "text/plain; charset=utf-8",
+		body:        utf16le("\ufeff2019-09-05T15:19:28Z\tcafé\r\n"),
+		charset:     "utf-16le",
+		bom:         true,
+	},
+	{
+		name:        "Default Charset",
+		contentType: "text/plain",
+		body:        []byte("2019-09-05T15:19:28Z\tcaf\xe9\n"),
+		rules:       ContentRules{DefaultCharset: "latin1"},
+		charset:     "windows-1252",
+	},
+	{
+		name:        "Rejected Type",
+		contentType: "text/html",
+		body:        []byte("<html></html>"),
+		wantErr:     true,
+	},
+	{
+		name:        "Wildcard Type",
+		contentType: "text/x-twtxt",
+		body:        []byte("2019-09-05T15:19:28Z\tcafé\n"),
+		rules:       ContentRules{AcceptTypes: []string{"text/*"}},
+		charset:     "utf-8",
+	},
+	{
+		name:        "Unknown Charset",
+		contentType: "text/plain; charset=klingon",
+		body:        []byte("2019-09-05T15:19:28Z\tcafé\n"),
+		wantErr:     true,
+	},
+}
+
+// Encodes ASCII and Latin-1 text as UTF-16LE.
+func utf16le(s string) []byte {
+	var out []byte
+	for _, r := range s {
+		out = append(out, byte(r), byte(r>>8))
+	}
+	return out
+}
+
+func Test_Registry_FetchUser_Content(t *testing.T) {
+	for _, tt := range fetchContentCases {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write(tt.body)
+			}))
+			defer srv.Close()
+
+			registry := New(srv.Client())
+			registry.Content = tt.rules
+
+			feed, err := registry.FetchUser(srv.URL+"/twtxt.txt", "foo")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got none\n")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%v\n", err)
+			}
+
+			if feed.Charset != tt.charset || feed.BOM != tt.bom {
+				t.Errorf("Expected charset %v (BOM %v), got %v (BOM %v)\n", tt.charset, tt.bom, feed.Charset, feed.BOM)
+			}
+			if len(feed.Statuses) != 1 {
+				t.Fatalf("Expected 1 status, got %v\n", len(feed.Statuses))
+			}
+			for _, e := range feed.Statuses {
+				if e.Text != "café" {
+					t.Errorf("Status not decoded to UTF-8: %q\n", e)
+				}
+			}
+		})
+	}
+}
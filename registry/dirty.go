@@ -0,0 +1,180 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"sync"
+	"time"
+)
+
+// Tracks what's changed in a Registry since it was last
+// saved, so Save only has to write that. Changes are marked
+// after the Registry is modified, so a Save running between
+// the two writes the new data early rather than missing it.
+// The mutex is never held while taking another lock.
+type changes struct {
+	mu      sync.Mutex
+	users   map[string]*userChanges
+	deleted map[string]bool
+	aliases map[string]bool
+}
+
+// What's changed for a single user. If all is set,
+// their information and every status are saved.
+// Removed statuses are deleted unless the user
+// has a status at the same time when saved.
+type userChanges struct {
+	all      bool
+	info     bool
+	statuses map[time.Time]bool
+	removed  map[time.Time]bool
+}
+
+func newChanges() *changes {
+	return &changes{
+		users:   make(map[string]*userChanges),
+		deleted: make(map[string]bool),
+		aliases: make(map[string]bool),
+	}
+}
+
+// Returns the user's changes. The caller
+// must hold the changes' mutex.
+func (c *changes) user(urlKey string) *userChanges {
+	uc, ok := c.users[urlKey]
+	if !ok {
+		uc = &userChanges{
+			statuses: make(map[time.Time]bool),
+			removed:  make(map[time.Time]bool),
+		}
+		c.users[urlKey] = uc
+	}
+	return uc
+}
+
+// Marks the user's information and all of
+// their statuses, such as when they're added.
+func (c *changes) addUser(urlKey string) {
+	c.mu.Lock()
+	c.user(urlKey).all = true
+	c.mu.Unlock()
+}
+
+// Marks the user's information.
+func (c *changes) setInfo(urlKey string) {
+	c.mu.Lock()
+	c.user(urlKey).info = true
+	c.mu.Unlock()
+}
+
+// Marks some of the user's statuses.
+func (c *changes) addStatuses(urlKey string, times []time.Time) {
+	if len(times) == 0 {
+		return
+	}
+	c.mu.Lock()
+	uc := c.user(urlKey)
+	for _, e := range times {
+		uc.statuses[e] = true
+	}
+	c.mu.Unlock()
+}
+
+// Marks some of the user's statuses as removed,
+// such as when they're pruned.
+func (c *changes) delStatuses(urlKey string, times []time.Time) {
+	if len(times) == 0 {
+		return
+	}
+	c.mu.Lock()
+	uc := c.user(urlKey)
+	for _, e := range times {
+		uc.removed[e] = true
+	}
+	c.mu.Unlock()
+}
+
+// Marks the user as deleted. Anything stored under
+// their URL is removed before any later changes
+// to a user at the same URL are written.
+func (c *changes) delUser(urlKey string) {
+	c.mu.Lock()
+	delete(c.users, urlKey)
+	c.deleted[urlKey] = true
+	c.mu.Unlock()
+}
+
+// Marks the alias kept for the URL.
+func (c *changes) setAlias(urlKey string) {
+	c.mu.Lock()
+	c.aliases[urlKey] = true
+	c.mu.Unlock()
+}
+
+// Returns the pending changes, leaving
+// none in their place.
+func (c *changes) take() *changes {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := &changes{
+		users:   c.users,
+		deleted: c.deleted,
+		aliases: c.aliases,
+	}
+	c.users = make(map[string]*userChanges)
+	c.deleted = make(map[string]bool)
+	c.aliases = make(map[string]bool)
+
+	return pending
+}
+
+// Puts back changes that couldn't be saved. Anything
+// marked since they were taken still applies, and is
+// written after them.
+func (c *changes) restore(pending *changes) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k := range pending.deleted {
+		c.deleted[k] = true
+	}
+	for k, v := range pending.users {
+		uc := c.user(k)
+		uc.all = uc.all || v.all
+		uc.info = uc.info || v.info
+		for i := range v.statuses {
+			uc.statuses[i] = true
+		}
+		for i := range v.removed {
+			uc.removed[i] = true
+		}
+	}
+	for k := range pending.aliases {
+		c.aliases[k] = true
+	}
+}
+
+// Reports whether there's anything to save.
+func (c *changes) empty() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.users) == 0 && len(c.deleted) == 0 && len(c.aliases) == 0
+}
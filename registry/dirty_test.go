@@ -0,0 +1,181 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Records what Save writes, and fails
+// while fail is set.
+type countingStorage struct {
+	*memStorage
+	users    int
+	statuses int
+	deleted  []string
+	fail     bool
+}
+
+func (c *countingStorage) PutUser(urlKey string, user *User) error {
+	if c.fail {
+		return fmt.Errorf("failing on purpose")
+	}
+	c.users++
+	return c.memStorage.PutUser(urlKey, user)
+}
+
+func (c *countingStorage) PutStatuses(urlKey string, statuses TimeMap) error {
+	c.statuses += len(statuses)
+	return c.memStorage.PutStatuses(urlKey, statuses)
+}
+
+func (c *countingStorage) DelUser(urlKey string) error {
+	c.deleted = append(c.deleted, urlKey)
+	return c.memStorage.DelUser(urlKey)
+}
+
+func (c *countingStorage) reset() {
+	c.users, c.statuses, c.deleted = 0, 0, nil
+}
+
+func Test_Registry_Save_Changes(t *testing.T) {
+	body := "2019-09-01T00:00:00Z\tone\n2019-09-02T00:00:00Z\ttwo\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	registry := New(srv.Client())
+	store := &countingStorage{memStorage: newMemStorage()}
+	urlKey := srv.URL + "/twtxt.txt"
+
+	feed, err := registry.FetchUser(urlKey, "foo")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := registry.AddUser("foo", urlKey, nil, feed.Statuses); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	t.Run("New User", func(t *testing.T) {
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if store.users != 1 || store.statuses != 2 {
+			t.Errorf("Expected 1 user and 2 statuses written, got %v and %v\n", store.users, store.statuses)
+		}
+		if registry.Dirty() {
+			t.Errorf("Registry still dirty after saving\n")
+		}
+	})
+
+	t.Run("No Changes", func(t *testing.T) {
+		store.reset()
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if store.users != 0 || store.statuses != 0 {
+			t.Errorf("Unchanged registry wrote %v users and %v statuses\n", store.users, store.statuses)
+		}
+	})
+
+	t.Run("New Status", func(t *testing.T) {
+		store.reset()
+		body += "2019-09-03T00:00:00Z\tthree\n"
+		if err := registry.UpdateUser(urlKey); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if store.statuses != 1 {
+			t.Errorf("Expected only the new status written, got %v\n", store.statuses)
+		}
+	})
+
+	t.Run("Failed Save", func(t *testing.T) {
+		store.reset()
+		registry.Put(registry.Users[urlKey])
+		store.fail = true
+		if err := registry.Save(store); err == nil {
+			t.Errorf("Expected error from failing storage\n")
+		}
+		if !registry.Dirty() {
+			t.Errorf("Changes lost after failed save\n")
+		}
+		store.fail = false
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if store.users != 1 || store.statuses != 3 {
+			t.Errorf("Retried save wrote %v users and %v statuses\n", store.users, store.statuses)
+		}
+	})
+
+	t.Run("Deleted User", func(t *testing.T) {
+		store.reset()
+		if err := registry.DelUser(urlKey); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if len(store.deleted) != 1 || store.deleted[0] != urlKey {
+			t.Errorf("Expected %v deleted, got %v\n", urlKey, store.deleted)
+		}
+		if _, ok := store.memStorage.users[urlKey]; ok {
+			t.Errorf("User still stored\n")
+		}
+	})
+}
+
+func Test_Registry_Save_Moved(t *testing.T) {
+	registry := New(nil)
+	store := &countingStorage{memStorage: newMemStorage()}
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	from := "https://old.example.com/twtxt.txt"
+	to := "https://new.example.com/twtxt.txt"
+
+	registry.AddUser("foo", from, nil, TimeMap{then: NewStatus("foo", from, then, "hi")})
+	if err := registry.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := registry.MoveUser(from, to); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := registry.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	if _, ok := store.memStorage.users[from]; ok {
+		t.Errorf("User still stored under old URL\n")
+	}
+	if _, ok := store.memStorage.users[to]; !ok {
+		t.Errorf("User not stored under new URL\n")
+	}
+	if store.aliases[from] != to {
+		t.Errorf("Alias not stored: %v\n", store.aliases)
+	}
+}
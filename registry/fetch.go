@@ -22,7 +22,9 @@ package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -39,47 +41,124 @@ const rfc3339WithoutSeconds = "2006-01-02T15:04Z07:00"
 // another registry's /api/plain/tweets. The output of
 // GetTwtxt should be passed to either ParseUserTwtxt or
 // ParseRegistryTwtxt, respectively.
+// The default ContentRules apply, and the data is returned
+// as UTF-8. At most DefaultMaxBodySize bytes are read. If the file is
+// larger, the complete lines read so far are returned along
+// with a *TruncatedError. To parse a single user's twtxt file
+// as it's read, use Registry.FetchUser instead.
 // Generally, the *http.Client inside a given Registry instance should
 // be passed to GetTwtxt. If the *http.Client passed is nil,
 // Registry will use a preconstructed client with a
 // timeout of 10s and all other values set to default.
 func GetTwtxt(urlKey string, client *http.Client) ([]byte, bool, error) {
-	if !strings.HasPrefix(urlKey, "http://") && !strings.HasPrefix(urlKey, "https://") {
-		return nil, false, fmt.Errorf("invalid URL: %v", urlKey)
-	}
+	return GetTwtxtContext(context.Background(), urlKey, client)
+}
 
-	res, err := doReq(urlKey, "GET", "", client)
+// GetTwtxtContext is GetTwtxt, with the request bound
+// to the provided context.
+func GetTwtxtContext(ctx context.Context, urlKey string, client *http.Client) ([]byte, bool, error) {
+	res, decoded, _, err := openTwtxt(ctx, urlKey, client, ContentRules{})
 	if err != nil {
 		return nil, false, err
 	}
 	defer res.Body.Close()
 
-	var textPlain bool
-	for _, v := range res.Header["Content-Type"] {
-		if strings.Contains(v, "text/plain") {
-			textPlain = true
-			break
+	body := &boundedReader{r: decoded, n: DefaultMaxBodySize}
+	twtxt, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading response body from %v: %v", urlKey, err)
+	}
+
+	if body.exceeded {
+		// drop the incomplete final line
+		if i := bytes.LastIndexByte(twtxt, '\n'); i >= 0 {
+			twtxt = twtxt[:i+1]
 		}
+		return twtxt, IsRemoteRegistry(urlKey), &TruncatedError{Limit: "size", Max: DefaultMaxBodySize}
 	}
-	if !textPlain {
-		return nil, false, fmt.Errorf("received non-text/plain response body from %v", urlKey)
+
+	return twtxt, IsRemoteRegistry(urlKey), nil
+}
+
+// FetchUser fetches a single user's twtxt file and parses it
+// as it's read, within the bounds of the Registry's Limits.
+// See ReadUserTwtxt for the meaning of the returned values.
+// The response must satisfy the Registry's ContentRules, and is
+// transcoded to UTF-8 as needed. If the file was reached only
+// through permanent redirects, Feed.MovedTo is set to its new URL.
+func (registry *Registry) FetchUser(urlKey, nickname string) (*Feed, error) {
+	return registry.FetchUserContext(context.Background(), urlKey, nickname)
+}
+
+// FetchUserContext is FetchUser, with the request
+// bound to the provided context.
+func (registry *Registry) FetchUserContext(ctx context.Context, urlKey, nickname string) (*Feed, error) {
+	if IsRemoteRegistry(urlKey) {
+		return nil, fmt.Errorf("can't fetch registry URL as a single user: %v", urlKey)
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, false, fmt.Errorf("didn't get 200 from remote server, received %v: %v", res.StatusCode, urlKey)
+	registry.Mu.RLock()
+	limits := registry.Limits
+	rules := registry.Content
+	registry.Mu.RUnlock()
+
+	res, decoded, info, err := openTwtxt(ctx, urlKey, registry.HTTPClient, rules)
+	if err != nil {
+		return nil, err
 	}
+	defer res.Body.Close()
 
-	twtxt, err := ioutil.ReadAll(res.Body)
+	feed, err := ReadUserTwtxt(decoded, nickname, urlKey, limits)
+	if feed != nil {
+		if loc := permanentLocation(res); loc != urlKey {
+			feed.MovedTo = loc
+		}
+		feed.ContentType = info.mediaType
+		feed.Charset = info.charset
+		feed.BOM = info.bom
+	}
+	return feed, err
+}
+
+// IsRemoteRegistry reports whether the URL points to the
+// status output of another registry, rather than a single
+// user's twtxt file.
+func IsRemoteRegistry(urlKey string) bool {
+	return strings.HasSuffix(urlKey, "/api/plain/tweets") || strings.HasSuffix(urlKey, "/api/plain/tweets/all")
+}
+
+// Requests a twtxt file, returning the response if it's
+// acceptable under the provided rules, along with a reader
+// of its body decoded to UTF-8. The caller must close the
+// response body.
+func openTwtxt(ctx context.Context, urlKey string, client *http.Client, rules ContentRules) (*http.Response, io.Reader, contentInfo, error) {
+	if !strings.HasPrefix(urlKey, "http://") && !strings.HasPrefix(urlKey, "https://") {
+		return nil, nil, contentInfo{}, fmt.Errorf("invalid URL: %v", urlKey)
+	}
+
+	res, err := doReq(ctx, urlKey, "GET", "", client)
 	if err != nil {
-		return nil, false, fmt.Errorf("error reading response body from %v: %v", urlKey, err)
+		return nil, nil, contentInfo{}, err
 	}
 
-	// Signal that we're adding another twtxt registry as a "user"
-	if strings.HasSuffix(urlKey, "/api/plain/tweets") || strings.HasSuffix(urlKey, "/api/plain/tweets/all") {
-		return twtxt, true, nil
+	mediaType, charset, ok := rules.accepts(res.Header)
+	if !ok {
+		res.Body.Close()
+		return nil, nil, contentInfo{}, fmt.Errorf("received unaccepted content type %v from %v", mediaType, urlKey)
 	}
 
-	return twtxt, false, nil
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, nil, contentInfo{}, fmt.Errorf("didn't get 200 from remote server, received %v: %v", res.StatusCode, urlKey)
+	}
+
+	decoded, info, err := rules.decode(res.Body, mediaType, charset)
+	if err != nil {
+		res.Body.Close()
+		return nil, nil, contentInfo{}, fmt.Errorf("can't decode twtxt file from %v: %v", urlKey, err)
+	}
+
+	return res, decoded, info, nil
 }
 
 // DiffTwtxt issues a HEAD request on the user's
@@ -92,34 +171,40 @@ func GetTwtxt(urlKey string, client *http.Client) ([]byte, bool, error) {
 // In other error conditions considered "unrecoverable,"
 // such as the supplied URL being invalid, it returns false.
 func (registry *Registry) DiffTwtxt(urlKey string) (bool, error) {
+	return registry.DiffTwtxtContext(context.Background(), urlKey)
+}
+
+// DiffTwtxtContext is DiffTwtxt, with the request
+// bound to the provided context.
+func (registry *Registry) DiffTwtxtContext(ctx context.Context, urlKey string) (bool, error) {
 	if !strings.HasPrefix(urlKey, "http://") && !strings.HasPrefix(urlKey, "https://") {
 		return false, fmt.Errorf("invalid URL: %v", urlKey)
 	}
 
-	registry.Mu.Lock()
+	registry.Mu.RLock()
 	user, ok := registry.Users[urlKey]
+	registry.Mu.RUnlock()
 	if !ok {
 		return true, fmt.Errorf("user not in registry")
 	}
 
-	user.Mu.Lock()
-
-	defer func() {
-		registry.Users[urlKey] = user
-		user.Mu.Unlock()
-		registry.Mu.Unlock()
-	}()
+	user.Mu.RLock()
+	lastModified := user.LastModified
+	user.Mu.RUnlock()
 
-	res, err := doReq(urlKey, "HEAD", user.LastModified, registry.HTTPClient)
+	// The request may wait on the client's Limiter,
+	// so no locks are held while it's made.
+	res, err := doReq(ctx, urlKey, "HEAD", lastModified, registry.HTTPClient)
 	if err != nil {
 		return false, err
 	}
+	res.Body.Close()
 
 	switch res.StatusCode {
 	case http.StatusOK:
 		for _, e := range res.Header["Last-Modified"] {
-			if e != "" {
-				user.LastModified = e
+			if e != "" && e != lastModified {
+				registry.setLastModified(urlKey, user, e)
 				break
 			}
 		}
@@ -132,8 +217,25 @@ func (registry *Registry) DiffTwtxt(urlKey string) (bool, error) {
 	return false, nil
 }
 
+// Stores the Last-Modified header received for the user,
+// unless they've been removed or replaced in the meantime.
+func (registry *Registry) setLastModified(urlKey string, user *User, lastModified string) {
+	registry.Mu.RLock()
+	current := registry.Users[urlKey]
+	registry.Mu.RUnlock()
+	if current != user {
+		return
+	}
+
+	user.Mu.Lock()
+	user.LastModified = lastModified
+	user.Mu.Unlock()
+	registry.changes.setInfo(urlKey)
+}
+
 // internal function. boilerplate for http requests.
-func doReq(urlKey, method, modTime string, client *http.Client) (*http.Response, error) {
+// The request is cancelled along with ctx.
+func doReq(ctx context.Context, urlKey, method, modTime string, client *http.Client) (*http.Response, error) {
 	if client == nil {
 		client = &http.Client{
 			Transport:     nil,
@@ -150,6 +252,16 @@ func doReq(urlKey, method, modTime string, client *http.Client) (*http.Response,
 		return nil, err
 	}
 
+	// Wait for the limiter up front, so time spent
+	// queued doesn't count against the client's Timeout.
+	if l, ok := client.Transport.(*Limiter); ok {
+		ctx, err = l.prepay(ctx, req.URL.Host)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't %v %v: %v", method, urlKey, err)
+		}
+	}
+	req = req.WithContext(ctx)
+
 	if modTime != "" {
 		req.Header.Set("If-Modified-Since", modTime)
 	}
@@ -165,60 +277,27 @@ func doReq(urlKey, method, modTime string, client *http.Client) (*http.Response,
 // ParseUserTwtxt takes a fetched twtxt file in the form of
 // a slice of bytes, parses it, and returns it as a
 // TimeMap. The output may then be passed to Index.AddUser()
+// The default Limits apply. Lines that can't be parsed are
+// skipped, and returned as ParseErrors alongside the statuses
+// that could be. Otherwise, if the Limits are exceeded, the
+// statuses that could be parsed are returned with a
+// *TruncatedError.
 func ParseUserTwtxt(twtxt []byte, nickname, urlKey string) (TimeMap, error) {
-	var erz []byte
 	if len(twtxt) == 0 {
 		return nil, fmt.Errorf("no data to parse in twtxt file")
 	}
 
-	reader := bytes.NewReader(twtxt)
-	scanner := bufio.NewScanner(reader)
-	timemap := NewTimeMap()
-
-	for scanner.Scan() {
-		nopadding := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(nopadding, "#") || nopadding == "" {
-			continue
-		}
-
-		columns := strings.Split(nopadding, "\t")
-		if len(columns) != 2 {
-			return nil, fmt.Errorf("improperly formatted data in twtxt file")
-		}
-
-		noSeconds := false
-		count := strings.Count(columns[0], ":")
-
-		if strings.Contains(columns[0], "Z") {
-			split := strings.Split(columns[0], "Z")
-			if len(split[1]) > 0 && count == 2 {
-				noSeconds = true
-			}
-		} else if count == 2 {
-			noSeconds = true
-		}
-
-		var thetime time.Time
-		var err error
-		if strings.Contains(columns[0], ".") {
-			thetime, err = time.Parse(time.RFC3339Nano, columns[0])
-		} else if noSeconds {
-			// this means they're probably not including seconds into the datetime
-			thetime, err = time.Parse(rfc3339WithoutSeconds, columns[0])
-		} else {
-			thetime, err = time.Parse(time.RFC3339, columns[0])
-		}
-		if err != nil {
-			erz = append(erz, []byte(fmt.Sprintf("unable to retrieve date: %v\n", err))...)
-		}
-
-		timemap[thetime] = nickname + "\t" + urlKey + "\t" + nopadding
+	feed, err := ReadUserTwtxt(bytes.NewReader(twtxt), nickname, urlKey, Limits{})
+	if err != nil {
+		return nil, err
 	}
-
-	if len(erz) == 0 {
-		return timemap, nil
+	if len(feed.Errors) > 0 {
+		return feed.Statuses, feed.Errors
+	}
+	if feed.Truncated != nil {
+		return feed.Statuses, feed.Truncated
 	}
-	return timemap, fmt.Errorf("%v", string(erz))
+	return feed.Statuses, nil
 }
 
 // ParseRegistryTwtxt takes output from a remote registry and outputs
@@ -241,20 +320,19 @@ func ParseRegistryTwtxt(twtxt []byte) ([]*User, error) {
 			continue
 		}
 
-		columns := strings.Split(nopadding, "\t")
-		if len(columns) != 4 {
+		if len(strings.Split(nopadding, "\t")) != 4 {
 			return nil, fmt.Errorf("improperly formatted data")
 		}
 
-		thetime, err := time.Parse(time.RFC3339, columns[2])
+		status, err := ParseStatus(nopadding)
 		if err != nil {
 			erz = append(erz, []byte(fmt.Sprintf("%v\n", err))...)
 			continue
 		}
 
-		parsednickname := columns[0]
+		parsednickname := status.Nick
 		dataIndex := 0
-		parsedurl := columns[1]
+		parsedurl := status.URL
 		inIndex := false
 
 		for i, e := range userdata {
@@ -267,21 +345,17 @@ func ParseRegistryTwtxt(twtxt []byte) ([]*User, error) {
 
 		if inIndex {
 			tmp := userdata[dataIndex]
-			tmp.Status[thetime] = nopadding
+			tmp.Status[status.Time] = status
 			userdata[dataIndex] = tmp
 		} else {
 			timeNowRFC := time.Now().Format(time.RFC3339)
-			if err != nil {
-				erz = append(erz, []byte(fmt.Sprintf("%v\n", err))...)
-			}
-
 			tmp := &User{
 				Mu:   sync.RWMutex{},
 				Nick: parsednickname,
 				URL:  parsedurl,
 				Date: timeNowRFC,
 				Status: TimeMap{
-					thetime: nopadding,
+					status.Time: status,
 				},
 			}
 
@@ -289,5 +363,8 @@ func ParseRegistryTwtxt(twtxt []byte) ([]*User, error) {
 		}
 	}
 
-	return userdata, fmt.Errorf("%v", erz)
+	if len(erz) == 0 {
+		return userdata, nil
+	}
+	return userdata, fmt.Errorf("%v", string(erz))
 }
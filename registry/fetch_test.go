@@ -22,9 +22,10 @@ package registry
 import (
 	"bufio"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
-	"strings"
 	"testing"
 	"time"
 )
@@ -35,8 +36,7 @@ func constructTwtxt() []byte {
 	// iterates through each mock user's mock statuses
 	for _, v := range registry.Users {
 		for _, e := range v.Status {
-			split := strings.Split(e, "\t")
-			status := []byte(split[2] + "\t" + split[3] + "\n")
+			status := []byte(e.Time.Format(time.RFC3339) + "\t" + e.Text + "\n")
 			resp = append(resp, status...)
 		}
 	}
@@ -228,7 +228,7 @@ func Test_ParseUserTwtxt(t *testing.T) {
 				}
 
 				for k, v := range timemap {
-					if k == (time.Time{}) || v == "" {
+					if k == (time.Time{}) || v == nil || v.Text == "" {
 						t.Errorf("Empty status or empty timestamp: %v, %v\n", k, v)
 					}
 				}
@@ -273,3 +273,66 @@ var timestampCases = []struct {
 		expected: "2020-01-14T00:19:45.092344Z",
 	},
 }
+
+func Test_DiffTwtxt(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Last-Modified", "Mon, 19 Oct 2026 10:00:00 GMT")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	l := NewLimiter(nil, 2, 1, 0)
+	registry := New(&http.Client{Transport: l, Timeout: 10 * time.Second})
+	urlKey := srv.URL + "/twtxt.txt"
+	if err := registry.AddUser("foo", urlKey, net.ParseIP("127.0.0.1"), nil); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	t.Run("Unknown User", func(t *testing.T) {
+		if _, err := registry.DiffTwtxt(srv.URL + "/other.txt"); err == nil {
+			t.Errorf("Expected error for unknown user\n")
+		}
+		locked := make(chan struct{})
+		go func() {
+			registry.Mu.Lock()
+			registry.Mu.Unlock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(time.Second):
+			t.Fatalf("Registry left locked\n")
+		}
+	})
+
+	t.Run("Unlocked While Waiting", func(t *testing.T) {
+		// use up the host's burst, so the next request waits 500ms
+		l.reserve(srv.Listener.Addr().String(), time.Now())
+
+		done := make(chan bool)
+		go func() {
+			diff, err := registry.DiffTwtxt(urlKey)
+			if err != nil {
+				t.Errorf("%v\n", err)
+			}
+			done <- diff
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		start := time.Now()
+		if _, err := registry.Get(urlKey); err != nil {
+			t.Errorf("%v\n", err)
+		}
+		if time.Since(start) > 250*time.Millisecond {
+			t.Errorf("Registry was locked while waiting for the limiter: %v\n", time.Since(start))
+		}
+
+		if !<-done {
+			t.Errorf("Expected changed file\n")
+		}
+		user, _ := registry.Get(urlKey)
+		if user.LastModified != "Mon, 19 Oct 2026 10:00:00 GMT" {
+			t.Errorf("Last-Modified not stored: %q\n", user.LastModified)
+		}
+	})
+}
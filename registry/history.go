@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The most earlier versions kept for a single status.
+// Past it, the oldest edit after the original text is
+// dropped, so what the status first said is kept.
+const maxEdits = 50
+
+// Edit is an earlier version of a status, which came
+// back from its author's twtxt file with different text
+// but the same timestamp.
+type Edit struct {
+	// The status's text before it changed.
+	Text string
+
+	// When the change was noticed.
+	Seen time.Time
+}
+
+// String formats the edit for storage, as "seen\ttext".
+// The result can be read back with ParseEdit.
+func (edit Edit) String() string {
+	return edit.Seen.Format(time.RFC3339Nano) + "\t" + edit.Text
+}
+
+// ParseEdit parses an edit in the form
+// written by String: "seen\ttext".
+func ParseEdit(line string) (Edit, error) {
+	parts := strings.SplitN(line, "\t", 2)
+	if len(parts) != 2 {
+		return Edit{}, fmt.Errorf("improperly formatted edit: %#v", line)
+	}
+
+	seen, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return Edit{}, err
+	}
+	return Edit{Text: parts[1], Seen: seen}, nil
+}
+
+// FormatEdits formats a status's edits for storage,
+// one per line. Status text never holds a newline.
+func FormatEdits(edits []Edit) string {
+	lines := make([]string, len(edits))
+	for i, e := range edits {
+		lines[i] = e.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ParseEdits reads back the edits formatted by FormatEdits.
+func ParseEdits(data string) ([]Edit, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	lines := strings.Split(data, "\n")
+	out := make([]Edit, len(lines))
+	for i, e := range lines {
+		edit, err := ParseEdit(e)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = edit
+	}
+	return out, nil
+}
+
+// Carries the history of the status being replaced over
+// to its replacement, adding the replaced text if it
+// changed. Statuses are shared with readers of the
+// Registry, so neither status is modified.
+func withHistory(old, status *Status, seen time.Time) *Status {
+	if old == nil || status == nil || (old.Text == status.Text && len(old.Edits) == 0) {
+		return status
+	}
+
+	out := *status
+	out.Edits = make([]Edit, 0, len(old.Edits)+1)
+	out.Edits = append(out.Edits, old.Edits...)
+	if old.Text != status.Text {
+		out.Edits = append(out.Edits, Edit{Text: old.Text, Seen: seen})
+	}
+	if len(out.Edits) > maxEdits {
+		out.Edits = append(out.Edits[:1], out.Edits[len(out.Edits)-maxEdits+1:]...)
+	}
+	return &out
+}
+
+// GetStatus returns the status the user at the URL posted
+// at the given time, along with its earlier versions. The
+// URLs the user moved from are followed.
+func (registry *Registry) GetStatus(urlKey string, posted time.Time) (*Status, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't get status from an empty registry")
+	} else if urlKey == "" || !strings.HasPrefix(urlKey, "http") {
+		return nil, fmt.Errorf("invalid URL: %v", urlKey)
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	user, ok := registry.Users[registry.resolve(urlKey)]
+	if !ok || user == nil {
+		return nil, fmt.Errorf("can't retrieve status of nonexistent user")
+	}
+
+	user.Mu.RLock()
+	defer user.Mu.RUnlock()
+	for k, v := range user.Status {
+		if k.Equal(posted) {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("no status from %v at %v", urlKey, posted.Format(time.RFC3339Nano))
+}
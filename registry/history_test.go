@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_ParseEdits(t *testing.T) {
+	seen := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	edits := []Edit{
+		{Text: "first\twith a tab", Seen: seen},
+		{Text: "", Seen: seen.Add(time.Nanosecond)},
+	}
+
+	got, err := ParseEdits(FormatEdits(edits))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !reflect.DeepEqual(got, edits) {
+		t.Errorf("Expected %v, got %v\n", edits, got)
+	}
+
+	if got, err := ParseEdits(""); err != nil || len(got) != 0 {
+		t.Errorf("Expected no edits, got %v, %v\n", got, err)
+	}
+	if _, err := ParseEdits("yesterday\thello"); err == nil {
+		t.Errorf("Expected an error for a bad time\n")
+	}
+}
+
+func Test_withHistory(t *testing.T) {
+	posted := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	seen := posted.Add(time.Hour)
+	urlKey := "https://example.com/twtxt.txt"
+	first := NewStatus("foo", urlKey, posted, "helo")
+	second := NewStatus("foo", urlKey, posted, "hello")
+
+	if got := withHistory(nil, first, seen); got != first {
+		t.Errorf("New status changed: %v\n", got)
+	}
+	if got := withHistory(first, NewStatus("foo", urlKey, posted, "helo"), seen); len(got.Edits) != 0 {
+		t.Errorf("Unchanged status given edits: %v\n", got.Edits)
+	}
+
+	edited := withHistory(first, second, seen)
+	if len(edited.Edits) != 1 || edited.Edits[0].Text != "helo" || !edited.Edits[0].Seen.Equal(seen) {
+		t.Errorf("Edit not recorded: %v\n", edited.Edits)
+	}
+	if len(second.Edits) != 0 {
+		t.Errorf("Replacement modified in place\n")
+	}
+
+	// edits are kept when the text comes back unchanged
+	again := withHistory(edited, NewStatus("foo", urlKey, posted, "hello"), seen.Add(time.Hour))
+	if !reflect.DeepEqual(again.Edits, edited.Edits) {
+		t.Errorf("Edits lost: %v\n", again.Edits)
+	}
+
+	// the original text outlives the limit
+	status := first
+	for i := 0; i < maxEdits+10; i++ {
+		status = withHistory(status, NewStatus("foo", urlKey, posted, fmt.Sprintf("version %v", i)), seen)
+	}
+	if len(status.Edits) != maxEdits || status.Edits[0].Text != "helo" || status.Edits[maxEdits-1].Text != fmt.Sprintf("version %v", maxEdits+8) {
+		t.Errorf("Expected the original and newest edits kept, got %v edits from %v\n", len(status.Edits), status.Edits[0].Text)
+	}
+}
+
+func Test_Registry_UpdateUser_Edits(t *testing.T) {
+	body := "2019-09-01T00:00:00Z\thelo\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	urlKey := srv.URL + "/twtxt.txt"
+
+	registry := New(srv.Client())
+	if err := registry.AddUser("foo", urlKey, nil, NewTimeMap()); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	body = "2019-09-01T00:00:00Z\thello\n"
+	before := time.Now()
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	// an offset time finds the same status
+	posted := time.Date(2019, 9, 1, 2, 0, 0, 0, time.FixedZone("", 2*60*60))
+	status, err := registry.GetStatus(urlKey, posted)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if status.Text != "hello" || len(status.Edits) != 1 || status.Edits[0].Text != "helo" || status.Edits[0].Seen.Before(before) {
+		t.Errorf("Edit not recorded: %v %v\n", status.Text, status.Edits)
+	}
+
+	// the index serves the same status
+	all, _ := registry.GetStatuses()
+	for _, e := range all {
+		if len(e.Edits) != 1 {
+			t.Errorf("Indexed status missing its edits: %v\n", e)
+		}
+	}
+
+	if _, err := registry.GetStatus(urlKey, posted.Add(time.Second)); err == nil {
+		t.Errorf("Expected an error for a missing status\n")
+	}
+	if _, err := registry.GetStatus("https://example.org/twtxt.txt", posted); err == nil {
+		t.Errorf("Expected an error for a missing user\n")
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Skiplist parameters. Each level holds about a quarter
+// of the nodes of the level below it, which comfortably
+// covers several million statuses.
+const (
+	indexMaxLevel = 16
+	indexP        = 4
+)
+
+// statusIndex keeps every status in the Registry ordered
+// newest first, with the same tiebreaker as StatusMap.Sorted,
+// so queries can walk it rather than sorting the statuses
+// on every request. It's a skiplist keyed by StatusKey.
+//
+// Each entry records the URL key of the user holding the
+// status. An entry is only valid while that user still
+// holds the same *Status at its timestamp: entries are
+// checked as they're read, so statuses replaced or removed
+// outside of the Registry's methods are skipped.
+type statusIndex struct {
+	mu    sync.RWMutex
+	head  *indexNode
+	level int
+	len   int
+	rand  *rand.Rand
+}
+
+type indexNode struct {
+	key StatusKey
+
+	// The user holding the status, and the
+	// key of their TimeMap it's held under.
+	owner string
+	at    time.Time
+
+	status *Status
+	next   []*indexNode
+}
+
+func newStatusIndex() *statusIndex {
+	return &statusIndex{
+		head:  &indexNode{next: make([]*indexNode, indexMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (idx *statusIndex) randomLevel() int {
+	level := 1
+	for level < indexMaxLevel && idx.rand.Intn(indexP) == 0 {
+		level++
+	}
+	return level
+}
+
+// Finds the last node before key on each level.
+func (idx *statusIndex) path(key StatusKey) [indexMaxLevel]*indexNode {
+	var update [indexMaxLevel]*indexNode
+	node := idx.head
+	for i := idx.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key.before(key) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	return update
+}
+
+// Returns a copy of the TimeMap, so the index can be
+// updated without holding the lock of the User it
+// belongs to. The index's lock is always taken before
+// a User's lock, never after.
+func snapshot(tm TimeMap) TimeMap {
+	out := make(TimeMap, len(tm))
+	for k, v := range tm {
+		out[k] = v
+	}
+	return out
+}
+
+// Adds each of the statuses held by the user
+// with the provided URL key to the index.
+func (idx *statusIndex) insert(owner string, tm TimeMap) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for k, e := range tm {
+		if e != nil {
+			idx.insertLocked(owner, k, e)
+		}
+	}
+}
+
+func (idx *statusIndex) insertLocked(owner string, at time.Time, status *Status) {
+	key := status.Key()
+	update := idx.path(key)
+
+	if node := update[0].next[0]; node != nil && node.key == key {
+		node.owner = owner
+		node.at = at
+		node.status = status
+		return
+	}
+
+	level := idx.randomLevel()
+	if level > idx.level {
+		for i := idx.level; i < level; i++ {
+			update[i] = idx.head
+		}
+		idx.level = level
+	}
+
+	node := &indexNode{
+		key:    key,
+		owner:  owner,
+		at:     at,
+		status: status,
+		next:   make([]*indexNode, level),
+	}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	idx.len++
+}
+
+// Removes the provided statuses from the index.
+func (idx *statusIndex) remove(tm TimeMap) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, e := range tm {
+		if e != nil {
+			idx.removeLocked(e.Key())
+		}
+	}
+}
+
+func (idx *statusIndex) removeLocked(key StatusKey) {
+	update := idx.path(key)
+	node := update[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := 0; i < idx.level; i++ {
+		if update[i].next[i] != node {
+			break
+		}
+		update[i].next[i] = node.next[i]
+	}
+	for idx.level > 1 && idx.head.next[idx.level-1] == nil {
+		idx.level--
+	}
+	idx.len--
+}
+
+// Empties the index.
+func (idx *statusIndex) reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.head = &indexNode{next: make([]*indexNode, indexMaxLevel)}
+	idx.level = 1
+	idx.len = 0
+}
+
+// Calls fn with each status in the index that its user still
+// holds, newest first, until fn returns false. The caller
+// must hold at least a read lock on the Registry. Entries
+// found to be stale are removed afterward.
+func (idx *statusIndex) ascend(users map[string]*User, fn func(*Status) bool) {
+	var stale []StatusKey
+
+	idx.mu.RLock()
+	for node := idx.head.next[0]; node != nil; node = node.next[0] {
+		if !node.current(users) {
+			stale = append(stale, node.key)
+			continue
+		}
+		if !fn(node.status) {
+			break
+		}
+	}
+	idx.mu.RUnlock()
+
+	if len(stale) == 0 {
+		return
+	}
+
+	// the entries may have been updated
+	// since they were read
+	idx.mu.Lock()
+	for _, e := range stale {
+		update := idx.path(e)
+		if node := update[0].next[0]; node != nil && node.key == e && !node.current(users) {
+			idx.removeLocked(e)
+		}
+	}
+	idx.mu.Unlock()
+}
+
+// Reports whether the node's user still holds its status.
+func (node *indexNode) current(users map[string]*User) bool {
+	user, ok := users[node.owner]
+	if !ok || user == nil {
+		return false
+	}
+	user.Mu.RLock()
+	defer user.Mu.RUnlock()
+	return user.Status[node.at] == node.status
+}
@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func Test_statusIndex(t *testing.T) {
+	then := time.Date(2020, 2, 4, 21, 28, 21, 0, time.UTC)
+	users := make(map[string]*User)
+	var all []*Status
+
+	for i := 0; i < 5; i++ {
+		url := fmt.Sprintf("https://user%v.example.com/twtxt.txt", i)
+		user := NewUser()
+		for j := 0; j < 200; j++ {
+			// plenty of statuses share a timestamp
+			thetime := then.Add(time.Duration(rand.Intn(50)) * time.Second)
+			status := NewStatus("user", url, thetime, fmt.Sprintf("status %v", j))
+			if _, ok := user.Status[thetime]; ok {
+				continue
+			}
+			user.Status[thetime] = status
+			all = append(all, status)
+		}
+		users[url] = user
+	}
+
+	idx := newStatusIndex()
+	for k, v := range users {
+		idx.insert(k, v.Status)
+	}
+	if idx.len != len(all) {
+		t.Fatalf("Expected %v entries, got %v\n", len(all), idx.len)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Key().before(all[j].Key())
+	})
+	var got []*Status
+	idx.ascend(users, func(s *Status) bool {
+		got = append(got, s)
+		return true
+	})
+	if len(got) != len(all) {
+		t.Fatalf("Expected %v statuses, got %v\n", len(all), len(got))
+	}
+	for i := range all {
+		if got[i] != all[i] {
+			t.Fatalf("Out of order at %v: %v, %v\n", i, got[i], all[i])
+		}
+	}
+
+	// removing a user's status outside of the index
+	// leaves a stale entry, which is skipped then dropped
+	victim := all[0]
+	delete(users[victim.URL].Status, victim.Time)
+	got = got[:0]
+	idx.ascend(users, func(s *Status) bool {
+		got = append(got, s)
+		return true
+	})
+	if len(got) != len(all)-1 || got[0] == victim {
+		t.Errorf("Stale entry returned\n")
+	}
+	if idx.len != len(all)-1 {
+		t.Errorf("Stale entry not removed, %v entries\n", idx.len)
+	}
+
+	idx.remove(TimeMap{all[1].Time: all[1]})
+	if idx.len != len(all)-2 {
+		t.Errorf("Entry not removed, %v entries\n", idx.len)
+	}
+}
+
+// Query results from different users must be
+// interleaved rather than grouped per user.
+func Test_Registry_QueryInStatus_Order(t *testing.T) {
+	registry := New(nil)
+	then := time.Date(2020, 2, 4, 21, 28, 21, 0, time.UTC)
+	for i, e := range []string{"foo", "bar"} {
+		url := "https://" + e + ".example.com/twtxt.txt"
+		statuses := NewTimeMap()
+		for j := 0; j < 3; j++ {
+			thetime := then.Add(time.Duration(2*j+i) * time.Minute)
+			statuses[thetime] = NewStatus(e, url, thetime, "hello")
+		}
+		if err := registry.AddUser(e, url, nil, statuses); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+
+	out, err := registry.QueryInStatus("hello")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(out) != 6 {
+		t.Fatalf("Expected 6 statuses, got %v\n", len(out))
+	}
+	for i := 1; i < len(out); i++ {
+		if !out[i].Time.Before(out[i-1].Time) {
+			t.Errorf("Statuses out of order:\n%v\n", FormatStatuses(out))
+			break
+		}
+	}
+}
@@ -32,6 +32,16 @@ func quickErr(err error) {
 	}
 }
 
+// Parses a status in the form "nick\turl\ttimestamp\ttext"
+// for use in test fixtures.
+func testStatus(line string) *Status {
+	status, err := ParseStatus(line)
+	if err != nil {
+		panic(err)
+	}
+	return status
+}
+
 // Sets up mock users and statuses
 func initTestEnv() *Registry {
 	hush, err := os.Open("/dev/null")
@@ -64,8 +74,8 @@ func initTestEnv() *Registry {
 			nick: "foo_barrington",
 			date: timeTwoMonthsPrevRFC,
 			status: TimeMap{
-				timeTwoMonthsPrev: "foo_barrington\thttps://example3.com/twtxt.txt\t" + timeTwoMonthsPrevRFC + "\tJust got started with #twtxt!",
-				timeMonthPrev:     "foo_barrington\thttps://example3.com/twtxt.txt\t" + timeMonthPrevRFC + "\tHey <@foo https://example.com/twtxt.txt>, I love programming. Just FYI.",
+				timeTwoMonthsPrev: testStatus("foo_barrington\thttps://example3.com/twtxt.txt\t" + timeTwoMonthsPrevRFC + "\tJust got started with #twtxt!"),
+				timeMonthPrev:     testStatus("foo_barrington\thttps://example3.com/twtxt.txt\t" + timeMonthPrevRFC + "\tHey <@foo https://example.com/twtxt.txt>, I love programming. Just FYI."),
 			},
 		},
 		{
@@ -73,8 +83,8 @@ func initTestEnv() *Registry {
 			nick: "foo",
 			date: timeFourMonthsPrevRFC,
 			status: TimeMap{
-				timeFourMonthsPrev:  "foo\thttps://example.com/twtxt.txt\t" + timeFourMonthsPrevRFC + "\tThis is so much better than #twitter",
-				timeThreeMonthsPrev: "foo\thttps://example.com/twtxt.txt\t" + timeThreeMonthsPrevRFC + "\tI can't wait to start on my next programming #project with <@foo_barrington https://example3.com/twtxt.txt>",
+				timeFourMonthsPrev:  testStatus("foo\thttps://example.com/twtxt.txt\t" + timeFourMonthsPrevRFC + "\tThis is so much better than #twitter"),
+				timeThreeMonthsPrev: testStatus("foo\thttps://example.com/twtxt.txt\t" + timeThreeMonthsPrevRFC + "\tI can't wait to start on my next programming #project with <@foo_barrington https://example3.com/twtxt.txt>"),
 			},
 		},
 	}
@@ -88,6 +98,7 @@ func initTestEnv() *Registry {
 		data.Status = e.status
 		registry.Users[e.url] = data
 	}
+	registry.Reindex()
 
 	return registry
 }
@@ -65,7 +65,7 @@ func Test_Integration(t *testing.T) {
 			t.Errorf("%v\n", err)
 		}
 		for _, e := range querystatus {
-			if !strings.Contains(e, "morning") {
+			if !strings.Contains(e.Text, "morning") {
 				t.Errorf("QueryInStatus() returned incorrect data\n")
 			}
 		}
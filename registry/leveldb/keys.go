@@ -0,0 +1,147 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package leveldb // import "git.sr.ht/~gbmor/getwtxt/registry/leveldb"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Keys begin with a byte saying what they hold. Keys for a
+// user's information and statuses follow it with the length
+// of the user's URL as a uvarint, then the URL, then the
+// field's name or the status's time. The earlier versions
+// of a status are kept under the same suffix as the status,
+// with a key of their own kind. Aliases and remote
+// registries are followed by just the URL. None of these
+// bytes are printable, so they can't be mistaken for keys
+// written before the encoding was versioned, which all
+// began with a URL.
+const (
+	kindMeta byte = iota
+	kindUser
+	kindStatus
+	kindAlias
+	kindRemote
+	kindQuarantine
+	kindEdits
+)
+
+// Holds the schema version, as a decimal string.
+var versionKey = []byte{kindMeta, 'v', 'e', 'r', 's', 'i', 'o', 'n'}
+
+// The fields of a user stored under kindUser keys.
+const (
+	fieldNick           = "nick"
+	fieldURL            = "url"
+	fieldIP             = "ip"
+	fieldDate           = "date"
+	fieldLastModified   = "last_modified"
+	fieldRemoteRegistry = "remote_registry"
+)
+
+// Returns the prefix of every key of the
+// given kind stored under the URL.
+func urlPrefix(kind byte, urlKey string) []byte {
+	key := make([]byte, 1, 1+binary.MaxVarintLen64+len(urlKey))
+	key[0] = kind
+	var n [binary.MaxVarintLen64]byte
+	key = append(key, n[:binary.PutUvarint(n[:], uint64(len(urlKey)))]...)
+	return append(key, urlKey...)
+}
+
+func userKey(urlKey, field string) []byte {
+	return append(urlPrefix(kindUser, urlKey), field...)
+}
+
+func statusKey(urlKey string, t time.Time) []byte {
+	return append(urlPrefix(kindStatus, urlKey), timeKey(t)...)
+}
+
+func editsKey(urlKey string, t time.Time) []byte {
+	return append(urlPrefix(kindEdits, urlKey), timeKey(t)...)
+}
+
+func aliasKey(urlKey string) []byte {
+	return append([]byte{kindAlias}, urlKey...)
+}
+
+func remoteKey(urlKey string) []byte {
+	return append([]byte{kindRemote}, urlKey...)
+}
+
+func quarantineKey(key []byte) []byte {
+	return append([]byte{kindQuarantine}, key...)
+}
+
+// Sorts the same way as the time it's made from, to the
+// nanosecond. Flipping the sign bit puts times before
+// 1970 ahead of those after.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano())^(1<<63))
+	return key
+}
+
+// Reads back a time made by timeKey.
+func keyTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key)^(1<<63)))
+}
+
+// A key taken apart. For user keys, rest is the field's
+// name. For status and edits keys, it's the time.
+type decodedKey struct {
+	kind byte
+	url  string
+	rest []byte
+}
+
+// Takes apart a key in the current encoding.
+func decodeKey(key []byte) (decodedKey, error) {
+	if len(key) < 2 {
+		return decodedKey{}, fmt.Errorf("key too short")
+	}
+
+	out := decodedKey{kind: key[0]}
+	switch out.kind {
+	case kindAlias, kindRemote:
+		out.url = string(key[1:])
+		return out, nil
+
+	case kindUser, kindStatus, kindEdits:
+		n, size := binary.Uvarint(key[1:])
+		if size <= 0 || uint64(len(key)-1-size) < n {
+			return decodedKey{}, fmt.Errorf("bad URL length")
+		}
+		start := 1 + size
+		out.url = string(key[start : start+int(n)])
+		out.rest = key[start+int(n):]
+		if out.kind != kindUser && len(out.rest) != 8 {
+			return decodedKey{}, fmt.Errorf("bad status time")
+		}
+		if out.kind == kindUser && len(out.rest) == 0 {
+			return decodedKey{}, fmt.Errorf("missing field")
+		}
+		return out, nil
+	}
+
+	return decodedKey{}, fmt.Errorf("unknown kind of key %#x", out.kind)
+}
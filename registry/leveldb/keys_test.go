@@ -0,0 +1,129 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package leveldb
+
+import (
+	"testing"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+)
+
+func Test_decodeKey(t *testing.T) {
+	then := time.Date(2019, 9, 1, 0, 0, 0, 500, time.UTC)
+	cases := []struct {
+		name string
+		key  []byte
+		want decodedKey
+	}{
+		{
+			name: "User Field",
+			key:  userKey("https://example.com/*/twtxt.txt", fieldNick),
+			want: decodedKey{kind: kindUser, url: "https://example.com/*/twtxt.txt", rest: []byte(fieldNick)},
+		},
+		{
+			name: "Status",
+			key:  statusKey("https://example.com/twtxt.txt", then),
+			want: decodedKey{kind: kindStatus, url: "https://example.com/twtxt.txt", rest: timeKey(then)},
+		},
+		{
+			name: "Alias",
+			key:  aliasKey("https://example.com/twtxt.txt"),
+			want: decodedKey{kind: kindAlias, url: "https://example.com/twtxt.txt"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeKey(tt.key)
+			if err != nil {
+				t.Fatalf("%v\n", err)
+			}
+			if got.kind != tt.want.kind || got.url != tt.want.url || string(got.rest) != string(tt.want.rest) {
+				t.Errorf("Expected %#v, got %#v\n", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("Garbage", func(t *testing.T) {
+		for _, e := range [][]byte{{}, {kindUser}, {kindUser, 200, 'h'}, {kindStatus, 1, 'h', 0}, []byte("https://example.com/twtxt.txt*Nick")} {
+			if _, err := decodeKey(e); err == nil {
+				t.Errorf("Expected error decoding %q\n", e)
+			}
+		}
+	})
+}
+
+// A URL that's a prefix of another shouldn't
+// share any of its keys.
+func Test_Store_DelUser_Prefix(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	reg := registry.New(nil)
+	for _, e := range []string{"https://example.com/a", "https://example.com/ab"} {
+		reg.AddUser("foo", e, nil, registry.TimeMap{then: registry.NewStatus("foo", e, then, "hi")})
+	}
+	if err := reg.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := store.DelUser("https://example.com/a"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	users, _, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if _, ok := users["https://example.com/a"]; ok {
+		t.Errorf("Deleted user still stored\n")
+	}
+	if user, ok := users["https://example.com/ab"]; !ok || len(user.Status) != 1 {
+		t.Errorf("Deleting a user removed another with a longer URL\n")
+	}
+}
+
+// Statuses posted within the same second
+// used to overwrite each other.
+func Test_Store_SubSecond(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	urlKey := "https://example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	later := then.Add(time.Millisecond)
+	reg := registry.New(nil)
+	reg.AddUser("foo", urlKey, nil, registry.TimeMap{
+		then:  registry.NewStatus("foo", urlKey, then, "one"),
+		later: registry.NewStatus("foo", urlKey, later, "two"),
+	})
+	if err := reg.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	users, _, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if n := len(users[urlKey].Status); n != 2 {
+		t.Errorf("Expected 2 statuses, got %v\n", n)
+	}
+}
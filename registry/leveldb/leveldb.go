@@ -0,0 +1,350 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package leveldb stores a twtxt Registry in a LevelDB database.
+package leveldb // import "git.sr.ht/~gbmor/getwtxt/registry/leveldb"
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	goleveldb "github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Store is a registry.Storage backed by LevelDB.
+// See keys.go for how data is laid out.
+type Store struct {
+	db *goleveldb.DB
+
+	// Set within Batch(), so writes are
+	// collected and committed together.
+	batch *goleveldb.Batch
+
+	// Set by OpenReadOnly, so LoadAll
+	// leaves undecodable keys in place.
+	readOnly bool
+}
+
+var _ registry.BatchStorage = &Store{}
+var _ registry.PruneStorage = &Store{}
+
+// Open opens the LevelDB database at the provided path,
+// creating it if necessary, and re-encodes any keys
+// written by earlier versions.
+func Open(path string) (*Store, error) {
+	db, err := goleveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't migrate database: %v", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// OpenReadOnly opens the existing LevelDB database at the
+// provided path without writing to it. Its keys must be
+// current: a database written by an earlier version has
+// to be opened with Open first, to re-encode them.
+func OpenReadOnly(path string) (*Store, error) {
+	db, err := goleveldb.OpenFile(path, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return nil, err
+	}
+	version, err := readVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if version != schemaVersion {
+		db.Close()
+		return nil, fmt.Errorf("database schema version %v needs to be upgraded to %v by opening it for writing first", version, schemaVersion)
+	}
+	return &Store{db: db, readOnly: true}, nil
+}
+
+// Close closes the database.
+func (lvl *Store) Close() error {
+	return lvl.db.Close()
+}
+
+// Batch collects the writes made by the function
+// into a single LevelDB batch.
+func (lvl *Store) Batch(fn func(registry.Storage) error) error {
+	if lvl.batch != nil {
+		return fn(lvl)
+	}
+
+	tx := &Store{db: lvl.db, batch: &goleveldb.Batch{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return lvl.db.Write(tx.batch, nil)
+}
+
+// Adds to the current batch, if there is one,
+// or writes a batch of its own.
+func (lvl *Store) write(fn func(*goleveldb.Batch)) error {
+	if lvl.batch != nil {
+		fn(lvl.batch)
+		return nil
+	}
+
+	batch := &goleveldb.Batch{}
+	fn(batch)
+	return lvl.db.Write(batch, nil)
+}
+
+// PutUser stores the user's information under their URL.
+func (lvl *Store) PutUser(urlKey string, user *registry.User) error {
+	if user == nil {
+		return fmt.Errorf("can't store nil user %v", urlKey)
+	}
+
+	var ip string
+	if user.IP != nil {
+		ip = user.IP.String()
+	}
+	return lvl.write(func(b *goleveldb.Batch) {
+		b.Put(userKey(urlKey, fieldNick), []byte(user.Nick))
+		b.Put(userKey(urlKey, fieldURL), []byte(user.URL))
+		b.Put(userKey(urlKey, fieldIP), []byte(ip))
+		b.Put(userKey(urlKey, fieldDate), []byte(user.Date))
+		b.Put(userKey(urlKey, fieldLastModified), []byte(user.LastModified))
+		b.Put(userKey(urlKey, fieldRemoteRegistry), []byte(user.RemoteRegistry))
+	})
+}
+
+// PutStatuses stores each status, and its earlier
+// versions, under the user's URL and the time it
+// was posted.
+func (lvl *Store) PutStatuses(urlKey string, statuses registry.TimeMap) error {
+	return lvl.write(func(b *goleveldb.Batch) {
+		for _, v := range statuses {
+			if v == nil {
+				continue
+			}
+			b.Put(statusKey(urlKey, v.Time), []byte(v.String()))
+			if len(v.Edits) > 0 {
+				b.Put(editsKey(urlKey, v.Time), []byte(registry.FormatEdits(v.Edits)))
+			} else {
+				b.Delete(editsKey(urlKey, v.Time))
+			}
+		}
+	})
+}
+
+// DelStatuses deletes the user's statuses posted
+// at the given times, and their earlier versions.
+func (lvl *Store) DelStatuses(urlKey string, times []time.Time) error {
+	return lvl.write(func(b *goleveldb.Batch) {
+		for _, e := range times {
+			b.Delete(statusKey(urlKey, e))
+			b.Delete(editsKey(urlKey, e))
+		}
+	})
+}
+
+// PutAlias stores the URL a user moved to
+// under the URL they moved from.
+func (lvl *Store) PutAlias(from, to string) error {
+	return lvl.write(func(b *goleveldb.Batch) {
+		b.Put(aliasKey(from), []byte(to))
+	})
+}
+
+// DelUser deletes the user's information and statuses,
+// along with any alias kept for their URL.
+func (lvl *Store) DelUser(urlKey string) error {
+	keys := [][]byte{aliasKey(urlKey)}
+
+	for _, prefix := range [][]byte{urlPrefix(kindUser, urlKey), urlPrefix(kindStatus, urlKey), urlPrefix(kindEdits, urlKey)} {
+		iter := lvl.db.NewIterator(util.BytesPrefix(prefix), nil)
+		for iter.Next() {
+			keys = append(keys, append([]byte{}, iter.Key()...))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+
+	return lvl.write(func(b *goleveldb.Batch) {
+		for _, e := range keys {
+			b.Delete(e)
+		}
+	})
+}
+
+// PutRemoteRegistry stores the remote registry's URL.
+func (lvl *Store) PutRemoteRegistry(urlKey string) error {
+	return lvl.write(func(b *goleveldb.Batch) {
+		b.Put(remoteKey(urlKey), []byte{})
+	})
+}
+
+// RemoteRegistries lists the stored remote registries.
+func (lvl *Store) RemoteRegistries() ([]string, error) {
+	out := make([]string, 0)
+
+	iter := lvl.db.NewIterator(util.BytesPrefix([]byte{kindRemote}), nil)
+	for iter.Next() {
+		out = append(out, string(iter.Key()[1:]))
+	}
+	iter.Release()
+
+	return out, iter.Error()
+}
+
+// LoadAll reads every user, status and alias in the
+// database. Keys that can't be decoded, and statuses
+// or edits that can't be parsed, are quarantined,
+// as are the edits of statuses that are missing.
+// See Quarantined. If the database was opened with
+// OpenReadOnly, they're only skipped.
+func (lvl *Store) LoadAll() (map[string]*registry.User, map[string]string, error) {
+	users := make(map[string]*registry.User)
+	aliases := make(map[string]string)
+	loaded := make(map[postedAt]*registry.Status)
+	bad := make(map[string][]byte)
+
+	iter := lvl.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if k := iter.Key()[0]; k == kindMeta || k == kindQuarantine || k == kindRemote {
+			continue
+		}
+		if !loadKey(users, aliases, loaded, iter.Key(), iter.Value()) {
+			bad[string(iter.Key())] = append([]byte{}, iter.Value()...)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(bad) > 0 && !lvl.readOnly {
+		err := lvl.write(func(b *goleveldb.Batch) {
+			for k, v := range bad {
+				b.Put(quarantineKey([]byte(k)), v)
+				b.Delete([]byte(k))
+			}
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't quarantine %v undecodable keys: %v", len(bad), err)
+		}
+	}
+
+	return users, aliases, nil
+}
+
+// Identifies a status by its user's URL and when it
+// was posted, to the nanosecond, as its keys do.
+type postedAt struct {
+	url  string
+	unix int64
+}
+
+// Reads a single key into the users or aliases,
+// reporting whether it could be decoded. Statuses
+// are added to loaded, so their edits can find them.
+func loadKey(users map[string]*registry.User, aliases map[string]string, loaded map[postedAt]*registry.Status, key, val []byte) bool {
+	dk, err := decodeKey(key)
+	if err != nil {
+		return false
+	}
+	if dk.kind == kindAlias {
+		aliases[dk.url] = string(val)
+		return true
+	}
+
+	user := func() *registry.User {
+		user, ok := users[dk.url]
+		if !ok {
+			user = registry.NewUser()
+			user.URL = dk.url
+			users[dk.url] = user
+		}
+		return user
+	}
+
+	if dk.kind == kindStatus {
+		status, err := registry.ParseStoredStatus(string(val), keyTime(dk.rest).UTC())
+		if err != nil {
+			return false
+		}
+		user().Status[status.Time] = status
+		loaded[postedAt{dk.url, keyTime(dk.rest).UnixNano()}] = status
+		return true
+	}
+
+	// Edits sort after statuses, so their status
+	// is already read. Edits without a status are
+	// quarantined along with those that can't be
+	// parsed.
+	if dk.kind == kindEdits {
+		edits, err := registry.ParseEdits(string(val))
+		if err != nil {
+			return false
+		}
+		status, ok := loaded[postedAt{dk.url, keyTime(dk.rest).UnixNano()}]
+		if !ok {
+			return false
+		}
+		status.Edits = edits
+		return true
+	}
+
+	switch string(dk.rest) {
+	case fieldNick:
+		user().Nick = string(val)
+	case fieldURL:
+		user().URL = string(val)
+	case fieldIP:
+		user().IP = net.ParseIP(string(val))
+	case fieldDate:
+		user().Date = string(val)
+	case fieldLastModified:
+		user().LastModified = string(val)
+	case fieldRemoteRegistry:
+		user().RemoteRegistry = string(val)
+	default:
+		return false
+	}
+	return true
+}
+
+// Quarantined returns the keys LoadAll or the migration
+// from an earlier version couldn't decode, and their
+// values, for an operator to inspect or restore.
+func (lvl *Store) Quarantined() (map[string][]byte, error) {
+	out := make(map[string][]byte)
+
+	iter := lvl.db.NewIterator(util.BytesPrefix([]byte{kindQuarantine}), nil)
+	for iter.Next() {
+		out[string(iter.Key()[1:])] = append([]byte{}, iter.Value()...)
+	}
+	iter.Release()
+
+	return out, iter.Error()
+}
@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package leveldb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	"git.sr.ht/~gbmor/getwtxt/registry/storagetest"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func openTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store, err := Open(filepath.Join(dir, "getwtxt.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("%v\n", err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_Storage(t *testing.T) {
+	storagetest.Run(t, storagetest.Backend{
+		Open: func(t *testing.T) (registry.Storage, func()) {
+			return openTestStore(t)
+		},
+		CountEdits: func(store registry.Storage) (int, error) {
+			var n int
+			iter := store.(*Store).db.NewIterator(util.BytesPrefix([]byte{kindEdits}), nil)
+			for iter.Next() {
+				n++
+			}
+			iter.Release()
+			return n, iter.Error()
+		},
+	})
+}
+
+// Statuses stored with the timestamp from
+// the twtxt file should still be loaded.
+func Test_Store_LoadAll_StoredTimestamps(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	urlKey := "https://x/twtxt.txt"
+	then := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	records := map[time.Time]string{
+		then:                "foo\thttps://x/twtxt.txt\t2019-05-01T12:00Z\thello",
+		then.Add(time.Hour): "foo\thttps://x/twtxt.txt\tlater\thi",
+	}
+	for k, v := range records {
+		if err := store.db.Put(statusKey(urlKey, k), []byte(v), nil); err != nil {
+			t.Fatalf("Couldn't set up test: %v\n", err)
+		}
+	}
+
+	users, _, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	stored := users[urlKey].Status
+	if status, ok := stored[then]; !ok || status.Text != "hello" {
+		t.Errorf("Status without seconds not loaded: %v\n", stored)
+	}
+	if status, ok := stored[then.Add(time.Hour)]; !ok || status.Text != "hi" {
+		t.Errorf("Status with unreadable timestamp not given its stored time: %v\n", stored)
+	}
+	if quarantined, _ := store.Quarantined(); len(quarantined) != 0 {
+		t.Errorf("Readable statuses quarantined: %v\n", quarantined)
+	}
+}
+
+// Edits should find their status whatever timezone it
+// was posted in, and be set aside if it's missing.
+func Test_Store_LoadAll_Edits(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	urlKey := "https://example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 2, 0, 0, 0, time.FixedZone("", 2*3600))
+	status := registry.NewStatus("foo", urlKey, then, "second")
+	status.Edits = []registry.Edit{{Text: "first", Seen: then.Add(time.Hour)}}
+	if err := store.PutStatuses(urlKey, registry.TimeMap{then: status}); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	orphan := editsKey(urlKey, then.Add(time.Hour))
+	if err := store.db.Put(orphan, []byte(registry.FormatEdits(status.Edits)), nil); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	users, _, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var loaded *registry.Status
+	for _, v := range users[urlKey].Status {
+		loaded = v
+	}
+	if loaded == nil || len(loaded.Edits) != 1 || loaded.Edits[0].Text != "first" {
+		t.Errorf("Edits not loaded with their status: %v\n", users[urlKey].Status)
+	}
+	if quarantined, _ := store.Quarantined(); len(quarantined) != 1 || quarantined[string(orphan)] == nil {
+		t.Errorf("Edits without a status not quarantined: %v\n", quarantined)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package leveldb // import "git.sr.ht/~gbmor/getwtxt/registry/leveldb"
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	goleveldb "github.com/syndtr/goleveldb/leveldb"
+)
+
+// The version of the key encoding in keys.go. Databases
+// without a version record were written with keys like
+// "url*Nick" and "url*Status*timestamp".
+const schemaVersion = 1
+
+// Brings the database's keys up to date.
+func migrate(db *goleveldb.DB) error {
+	version, err := readVersion(db)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case version > schemaVersion:
+		return fmt.Errorf("database schema version %v is newer than this version supports (%v)", version, schemaVersion)
+	case version == 0:
+		return migrateKeys(db)
+	}
+	return nil
+}
+
+func readVersion(db *goleveldb.DB) (int, error) {
+	val, err := db.Get(versionKey, nil)
+	if err == goleveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(val))
+}
+
+// Fields of users stored before the encoding was
+// versioned, and what they're called now.
+var unversionedFields = map[string]string{
+	"Nick":           fieldNick,
+	"URL":            fieldURL,
+	"IP":             fieldIP,
+	"Date":           fieldDate,
+	"LastModified":   fieldLastModified,
+	"RemoteRegistry": fieldRemoteRegistry,
+}
+
+// Re-encodes every key written before the encoding
+// was versioned, in a single batch along with the
+// version record. Keys that can't be made sense
+// of are quarantined.
+func migrateKeys(db *goleveldb.DB) error {
+	batch := &goleveldb.Batch{}
+
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		val := append([]byte{}, iter.Value()...)
+
+		newKey, ok := reencodeKey(string(key), val)
+		if !ok {
+			newKey = quarantineKey(key)
+		}
+		batch.Put(newKey, val)
+		batch.Delete(key)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	batch.Put(versionKey, []byte(strconv.Itoa(schemaVersion)))
+	return db.Write(batch, nil)
+}
+
+// Works out the current key for one written before the
+// encoding was versioned. The field is matched from the
+// end of the key, as the URL before it may contain
+// asterisks of its own.
+func reencodeKey(key string, val []byte) ([]byte, bool) {
+	if strings.HasPrefix(key, "remote*") {
+		return remoteKey(string(val)), len(val) > 0
+	}
+
+	// the status's own timestamp was kept as it was in
+	// the twtxt file, so the key's is used if need be
+	if i := strings.LastIndex(key, "*Status*"); i > 0 {
+		posted, _ := time.Parse(time.RFC3339, key[i+len("*Status*"):])
+		status, err := registry.ParseStoredStatus(string(val), posted)
+		if err != nil {
+			return nil, false
+		}
+		return statusKey(key[:i], status.Time), true
+	}
+
+	if strings.HasSuffix(key, "*MovedTo") {
+		return aliasKey(strings.TrimSuffix(key, "*MovedTo")), true
+	}
+
+	for old, field := range unversionedFields {
+		if strings.HasSuffix(key, "*"+old) {
+			urlKey := strings.TrimSuffix(key, "*"+old)
+			if urlKey == "" {
+				return nil, false
+			}
+			return userKey(urlKey, field), true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,188 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package leveldb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	goleveldb "github.com/syndtr/goleveldb/leveldb"
+)
+
+func Test_Open_Migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "getwtxt.db")
+
+	starURL := "https://example.com/~foo*bar/twtxt.txt"
+	old := map[string]string{
+		starURL + "*Nick":                           "foo",
+		starURL + "*URL":                            starURL,
+		starURL + "*IP":                             "127.0.0.1",
+		starURL + "*Status*2019-09-01T00:00:00Z":    "foo\t" + starURL + "\t2019-09-01T00:00:00Z\thi",
+		starURL + "*Status*2019-09-02T00:00:00Z":    "not a status",
+		starURL + "*Status*2019-09-03T12:00:00Z":    "foo\t" + starURL + "\t2019-09-03T12:00Z\tno seconds",
+		starURL + "*Status*2019-09-04T00:00:00Z":    "foo\t" + starURL + "\tyesterday\tbad timestamp",
+		"https://old.example.com/twtxt.txt*MovedTo": starURL,
+		"remote*https://twtxt.example.net/api":      "https://twtxt.example.net/api",
+		"nonsense":                                  "?",
+	}
+
+	db, err := goleveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	for k, v := range old {
+		if err := db.Put([]byte(k), []byte(v), nil); err != nil {
+			t.Fatalf("Couldn't set up test: %v\n", err)
+		}
+	}
+	db.Close()
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer store.Close()
+
+	users, aliases, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	user, ok := users[starURL]
+	if !ok {
+		t.Fatalf("User with an asterisk in their URL not migrated: %v\n", users)
+	}
+	if user.Nick != "foo" || user.IP.String() != "127.0.0.1" || len(user.Status) != 3 {
+		t.Errorf("User migrated incorrectly: %v %v %v\n", user.Nick, user.IP, user.Status)
+	}
+	if status, ok := user.Status[time.Date(2019, 9, 3, 12, 0, 0, 0, time.UTC)]; !ok || status.Text != "no seconds" {
+		t.Errorf("Status without seconds not migrated: %v\n", user.Status)
+	}
+	if status, ok := user.Status[time.Date(2019, 9, 4, 0, 0, 0, 0, time.UTC)]; !ok || status.Text != "bad timestamp" {
+		t.Errorf("Status with unreadable timestamp not given its key's time: %v\n", user.Status)
+	}
+	if len(users) != 1 {
+		t.Errorf("Expected 1 user, got %v\n", len(users))
+	}
+	if aliases["https://old.example.com/twtxt.txt"] != starURL {
+		t.Errorf("Alias not migrated: %v\n", aliases)
+	}
+	if remotes, _ := store.RemoteRegistries(); len(remotes) != 1 || remotes[0] != "https://twtxt.example.net/api" {
+		t.Errorf("Remote registry not migrated: %v\n", remotes)
+	}
+
+	quarantined, err := store.Quarantined()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	for _, e := range []string{"nonsense", starURL + "*Status*2019-09-02T00:00:00Z"} {
+		if _, ok := quarantined[e]; !ok {
+			t.Errorf("%q not quarantined: %v\n", e, quarantined)
+		}
+	}
+
+	if version, err := readVersion(store.db); err != nil || version != schemaVersion {
+		t.Errorf("Expected schema version %v, got %v, %v\n", schemaVersion, version, err)
+	}
+}
+
+// Keys that can't be decoded once the database is
+// current should be set aside rather than loaded.
+func Test_Store_LoadAll_Quarantine(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	bad := userKey("https://example.com/twtxt.txt", "favorite_color")
+	if err := store.db.Put(bad, []byte("blue"), nil); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	users, _, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(users) != 0 {
+		t.Errorf("Undecodable key loaded as a user: %v\n", users)
+	}
+	quarantined, _ := store.Quarantined()
+	if string(quarantined[string(bad)]) != "blue" {
+		t.Errorf("Key not quarantined: %v\n", quarantined)
+	}
+	if _, err := store.db.Get(bad, nil); err != goleveldb.ErrNotFound {
+		t.Errorf("Quarantined key left in place\n")
+	}
+}
+
+func Test_Open_NewerVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "getwtxt.db")
+
+	db, err := goleveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	db.Put(versionKey, []byte("99"), nil)
+	db.Close()
+
+	if store, err := Open(path); err == nil {
+		store.Close()
+		t.Errorf("Expected error opening a database from a newer version\n")
+	}
+}
+
+// Opening a database read-only can't re-encode
+// its keys, so one that needs it is refused.
+func Test_OpenReadOnly_Unmigrated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "getwtxt.db")
+
+	db, err := goleveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := db.Put([]byte("https://example.com/twtxt.txt*Nick"), []byte("foo"), nil); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	db.Close()
+
+	if store, err := OpenReadOnly(path); err == nil {
+		store.Close()
+		t.Errorf("Expected error opening an unmigrated database read-only\n")
+	}
+	if store, err := OpenReadOnly(filepath.Join(dir, "nothing.db")); err == nil {
+		store.Close()
+		t.Errorf("Expected error opening a database that doesn't exist\n")
+	}
+}
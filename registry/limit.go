@@ -0,0 +1,255 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Buckets for hosts that haven't been contacted in
+// this long are discarded, as they would be full.
+const limiterIdle = 10 * time.Minute
+
+// Limiter paces outgoing requests using a token bucket
+// per host, plus an optional bucket shared by all hosts.
+// It satisfies http.RoundTripper, so it may be used as the
+// Transport of the *http.Client passed to New().
+type Limiter struct {
+	// The RoundTripper used to make requests once
+	// they're allowed through. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	mu        sync.Mutex
+	hostRate  float64
+	hostBurst float64
+	global    *bucket
+	hosts     map[string]*bucket
+	lastSweep time.Time
+}
+
+// A token bucket. Tokens may go negative, in which
+// case the number of tokens owed determines how long
+// the next caller must wait.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter that allows hostRate requests
+// per second to any single host, with bursts of up to hostBurst
+// requests, and globalRate requests per second in total. A rate
+// of zero or less disables the respective limit.
+func NewLimiter(transport http.RoundTripper, hostRate float64, hostBurst int, globalRate float64) *Limiter {
+	l := &Limiter{
+		Transport: transport,
+		hosts:     make(map[string]*bucket),
+	}
+	l.SetLimits(hostRate, hostBurst, globalRate)
+	return l
+}
+
+// SetLimits changes the rates of an existing Limiter.
+// Requests already waiting are not affected.
+func (l *Limiter) SetLimits(hostRate float64, hostBurst int, globalRate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if hostBurst < 1 {
+		hostBurst = 1
+	}
+	l.hostRate = hostRate
+	l.hostBurst = float64(hostBurst)
+	for _, e := range l.hosts {
+		e.rate = l.hostRate
+		e.burst = l.hostBurst
+	}
+
+	if globalRate <= 0 {
+		l.global = nil
+		return
+	}
+	globalBurst := math.Max(1, math.Ceil(globalRate))
+	if l.global == nil {
+		l.global = newBucket(globalRate, globalBurst)
+		return
+	}
+	l.global.rate = globalRate
+	l.global.burst = globalBurst
+}
+
+// RoundTrip waits until both the request's host and the
+// global budget allow another request, then passes it
+// along to the underlying Transport. If the request's
+// context is cancelled while waiting, its error is
+// returned.
+func (l *Limiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if p, ok := req.Context().Value(prepaidKey{}).(*prepaid); !ok || !p.use(req.URL.Host) {
+		if err := l.wait(req.Context(), req.URL.Host); err != nil {
+			return nil, err
+		}
+	}
+
+	transport := l.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(req)
+}
+
+// Context key for a request that's already
+// waited on the Limiter.
+type prepaidKey struct{}
+
+// A token taken ahead of the request it's for. Only the
+// first round trip to the host uses it, so redirects are
+// still paced.
+type prepaid struct {
+	host string
+	used int32
+}
+
+func (p *prepaid) use(host string) bool {
+	if strings.ToLower(host) != p.host {
+		return false
+	}
+	return atomic.CompareAndSwapInt32(&p.used, 0, 1)
+}
+
+// Waits as RoundTrip would for a request to the host,
+// returning a context under which RoundTrip lets the
+// request through without waiting again. This lets
+// callers wait before the *http.Client's Timeout starts.
+func (l *Limiter) prepay(ctx context.Context, host string) (context.Context, error) {
+	if err := l.wait(ctx, host); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, prepaidKey{}, &prepaid{host: strings.ToLower(host)}), nil
+}
+
+// Blocks until the host and the global budget allow
+// another request, or the context is done.
+// If the context ends first, the tokens taken
+// are given back for the next caller.
+func (l *Limiter) wait(ctx context.Context, host string) error {
+	wait, taken := l.reserve(host, time.Now())
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.refund(taken)
+		return ctx.Err()
+	}
+}
+
+// Takes a token from the host's bucket and the global
+// bucket, returning how long the caller must wait
+// before it may use them, and the buckets taken from.
+func (l *Limiter) reserve(host string, now time.Time) (time.Duration, []*bucket) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	host = strings.ToLower(host)
+	l.sweep(now)
+
+	var wait time.Duration
+	var taken []*bucket
+	if l.hostRate > 0 {
+		b, ok := l.hosts[host]
+		if !ok {
+			b = newBucket(l.hostRate, l.hostBurst)
+			l.hosts[host] = b
+		}
+		wait = b.take(now)
+		taken = append(taken, b)
+	}
+	if l.global != nil {
+		if gwait := l.global.take(now); gwait > wait {
+			wait = gwait
+		}
+		taken = append(taken, l.global)
+	}
+
+	return wait, taken
+}
+
+// Gives back the tokens taken by a
+// reservation that won't be used.
+func (l *Limiter) refund(taken []*bucket) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, e := range taken {
+		e.tokens = math.Min(e.tokens+1, e.burst)
+	}
+}
+
+// Discards idle host buckets so the map doesn't
+// grow without bound.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterIdle {
+		return
+	}
+	l.lastSweep = now
+	for k, v := range l.hosts {
+		if now.Sub(v.last) > limiterIdle {
+			delete(l.hosts, k)
+		}
+	}
+}
+
+func newBucket(rate, burst float64) *bucket {
+	return &bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *bucket) take(now time.Time) time.Duration {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		b.last = now
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_Limiter_reserve(t *testing.T) {
+	now := time.Now()
+
+	t.Run("Per Host", func(t *testing.T) {
+		l := NewLimiter(nil, 1, 2, 0)
+		for i := 0; i < 2; i++ {
+			if wait, _ := l.reserve("example.com", now); wait != 0 {
+				t.Errorf("Burst request %v had to wait %v\n", i, wait)
+			}
+		}
+		if wait, _ := l.reserve("example.com", now); wait != time.Second {
+			t.Errorf("Expected to wait 1s, got %v\n", wait)
+		}
+		if wait, _ := l.reserve("example.org", now); wait != 0 {
+			t.Errorf("Separate host had to wait %v\n", wait)
+		}
+		if wait, _ := l.reserve("example.com", now.Add(3*time.Second)); wait != 0 {
+			t.Errorf("Refilled bucket had to wait %v\n", wait)
+		}
+	})
+
+	t.Run("Global", func(t *testing.T) {
+		l := NewLimiter(nil, 0, 0, 2)
+		l.reserve("a.example.com", now)
+		l.reserve("b.example.com", now)
+		if wait, _ := l.reserve("c.example.com", now); wait != 500*time.Millisecond {
+			t.Errorf("Expected to wait 500ms, got %v\n", wait)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		l := NewLimiter(nil, 0, 0, 0)
+		for i := 0; i < 100; i++ {
+			if wait, _ := l.reserve("example.com", now); wait != 0 {
+				t.Errorf("Unlimited request had to wait %v\n", wait)
+			}
+		}
+	})
+}
+
+// A caller that gives up waiting shouldn't
+// hold up the ones that come after it.
+func Test_Limiter_wait(t *testing.T) {
+	l := NewLimiter(nil, 1, 1, 1)
+	if err := l.wait(context.Background(), "example.com"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, "example.com"); err == nil {
+		t.Fatalf("Expected error from cancelled wait\n")
+	}
+
+	if wait, _ := l.reserve("example.com", time.Now()); wait > time.Second {
+		t.Errorf("Cancelled wait wasn't refunded, next caller waits %v\n", wait)
+	}
+}
+
+func Test_Limiter_RoundTrip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	l := NewLimiter(nil, 1, 1, 0)
+	client := &http.Client{Transport: l}
+
+	res, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	res.Body.Close()
+
+	t.Run("Cancelled While Waiting", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+
+		start := time.Now()
+		_, err := client.Do(req.WithContext(ctx))
+		if err == nil {
+			t.Errorf("Expected error from cancelled request\n")
+		}
+		if time.Since(start) > 500*time.Millisecond {
+			t.Errorf("Cancelled request waited too long: %v\n", time.Since(start))
+		}
+	})
+}
+
+func Test_Limiter_prepay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	// The second request waits 200ms, longer
+	// than the client's Timeout.
+	l := NewLimiter(nil, 5, 1, 0)
+	client := &http.Client{Transport: l, Timeout: 100 * time.Millisecond}
+
+	for i := 0; i < 2; i++ {
+		res, err := doReq(context.Background(), srv.URL, "GET", "", client)
+		if err != nil {
+			t.Fatalf("Request %v: %v\n", i, err)
+		}
+		res.Body.Close()
+	}
+
+	t.Run("Redirects Still Paced", func(t *testing.T) {
+		ctx, err := l.prepay(context.Background(), "example.com")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		p := ctx.Value(prepaidKey{}).(*prepaid)
+		if !p.use("EXAMPLE.com") {
+			t.Errorf("Prepaid token wasn't used\n")
+		}
+		if p.use("example.com") {
+			t.Errorf("Prepaid token was used twice\n")
+		}
+	})
+}
+
+func Benchmark_Limiter_reserve(b *testing.B) {
+	l := NewLimiter(nil, 1000000, 10, 0)
+	now := time.Now()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		l.reserve("example.com", now)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ParseError describes a single line of a twtxt
+// file that couldn't be parsed, and was skipped.
+type ParseError struct {
+	// Line number, starting from 1.
+	Line int
+
+	// Column, in characters, starting from 1,
+	// where the problem was found.
+	Column int
+
+	// What was wrong with the line.
+	Reason string
+}
+
+// ParseErrors collects the lines of a twtxt
+// file that were skipped while parsing it.
+type ParseErrors []*ParseError
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %v, column %v: %v", e.Line, e.Column, e.Reason)
+}
+
+func (e ParseErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, v := range e {
+		lines[i] = v.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Timestamp layouts tried, in order, after normalizing
+// the separators and the "Z" suffix. The latter layouts
+// lack a timezone, and are taken to be UTC.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04",
+}
+
+// Trims surrounding whitespace from a line of a twtxt
+// file, reporting whether it holds a status rather than
+// a comment or nothing at all. A trailing tab is kept,
+// so a status missing its text is reported as such.
+func trimLine(line string) (string, bool) {
+	nopadding := strings.TrimLeftFunc(line, unicode.IsSpace)
+	nopadding = strings.TrimRight(nopadding, " \r\n")
+	if strings.HasPrefix(nopadding, "#") || strings.TrimSpace(nopadding) == "" {
+		return strings.TrimSpace(nopadding), false
+	}
+	return nopadding, true
+}
+
+// Splits a trimmed comment line holding metadata,
+// "# key = value", into its lowercased key and
+// its value.
+func metadataLine(line string) (string, string, bool) {
+	if !strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(line, "#"), "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1]), true
+}
+
+// Parses a single status line, which has already been
+// trimmed, into its timestamp and text. The column of any
+// ParseError is relative to the trimmed line, and the line
+// number is left for the caller to fill in.
+func parseStatusLine(nopadding string) (time.Time, string, *ParseError) {
+	tab := strings.Index(nopadding, "\t")
+	if tab < 0 {
+		return time.Time{}, "", &ParseError{
+			Column: utf8.RuneCountInString(nopadding) + 1,
+			Reason: "missing tab between timestamp and text",
+		}
+	}
+
+	stamp := strings.TrimSpace(nopadding[:tab])
+	text := strings.TrimSpace(nopadding[tab+1:])
+	if text == "" {
+		return time.Time{}, "", &ParseError{
+			Column: utf8.RuneCountInString(nopadding[:tab]) + 2,
+			Reason: "missing status text",
+		}
+	}
+
+	if thetime, err := time.Parse(time.RFC3339Nano, stamp); err == nil {
+		return thetime, text, nil
+	}
+
+	thetime, ok := parseTimestamp(stamp)
+	if !ok {
+		return time.Time{}, "", &ParseError{
+			Column: 1,
+			Reason: fmt.Sprintf("unrecognized timestamp %#v", stamp),
+		}
+	}
+
+	return thetime, text, nil
+}
+
+// Accepts RFC3339 timestamps along with common variants:
+// a space instead of "T", a lowercase "t" or "z", a
+// timezone offset without a colon, missing seconds,
+// and a missing timezone, which is taken to be UTC.
+func parseTimestamp(stamp string) (time.Time, bool) {
+	if len(stamp) > 10 {
+		switch stamp[10] {
+		case ' ', 't':
+			stamp = stamp[:10] + "T" + strings.TrimSpace(stamp[11:])
+		}
+	}
+	if strings.HasSuffix(stamp, "z") {
+		stamp = strings.TrimSuffix(stamp, "z") + "Z"
+	}
+
+	for _, e := range timestampLayouts {
+		if thetime, err := time.Parse(e, stamp); err == nil {
+			return thetime, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,118 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var parseTimestampCases = []struct {
+	name     string
+	orig     string
+	expected time.Time
+}{
+	{
+		name:     "RFC3339",
+		orig:     "2020-02-04T21:28:21Z",
+		expected: time.Date(2020, 2, 4, 21, 28, 21, 0, time.UTC),
+	},
+	{
+		name:     "Space Separator",
+		orig:     "2020-02-04 21:28:21+00:00",
+		expected: time.Date(2020, 2, 4, 21, 28, 21, 0, time.UTC),
+	},
+	{
+		name:     "Lowercase z",
+		orig:     "2020-02-04t21:28:21z",
+		expected: time.Date(2020, 2, 4, 21, 28, 21, 0, time.UTC),
+	},
+	{
+		name:     "Missing Timezone",
+		orig:     "2020-02-04T21:28:21.5",
+		expected: time.Date(2020, 2, 4, 21, 28, 21, 500000000, time.UTC),
+	},
+	{
+		name:     "No Seconds",
+		orig:     "2020-02-04T21:28+01:00",
+		expected: time.Date(2020, 2, 4, 20, 28, 0, 0, time.UTC),
+	},
+	{
+		name:     "Offset Without Colon",
+		orig:     "2020-02-04T22:28:21+0100",
+		expected: time.Date(2020, 2, 4, 21, 28, 21, 0, time.UTC),
+	},
+}
+
+func Test_parseTimestamp(t *testing.T) {
+	for _, tt := range parseTimestampCases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseTimestamp(tt.orig)
+			if !ok {
+				t.Fatalf("Couldn't parse %v\n", tt.orig)
+			}
+			if !got.Equal(tt.expected) {
+				t.Errorf("Expected %v, got %v\n", tt.expected, got)
+			}
+		})
+	}
+}
+
+func Test_ReadUserTwtxt_Diagnostics(t *testing.T) {
+	data := strings.Join([]string{
+		"# nick = foo",
+		"2020-02-04T21:28:21Z\tgood",
+		"no tab here",
+		"  yesterday\tbad timestamp",
+		"2020-02-04T21:29:21Z\t",
+		"2020-02-04 21:30:21\tvariant",
+	}, "\n")
+
+	feed, err := ReadUserTwtxt(strings.NewReader(data), "foo", "https://example.com/twtxt.txt", Limits{})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	if len(feed.Statuses) != 2 {
+		t.Errorf("Expected the 2 good lines to be kept, got %v\n", len(feed.Statuses))
+	}
+
+	expected := []ParseError{
+		{Line: 3, Column: 12},
+		{Line: 4, Column: 3},
+		{Line: 5, Column: 22},
+	}
+	if len(feed.Errors) != len(expected) {
+		t.Fatalf("Expected %v errors, got %v: %v\n", len(expected), len(feed.Errors), feed.Errors)
+	}
+	for i, e := range expected {
+		got := feed.Errors[i]
+		if got.Line != e.Line || got.Column != e.Column || got.Reason == "" {
+			t.Errorf("Expected line %v column %v, got %v\n", e.Line, e.Column, got)
+		}
+	}
+
+	// variants are stored as RFC3339
+	variant := feed.Statuses[time.Date(2020, 2, 4, 21, 30, 21, 0, time.UTC)]
+	if !strings.Contains(variant.String(), "\t2020-02-04T21:30:21Z\tvariant") {
+		t.Errorf("Variant timestamp not normalized: %q\n", variant)
+	}
+}
@@ -20,10 +20,12 @@ along with Registry.  If not, see <https://www.gnu.org/licenses/>.
 package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // QueryUser checks the Registry for usernames
@@ -36,7 +38,7 @@ func (registry *Registry) QueryUser(term string) ([]string, error) {
 	}
 
 	term = strings.ToLower(term)
-	timekey := NewTimeMap()
+	timekey := make(map[time.Time]string)
 	keys := make(TimeSlice, 0)
 	var users []string
 
@@ -68,54 +70,186 @@ func (registry *Registry) QueryUser(term string) ([]string, error) {
 	return users, nil
 }
 
-// QueryInStatus returns all statuses in the Registry
-// that contain the provided substring (tag, mention URL, etc).
-func (registry *Registry) QueryInStatus(substring string) ([]string, error) {
+// QueryInStatus returns all statuses in the Registry whose
+// text contains the provided substring (tag, mention URL, etc),
+// sorted by timestamp.
+func (registry *Registry) QueryInStatus(substring string) ([]*Status, error) {
+	return registry.QueryInStatusContext(context.Background(), substring)
+}
+
+// QueryInStatusContext is QueryInStatus, stopping with
+// the context's error if it ends during the query.
+func (registry *Registry) QueryInStatusContext(ctx context.Context, substring string) ([]*Status, error) {
 	if substring == "" {
 		return nil, fmt.Errorf("cannot query for empty tag")
 	} else if registry == nil {
 		return nil, fmt.Errorf("can't query statuses of empty registry")
+	} else if len(substring) > 140 {
+		return []*Status{}, nil
 	}
 
-	statusmap := make([]TimeMap, 0)
+	substring = strings.ToLower(substring)
 
 	registry.Mu.RLock()
 	defer registry.Mu.RUnlock()
 
-	for _, v := range registry.Users {
-		statusmap = append(statusmap, v.FindInStatus(substring))
-	}
+	return registry.collect(ctx, func(status *Status) bool {
+		return strings.Contains(strings.ToLower(status.Text), substring)
+	}, 0, 0)
+}
 
-	sorted, err := SortByTime(statusmap...)
-	if err != nil {
-		return nil, err
+// QueryMentions returns all statuses in the Registry that
+// mention the provided URL, sorted by timestamp. Mentions
+// of any URL the user was known by before moving their
+// twtxt file are included.
+func (registry *Registry) QueryMentions(urlKey string) ([]*Status, error) {
+	return registry.QueryMentionsContext(context.Background(), urlKey)
+}
+
+// QueryMentionsContext is QueryMentions, stopping with
+// the context's error if it ends during the query.
+func (registry *Registry) QueryMentionsContext(ctx context.Context, urlKey string) ([]*Status, error) {
+	if urlKey == "" {
+		return nil, fmt.Errorf("cannot query for empty URL")
+	} else if registry == nil {
+		return nil, fmt.Errorf("can't query statuses of empty registry")
 	}
 
-	return sorted, nil
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	urls := registry.aliasesOf(urlKey)
+	return registry.collect(ctx, func(status *Status) bool {
+		return status.mentionsAny(urls...)
+	}, 0, 0)
+}
+
+// QueryAllStatuses returns all statuses in
+// the Registry sorted by timestamp.
+func (registry *Registry) QueryAllStatuses() ([]*Status, error) {
+	return registry.QueryAllStatusesContext(context.Background())
 }
 
-// QueryAllStatuses returns all statuses in the Registry
-// as a slice of strings sorted by timestamp.
-func (registry *Registry) QueryAllStatuses() ([]string, error) {
+// QueryAllStatusesContext is QueryAllStatuses, stopping
+// with the context's error if it ends during the query.
+func (registry *Registry) QueryAllStatusesContext(ctx context.Context) ([]*Status, error) {
 	if registry == nil {
 		return nil, fmt.Errorf("can't get latest statuses from empty registry")
 	}
 
-	statusmap, err := registry.GetStatuses()
-	if err != nil {
-		return nil, err
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	return registry.collect(ctx, nil, 0, 0)
+}
+
+// QueryStatuses returns the statuses matching q, in the same
+// order as QueryAllStatuses. Mentions of any URL a user was known
+// by before moving their twtxt file are matched, as with
+// QueryMentions. If store is a QueryStorage, and the Registry has
+// no changes left to save to it, the query is pushed down to store
+// so it needn't walk every status in memory. Otherwise, or if store
+// is nil, the Registry answers it itself.
+//
+// Storage may only fold the case of ASCII letters when matching
+// q.Substring, so substrings with other characters are always
+// matched in memory. Even so, the two can differ: a status whose
+// text has one of the few other letters that fold to ASCII, such
+// as the Kelvin sign, is only matched in memory. Statuses posted
+// at the same instant from the same URL, which only happens when
+// a user has been added twice, may also be paged differently.
+func (registry *Registry) QueryStatuses(store Storage, q StatusQuery) ([]*Status, error) {
+	return registry.QueryStatusesContext(context.Background(), store, q)
+}
+
+// QueryStatusesContext is QueryStatuses, stopping with
+// the context's error if it ends during the query.
+func (registry *Registry) QueryStatusesContext(ctx context.Context, store Storage, q StatusQuery) ([]*Status, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't query statuses of empty registry")
+	} else if len(q.Substring) > 140 {
+		return []*Status{}, nil
 	}
 
-	sorted, err := SortByTime(statusmap)
-	if err != nil {
-		return nil, err
+	registry.Mu.RLock()
+	if q.User != "" {
+		q.User = registry.resolve(q.User)
+	}
+	var mentions []string
+	for _, e := range q.Mentions {
+		mentions = append(mentions, registry.aliasesOf(e)...)
 	}
+	q.Mentions = mentions
+	registry.Mu.RUnlock()
 
-	if sorted == nil {
-		sorted = make([]string, 1)
+	if stored, ok := store.(QueryStorage); ok && !registry.Dirty() && isASCII(q.Substring) {
+		statuses, err := stored.QueryStatuses(q)
+		if err != nil {
+			return nil, err
+		}
+		// the store may break ties differently, and
+		// return the same status under two users
+		sm := NewStatusMap()
+		for _, e := range statuses {
+			sm[e.Key()] = e
+		}
+		return sm.Sorted(), nil
 	}
 
-	return sorted, nil
+	substring := strings.ToLower(q.Substring)
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	return registry.collect(ctx, func(status *Status) bool {
+		switch {
+		case substring != "" && !strings.Contains(strings.ToLower(status.Text), substring):
+			return false
+		case q.User != "" && status.URL != q.User:
+			return false
+		case len(q.Mentions) > 0 && !status.mentionsAny(q.Mentions...):
+			return false
+		case !q.Before.IsZero() && !status.Time.Before(q.Before):
+			return false
+		}
+		return true
+	}, q.Offset, q.Limit)
+}
+
+// Walks the Registry's index, returning the statuses matched
+// by the provided function, or all of them if it's nil, in
+// order. The first offset matches are skipped, and the walk
+// stops once limit statuses are found, unless limit is zero.
+// The caller must hold a read lock on the Registry.
+func (registry *Registry) collect(ctx context.Context, match func(*Status) bool, offset, limit int) ([]*Status, error) {
+	out := make([]*Status, 0)
+	var err error
+	n := 0
+	registry.index.ascend(registry.Users, func(status *Status) bool {
+		// checking the context has a cost,
+		// so only do it every so often
+		if n++; n%256 == 0 {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
+		}
+		if match != nil && !match(status) {
+			return true
+		}
+		if offset > 0 {
+			offset--
+			return true
+		}
+		out = append(out, status)
+		return limit < 1 || len(out) < limit
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
 // ReduceToPage returns the passed 'page' worth of output.
@@ -124,21 +258,34 @@ func (registry *Registry) QueryAllStatuses() ([]string, error) {
 // registry specification, queries should accept a "page"
 // value.
 func ReduceToPage(page int, data []string) []string {
+	beg, end := pageBounds(page, len(data))
+	return data[beg:end]
+}
+
+// ReduceStatusesToPage is ReduceToPage for statuses,
+// so a page can be taken before formatting them.
+func ReduceStatusesToPage(page int, data []*Status) []*Status {
+	beg, end := pageBounds(page, len(data))
+	return data[beg:end]
+}
+
+func pageBounds(page, n int) (int, int) {
 	end := 20 * page
-	if end > len(data) || end < 1 {
-		end = len(data)
+	if end > n || end < 1 {
+		end = n
 	}
 
 	beg := end - 20
-	if beg > len(data)-1 || beg < 0 {
+	if beg > n-1 || beg < 0 {
 		beg = 0
 	}
 
-	return data[beg:end]
+	return beg, end
 }
 
-// FindInStatus takes a user's statuses and looks for a given substring.
-// Returns the statuses that include the substring as a TimeMap.
+// FindInStatus takes a user's statuses and looks for a given substring
+// in their text. Returns the statuses that include the substring as
+// a TimeMap.
 func (userdata *User) FindInStatus(substring string) TimeMap {
 	if userdata == nil {
 		return nil
@@ -153,12 +300,7 @@ func (userdata *User) FindInStatus(substring string) TimeMap {
 	defer userdata.Mu.RUnlock()
 
 	for k, e := range userdata.Status {
-		if _, ok := userdata.Status[k]; !ok {
-			continue
-		}
-
-		parts := strings.Split(strings.ToLower(e), "\t")
-		if strings.Contains(parts[3], substring) {
+		if e != nil && strings.Contains(strings.ToLower(e.Text), substring) {
 			statuses[k] = e
 		}
 	}
@@ -166,31 +308,28 @@ func (userdata *User) FindInStatus(substring string) TimeMap {
 	return statuses
 }
 
-// SortByTime returns a string slice of the query results,
-// sorted by timestamp in descending order (newest first).
-func SortByTime(tm ...TimeMap) ([]string, error) {
+// SortByTime returns a slice of the query results, sorted
+// by timestamp in descending order (newest first). Statuses
+// from all of the TimeMaps are interleaved, with the same
+// tiebreaker as StatusMap.Sorted.
+func SortByTime(tm ...TimeMap) ([]*Status, error) {
 	if tm == nil {
 		return nil, fmt.Errorf("can't sort nil TimeMaps")
 	}
 
-	var times = make(TimeSlice, 0)
-	var data []string
-
+	statuses := NewStatusMap()
 	for _, e := range tm {
-		for k := range e {
-			times = append(times, k)
-		}
+		statuses.Add(e)
 	}
 
-	sort.Sort(times)
+	return statuses.Sorted(), nil
+}
 
-	for k := range tm {
-		for _, e := range times {
-			if _, ok := tm[k][e]; ok {
-				data = append(data, tm[k][e])
-			}
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
 		}
 	}
-
-	return data, nil
+	return true
 }
@@ -21,6 +21,7 @@ package registry
 
 import (
 	"bufio"
+	"context"
 	"os"
 	"strings"
 	"testing"
@@ -194,12 +195,8 @@ func Test_Registry_QueryInStatus(t *testing.T) {
 			}
 
 			for _, e := range out {
-				split := strings.Split(strings.ToLower(e), "\t")
-
-				if e != "" {
-					if !strings.Contains(split[3], strings.ToLower(tt.substr)) {
-						t.Errorf("Status without substring returned\n")
-					}
+				if !strings.Contains(strings.ToLower(e.Text), strings.ToLower(tt.substr)) {
+					t.Errorf("Status without substring returned\n")
 				}
 			}
 		})
@@ -231,6 +228,130 @@ func Test_QueryAllStatuses(t *testing.T) {
 		}
 	})
 }
+
+// A Storage that answers queries with
+// whatever it's been given.
+type queryStorage struct {
+	*memStorage
+	queries []StatusQuery
+	answer  []*Status
+}
+
+func (qs *queryStorage) QueryStatuses(q StatusQuery) ([]*Status, error) {
+	qs.queries = append(qs.queries, q)
+	return qs.answer, nil
+}
+
+func Test_Registry_QueryStatuses(t *testing.T) {
+	a, b := "https://a.example.com/twtxt.txt", "https://b.example.com/twtxt.txt"
+	base := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	registry := New(nil)
+	for _, urlKey := range []string{a, b} {
+		statuses := NewTimeMap()
+		for i := 0; i < 3; i++ {
+			then := base.Add(time.Duration(i) * time.Hour)
+			statuses[then] = NewStatus("foo", urlKey, then, "Hello @<bar https://old.example.com/twtxt.txt>")
+		}
+		registry.AddUser("foo", urlKey, nil, statuses)
+	}
+	registry.Aliases["https://old.example.com/twtxt.txt"] = b
+
+	cases := []struct {
+		name string
+		q    StatusQuery
+		want int
+	}{
+		{name: "Everything", q: StatusQuery{}, want: 6},
+		{name: "Substring", q: StatusQuery{Substring: "HELLO"}, want: 6},
+		{name: "No Match", q: StatusQuery{Substring: "goodbye"}, want: 0},
+		{name: "Mentions Through Alias", q: StatusQuery{Mentions: []string{b}}, want: 6},
+		{name: "User Before", q: StatusQuery{User: a, Before: base.Add(2 * time.Hour)}, want: 2},
+		{name: "Page", q: StatusQuery{Limit: 4, Offset: 4}, want: 2},
+		{name: "Past the End", q: StatusQuery{Offset: 10}, want: 0},
+	}
+	all, _ := registry.QueryAllStatuses()
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := registry.QueryStatuses(nil, tt.q)
+			if err != nil {
+				t.Fatalf("%v\n", err)
+			}
+			if len(out) != tt.want {
+				t.Errorf("Expected %v statuses, got %v\n", tt.want, len(out))
+			}
+			if len(out) > 0 && tt.q.Offset > 0 && out[0] != all[tt.q.Offset] {
+				t.Errorf("Page starts at the wrong status: %v\n", out[0])
+			}
+		})
+	}
+
+	t.Run("Pushed Down Once Saved", func(t *testing.T) {
+		store := &queryStorage{memStorage: newMemStorage()}
+		store.answer = []*Status{all[1], all[0], all[0]}
+
+		if _, err := registry.QueryStatuses(store, StatusQuery{}); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if len(store.queries) != 0 {
+			t.Errorf("Query pushed down with unsaved changes\n")
+		}
+
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		out, err := registry.QueryStatuses(store, StatusQuery{Mentions: []string{b}})
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if len(store.queries) != 1 {
+			t.Fatalf("Query wasn't pushed down\n")
+		}
+		if q := store.queries[0]; len(q.Mentions) != 2 || q.Mentions[0] != b {
+			t.Errorf("Aliases weren't included in the query: %v\n", q.Mentions)
+		}
+		if len(out) != 2 || out[0] != all[0] || out[1] != all[1] {
+			t.Errorf("Stored results weren't deduplicated and sorted: %v\n", out)
+		}
+
+		// storage can't fold the case of other letters
+		if _, err := registry.QueryStatuses(store, StatusQuery{Substring: "HÉLLO"}); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if len(store.queries) != 1 {
+			t.Errorf("Query for a substring that isn't ASCII pushed down\n")
+		}
+	})
+}
+
+// A page of statuses shouldn't need
+// the whole index to be walked.
+func Test_Registry_collect_Limit(t *testing.T) {
+	base := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	registry := New(nil)
+	statuses := NewTimeMap()
+	for i := 0; i < 6; i++ {
+		then := base.Add(time.Duration(i) * time.Hour)
+		statuses[then] = NewStatus("foo", "https://example.com/twtxt.txt", then, "hi")
+	}
+	registry.AddUser("foo", "https://example.com/twtxt.txt", nil, statuses)
+	all, _ := registry.QueryAllStatuses()
+
+	walked := 0
+	out, err := registry.collect(context.Background(), func(*Status) bool {
+		walked++
+		return true
+	}, 1, 2)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(out) != 2 || out[0] != all[1] || out[1] != all[2] {
+		t.Errorf("Wrong page: %v\n", out)
+	}
+	if walked != 3 {
+		t.Errorf("Expected the walk to stop after 3 statuses, walked %v\n", walked)
+	}
+}
+
 func Benchmark_QueryAllStatuses(b *testing.B) {
 	registry := initTestEnv()
 	b.ResetTimer()
@@ -272,9 +393,9 @@ func Test_ReduceToPage(t *testing.T) {
 			if err != nil && !tt.wantErr {
 				t.Errorf("%v\n", err.Error())
 			}
-			out = ReduceToPage(tt.page, out)
-			if len(out) > 20 || len(out) == 0 {
-				t.Errorf("Page-Reduce Malfunction: length of data %v\n", len(out))
+			page := ReduceToPage(tt.page, FormatStatuses(out))
+			if len(page) > 20 || len(page) == 0 {
+				t.Errorf("Page-Reduce Malfunction: length of data %v\n", len(page))
 			}
 		})
 	}
@@ -283,10 +404,11 @@ func Test_ReduceToPage(t *testing.T) {
 func Benchmark_ReduceToPage(b *testing.B) {
 	registry := initTestEnv()
 	out, _ := registry.QueryAllStatuses()
+	lines := FormatStatuses(out)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		for _, tt := range get20cases {
-			ReduceToPage(tt.page, out)
+			ReduceToPage(tt.page, lines)
 		}
 	}
 }
@@ -346,7 +468,7 @@ func Benchmark_User_FindInStatus(b *testing.B) {
 func Test_SortByTime_Slice(t *testing.T) {
 	registry := initTestEnv()
 
-	statusmap, err := registry.GetStatuses()
+	statusmap, err := registry.GetUserStatuses("https://example.com/twtxt.txt")
 	if err != nil {
 		t.Errorf("Failed to finish test initialization: %v\n", err)
 	}
@@ -356,14 +478,12 @@ func Test_SortByTime_Slice(t *testing.T) {
 		if err != nil {
 			t.Errorf("%v\n", err)
 		}
-		split := strings.Split(sorted[0], "\t")
-		firsttime, _ := time.Parse("RFC3339", split[0])
+		firsttime := sorted[0].Time
 
 		for i := range sorted {
 			if i < len(sorted)-1 {
 
-				nextsplit := strings.Split(sorted[i+1], "\t")
-				nexttime, _ := time.Parse("RFC3339", nextsplit[0])
+				nexttime := sorted[i+1].Time
 
 				if firsttime.Before(nexttime) {
 					t.Errorf("Timestamps out of order: %v\n", sorted)
@@ -386,7 +506,7 @@ func Benchmark_SortByTime_Slice(b *testing.B) {
 	b.Logf("Benchmarking SortByTime with a constructed slice of %v statuses ...\n", sortMultiplier*4)
 	registry := initTestEnv()
 
-	statusmap, err := registry.GetStatuses()
+	statusmap, err := registry.GetUserStatuses("https://example.com/twtxt.txt")
 	if err != nil {
 		b.Errorf("Failed to finish benchmark initialization: %v\n", err)
 	}
@@ -411,7 +531,7 @@ func Benchmark_SortByTime_Slice(b *testing.B) {
 func Test_SortByTime_Single(t *testing.T) {
 	registry := initTestEnv()
 
-	statusmap, err := registry.GetStatuses()
+	statusmap, err := registry.GetUserStatuses("https://example.com/twtxt.txt")
 	if err != nil {
 		t.Errorf("Failed to finish test initialization: %v\n", err)
 	}
@@ -421,14 +541,12 @@ func Test_SortByTime_Single(t *testing.T) {
 		if err != nil {
 			t.Errorf("%v\n", err)
 		}
-		split := strings.Split(sorted[0], "\t")
-		firsttime, _ := time.Parse("RFC3339", split[0])
+		firsttime := sorted[0].Time
 
 		for i := range sorted {
 			if i < len(sorted)-1 {
 
-				nextsplit := strings.Split(sorted[i+1], "\t")
-				nexttime, _ := time.Parse("RFC3339", nextsplit[0])
+				nexttime := sorted[i+1].Time
 
 				if firsttime.Before(nexttime) {
 					t.Errorf("Timestamps out of order: %v\n", sorted)
@@ -443,7 +561,7 @@ func Test_SortByTime_Single(t *testing.T) {
 func Benchmark_SortByTime_Single(b *testing.B) {
 	registry := initTestEnv()
 
-	statusmap, err := registry.GetStatuses()
+	statusmap, err := registry.GetUserStatuses("https://example.com/twtxt.txt")
 	if err != nil {
 		b.Errorf("Failed to finish benchmark initialization: %v\n", err)
 	}
@@ -0,0 +1,137 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"sort"
+	"time"
+)
+
+// RetentionPolicy bounds the statuses kept for a user.
+// Statuses outside either bound are pruned, oldest first.
+type RetentionPolicy struct {
+	// Statuses posted longer ago than this
+	// are pruned.
+	MaxAge time.Duration
+
+	// The most statuses kept for a user.
+	// When exceeded, the newest are kept.
+	MaxStatuses int
+}
+
+// Retention decides which statuses the Registry keeps.
+// Local applies to users added directly, and Remote to
+// those found via CrawlRemoteRegistry. Fields of Local
+// left as zero keep everything. Fields of Remote left as
+// zero take the value from Local, while negative values
+// keep everything.
+type Retention struct {
+	Local  RetentionPolicy
+	Remote RetentionPolicy
+}
+
+// Returns the policy for a user, who's either
+// local or from the remote registry.
+func (ret Retention) policy(remote bool) RetentionPolicy {
+	if !remote {
+		return ret.Local
+	}
+	policy := ret.Remote
+	if policy.MaxAge == 0 {
+		policy.MaxAge = ret.Local.MaxAge
+	}
+	if policy.MaxStatuses == 0 {
+		policy.MaxStatuses = ret.Local.MaxStatuses
+	}
+	return policy
+}
+
+// Returns the times of the statuses the
+// policy would prune as of now.
+func (policy RetentionPolicy) expired(statuses TimeMap, now time.Time) []time.Time {
+	if policy.MaxAge <= 0 && policy.MaxStatuses <= 0 {
+		return nil
+	}
+
+	times := make(TimeSlice, 0, len(statuses))
+	for k := range statuses {
+		times = append(times, k)
+	}
+	// newest first
+	sort.Sort(times)
+
+	out := make([]time.Time, 0)
+	for i, e := range times {
+		if (policy.MaxStatuses > 0 && i >= policy.MaxStatuses) ||
+			(policy.MaxAge > 0 && now.Sub(e) > policy.MaxAge) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Prune removes the statuses the Registry's Retention
+// doesn't keep from each user, returning how many were
+// removed. The next Save removes them from Storage.
+// UpdateUser prunes the user it updates, so calling Prune
+// is only needed to apply a new Retention to every user,
+// or to catch users whose files haven't changed.
+func (registry *Registry) Prune() int {
+	return registry.prune(time.Now())
+}
+
+func (registry *Registry) prune(now time.Time) int {
+	registry.Mu.RLock()
+	retention := registry.Retention
+	users := make(map[string]*User, len(registry.Users))
+	for k, v := range registry.Users {
+		users[k] = v
+	}
+	registry.Mu.RUnlock()
+
+	n := 0
+	for k, v := range users {
+		if v != nil {
+			n += registry.pruneUser(k, v, retention, now)
+		}
+	}
+	return n
+}
+
+// Removes the user's statuses the retention
+// doesn't keep, returning how many.
+func (registry *Registry) pruneUser(urlKey string, user *User, retention Retention, now time.Time) int {
+	user.Mu.Lock()
+	policy := retention.policy(user.RemoteRegistry != "")
+	expired := policy.expired(user.Status, now)
+	pruned := NewTimeMap()
+	for _, e := range expired {
+		pruned[e] = user.Status[e]
+		delete(user.Status, e)
+	}
+	user.Mu.Unlock()
+
+	if len(pruned) == 0 {
+		return 0
+	}
+	registry.index.remove(pruned)
+	registry.changes.delStatuses(urlKey, expired)
+	return len(pruned)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_RetentionPolicy_expired(t *testing.T) {
+	now := time.Date(2019, 9, 10, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	statuses := NewTimeMap()
+	for i := 0; i < 5; i++ {
+		then := now.Add(-time.Duration(i) * day)
+		statuses[then] = NewStatus("foo", "https://example.com/twtxt.txt", then, "hi")
+	}
+
+	cases := []struct {
+		name   string
+		policy RetentionPolicy
+		want   int
+	}{
+		{name: "Keep Everything", policy: RetentionPolicy{}, want: 0},
+		{name: "Max Age", policy: RetentionPolicy{MaxAge: 2*day + time.Hour}, want: 2},
+		{name: "Max Statuses", policy: RetentionPolicy{MaxStatuses: 4}, want: 1},
+		{name: "Both", policy: RetentionPolicy{MaxAge: 3*day + time.Hour, MaxStatuses: 2}, want: 3},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.expired(statuses, now)
+			if len(got) != tt.want {
+				t.Fatalf("Expected %v pruned, got %v\n", tt.want, got)
+			}
+			// the oldest are pruned
+			for _, e := range got {
+				if now.Sub(e) < time.Duration(5-tt.want)*day {
+					t.Errorf("Pruned a status that should be kept: %v\n", e)
+				}
+			}
+		})
+	}
+}
+
+func Test_Retention_policy(t *testing.T) {
+	ret := Retention{
+		Local:  RetentionPolicy{MaxAge: time.Hour, MaxStatuses: 10},
+		Remote: RetentionPolicy{MaxStatuses: -1},
+	}
+	if got := ret.policy(false); got != ret.Local {
+		t.Errorf("Local users got %v\n", got)
+	}
+	if got := ret.policy(true); got.MaxAge != time.Hour || got.MaxStatuses != -1 {
+		t.Errorf("Remote users got %v\n", got)
+	}
+}
+
+// A Storage that can delete single statuses.
+type pruneStorage struct {
+	*memStorage
+	deleted int
+}
+
+func (p *pruneStorage) DelStatuses(urlKey string, times []time.Time) error {
+	p.deleted += len(times)
+	for _, e := range times {
+		delete(p.users[urlKey].Status, e)
+	}
+	return nil
+}
+
+func Test_Registry_Prune(t *testing.T) {
+	now := time.Now()
+	local := "https://example.com/twtxt.txt"
+	remote := "https://example.org/twtxt.txt"
+
+	setup := func() *Registry {
+		registry := New(nil)
+		for _, e := range []string{local, remote} {
+			statuses := NewTimeMap()
+			for i := 0; i < 4; i++ {
+				then := now.Add(-time.Duration(i) * time.Hour)
+				statuses[then] = NewStatus("foo", e, then, "hi")
+			}
+			registry.AddUser("foo", e, nil, statuses)
+		}
+		registry.Users[remote].RemoteRegistry = "https://example.net/api/plain/users"
+		registry.Retention = Retention{
+			Local:  RetentionPolicy{MaxStatuses: 3},
+			Remote: RetentionPolicy{MaxAge: 90 * time.Minute},
+		}
+		return registry
+	}
+
+	check := func(t *testing.T, registry *Registry, users map[string]*User) {
+		if n := len(registry.Users[local].Status); n != 3 {
+			t.Errorf("Expected 3 local statuses, got %v\n", n)
+		}
+		if n := len(registry.Users[remote].Status); n != 2 {
+			t.Errorf("Expected 2 remote statuses, got %v\n", n)
+		}
+		if out, _ := registry.QueryAllStatuses(); len(out) != 5 {
+			t.Errorf("Pruned statuses left in the index: %v\n", len(out))
+		}
+		if len(users[local].Status) != 3 || len(users[remote].Status) != 2 {
+			t.Errorf("Pruned statuses left in storage: %v, %v\n", len(users[local].Status), len(users[remote].Status))
+		}
+	}
+
+	t.Run("PruneStorage", func(t *testing.T) {
+		registry := setup()
+		store := &pruneStorage{memStorage: newMemStorage()}
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if n := registry.prune(now); n != 3 {
+			t.Errorf("Expected 3 pruned, got %v\n", n)
+		}
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if store.deleted != 3 {
+			t.Errorf("Expected 3 statuses deleted from storage, got %v\n", store.deleted)
+		}
+		check(t, registry, store.users)
+	})
+
+	// Other Storage have the
+	// user rewritten instead.
+	t.Run("Storage", func(t *testing.T) {
+		registry := setup()
+		store := newMemStorage()
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		registry.prune(now)
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		check(t, registry, store.users)
+	})
+}
+
+// Refreshing a user should prune the statuses
+// they've accumulated beyond the retention.
+func Test_Registry_UpdateUser_Prune(t *testing.T) {
+	body := "2019-09-01T00:00:00Z\tone\n2019-09-02T00:00:00Z\ttwo\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	registry := New(srv.Client())
+	registry.Retention.Local.MaxStatuses = 2
+	urlKey := srv.URL + "/twtxt.txt"
+
+	older := time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC)
+	registry.AddUser("foo", urlKey, nil, TimeMap{older: NewStatus("foo", urlKey, older, "zero")})
+
+	if err := registry.UpdateUser(urlKey); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	statuses, _ := registry.GetUserStatuses(urlKey)
+	if _, ok := statuses[older]; ok || len(statuses) != 2 {
+		t.Errorf("Expected the oldest status pruned, got %v\n", statuses)
+	}
+}
@@ -0,0 +1,274 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RobotsAgent is the user-agent token looked for in
+// robots.txt files. Only rules in groups naming this
+// agent are honoured.
+const RobotsAgent = "getwtxt"
+
+// How long the rules for a given host are kept
+// before robots.txt is requested again.
+const robotsTTL = 24 * time.Hour
+
+// The largest robots.txt we're willing to read.
+const robotsMaxSize = 512 * 1024
+
+// ErrDisallowed is returned when a host's robots.txt
+// forbids getwtxt from fetching a twtxt file.
+var ErrDisallowed = errors.New("fetching disallowed by robots.txt")
+
+// ErrOptedOut is returned when a twtxt file contains
+// metadata asking not to be included in registries.
+var ErrOptedOut = errors.New("twtxt file has opted out of registries")
+
+// Caches the parsed robots.txt rules
+// for each host, keyed by scheme and host.
+type robotsCache struct {
+	mu    sync.Mutex
+	hosts map[string]*robotsEntry
+}
+
+type robotsEntry struct {
+	rules   []robotsRule
+	fetched time.Time
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+func newRobotsCache() *robotsCache {
+	return &robotsCache{
+		hosts: make(map[string]*robotsEntry),
+	}
+}
+
+// RobotsAllowed reports whether the robots.txt of the host
+// serving the twtxt file at urlKey permits it to be fetched.
+// Results are cached for each host. If robots.txt can't be
+// retrieved, fetching is allowed.
+func (registry *Registry) RobotsAllowed(urlKey string) (bool, error) {
+	return registry.RobotsAllowedContext(context.Background(), urlKey)
+}
+
+// RobotsAllowedContext is RobotsAllowed, with any request
+// for robots.txt bound to the provided context. If the
+// context ends before robots.txt is retrieved, its error
+// is returned and nothing is cached.
+func (registry *Registry) RobotsAllowedContext(ctx context.Context, urlKey string) (bool, error) {
+	target, err := url.Parse(urlKey)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return false, fmt.Errorf("invalid URL: %v", urlKey)
+	}
+
+	cache := registry.robots
+	if cache == nil {
+		cache = newRobotsCache()
+	}
+
+	hostKey := target.Scheme + "://" + strings.ToLower(target.Host)
+	cache.mu.Lock()
+	entry, ok := cache.hosts[hostKey]
+	cache.mu.Unlock()
+
+	if !ok || time.Since(entry.fetched) > robotsTTL {
+		entry = &robotsEntry{
+			rules:   fetchRobots(ctx, hostKey+"/robots.txt", registry.HTTPClient),
+			fetched: time.Now(),
+		}
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		cache.mu.Lock()
+		cache.hosts[hostKey] = entry
+		cache.mu.Unlock()
+	}
+
+	path := target.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if target.RawQuery != "" {
+		path += "?" + target.RawQuery
+	}
+
+	return robotsPermits(entry.rules, path), nil
+}
+
+// Retrieves and parses a robots.txt file. Any failure
+// results in an empty set of rules.
+func fetchRobots(ctx context.Context, robotsURL string, client *http.Client) []robotsRule {
+	res, err := doReq(ctx, robotsURL, "GET", "", client)
+	if err != nil {
+		return nil
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, robotsMaxSize))
+	if err != nil {
+		return nil
+	}
+
+	return parseRobots(data)
+}
+
+// Extracts the rules from groups of a robots.txt
+// file whose user-agent lines name RobotsAgent.
+func parseRobots(data []byte) []robotsRule {
+	var rules []robotsRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	inGroup := false
+	matched := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		switch field {
+		case "user-agent":
+			// A user-agent line after rules
+			// begins a new group.
+			if inGroup {
+				inGroup = false
+				matched = false
+			}
+			if strings.Contains(strings.ToLower(value), RobotsAgent) {
+				matched = true
+			}
+
+		case "allow", "disallow":
+			inGroup = true
+			if !matched || value == "" {
+				continue
+			}
+			rules = append(rules, robotsRule{
+				allow:   field == "allow",
+				pattern: value,
+			})
+		}
+	}
+
+	return rules
+}
+
+// The longest matching rule wins. If an allow and
+// disallow rule are the same length, allow wins.
+func robotsPermits(rules []robotsRule, path string) bool {
+	allowed := true
+	longest := -1
+
+	for _, e := range rules {
+		if !robotsMatch(e.pattern, path) {
+			continue
+		}
+		if len(e.pattern) > longest || (len(e.pattern) == longest && e.allow) {
+			longest = len(e.pattern)
+			allowed = e.allow
+		}
+	}
+
+	return allowed
+}
+
+// Matches a robots.txt path pattern against a path.
+// Supports the '*' wildcard and the '$' end anchor.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	pieces := strings.Split(pattern, "*")
+
+	if !strings.HasPrefix(path, pieces[0]) {
+		return false
+	}
+	rest := path[len(pieces[0]):]
+
+	for i, e := range pieces[1:] {
+		last := i == len(pieces)-2
+		if last && anchored {
+			return strings.HasSuffix(rest, e)
+		}
+		idx := strings.Index(rest, e)
+		if idx < 0 {
+			return false
+		}
+		rest = rest[idx+len(e):]
+	}
+
+	return !anchored || rest == ""
+}
+
+// OptedOut reports whether a twtxt file contains the
+// metadata line "# noindex = true", signalling that its
+// owner doesn't want it included in registries.
+func OptedOut(twtxt []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(twtxt))
+
+	for scanner.Scan() {
+		if isOptOutLine(strings.TrimSpace(scanner.Text())) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Matches the trimmed metadata line described
+// in OptedOut.
+func isOptOutLine(line string) bool {
+	key, value, ok := metadataLine(line)
+	if !ok || key != "noindex" {
+		return false
+	}
+
+	switch strings.ToLower(value) {
+	case "true", "yes", "1":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const testRobots = `
+User-agent: *
+Disallow: /
+
+User-agent: SomeBot
+User-agent: getwtxt
+Disallow: /private/
+Disallow: /*.cgi$
+Allow: /private/twtxt.txt
+
+User-agent: OtherBot
+Allow: /
+`
+
+var robotsPermitsCases = []struct {
+	path    string
+	allowed bool
+}{
+	{path: "/twtxt.txt", allowed: true},
+	{path: "/private/notes.txt", allowed: false},
+	{path: "/private/twtxt.txt", allowed: true},
+	{path: "/feed.cgi", allowed: false},
+	{path: "/feed.cgi?user=foo", allowed: true},
+}
+
+func Test_robotsPermits(t *testing.T) {
+	rules := parseRobots([]byte(testRobots))
+	if len(rules) != 3 {
+		t.Fatalf("Expected 3 rules for getwtxt, got %v: %v\n", len(rules), rules)
+	}
+
+	for _, tt := range robotsPermitsCases {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := robotsPermits(rules, tt.path); got != tt.allowed {
+				t.Errorf("Expected %v, got %v\n", tt.allowed, got)
+			}
+		})
+	}
+}
+
+func Test_Registry_RobotsAllowed(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			atomic.AddInt32(&hits, 1)
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(testRobots))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	registry := New(nil)
+
+	t.Run("Allowed", func(t *testing.T) {
+		ok, err := registry.RobotsAllowed(srv.URL + "/twtxt.txt")
+		if err != nil || !ok {
+			t.Errorf("Expected to be allowed: %v %v\n", ok, err)
+		}
+	})
+	t.Run("Disallowed", func(t *testing.T) {
+		ok, err := registry.RobotsAllowed(srv.URL + "/private/notes.txt")
+		if err != nil || ok {
+			t.Errorf("Expected to be disallowed: %v %v\n", ok, err)
+		}
+	})
+	t.Run("Cached", func(t *testing.T) {
+		if n := atomic.LoadInt32(&hits); n != 1 {
+			t.Errorf("Expected robots.txt to be fetched once, got %v\n", n)
+		}
+	})
+	t.Run("Invalid URL", func(t *testing.T) {
+		if _, err := registry.RobotsAllowed("/etc/passwd"); err == nil {
+			t.Errorf("Expected error, received nil\n")
+		}
+	})
+}
+
+var optedOutCases = []struct {
+	name string
+	data string
+	want bool
+}{
+	{
+		name: "Opted Out",
+		data: "# nick = foo\n#   noindex = true\n2019-09-05T15:19:28Z\thi\n",
+		want: true,
+	},
+	{
+		name: "Opted In",
+		data: "# noindex = false\n2019-09-05T15:19:28Z\thi\n",
+		want: false,
+	},
+	{
+		name: "Not a Comment",
+		data: "2019-09-05T15:19:28Z\tnoindex = true\n",
+		want: false,
+	},
+}
+
+func Test_OptedOut(t *testing.T) {
+	for _, tt := range optedOutCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := OptedOut([]byte(tt.data)); got != tt.want {
+				t.Errorf("Expected %v, got %v\n", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_Registry_UpdateUser_Excluded(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			w.Write([]byte("User-agent: getwtxt\nDisallow: /crawled/\n"))
+		case "/optout/twtxt.txt":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("# noindex = yes\n2019-09-05T15:19:28Z\thi\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	registry := New(nil)
+	registry.Users[srv.URL+"/optout/twtxt.txt"] = &User{Nick: "optout", Status: NewTimeMap()}
+	registry.Users[srv.URL+"/crawled/twtxt.txt"] = &User{Nick: "crawled", Status: NewTimeMap(), RemoteRegistry: "https://example.com/api/plain/tweets"}
+
+	t.Run("Opted Out", func(t *testing.T) {
+		if err := registry.UpdateUser(srv.URL + "/optout/twtxt.txt"); err != ErrOptedOut {
+			t.Errorf("Expected ErrOptedOut, got %v\n", err)
+		}
+	})
+	t.Run("Disallowed", func(t *testing.T) {
+		if err := registry.UpdateUser(srv.URL + "/crawled/twtxt.txt"); err != ErrDisallowed {
+			t.Errorf("Expected ErrDisallowed, got %v\n", err)
+		}
+	})
+}
+
+func Benchmark_robotsPermits(b *testing.B) {
+	rules := parseRobots([]byte(testRobots))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, tt := range robotsPermitsCases {
+			robotsPermits(rules, tt.path)
+		}
+	}
+}
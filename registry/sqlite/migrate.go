@@ -0,0 +1,270 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sqlite // import "git.sr.ht/~gbmor/getwtxt/registry/sqlite"
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+)
+
+// Each migration moves the schema up one version, and
+// runs in the same transaction as recording that it did.
+// The schema's version is the number that have been run.
+var migrations = []func(*sql.Tx) error{
+	migrateTables,
+	migrateEdits,
+	migrateQuarantine,
+}
+
+// Brings the database's schema up to date.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS metadata (key TEXT PRIMARY KEY, value TEXT NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %v is newer than this version supports (%v)", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := migrations[i](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("couldn't migrate database to schema version %v: %v", i+1, err)
+		}
+		_, err = tx.Exec("INSERT OR REPLACE INTO metadata (key, value) VALUES ('schema_version', ?)", strconv.Itoa(i+1))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var val string
+	err := db.QueryRow("SELECT value FROM metadata WHERE key = 'schema_version'").Scan(&val)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(val)
+}
+
+// Version 1 gives users, statuses, mentions, aliases
+// and remote registries their own tables. If the
+// database was made before versioning, everything
+// in the old key/value table is moved over.
+func migrateTables(tx *sql.Tx) error {
+	tables := []string{
+		`CREATE TABLE users (
+			url TEXT PRIMARY KEY,
+			nick TEXT NOT NULL,
+			ip TEXT NOT NULL DEFAULT '',
+			date TEXT NOT NULL DEFAULT '',
+			last_modified TEXT NOT NULL DEFAULT '',
+			remote_registry TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE statuses (
+			user_url TEXT NOT NULL,
+			unix INTEGER NOT NULL,
+			nick TEXT NOT NULL,
+			url TEXT NOT NULL,
+			time TEXT NOT NULL,
+			text TEXT NOT NULL,
+			PRIMARY KEY (user_url, unix)
+		)`,
+		"CREATE INDEX statuses_by_time ON statuses (unix DESC, url)",
+		`CREATE TABLE mentions (
+			user_url TEXT NOT NULL,
+			unix INTEGER NOT NULL,
+			url TEXT NOT NULL
+		)`,
+		"CREATE INDEX mentions_by_status ON mentions (user_url, unix)",
+		"CREATE INDEX mentions_by_url ON mentions (url)",
+		"CREATE TABLE aliases (url TEXT PRIMARY KEY, moved_to TEXT NOT NULL)",
+		"CREATE TABLE remote_registries (url TEXT PRIMARY KEY)",
+	}
+	for _, e := range tables {
+		if _, err := tx.Exec(e); err != nil {
+			return err
+		}
+	}
+
+	var old int
+	err := tx.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'getwtxt'").Scan(&old)
+	if err != nil || old == 0 {
+		return err
+	}
+	if err := migrateKeyValue(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DROP TABLE getwtxt")
+	return err
+}
+
+// Reads the key/value table used before the schema was
+// versioned. It could hold the same row several times
+// over, so the last one for each key wins. Statuses
+// that can't be parsed are quarantined.
+func migrateKeyValue(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT urlKey, isUser, dataKey, data FROM getwtxt ORDER BY id")
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]*registry.User)
+	aliases := make(map[string]string)
+	remotes := make([]string, 0)
+	bad := make(map[[2]string][]byte)
+
+	for rows.Next() {
+		var urlKey string
+		var isUser bool
+		var dataKey string
+		var dBlob []byte
+
+		if err := rows.Scan(&urlKey, &isUser, &dataKey, &dBlob); err != nil {
+			rows.Close()
+			return err
+		}
+		if !isUser {
+			remotes = append(remotes, urlKey)
+			continue
+		}
+		if dataKey == "movedto" {
+			aliases[urlKey] = string(dBlob)
+			continue
+		}
+
+		user, ok := users[urlKey]
+		if !ok {
+			user = registry.NewUser()
+			user.URL = urlKey
+			users[urlKey] = user
+		}
+
+		switch dataKey {
+		case "nickname":
+			user.Nick = string(dBlob)
+		case "uip":
+			user.IP = net.ParseIP(string(dBlob))
+		case "date":
+			user.Date = string(dBlob)
+		case "lastmodified":
+			user.LastModified = string(dBlob)
+		case "remoteregistry":
+			user.RemoteRegistry = string(dBlob)
+		default:
+			// the key is the time the status was
+			// stored under, in RFC3339 format
+			posted, _ := time.Parse(time.RFC3339, dataKey)
+			status, err := registry.ParseStoredStatus(string(dBlob), posted)
+			if err != nil {
+				bad[[2]string{urlKey, dataKey}] = dBlob
+				continue
+			}
+			delete(bad, [2]string{urlKey, dataKey})
+			user.Status[status.Time] = status
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	store := &Store{tx: tx}
+	for k, v := range users {
+		if err := store.PutUser(k, v); err != nil {
+			return err
+		}
+		if err := store.putStatuses(k, v.Status); err != nil {
+			return err
+		}
+	}
+	for k, v := range aliases {
+		if err := store.PutAlias(k, v); err != nil {
+			return err
+		}
+	}
+	for _, e := range remotes {
+		if err := store.PutRemoteRegistry(e); err != nil {
+			return err
+		}
+	}
+
+	if len(bad) == 0 {
+		return nil
+	}
+	if err := migrateQuarantine(tx); err != nil {
+		return err
+	}
+	for k, v := range bad {
+		if _, err := tx.Exec("INSERT OR REPLACE INTO quarantine (user_url, data_key, data) VALUES (?, ?, ?)", k[0], k[1], v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Version 2 adds a table of the earlier versions of
+// statuses, numbered from oldest to newest.
+func migrateEdits(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE edits (
+		user_url TEXT NOT NULL,
+		unix INTEGER NOT NULL,
+		seq INTEGER NOT NULL,
+		seen TEXT NOT NULL,
+		text TEXT NOT NULL,
+		PRIMARY KEY (user_url, unix, seq)
+	)`)
+	return err
+}
+
+// Version 3 adds a table for the statuses that couldn't
+// be read when moving them out of the key/value table,
+// so they aren't lost. The move may have made it already.
+func migrateQuarantine(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS quarantine (
+		user_url TEXT NOT NULL,
+		data_key TEXT NOT NULL,
+		data BLOB,
+		PRIMARY KEY (user_url, data_key)
+	)`)
+	return err
+}
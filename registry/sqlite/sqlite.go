@@ -0,0 +1,550 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sqlite stores a twtxt Registry in a SQLite database.
+package sqlite // import "git.sr.ht/~gbmor/getwtxt/registry/sqlite"
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	_ "github.com/mattn/go-sqlite3" // for the sqlite3 driver
+)
+
+// Store is a registry.Storage backed by SQLite. Users,
+// statuses, the URLs they mention, their earlier versions,
+// aliases and remote registries each have their own table. The schema is
+// migrated when the database is opened.
+type Store struct {
+	db *sql.DB
+
+	// Set within Batch(), so writes are
+	// committed together.
+	tx *sql.Tx
+}
+
+var _ registry.BatchStorage = &Store{}
+var _ registry.QueryStorage = &Store{}
+var _ registry.PruneStorage = &Store{}
+
+// Either a database or a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Open opens the SQLite database at the provided path,
+// creating it if necessary, and brings its schema up
+// to date, including moving data out of the single
+// table used by earlier versions.
+func Open(path string) (*Store, error) {
+	lite, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := lite.Ping(); err != nil {
+		lite.Close()
+		return nil, err
+	}
+	if err := migrate(lite); err != nil {
+		lite.Close()
+		return nil, err
+	}
+
+	return &Store{db: lite}, nil
+}
+
+// OpenReadOnly opens the existing SQLite database at the
+// provided path without writing to it. Its schema must be
+// current: a database made by an earlier version has to
+// be opened with Open first, to bring it up to date.
+func OpenReadOnly(path string) (*Store, error) {
+	lite, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	if err := lite.Ping(); err != nil {
+		lite.Close()
+		return nil, err
+	}
+
+	var versioned int
+	err = lite.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'metadata'").Scan(&versioned)
+	version := 0
+	if err == nil && versioned > 0 {
+		version, err = schemaVersion(lite)
+	}
+	if err != nil {
+		lite.Close()
+		return nil, err
+	}
+	if version != len(migrations) {
+		lite.Close()
+		return nil, fmt.Errorf("database schema version %v needs to be upgraded to %v by opening it for writing first", version, len(migrations))
+	}
+
+	return &Store{db: lite}, nil
+}
+
+// Close closes the database.
+func (lite *Store) Close() error {
+	return lite.db.Close()
+}
+
+func (lite *Store) conn() execer {
+	if lite.tx != nil {
+		return lite.tx
+	}
+	return lite.db
+}
+
+// Batch runs the function within a transaction, which
+// is rolled back if it returns an error.
+func (lite *Store) Batch(fn func(registry.Storage) error) error {
+	if lite.tx != nil {
+		return fn(lite)
+	}
+
+	tx, err := lite.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(&Store{db: lite.db, tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// PutUser stores the user's information under their URL.
+func (lite *Store) PutUser(urlKey string, user *registry.User) error {
+	if user == nil {
+		return fmt.Errorf("can't store nil user %v", urlKey)
+	}
+
+	var ip string
+	if user.IP != nil {
+		ip = user.IP.String()
+	}
+	_, err := lite.conn().Exec("INSERT OR REPLACE INTO users (url, nick, ip, date, last_modified, remote_registry) VALUES (?, ?, ?, ?, ?, ?)",
+		urlKey, user.Nick, ip, user.Date, user.LastModified, user.RemoteRegistry)
+	return err
+}
+
+// PutStatuses stores each status, the URLs it mentions
+// and its earlier versions, under the user's URL and
+// its timestamp.
+func (lite *Store) PutStatuses(urlKey string, statuses registry.TimeMap) error {
+	if lite.tx == nil {
+		return lite.Batch(func(tx registry.Storage) error {
+			return tx.PutStatuses(urlKey, statuses)
+		})
+	}
+
+	if err := lite.putStatuses(urlKey, statuses); err != nil {
+		return err
+	}
+	return lite.putEdits(urlKey, statuses)
+}
+
+// Stores the statuses and their mentions, but not their
+// edits, whose table is newer than the first version of
+// the schema. The caller must hold a transaction.
+func (lite *Store) putStatuses(urlKey string, statuses registry.TimeMap) error {
+	putStatus, err := lite.tx.Prepare("INSERT OR REPLACE INTO statuses (user_url, unix, nick, url, time, text) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer putStatus.Close()
+	delMentions, err := lite.tx.Prepare("DELETE FROM mentions WHERE user_url = ? AND unix = ?")
+	if err != nil {
+		return err
+	}
+	defer delMentions.Close()
+	putMention, err := lite.tx.Prepare("INSERT INTO mentions (user_url, unix, url) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer putMention.Close()
+
+	for _, v := range statuses {
+		if v == nil {
+			continue
+		}
+		unix := v.Time.UnixNano()
+		_, err := putStatus.Exec(urlKey, unix, v.Nick, v.URL, v.Time.Format(time.RFC3339Nano), v.Text)
+		if err != nil {
+			return err
+		}
+		if _, err := delMentions.Exec(urlKey, unix); err != nil {
+			return err
+		}
+		for _, e := range v.Mentions {
+			if _, err := putMention.Exec(urlKey, unix, e.URL); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Replaces the earlier versions stored for each status.
+// The caller must hold a transaction.
+func (lite *Store) putEdits(urlKey string, statuses registry.TimeMap) error {
+	delEdits, err := lite.tx.Prepare("DELETE FROM edits WHERE user_url = ? AND unix = ?")
+	if err != nil {
+		return err
+	}
+	defer delEdits.Close()
+	putEdit, err := lite.tx.Prepare("INSERT INTO edits (user_url, unix, seq, seen, text) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer putEdit.Close()
+
+	for _, v := range statuses {
+		if v == nil {
+			continue
+		}
+		unix := v.Time.UnixNano()
+		if _, err := delEdits.Exec(urlKey, unix); err != nil {
+			return err
+		}
+		for i, e := range v.Edits {
+			if _, err := putEdit.Exec(urlKey, unix, i, e.Seen.Format(time.RFC3339Nano), e.Text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DelStatuses deletes the user's statuses posted at the
+// given times, along with the URLs they mention and
+// their earlier versions.
+func (lite *Store) DelStatuses(urlKey string, times []time.Time) error {
+	if lite.tx == nil {
+		return lite.Batch(func(tx registry.Storage) error {
+			return tx.(*Store).DelStatuses(urlKey, times)
+		})
+	}
+
+	for _, e := range []string{
+		"DELETE FROM edits WHERE user_url = ? AND unix = ?",
+		"DELETE FROM mentions WHERE user_url = ? AND unix = ?",
+		"DELETE FROM statuses WHERE user_url = ? AND unix = ?",
+	} {
+		stmt, err := lite.tx.Prepare(e)
+		if err != nil {
+			return err
+		}
+		for _, t := range times {
+			if _, err := stmt.Exec(urlKey, t.UnixNano()); err != nil {
+				stmt.Close()
+				return err
+			}
+		}
+		stmt.Close()
+	}
+	return nil
+}
+
+// PutAlias stores the URL a user moved to
+// under the URL they moved from.
+func (lite *Store) PutAlias(from, to string) error {
+	_, err := lite.conn().Exec("INSERT OR REPLACE INTO aliases (url, moved_to) VALUES (?, ?)", from, to)
+	return err
+}
+
+// DelUser deletes the user at the URL, along with their
+// statuses and any alias kept for the URL.
+func (lite *Store) DelUser(urlKey string) error {
+	if lite.tx == nil {
+		return lite.Batch(func(tx registry.Storage) error {
+			return tx.DelUser(urlKey)
+		})
+	}
+
+	for _, e := range []string{
+		"DELETE FROM edits WHERE user_url = ?",
+		"DELETE FROM mentions WHERE user_url = ?",
+		"DELETE FROM statuses WHERE user_url = ?",
+		"DELETE FROM users WHERE url = ?",
+		"DELETE FROM aliases WHERE url = ?",
+	} {
+		if _, err := lite.tx.Exec(e, urlKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutRemoteRegistry stores the remote registry's URL.
+func (lite *Store) PutRemoteRegistry(urlKey string) error {
+	_, err := lite.conn().Exec("INSERT OR IGNORE INTO remote_registries (url) VALUES (?)", urlKey)
+	return err
+}
+
+// RemoteRegistries lists the stored remote registries.
+func (lite *Store) RemoteRegistries() ([]string, error) {
+	rows, err := lite.conn().Query("SELECT url FROM remote_registries ORDER BY url")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]string, 0)
+	for rows.Next() {
+		var urlKey string
+		if err := rows.Scan(&urlKey); err != nil {
+			return nil, err
+		}
+		out = append(out, urlKey)
+	}
+	return out, rows.Err()
+}
+
+// Quarantined returns the statuses that couldn't be read
+// when moving them out of the table used by earlier
+// versions, keyed by their user's URL and the time they
+// were stored under, separated by a tab, for an operator
+// to inspect or restore.
+func (lite *Store) Quarantined() (map[string][]byte, error) {
+	rows, err := lite.conn().Query("SELECT user_url, data_key, data FROM quarantine")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string][]byte)
+	for rows.Next() {
+		var urlKey, dataKey string
+		var data []byte
+		if err := rows.Scan(&urlKey, &dataKey, &data); err != nil {
+			return nil, err
+		}
+		out[urlKey+"\t"+dataKey] = data
+	}
+	return out, rows.Err()
+}
+
+// Identifies a status by its user's URL and the
+// unix column, as in the statuses table.
+type statusRow struct {
+	userURL string
+	unix    int64
+}
+
+// LoadAll reads every user, status and alias in the database.
+// Statuses that can't be parsed are skipped.
+func (lite *Store) LoadAll() (map[string]*registry.User, map[string]string, error) {
+	conn := lite.conn()
+	users := make(map[string]*registry.User)
+	aliases := make(map[string]string)
+
+	rows, err := conn.Query("SELECT url, nick, ip, date, last_modified, remote_registry FROM users")
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		user := registry.NewUser()
+		var ip string
+		if err := rows.Scan(&user.URL, &user.Nick, &ip, &user.Date, &user.LastModified, &user.RemoteRegistry); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		user.IP = net.ParseIP(ip)
+		users[user.URL] = user
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// statuses by the columns their edits are kept under
+	loaded := make(map[statusRow]*registry.Status)
+	rows, err = conn.Query("SELECT user_url, nick, url, time, text FROM statuses")
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var userURL string
+		status, err := scanStatus(rows, &userURL)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		user, ok := users[userURL]
+		if !ok || status == nil {
+			continue
+		}
+		user.Status[status.Time] = status
+		loaded[statusRow{userURL, status.Time.UnixNano()}] = status
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	err = loadEdits(conn, loaded, "SELECT user_url, unix, seen, text FROM edits ORDER BY user_url, unix, seq")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = conn.Query("SELECT url, moved_to FROM aliases")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var from, to string
+		if err := rows.Scan(&from, &to); err != nil {
+			return nil, nil, err
+		}
+		aliases[from] = to
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return users, aliases, nil
+}
+
+// Attaches the edits selected by the query to the loaded
+// statuses. The query must select the user's URL, unix
+// column, time seen and text of each edit, ordered by
+// seq within each status so they're kept oldest first.
+// Edits of statuses that weren't loaded are skipped.
+func loadEdits(conn execer, loaded map[statusRow]*registry.Status, query string, args ...interface{}) error {
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userURL, seen, text string
+		var unix int64
+		if err := rows.Scan(&userURL, &unix, &seen, &text); err != nil {
+			return err
+		}
+		thetime, err := time.Parse(time.RFC3339Nano, seen)
+		status, ok := loaded[statusRow{userURL, unix}]
+		if err != nil || !ok {
+			continue
+		}
+		status.Edits = append(status.Edits, registry.Edit{Text: text, Seen: thetime})
+	}
+	return rows.Err()
+}
+
+// Scans a row of the user's URL, then the status's nick,
+// URL, time and text. The status is nil if its time
+// can't be parsed.
+func scanStatus(rows *sql.Rows, userURL *string) (*registry.Status, error) {
+	var nick, urlKey, stamp, text string
+	if err := rows.Scan(userURL, &nick, &urlKey, &stamp, &text); err != nil {
+		return nil, err
+	}
+	thetime, err := time.Parse(time.RFC3339Nano, stamp)
+	if err != nil {
+		return nil, nil
+	}
+	return registry.NewStatus(nick, urlKey, thetime, text), nil
+}
+
+// QueryStatuses finds the statuses matching the query
+// in the database, without loading the rest.
+func (lite *Store) QueryStatuses(q registry.StatusQuery) ([]*registry.Status, error) {
+	var where []string
+	var args []interface{}
+
+	if q.Substring != "" {
+		where = append(where, "instr(lower(s.text), lower(?)) > 0")
+		args = append(args, q.Substring)
+	}
+	if q.User != "" {
+		where = append(where, "s.user_url = ?")
+		args = append(args, q.User)
+	}
+	if len(q.Mentions) > 0 {
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(q.Mentions)), ", ")
+		where = append(where, "EXISTS (SELECT 1 FROM mentions m WHERE m.user_url = s.user_url AND m.unix = s.unix AND m.url IN ("+marks+"))")
+		for _, e := range q.Mentions {
+			args = append(args, e)
+		}
+	}
+	if !q.Before.IsZero() {
+		where = append(where, "s.unix < ?")
+		args = append(args, q.Before.UnixNano())
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+	query := "SELECT s.user_url, s.nick, s.url, s.time, s.text FROM statuses s" + filter + " ORDER BY s.unix DESC, s.url"
+	paged := args
+	if q.Limit > 0 || q.Offset > 0 {
+		limit := q.Limit
+		if limit < 1 {
+			limit = -1
+		}
+		query += " LIMIT ? OFFSET ?"
+		paged = append(append([]interface{}{}, args...), limit, q.Offset)
+	}
+
+	conn := lite.conn()
+	rows, err := conn.Query(query, paged...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]*registry.Status, 0)
+	loaded := make(map[statusRow]*registry.Status)
+	for rows.Next() {
+		var userURL string
+		status, err := scanStatus(rows, &userURL)
+		if err != nil {
+			return nil, err
+		}
+		if status != nil {
+			out = append(out, status)
+			loaded[statusRow{userURL, status.Time.UnixNano()}] = status
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// edits of matching statuses outside the
+	// requested page are skipped
+	err = loadEdits(conn, loaded, "SELECT e.user_url, e.unix, e.seen, e.text FROM edits e JOIN statuses s ON s.user_url = e.user_url AND s.unix = e.unix"+filter+" ORDER BY e.user_url, e.unix, e.seq", args...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,255 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sqlite
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	"git.sr.ht/~gbmor/getwtxt/registry/storagetest"
+)
+
+func openTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store, err := Open(filepath.Join(dir, "getwtxt.sqlite"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("%v\n", err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_Storage(t *testing.T) {
+	storagetest.Run(t, storagetest.Backend{
+		Open: func(t *testing.T) (registry.Storage, func()) {
+			return openTestStore(t)
+		},
+		CountEdits: func(store registry.Storage) (int, error) {
+			var n int
+			err := store.(*Store).db.QueryRow("SELECT count(*) FROM edits").Scan(&n)
+			return n, err
+		},
+	})
+}
+
+// Databases made before the schema was versioned kept
+// everything in one table, often with duplicate rows.
+func Test_Open_Migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "getwtxt.sqlite")
+
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	stmts := []string{
+		"CREATE TABLE getwtxt (id INTEGER PRIMARY KEY, urlKey TEXT, isUser BOOL, dataKey TEXT, data BLOB)",
+		"INSERT INTO getwtxt (urlKey, isUser, dataKey, data) VALUES ('https://example.com/twtxt.txt', 1, 'nickname', 'foo')",
+		"INSERT INTO getwtxt (urlKey, isUser, dataKey, data) VALUES ('https://example.com/twtxt.txt', 1, 'nickname', 'foo')",
+		"INSERT INTO getwtxt (urlKey, isUser, dataKey, data) VALUES ('https://example.com/twtxt.txt', 1, 'uip', '127.0.0.1')",
+		"INSERT INTO getwtxt (urlKey, isUser, dataKey, data) VALUES ('https://example.com/twtxt.txt', 1, '2019-09-01T00:00:00Z', 'foo\thttps://example.com/twtxt.txt\t2019-09-01T00:00:00Z\thi @<bar https://bar.example.com/twtxt.txt>')",
+		"INSERT INTO getwtxt (urlKey, isUser, dataKey, data) VALUES ('https://example.com/twtxt.txt', 1, '2019-09-01T00:00:00Z', 'foo\thttps://example.com/twtxt.txt\t2019-09-01T00:00:00Z\thi @<bar https://bar.example.com/twtxt.txt>')",
+		"INSERT INTO getwtxt (urlKey, isUser, dataKey, data) VALUES ('https://example.com/twtxt.txt', 1, '2019-09-02T12:00:00Z', 'foo	https://example.com/twtxt.txt	2019-09-02T12:00Z	no seconds')",
+		"INSERT INTO getwtxt (urlKey, isUser, dataKey, data) VALUES ('https://example.com/twtxt.txt', 1, '2019-09-03T00:00:00Z', 'foo	https://example.com/twtxt.txt	yesterday	bad timestamp')",
+		"INSERT INTO getwtxt (urlKey, isUser, dataKey, data) VALUES ('https://example.com/twtxt.txt', 1, 'garbage', 'not a status')",
+		"INSERT INTO getwtxt (urlKey, isUser, dataKey, data) VALUES ('https://old.example.com/twtxt.txt', 1, 'movedto', 'https://example.com/twtxt.txt')",
+		"INSERT INTO getwtxt (urlKey, isUser, dataKey, data) VALUES ('https://twtxt.example.net/api/plain/users', 0, 'REMOTE REGISTRY', 'NULL')",
+	}
+	for _, e := range stmts {
+		if _, err := old.Exec(e); err != nil {
+			t.Fatalf("Couldn't set up test: %v\n", err)
+		}
+	}
+	old.Close()
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer store.Close()
+
+	users, aliases, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	user, ok := users["https://example.com/twtxt.txt"]
+	if !ok || user.Nick != "foo" || len(user.Status) != 3 {
+		t.Fatalf("User not migrated: %#v\n", user)
+	}
+	if status, ok := user.Status[time.Date(2019, 9, 2, 12, 0, 0, 0, time.UTC)]; !ok || status.Text != "no seconds" {
+		t.Errorf("Status without seconds not migrated: %v\n", user.Status)
+	}
+	if status, ok := user.Status[time.Date(2019, 9, 3, 0, 0, 0, 0, time.UTC)]; !ok || status.Text != "bad timestamp" {
+		t.Errorf("Status with unreadable timestamp not given its stored time: %v\n", user.Status)
+	}
+	quarantined, err := store.Quarantined()
+	if err != nil || len(quarantined) != 1 || string(quarantined["https://example.com/twtxt.txt\tgarbage"]) != "not a status" {
+		t.Errorf("Unreadable row not quarantined: %v, %v\n", quarantined, err)
+	}
+	if !user.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("IP not migrated: %v\n", user.IP)
+	}
+	if aliases["https://old.example.com/twtxt.txt"] != "https://example.com/twtxt.txt" {
+		t.Errorf("Alias not migrated: %v\n", aliases)
+	}
+	if remotes, _ := store.RemoteRegistries(); len(remotes) != 1 {
+		t.Errorf("Remote registry not migrated: %v\n", remotes)
+	}
+
+	mentions, err := store.QueryStatuses(registry.StatusQuery{Mentions: []string{"https://bar.example.com/twtxt.txt"}})
+	if err != nil || len(mentions) != 1 {
+		t.Errorf("Mention not migrated: %v, %v\n", mentions, err)
+	}
+
+	version, err := schemaVersion(store.db)
+	if err != nil || version != len(migrations) {
+		t.Errorf("Expected schema version %v, got %v, %v\n", len(migrations), version, err)
+	}
+	var n int
+	store.db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'getwtxt'").Scan(&n)
+	if n != 0 {
+		t.Errorf("Old table left behind\n")
+	}
+}
+
+func Test_Store_DelUser_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "getwtxt.sqlite")
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	urlKey := "https://example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	reg := registry.New(nil)
+	reg.AddUser("foo", urlKey, nil, registry.TimeMap{then: registry.NewStatus("foo", urlKey, then, "hi")})
+	if err := reg.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := reg.DelUser(urlKey); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := reg.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Close()
+
+	store, err = Open(path)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer store.Close()
+	users, _, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if _, ok := users[urlKey]; ok {
+		t.Errorf("Deleted user came back after reopening\n")
+	}
+	if out, _ := store.QueryStatuses(registry.StatusQuery{}); len(out) != 0 {
+		t.Errorf("Deleted user's statuses left behind: %v\n", out)
+	}
+}
+
+func Test_Store_QueryStatuses(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	reg := registry.New(nil)
+	base := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	for _, e := range []string{"https://a.example.com/twtxt.txt", "https://b.example.com/twtxt.txt"} {
+		statuses := registry.NewTimeMap()
+		for i := 0; i < 3; i++ {
+			then := base.Add(time.Duration(i) * time.Hour)
+			statuses[then] = registry.NewStatus("foo", e, then, "status #twtxt")
+		}
+		statuses[base].Edits = []registry.Edit{{Text: "status", Seen: base.Add(time.Minute)}}
+		reg.AddUser("foo", e, nil, statuses)
+	}
+	if err := reg.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	want, _ := reg.QueryAllStatuses()
+	got, err := store.QueryStatuses(registry.StatusQuery{Substring: "#TWTXT"})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v statuses, got %v\n", len(want), len(got))
+	}
+	for i := range got {
+		if got[i].String() != want[i].String() {
+			t.Errorf("Status %v out of order: %v != %v\n", i, got[i], want[i])
+		}
+	}
+
+	// pushed down through the registry, the
+	// results match those from memory
+	pushed, err := reg.QueryStatuses(store, registry.StatusQuery{Substring: "#TWTXT"})
+	if err != nil || len(pushed) != len(want) {
+		t.Fatalf("Unexpected result: %v, %v\n", pushed, err)
+	}
+	for i := range pushed {
+		if pushed[i].Key() != want[i].Key() {
+			t.Errorf("Pushed down status %v out of order: %v != %v\n", i, pushed[i], want[i])
+		}
+	}
+
+	page, err := store.QueryStatuses(registry.StatusQuery{
+		User:   "https://b.example.com/twtxt.txt",
+		Before: base.Add(2 * time.Hour),
+		Limit:  1,
+	})
+	if err != nil || len(page) != 1 || !page[0].Time.Equal(base.Add(time.Hour)) || page[0].URL != "https://b.example.com/twtxt.txt" {
+		t.Errorf("Unexpected result: %v, %v\n", page, err)
+	}
+	oldest, err := store.QueryStatuses(registry.StatusQuery{
+		User:   "https://b.example.com/twtxt.txt",
+		Before: base.Add(time.Hour),
+	})
+	if err != nil || len(oldest) != 1 {
+		t.Fatalf("Unexpected result: %v, %v\n", oldest, err)
+	}
+	if edits := oldest[0].Edits; len(edits) != 1 || edits[0].Text != "status" || !edits[0].Seen.Equal(base.Add(time.Minute)) {
+		t.Errorf("Edits not loaded: %v\n", edits)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The number of entries kept in the tag and
+// mention rankings of UserStats.
+const statsTopN = 10
+
+var (
+	tagRegex     = regexp.MustCompile(`#<?([a-zA-Z0-9_-]+)`)
+	mentionRegex = regexp.MustCompile(`@<(?:([^\s>]+)\s+)?(https?://[^\s>]+)>`)
+)
+
+// UserStats holds aggregate information about a single
+// user, derived from their statuses and from the
+// statuses of every other user in the Registry.
+type UserStats struct {
+	Nick string
+	URL  string
+
+	// Total number of statuses held for the user.
+	Twts int
+
+	// Timestamps of the oldest and newest statuses.
+	First time.Time
+	Last  time.Time
+
+	// Average posting frequency between
+	// the first and last statuses.
+	PerDay  float64
+	PerWeek float64
+
+	// The tags the user has used most often
+	// and the users they have mentioned most
+	// often, in descending order.
+	TopTags     []Count
+	TopMentions []Count
+
+	// Number of statuses in the Registry,
+	// from any user, that mention this user.
+	MentionsReceived int
+}
+
+// Count pairs a tag or mentioned URL with the
+// number of times it was observed.
+type Count struct {
+	Key string
+	N   int
+}
+
+// UserStats derives posting statistics for the user
+// associated with the provided URL key.
+func (registry *Registry) UserStats(urlKey string) (*UserStats, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("can't get stats from an empty registry")
+	} else if urlKey == "" || !strings.HasPrefix(urlKey, "http") {
+		return nil, fmt.Errorf("invalid URL: %v", urlKey)
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	user, ok := registry.Users[urlKey]
+	if !ok || user == nil {
+		return nil, fmt.Errorf("can't retrieve stats of nonexistent user")
+	}
+
+	stats := &UserStats{
+		URL: urlKey,
+	}
+	tags := make(map[string]int)
+	mentions := make(map[string]int)
+
+	user.Mu.RLock()
+	stats.Nick = user.Nick
+	for k, v := range user.Status {
+		if k.IsZero() {
+			continue
+		}
+		stats.Twts++
+		if stats.First.IsZero() || k.Before(stats.First) {
+			stats.First = k
+		}
+		if k.After(stats.Last) {
+			stats.Last = k
+		}
+
+		for _, e := range v.Tags {
+			tags[strings.ToLower(e)]++
+		}
+		for _, e := range v.Mentions {
+			mentions[e.URL]++
+		}
+	}
+	user.Mu.RUnlock()
+
+	if stats.Twts > 0 {
+		days := stats.Last.Sub(stats.First).Hours() / 24
+		if days < 1 {
+			days = 1
+		}
+		stats.PerDay = float64(stats.Twts) / days
+		stats.PerWeek = stats.PerDay * 7
+	}
+
+	stats.TopTags = rankCounts(tags, statsTopN)
+	stats.TopMentions = rankCounts(mentions, statsTopN)
+
+	// mentions of the user's old URLs count too
+	known := make(map[string]bool)
+	for _, e := range registry.aliasesOf(urlKey) {
+		known[e] = true
+	}
+
+	for k, v := range registry.Users {
+		if k == urlKey || v == nil {
+			continue
+		}
+		v.Mu.RLock()
+		for _, e := range v.Status {
+			for _, m := range e.Mentions {
+				if known[m.URL] {
+					stats.MentionsReceived++
+					break
+				}
+			}
+		}
+		v.Mu.RUnlock()
+	}
+
+	return stats, nil
+}
+
+// Sorts the provided counts in descending order,
+// falling back to the key to keep the output stable,
+// and returns at most n entries.
+func rankCounts(counts map[string]int, n int) []Count {
+	out := make([]Count, 0, len(counts))
+	for k, v := range counts {
+		out = append(out, Count{Key: k, N: v})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].N != out[j].N {
+			return out[i].N > out[j].N
+		}
+		return out[i].Key < out[j].Key
+	})
+
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"testing"
+	"time"
+)
+
+// Adds a pair of users who mention each other
+// to the mock registry.
+func initStatsEnv() *Registry {
+	registry := initTestEnv()
+	now := time.Now().UTC().Truncate(time.Second)
+	weekAgo := now.AddDate(0, 0, -7)
+	rfc := func(t time.Time) string { return t.Format(time.RFC3339) }
+
+	registry.Users["https://stats.example.com/twtxt.txt"] = &User{
+		Nick: "stats",
+		URL:  "https://stats.example.com/twtxt.txt",
+		Date: rfc(weekAgo),
+		Status: TimeMap{
+			weekAgo:                 testStatus("stats\thttps://stats.example.com/twtxt.txt\t" + rfc(weekAgo) + "\tHello #golang @<foo https://example.com/twtxt.txt>"),
+			now.Add(-time.Hour):     testStatus("stats\thttps://stats.example.com/twtxt.txt\t" + rfc(now.Add(-time.Hour)) + "\tMore #GoLang and #twtxt"),
+			now:                     testStatus("stats\thttps://stats.example.com/twtxt.txt\t" + rfc(now) + "\t@<foo https://example.com/twtxt.txt> @<bar https://bar.example.com/twtxt.txt> hi"),
+			now.Add(-2 * time.Hour): testStatus("stats\thttps://stats.example.com/twtxt.txt\t" + rfc(now.Add(-2*time.Hour)) + "\tnothing to see here"),
+		},
+	}
+	registry.Users["https://bar.example.com/twtxt.txt"] = &User{
+		Nick: "bar",
+		URL:  "https://bar.example.com/twtxt.txt",
+		Date: rfc(weekAgo),
+		Status: TimeMap{
+			now.Add(-3 * time.Hour): testStatus("bar\thttps://bar.example.com/twtxt.txt\t" + rfc(now.Add(-3*time.Hour)) + "\they @<stats https://stats.example.com/twtxt.txt>"),
+		},
+	}
+
+	return registry
+}
+
+func Test_Registry_UserStats(t *testing.T) {
+	registry := initStatsEnv()
+
+	t.Run("Valid User", func(t *testing.T) {
+		stats, err := registry.UserStats("https://stats.example.com/twtxt.txt")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if stats.Nick != "stats" || stats.Twts != 4 {
+			t.Errorf("Incorrect nick or count: %v %v\n", stats.Nick, stats.Twts)
+		}
+		if stats.Last.Sub(stats.First) != 7*24*time.Hour {
+			t.Errorf("Incorrect first/last: %v %v\n", stats.First, stats.Last)
+		}
+		if stats.PerDay < 0.57 || stats.PerDay > 0.58 || stats.PerWeek != stats.PerDay*7 {
+			t.Errorf("Incorrect frequency: %v %v\n", stats.PerDay, stats.PerWeek)
+		}
+		if len(stats.TopTags) != 2 || stats.TopTags[0] != (Count{Key: "#golang", N: 2}) {
+			t.Errorf("Incorrect tags: %v\n", stats.TopTags)
+		}
+		if len(stats.TopMentions) != 2 || stats.TopMentions[0] != (Count{Key: "https://example.com/twtxt.txt", N: 2}) {
+			t.Errorf("Incorrect mentions: %v\n", stats.TopMentions)
+		}
+		if stats.MentionsReceived != 1 {
+			t.Errorf("Incorrect mentions received: %v\n", stats.MentionsReceived)
+		}
+	})
+
+	t.Run("Nonexistent User", func(t *testing.T) {
+		if _, err := registry.UserStats("https://doesnt.exist/twtxt.txt"); err == nil {
+			t.Errorf("Expected error, received nil\n")
+		}
+	})
+
+	t.Run("Invalid URL", func(t *testing.T) {
+		if _, err := registry.UserStats("foo"); err == nil {
+			t.Errorf("Expected error, received nil\n")
+		}
+	})
+}
+func Benchmark_Registry_UserStats(b *testing.B) {
+	registry := initStatsEnv()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := registry.UserStats("https://stats.example.com/twtxt.txt")
+		if err != nil {
+			b.Errorf("%v\n", err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var linkRegex = regexp.MustCompile(`https?://[^\s<>]+`)
+
+// Status is a single status from a user's twtxt file.
+type Status struct {
+	// The nickname and twtxt file URL
+	// of the status's author.
+	Nick string
+	URL  string
+
+	// When the status was posted.
+	Time time.Time
+
+	// The status text, as it appears
+	// in the author's twtxt file.
+	Text string
+
+	// Parsed from Text when the
+	// Status is created.
+	Mentions []Mention
+	Tags     []string
+	Links    []string
+
+	// Earlier versions of the status, oldest
+	// first. See UpdateUser().
+	Edits []Edit
+}
+
+// StatusKey identifies a status across all users.
+// Statuses from different users, or with different
+// text, never share a StatusKey even when they were
+// posted at the same time.
+type StatusKey struct {
+	URL  string
+	Time time.Time
+
+	// FNV-1a hash of the status text.
+	Hash uint64
+}
+
+// StatusMap holds statuses from any number
+// of users, keyed by their StatusKey.
+type StatusMap map[StatusKey]*Status
+
+// Mention is a reference to another user within
+// a status, in the form @<nick url> or @<url>.
+type Mention struct {
+	Nick string
+	URL  string
+}
+
+// NewStatus returns a Status with its mentions,
+// tags, and links parsed from the provided text.
+func NewStatus(nickname, urlKey string, thetime time.Time, text string) *Status {
+	status := &Status{
+		Nick: nickname,
+		URL:  urlKey,
+		Time: thetime,
+		Text: text,
+	}
+
+	for _, e := range mentionRegex.FindAllStringSubmatch(text, -1) {
+		status.Mentions = append(status.Mentions, Mention{Nick: e[1], URL: e[2]})
+	}
+	for _, e := range tagRegex.FindAllStringSubmatch(text, -1) {
+		status.Tags = append(status.Tags, "#"+e[1])
+	}
+
+	// URLs within mentions aren't links
+	for _, e := range linkRegex.FindAllString(mentionRegex.ReplaceAllString(text, ""), -1) {
+		status.Links = append(status.Links, e)
+	}
+
+	return status
+}
+
+// ParseStatus parses a status in the form used by the plain
+// API and by the database: "nick\turl\ttimestamp\ttext".
+// The timestamp may be in any form a twtxt file's may,
+// as databases of earlier versions kept it as it was.
+func ParseStatus(line string) (*Status, error) {
+	return ParseStoredStatus(line, time.Time{})
+}
+
+// ParseStoredStatus is ParseStatus for statuses read back
+// from storage that keeps the time each was posted apart
+// from the status itself. If the status's timestamp can't
+// be parsed, it's given the stored time instead, unless
+// that's zero too.
+func ParseStoredStatus(line string, posted time.Time) (*Status, error) {
+	parts := strings.SplitN(strings.TrimSpace(line), "\t", 4)
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("improperly formatted status: %#v", line)
+	}
+
+	thetime, ok := parseTimestamp(parts[2])
+	if !ok {
+		if posted.IsZero() {
+			return nil, fmt.Errorf("unrecognized timestamp: %#v", parts[2])
+		}
+		thetime = posted
+	}
+
+	return NewStatus(parts[0], parts[1], thetime, parts[3]), nil
+}
+
+// String formats the status for the plain API, as
+// "nick\turl\ttimestamp\ttext". The result can be
+// read back with ParseStatus.
+func (status *Status) String() string {
+	return status.Nick + "\t" + status.URL + "\t" + status.Time.Format(time.RFC3339Nano) + "\t" + status.Text
+}
+
+// Key returns the StatusKey identifying the status.
+func (status *Status) Key() StatusKey {
+	h := fnv.New64a()
+	h.Write([]byte(status.Text))
+	return StatusKey{
+		URL:  status.URL,
+		Time: status.Time,
+		Hash: h.Sum64(),
+	}
+}
+
+// Reports whether the status mentions
+// any of the provided URLs.
+func (status *Status) mentionsAny(urls ...string) bool {
+	for _, m := range status.Mentions {
+		for _, e := range urls {
+			if m.URL == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns a copy of the status attributed to a different
+// URL. The parsed fields are shared with the original.
+func (status *Status) withURL(urlKey string) *Status {
+	moved := *status
+	moved.URL = urlKey
+	return &moved
+}
+
+// FormatStatuses formats each of the provided
+// statuses for the plain API with String.
+func FormatStatuses(statuses []*Status) []string {
+	out := make([]string, len(statuses))
+	for i, e := range statuses {
+		out[i] = e.String()
+	}
+	return out
+}
+
+// NewStatusMap returns an initialized StatusMap.
+func NewStatusMap() StatusMap {
+	return make(StatusMap)
+}
+
+// Add inserts the provided statuses
+// into the StatusMap.
+func (sm StatusMap) Add(tm TimeMap) {
+	for _, e := range tm {
+		if e != nil {
+			sm[e.Key()] = e
+		}
+	}
+}
+
+// Sorted returns the statuses in the StatusMap newest first.
+// Statuses posted at the same time are ordered by author URL,
+// then by the hash of their text, so the order is the same
+// on every call.
+func (sm StatusMap) Sorted() []*Status {
+	keys := make([]StatusKey, 0, len(sm))
+	for k := range sm {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].before(keys[j])
+	})
+
+	out := make([]*Status, len(keys))
+	for i, k := range keys {
+		out[i] = sm[k]
+	}
+	return out
+}
+
+// Reports whether the status identified by key should
+// be listed before the one identified by other.
+func (key StatusKey) before(other StatusKey) bool {
+	if !key.Time.Equal(other.Time) {
+		return key.Time.After(other.Time)
+	}
+	if key.URL != other.URL {
+		return key.URL < other.URL
+	}
+	return key.Hash < other.Hash
+}
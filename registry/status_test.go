@@ -0,0 +1,108 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_ParseStatus(t *testing.T) {
+	line := "foo\thttps://example.com/twtxt.txt\t2020-02-04T21:28:21Z\thi @<bar https://bar.example.com/twtxt.txt> and @<https://baz.example.com/twtxt.txt>, see https://example.org/post #Go #<twtxt https://example.org/tags>"
+
+	status, err := ParseStatus(line)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	if status.Nick != "foo" || status.URL != "https://example.com/twtxt.txt" {
+		t.Errorf("Incorrect author: %v %v\n", status.Nick, status.URL)
+	}
+	if !status.Time.Equal(time.Date(2020, 2, 4, 21, 28, 21, 0, time.UTC)) {
+		t.Errorf("Incorrect time: %v\n", status.Time)
+	}
+
+	mentions := []Mention{
+		{Nick: "bar", URL: "https://bar.example.com/twtxt.txt"},
+		{URL: "https://baz.example.com/twtxt.txt"},
+	}
+	if !reflect.DeepEqual(status.Mentions, mentions) {
+		t.Errorf("Expected mentions %v, got %v\n", mentions, status.Mentions)
+	}
+	if tags := []string{"#Go", "#twtxt"}; !reflect.DeepEqual(status.Tags, tags) {
+		t.Errorf("Expected tags %v, got %v\n", tags, status.Tags)
+	}
+	if links := []string{"https://example.org/post", "https://example.org/tags"}; !reflect.DeepEqual(status.Links, links) {
+		t.Errorf("Expected links %v, got %v\n", links, status.Links)
+	}
+
+	if status.String() != line {
+		t.Errorf("Status didn't format back to its original form:\n%q\n%q\n", line, status.String())
+	}
+
+	if _, err := ParseStatus("foo\thttps://example.com/twtxt.txt\thi"); err == nil {
+		t.Errorf("Expected error for status missing a field\n")
+	}
+}
+
+// Earlier versions stored the timestamp as it
+// appeared in the twtxt file.
+func Test_ParseStoredStatus(t *testing.T) {
+	then := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	status, err := ParseStatus("foo\thttps://x/twtxt.txt\t2019-05-01T12:00Z\thello")
+	if err != nil || !status.Time.Equal(then) {
+		t.Errorf("Timestamp without seconds not parsed: %v, %v\n", status, err)
+	}
+
+	status, err = ParseStoredStatus("foo\thttps://x/twtxt.txt\tyesterday\thello", then)
+	if err != nil || !status.Time.Equal(then) || status.Text != "hello" {
+		t.Errorf("Stored time not used: %v, %v\n", status, err)
+	}
+	if _, err := ParseStoredStatus("foo\thttps://x/twtxt.txt\tyesterday\thello", time.Time{}); err == nil {
+		t.Errorf("Expected error for unrecognized timestamp\n")
+	}
+}
+
+func Test_StatusMap_Sorted(t *testing.T) {
+	then := time.Date(2020, 2, 4, 21, 28, 21, 0, time.UTC)
+	statuses := []*Status{
+		NewStatus("bar", "https://bar.example.com/twtxt.txt", then, "same second"),
+		NewStatus("foo", "https://foo.example.com/twtxt.txt", then.Add(-time.Minute), "older"),
+		NewStatus("foo", "https://foo.example.com/twtxt.txt", then, "same second"),
+		NewStatus("baz", "https://baz.example.com/twtxt.txt", then.Add(time.Minute), "newer"),
+	}
+
+	sm := NewStatusMap()
+	for _, e := range statuses {
+		sm.Add(TimeMap{e.Time: e})
+	}
+	if len(sm) != len(statuses) {
+		t.Fatalf("Expected %v statuses, got %v\n", len(statuses), len(sm))
+	}
+
+	expected := []*Status{statuses[3], statuses[0], statuses[2], statuses[1]}
+	for i := 0; i < 10; i++ {
+		if got := sm.Sorted(); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("Incorrect order:\n%v\n%v\n", FormatStatuses(expected), FormatStatuses(got))
+		}
+	}
+}
@@ -0,0 +1,386 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"fmt"
+	"time"
+)
+
+// Storage persists a Registry's users, their statuses and
+// aliases, along with the remote registries it crawls.
+// Implementations for LevelDB, SQLite and bbolt are in
+// the registry/leveldb, registry/sqlite and registry/bolt
+// packages.
+//
+// Methods are not called concurrently by the Registry.
+// The Put methods should replace whatever was stored
+// under the same key.
+type Storage interface {
+	// LoadAll returns every stored user, keyed
+	// by URL, and every stored alias.
+	LoadAll() (map[string]*User, map[string]string, error)
+
+	// PutUser stores the user's information, apart
+	// from their statuses. The user's lock is held
+	// for reading during the call.
+	PutUser(urlKey string, user *User) error
+
+	// PutStatuses stores the user's statuses.
+	PutStatuses(urlKey string, statuses TimeMap) error
+
+	// PutAlias records that the user at one
+	// URL has moved to another.
+	PutAlias(from, to string) error
+
+	// DelUser removes everything stored under the
+	// user's URL, including any alias.
+	DelUser(urlKey string) error
+
+	// PutRemoteRegistry stores the URL
+	// of a remote registry.
+	PutRemoteRegistry(urlKey string) error
+
+	// RemoteRegistries lists the URLs of the
+	// stored remote registries.
+	RemoteRegistries() ([]string, error)
+
+	// Close releases the underlying database.
+	Close() error
+}
+
+// BatchStorage is a Storage that can group writes so
+// they're committed together. Save uses it if available.
+type BatchStorage interface {
+	Storage
+
+	// Batch calls the function with a Storage whose
+	// writes are committed once it returns, or
+	// discarded if it returns an error.
+	Batch(fn func(Storage) error) error
+}
+
+// PruneStorage is a Storage that can delete single
+// statuses. Save uses it to remove statuses pruned by
+// the Registry's Retention. For other Storage, the
+// user is deleted, then written again in full.
+type PruneStorage interface {
+	Storage
+	DelStatuses(urlKey string, times []time.Time) error
+}
+
+// StatusQuery selects stored statuses. Empty fields
+// match everything. Statuses are returned newest first.
+type StatusQuery struct {
+	// Statuses whose text contains this,
+	// ignoring case.
+	Substring string
+
+	// Statuses mentioning any of these URLs.
+	Mentions []string
+
+	// Statuses from the user at this URL.
+	User string
+
+	// Statuses posted before this time.
+	Before time.Time
+
+	// The most statuses to return, and how
+	// many to skip. A zero Limit means
+	// no limit.
+	Limit  int
+	Offset int
+}
+
+// QueryStorage is a Storage that can answer status
+// queries itself, so they needn't be loaded into
+// memory first.
+type QueryStorage interface {
+	Storage
+	QueryStatuses(q StatusQuery) ([]*Status, error)
+}
+
+// Save writes the changes made to the Registry since it
+// was last saved to the provided Storage, in a single batch
+// if it's a BatchStorage. Only the statuses that are new or
+// changed are written. If saving fails, the changes are
+// kept to be tried again next time.
+// Users and aliases written to the Registry directly
+// aren't tracked. Use SaveAll to write them.
+func (registry *Registry) Save(store Storage) error {
+	if registry == nil {
+		return fmt.Errorf("can't save empty registry")
+	} else if store == nil {
+		return fmt.Errorf("can't save to nil storage")
+	}
+
+	pending := registry.changes.take()
+	err := registry.writeChanges(store, pending)
+	if err != nil {
+		registry.changes.restore(pending)
+	}
+	return err
+}
+
+// SaveAll writes every user, status and alias in
+// the Registry to the provided Storage, whether or
+// not they've changed.
+func (registry *Registry) SaveAll(store Storage) error {
+	if registry == nil {
+		return fmt.Errorf("can't save empty registry")
+	}
+
+	registry.Mu.RLock()
+	for k := range registry.Users {
+		registry.changes.addUser(k)
+	}
+	for k := range registry.Aliases {
+		registry.changes.setAlias(k)
+	}
+	registry.Mu.RUnlock()
+
+	return registry.Save(store)
+}
+
+// Export writes every user, status and alias in the
+// Registry to the provided Storage, like SaveAll, but
+// leaves the changes Save has yet to write alone. It's
+// for copying the Registry elsewhere, such as to an
+// archive, without disturbing its usual Storage.
+func (registry *Registry) Export(store Storage) error {
+	if registry == nil {
+		return fmt.Errorf("can't export empty registry")
+	} else if store == nil {
+		return fmt.Errorf("can't export to nil storage")
+	}
+
+	everything := newChanges()
+	registry.Mu.RLock()
+	for k := range registry.Users {
+		everything.addUser(k)
+	}
+	for k := range registry.Aliases {
+		everything.setAlias(k)
+	}
+	registry.Mu.RUnlock()
+
+	return registry.writeChanges(store, everything)
+}
+
+// Dirty reports whether the Registry
+// has changes Save hasn't written.
+func (registry *Registry) Dirty() bool {
+	return !registry.changes.empty()
+}
+
+// Writes the changes in a single batch,
+// if the Storage supports it.
+func (registry *Registry) writeChanges(store Storage, pending *changes) error {
+	save := func(store Storage) error {
+		return registry.saveChanges(store, pending)
+	}
+	if batch, ok := store.(BatchStorage); ok {
+		return batch.Batch(save)
+	}
+	return save(store)
+}
+
+func (registry *Registry) saveChanges(store Storage, pending *changes) error {
+	for k := range pending.deleted {
+		if err := store.DelUser(k); err != nil {
+			return fmt.Errorf("couldn't delete %v: %v", k, err)
+		}
+	}
+
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	for k, v := range pending.users {
+		user, ok := registry.Users[k]
+		if !ok || user == nil {
+			continue
+		}
+		if err := saveUser(store, k, user, v); err != nil {
+			return fmt.Errorf("couldn't save %v: %v", k, err)
+		}
+	}
+
+	for k := range pending.aliases {
+		to, ok := registry.Aliases[k]
+		if !ok {
+			continue
+		}
+		if err := store.PutAlias(k, to); err != nil {
+			return fmt.Errorf("couldn't save alias %v: %v", k, err)
+		}
+	}
+
+	return nil
+}
+
+func saveUser(store Storage, urlKey string, user *User, uc *userChanges) error {
+	user.Mu.RLock()
+	defer user.Mu.RUnlock()
+
+	if removed := removedStatuses(user, uc); len(removed) > 0 {
+		if pruner, ok := store.(PruneStorage); ok {
+			if err := pruner.DelStatuses(urlKey, removed); err != nil {
+				return err
+			}
+		} else {
+			if err := store.DelUser(urlKey); err != nil {
+				return err
+			}
+			uc = &userChanges{all: true}
+		}
+	}
+
+	if uc.all || uc.info {
+		if err := store.PutUser(urlKey, user); err != nil {
+			return err
+		}
+	}
+
+	statuses := user.Status
+	if !uc.all {
+		statuses = NewTimeMap()
+		for k := range uc.statuses {
+			if e, ok := user.Status[k]; ok {
+				statuses[k] = e
+			}
+		}
+	}
+	if len(statuses) == 0 {
+		return nil
+	}
+	return store.PutStatuses(urlKey, statuses)
+}
+
+// Returns the times of the statuses removed from the user
+// that haven't been replaced since. The caller must hold
+// the user's lock.
+func removedStatuses(user *User, uc *userChanges) []time.Time {
+	out := make([]time.Time, 0, len(uc.removed))
+	for k := range uc.removed {
+		if _, ok := user.Status[k]; !ok {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// Load reads the users, statuses and aliases held by the
+// provided Storage into the Registry. The stored data
+// replaces that of users already in the Registry,
+// though their other statuses are kept.
+func (registry *Registry) Load(store Storage) error {
+	if registry == nil {
+		return fmt.Errorf("can't load into empty registry")
+	} else if store == nil {
+		return fmt.Errorf("can't load from nil storage")
+	}
+
+	users, aliases, err := store.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	registry.Mu.Lock()
+	registry.merge(users, aliases)
+	registry.Mu.Unlock()
+
+	registry.Reindex()
+	return nil
+}
+
+// Import reads the users, statuses and aliases held by the
+// provided Storage into the Registry, as Load does, and marks
+// them to be written by the next Save. If replace is set, the
+// Registry's users and aliases are removed first, so it's left
+// holding only what was imported.
+func (registry *Registry) Import(store Storage, replace bool) error {
+	if registry == nil {
+		return fmt.Errorf("can't import into empty registry")
+	} else if store == nil {
+		return fmt.Errorf("can't import from nil storage")
+	}
+
+	users, aliases, err := store.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	registry.Mu.Lock()
+	if replace {
+		// Aliases are removed from Storage
+		// along with the user at their URL.
+		for k := range registry.Users {
+			delete(registry.Users, k)
+			registry.changes.delUser(k)
+		}
+		for k := range registry.Aliases {
+			delete(registry.Aliases, k)
+			registry.changes.delUser(k)
+		}
+	}
+	registry.merge(users, aliases)
+	registry.Mu.Unlock()
+
+	for k := range users {
+		registry.changes.addUser(k)
+	}
+	for k := range aliases {
+		registry.changes.setAlias(k)
+	}
+
+	registry.Reindex()
+	return nil
+}
+
+// Adds the users and aliases to the Registry, replacing the
+// information of existing users but keeping their other
+// statuses. The caller must hold the Registry's lock.
+func (registry *Registry) merge(users map[string]*User, aliases map[string]string) {
+	for k, v := range users {
+		user, ok := registry.Users[k]
+		if !ok || user == nil {
+			if v.Status == nil {
+				v.Status = NewTimeMap()
+			}
+			registry.Users[k] = v
+			continue
+		}
+
+		user.Mu.Lock()
+		user.Nick = v.Nick
+		user.URL = v.URL
+		user.IP = v.IP
+		user.Date = v.Date
+		user.LastModified = v.LastModified
+		user.RemoteRegistry = v.RemoteRegistry
+		for i, e := range v.Status {
+			user.Status[i] = e
+		}
+		user.Mu.Unlock()
+	}
+	for k, v := range aliases {
+		registry.Aliases[k] = v
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// A Storage kept in memory, standing
+// in for a third-party backend.
+type memStorage struct {
+	users   map[string]*User
+	aliases map[string]string
+	remotes []string
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		users:   make(map[string]*User),
+		aliases: make(map[string]string),
+	}
+}
+
+func (mem *memStorage) LoadAll() (map[string]*User, map[string]string, error) {
+	users := make(map[string]*User)
+	for k, v := range mem.users {
+		user := NewUser()
+		user.Nick = v.Nick
+		user.URL = v.URL
+		user.Date = v.Date
+		for i, e := range v.Status {
+			user.Status[i] = e
+		}
+		users[k] = user
+	}
+	aliases := make(map[string]string)
+	for k, v := range mem.aliases {
+		aliases[k] = v
+	}
+	return users, aliases, nil
+}
+
+func (mem *memStorage) PutUser(urlKey string, user *User) error {
+	stored, ok := mem.users[urlKey]
+	if !ok {
+		stored = NewUser()
+		mem.users[urlKey] = stored
+	}
+	stored.Nick = user.Nick
+	stored.URL = user.URL
+	stored.Date = user.Date
+	return nil
+}
+
+func (mem *memStorage) PutStatuses(urlKey string, statuses TimeMap) error {
+	stored, ok := mem.users[urlKey]
+	if !ok {
+		return fmt.Errorf("no user %v", urlKey)
+	}
+	for k, v := range statuses {
+		stored.Status[k] = v
+	}
+	return nil
+}
+
+func (mem *memStorage) PutAlias(from, to string) error {
+	mem.aliases[from] = to
+	return nil
+}
+
+func (mem *memStorage) DelUser(urlKey string) error {
+	delete(mem.users, urlKey)
+	delete(mem.aliases, urlKey)
+	return nil
+}
+
+func (mem *memStorage) PutRemoteRegistry(urlKey string) error {
+	mem.remotes = append(mem.remotes, urlKey)
+	return nil
+}
+
+func (mem *memStorage) RemoteRegistries() ([]string, error) {
+	return mem.remotes, nil
+}
+
+func (mem *memStorage) Close() error {
+	return nil
+}
+
+func Test_Registry_SaveLoad(t *testing.T) {
+	registry := initTestEnv()
+	registry.Aliases["https://old.example.com/twtxt.txt"] = "https://example.com/twtxt.txt"
+	store := newMemStorage()
+
+	if err := registry.SaveAll(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	loaded := New(nil)
+	if err := loaded.Load(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	for k, v := range registry.Users {
+		user, ok := loaded.Users[k]
+		if !ok {
+			t.Errorf("User %v not loaded\n", k)
+			continue
+		}
+		if user.Nick != v.Nick || len(user.Status) != len(v.Status) {
+			t.Errorf("Loaded %v as %v with %v statuses\n", k, user.Nick, len(user.Status))
+		}
+	}
+	if got := loaded.Resolve("https://old.example.com/twtxt.txt"); got != "https://example.com/twtxt.txt" {
+		t.Errorf("Alias not loaded, got %v\n", got)
+	}
+
+	before, _ := registry.QueryAllStatuses()
+	after, err := loaded.QueryAllStatuses()
+	if err != nil || len(after) != len(before) {
+		t.Errorf("Loaded statuses not indexed: %v, %v\n", len(after), err)
+	}
+}
+
+// Loading into a Registry that already has the
+// user should keep the statuses it has.
+func Test_Registry_Load_Merge(t *testing.T) {
+	store := newMemStorage()
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	now := then.Add(time.Hour)
+	urlKey := "https://example.com/twtxt.txt"
+
+	saved := New(nil)
+	saved.AddUser("foo", urlKey, nil, TimeMap{then: NewStatus("foo", urlKey, then, "older")})
+	if err := saved.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	registry := New(nil)
+	registry.AddUser("foo", urlKey, nil, TimeMap{now: NewStatus("foo", urlKey, now, "newer")})
+	if err := registry.Load(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	out, _ := registry.QueryAllStatuses()
+	if len(out) != 2 {
+		t.Errorf("Expected 2 statuses after load, got %v\n", out)
+	}
+}
+
+// Exporting shouldn't use up the changes
+// waiting for the next Save.
+func Test_Registry_Export(t *testing.T) {
+	registry := New(nil)
+	urlKey := "https://example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	registry.AddUser("foo", urlKey, nil, TimeMap{then: NewStatus("foo", urlKey, then, "hi")})
+
+	exported := newMemStorage()
+	if err := registry.Export(exported); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(exported.users[urlKey].Status) != 1 {
+		t.Errorf("User not exported: %v\n", exported.users)
+	}
+	if !registry.Dirty() {
+		t.Errorf("Export used up the Registry's changes\n")
+	}
+}
+
+func Test_Registry_Import(t *testing.T) {
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	kept := "https://example.com/kept.txt"
+	imported := "https://example.com/imported.txt"
+
+	archive := newMemStorage()
+	source := New(nil)
+	source.AddUser("bar", imported, nil, TimeMap{then: NewStatus("bar", imported, then, "hello")})
+	source.Aliases["https://example.com/old.txt"] = imported
+	if err := source.SaveAll(archive); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	setup := func(t *testing.T) (*Registry, *memStorage) {
+		registry := New(nil)
+		registry.AddUser("foo", kept, nil, TimeMap{then: NewStatus("foo", kept, then, "hi")})
+		registry.Aliases["https://example.com/older.txt"] = kept
+		store := newMemStorage()
+		if err := registry.SaveAll(store); err != nil {
+			t.Fatalf("Couldn't set up test: %v\n", err)
+		}
+		return registry, store
+	}
+
+	t.Run("Merge", func(t *testing.T) {
+		registry, store := setup(t)
+		if err := registry.Import(archive, false); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if len(store.users) != 2 || len(store.aliases) != 2 {
+			t.Errorf("Expected 2 users and 2 aliases saved, got %v and %v\n", len(store.users), len(store.aliases))
+		}
+		if out, _ := registry.QueryAllStatuses(); len(out) != 2 {
+			t.Errorf("Imported statuses not indexed: %v\n", out)
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		registry, store := setup(t)
+		if err := registry.Import(archive, true); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if err := registry.Save(store); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if _, ok := store.users[kept]; ok || len(store.users) != 1 {
+			t.Errorf("Replacing left other users saved: %v\n", store.users)
+		}
+		if _, ok := store.aliases["https://example.com/older.txt"]; ok {
+			t.Errorf("Replacing left other aliases saved: %v\n", store.aliases)
+		}
+		if _, err := registry.Get(kept); err == nil {
+			t.Errorf("Replacing left other users in the registry\n")
+		}
+		if out, _ := registry.QueryAllStatuses(); len(out) != 1 {
+			t.Errorf("Expected only the imported status, got %v\n", out)
+		}
+	})
+}
@@ -0,0 +1,252 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package storagetest checks that a registry.Storage behaves
+// the way the Registry expects of it. Each storage backend's
+// tests run these checks against stores of their own.
+package storagetest // import "git.sr.ht/~gbmor/getwtxt/registry/storagetest"
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+)
+
+// Backend is the storage backend being checked.
+type Backend struct {
+	// Open creates an empty store, returning it along
+	// with a function that closes and removes it.
+	Open func(t *testing.T) (registry.Storage, func())
+
+	// CountEdits counts the earlier versions of
+	// statuses kept in the store, including any
+	// left behind by a status that's gone.
+	CountEdits func(store registry.Storage) (int, error)
+}
+
+// Run checks the backend, opening a new store for each
+// check. Batches and deleting statuses are only checked
+// if the store is a registry.BatchStorage or a
+// registry.PruneStorage.
+func Run(t *testing.T, b Backend) {
+	t.Run("Store", func(t *testing.T) { testStore(t, b) })
+	t.Run("DelStatuses", func(t *testing.T) { testDelStatuses(t, b) })
+	t.Run("Edits", func(t *testing.T) { testEdits(t, b) })
+	t.Run("Batch Rollback", func(t *testing.T) { testBatchRollback(t, b) })
+}
+
+func testStore(t *testing.T, b Backend) {
+	store, done := b.Open(t)
+	defer done()
+
+	urlKey := "https://example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	reg := registry.New(nil)
+	reg.AddUser("foo", urlKey, net.ParseIP("127.0.0.1"), registry.TimeMap{
+		then: registry.NewStatus("foo", urlKey, then, "hello #twtxt"),
+	})
+	reg.Aliases["https://old.example.com/twtxt.txt"] = urlKey
+
+	if err := reg.SaveAll(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := store.PutRemoteRegistry("https://twtxt.example.net/api/plain/users"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	t.Run("LoadAll", func(t *testing.T) {
+		users, aliases, err := store.LoadAll()
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		user, ok := users[urlKey]
+		if !ok {
+			t.Fatalf("User not stored\n")
+		}
+		if user.Nick != "foo" || user.URL != urlKey || !user.IP.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("User stored incorrectly: %v %v %v\n", user.Nick, user.URL, user.IP)
+		}
+		if status, ok := user.Status[then]; !ok || status.Text != "hello #twtxt" {
+			t.Errorf("Status stored incorrectly: %v\n", user.Status)
+		}
+		if aliases["https://old.example.com/twtxt.txt"] != urlKey {
+			t.Errorf("Alias not stored: %v\n", aliases)
+		}
+	})
+	t.Run("RemoteRegistries", func(t *testing.T) {
+		remotes, err := store.RemoteRegistries()
+		if err != nil || len(remotes) != 1 || remotes[0] != "https://twtxt.example.net/api/plain/users" {
+			t.Errorf("Remote registry not stored: %v, %v\n", remotes, err)
+		}
+	})
+	t.Run("DelUser", func(t *testing.T) {
+		if err := store.DelUser(urlKey); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		users, _, err := store.LoadAll()
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if _, ok := users[urlKey]; ok {
+			t.Errorf("User still stored after deletion\n")
+		}
+	})
+}
+
+// Statuses pruned from the registry
+// should be removed from disk too.
+func testDelStatuses(t *testing.T, b Backend) {
+	store, done := b.Open(t)
+	defer done()
+
+	urlKey := "https://example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	statuses := registry.NewTimeMap()
+	for i := 0; i < 3; i++ {
+		at := then.Add(time.Duration(i) * time.Hour)
+		statuses[at] = registry.NewStatus("foo", urlKey, at, fmt.Sprintf("status %v", i))
+	}
+	reg := registry.New(nil)
+	reg.AddUser("foo", urlKey, nil, statuses)
+	if err := reg.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	reg.Retention.Local.MaxStatuses = 1
+	if n := reg.Prune(); n != 2 {
+		t.Fatalf("Expected 2 statuses pruned, got %v\n", n)
+	}
+	if err := reg.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	users, _, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	stored := users[urlKey].Status
+	if _, ok := stored[then.Add(2*time.Hour)]; !ok || len(stored) != 1 {
+		t.Errorf("Expected only the newest status stored, got %v\n", stored)
+	}
+}
+
+func testEdits(t *testing.T, b Backend) {
+	store, done := b.Open(t)
+	defer done()
+
+	urlKey := "https://example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	status := registry.NewStatus("foo", urlKey, then, "third")
+	status.Edits = []registry.Edit{
+		{Text: "first", Seen: then.Add(time.Hour)},
+		{Text: "second", Seen: then.Add(2 * time.Hour)},
+	}
+	user := registry.NewUser()
+	user.Nick = "foo"
+	user.URL = urlKey
+	if err := store.PutUser(urlKey, user); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := store.PutStatuses(urlKey, registry.TimeMap{then: status}); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	users, _, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if n, err := b.CountEdits(store); err != nil || n == 0 {
+		t.Fatalf("Expected edits counted, got %v, %v\n", n, err)
+	}
+	edits := users[urlKey].Status[then].Edits
+	if len(edits) != 2 || edits[0].Text != "first" || edits[1].Text != "second" || !edits[1].Seen.Equal(then.Add(2*time.Hour)) {
+		t.Errorf("Edits not stored in order: %v\n", edits)
+	}
+
+	// replacing the status replaces its edits
+	if err := store.PutStatuses(urlKey, registry.TimeMap{then: registry.NewStatus("foo", urlKey, then, "third")}); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	users, _, err = store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if edits := users[urlKey].Status[then].Edits; len(edits) != 0 {
+		t.Errorf("Expected edits cleared, got %v\n", edits)
+	}
+
+	// edits go along with their status,
+	// whichever way it's deleted
+	if pruner, ok := store.(registry.PruneStorage); ok {
+		if err := store.PutStatuses(urlKey, registry.TimeMap{then: status}); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if err := pruner.DelStatuses(urlKey, []time.Time{then}); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if n, err := b.CountEdits(store); err != nil || n != 0 {
+			t.Errorf("Expected no edits left after DelStatuses, got %v, %v\n", n, err)
+		}
+	}
+
+	if err := store.PutStatuses(urlKey, registry.TimeMap{then: status}); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := store.DelUser(urlKey); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if n, err := b.CountEdits(store); err != nil || n != 0 {
+		t.Errorf("Expected no edits left after DelUser, got %v, %v\n", n, err)
+	}
+}
+
+// Everything written within a failed batch
+// should be rolled back.
+func testBatchRollback(t *testing.T, b Backend) {
+	store, done := b.Open(t)
+	defer done()
+
+	batch, ok := store.(registry.BatchStorage)
+	if !ok {
+		t.Skip("Store doesn't support batches")
+	}
+
+	urlKey := "https://example.com/twtxt.txt"
+	err := batch.Batch(func(tx registry.Storage) error {
+		if err := tx.PutUser(urlKey, registry.NewUser()); err != nil {
+			return err
+		}
+		return os.ErrInvalid
+	})
+	if err != os.ErrInvalid {
+		t.Errorf("Expected the batch's error, got %v\n", err)
+	}
+
+	users, _, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if _, ok := users[urlKey]; ok {
+		t.Errorf("Write from failed batch was kept\n")
+	}
+}
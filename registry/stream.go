@@ -0,0 +1,329 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Default values used for any Limits
+// fields left as zero.
+const (
+	DefaultMaxBodySize   = 8 << 20
+	DefaultMaxStatuses   = 20000
+	DefaultMaxLineLength = 16 << 10
+)
+
+// Limits bounds the resources used when fetching and
+// parsing a twtxt file. Fields left as zero take the
+// respective default value. Negative values disable
+// the respective limit.
+type Limits struct {
+	// Maximum number of bytes read from
+	// a twtxt file.
+	MaxBodySize int64
+
+	// Maximum number of statuses kept from a
+	// single twtxt file. When exceeded, the
+	// newest statuses are kept.
+	MaxStatuses int
+
+	// Lines longer than this many bytes
+	// are skipped.
+	MaxLineLength int
+}
+
+// TruncatedError is reported when a twtxt file exceeds
+// the bounds set by Limits. The statuses that could be
+// parsed are still used.
+type TruncatedError struct {
+	// The limit that was reached: "size", "statuses",
+	// or "line length".
+	Limit string
+
+	// The value of that limit.
+	Max int64
+
+	// Number of lines skipped for exceeding
+	// the maximum line length.
+	SkippedLines int
+}
+
+// Feed is the result of reading a single
+// user's twtxt file.
+type Feed struct {
+	Statuses TimeMap
+
+	// Set if the file contains the line
+	// "# noindex = true". See OptedOut().
+	OptedOut bool
+
+	// The hash and URL of the archived segment
+	// holding the file's older statuses, from
+	// the line "# prev = <hash> <url>".
+	Prev string
+
+	// If non-nil, a *TruncatedError describing
+	// how the file exceeded the Limits used to
+	// read it.
+	Truncated error
+
+	// The lines that were skipped because
+	// they couldn't be parsed.
+	Errors ParseErrors
+
+	// Set by Registry.FetchUser to the new URL
+	// if the file has permanently moved.
+	MovedTo string
+
+	// Set by Registry.FetchUser to the media type
+	// and charset the file was served as, and
+	// whether it began with a byte order mark.
+	ContentType string
+	Charset     string
+	BOM         bool
+}
+
+func (e *TruncatedError) Error() string {
+	var msg string
+	switch e.Limit {
+	case "size":
+		msg = fmt.Sprintf("twtxt file truncated: exceeded maximum size of %v bytes", e.Max)
+	case "statuses":
+		msg = fmt.Sprintf("twtxt file truncated: exceeded maximum of %v statuses, kept the newest", e.Max)
+	default:
+		msg = fmt.Sprintf("twtxt file truncated: skipped lines longer than %v bytes", e.Max)
+	}
+	if e.SkippedLines > 0 {
+		msg += fmt.Sprintf(" (%v lines skipped)", e.SkippedLines)
+	}
+	return msg
+}
+
+// Substitutes the defaults for zero values.
+func (l Limits) withDefaults() Limits {
+	if l.MaxBodySize == 0 {
+		l.MaxBodySize = DefaultMaxBodySize
+	}
+	if l.MaxStatuses == 0 {
+		l.MaxStatuses = DefaultMaxStatuses
+	}
+	if l.MaxLineLength == 0 {
+		l.MaxLineLength = DefaultMaxLineLength
+	}
+	return l
+}
+
+// ReadUserTwtxt parses twtxt data as it's read from r,
+// within the provided Limits. Lines that can't be parsed
+// are skipped and listed in Feed.Errors. If a limit is
+// reached, Feed.Truncated is set and the statuses parsed
+// so far are returned. An error is returned only if
+// the data couldn't be read at all.
+func ReadUserTwtxt(r io.Reader, nickname, urlKey string, limits Limits) (*Feed, error) {
+	limits = limits.withDefaults()
+	body := &boundedReader{r: r, n: limits.MaxBodySize}
+	lines := newLineReader(body, limits.MaxLineLength)
+
+	feed := &Feed{
+		Statuses: NewTimeMap(),
+	}
+	var oldest timeHeap
+	var truncated *TruncatedError
+	read := false
+
+	for {
+		line, terminated, err := lines.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading twtxt file: %v", err)
+		}
+		read = true
+
+		// The final line was cut short by the size limit.
+		if !terminated && body.exceeded {
+			break
+		}
+
+		nopadding, ok := trimLine(line)
+		if !ok {
+			if isOptOutLine(nopadding) {
+				feed.OptedOut = true
+			}
+			if key, value, ok := metadataLine(nopadding); ok && key == "prev" && feed.Prev == "" {
+				feed.Prev = value
+			}
+			continue
+		}
+
+		thetime, text, perr := parseStatusLine(nopadding)
+		if perr != nil {
+			perr.Line = lines.num
+			perr.Column += utf8.RuneCountInString(line[:strings.Index(line, nopadding)])
+			feed.Errors = append(feed.Errors, perr)
+			continue
+		}
+
+		if _, ok := feed.Statuses[thetime]; !ok {
+			heap.Push(&oldest, thetime)
+		}
+		feed.Statuses[thetime] = NewStatus(nickname, urlKey, thetime, text)
+
+		// Keep only the newest statuses
+		if limits.MaxStatuses >= 0 && len(feed.Statuses) > limits.MaxStatuses {
+			delete(feed.Statuses, heap.Pop(&oldest).(time.Time))
+			truncated = &TruncatedError{Limit: "statuses", Max: int64(limits.MaxStatuses)}
+		}
+	}
+
+	if !read {
+		return nil, fmt.Errorf("no data to parse in twtxt file")
+	}
+
+	if body.exceeded {
+		truncated = &TruncatedError{Limit: "size", Max: limits.MaxBodySize}
+	}
+	if lines.skipped > 0 {
+		if truncated == nil {
+			truncated = &TruncatedError{Limit: "line length", Max: int64(limits.MaxLineLength)}
+		}
+		truncated.SkippedLines = lines.skipped
+	}
+	if truncated != nil {
+		feed.Truncated = truncated
+	}
+
+	return feed, nil
+}
+
+// Passes through at most n bytes from the underlying
+// reader, noting whether there was more to read.
+// A negative n disables the limit.
+type boundedReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (b *boundedReader) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return b.r.Read(p)
+	}
+	if b.n == 0 {
+		var probe [1]byte
+		if n, _ := io.ReadFull(b.r, probe[:]); n > 0 {
+			b.exceeded = true
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.r.Read(p)
+	b.n -= int64(n)
+	return n, err
+}
+
+// Reads lines of at most max bytes, discarding
+// and counting any that are longer. A negative
+// max disables the limit.
+type lineReader struct {
+	r       *bufio.Reader
+	max     int
+	skipped int
+
+	// Number of the line last read or skipped.
+	num int
+}
+
+func newLineReader(r io.Reader, max int) *lineReader {
+	if max < 0 {
+		return &lineReader{r: bufio.NewReader(r), max: max}
+	}
+	// room for the line, a carriage return, and the newline
+	return &lineReader{r: bufio.NewReaderSize(r, max+2), max: max}
+}
+
+// Returns the next line without its trailing newline,
+// and whether it had one. Returns io.EOF once there
+// are no more lines.
+func (l *lineReader) next() (string, bool, error) {
+	l.num++
+	if l.max < 0 {
+		line, err := l.r.ReadString('\n')
+		return finishLine([]byte(line), err)
+	}
+
+	for {
+		line, err := l.r.ReadSlice('\n')
+		if err != bufio.ErrBufferFull {
+			return finishLine(line, err)
+		}
+		l.num++
+
+		for err == bufio.ErrBufferFull {
+			_, err = l.r.ReadSlice('\n')
+		}
+		l.skipped++
+		if err == io.EOF {
+			return "", false, io.EOF
+		} else if err != nil {
+			return "", false, err
+		}
+	}
+}
+
+func finishLine(line []byte, err error) (string, bool, error) {
+	if err == io.EOF {
+		if len(line) == 0 {
+			return "", false, io.EOF
+		}
+		return string(bytes.TrimSuffix(line, []byte("\r"))), false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	// normalize CRLF line endings
+	return string(bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))), true, nil
+}
+
+// A min-heap of timestamps, used to find the
+// oldest status when too many have been read.
+type timeHeap []time.Time
+
+func (h timeHeap) Len() int            { return len(h) }
+func (h timeHeap) Less(i, j int) bool  { return h[i].Before(h[j]) }
+func (h timeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *timeHeap) Push(x interface{}) { *h = append(*h, x.(time.Time)) }
+func (h *timeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,177 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Builds a twtxt file with n statuses, one minute apart,
+// oldest first.
+func makeTwtxt(n int) string {
+	var b strings.Builder
+	start := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "%v\tstatus number %v\n", start.Add(time.Duration(i)*time.Minute).Format(time.RFC3339), i)
+	}
+	return b.String()
+}
+
+var readUserTwtxtCases = []struct {
+	name      string
+	data      string
+	limits    Limits
+	statuses  int
+	truncated string
+	optedOut  bool
+}{
+	{
+		name:     "Within Limits",
+		data:     "# nick = foo\n" + makeTwtxt(5),
+		statuses: 5,
+	},
+	{
+		name:      "Too Many Statuses",
+		data:      makeTwtxt(10),
+		limits:    Limits{MaxStatuses: 4},
+		statuses:  4,
+		truncated: "statuses",
+	},
+	{
+		name:      "Too Large",
+		data:      makeTwtxt(10),
+		limits:    Limits{MaxBodySize: int64(len(makeTwtxt(3))) + 5},
+		statuses:  3,
+		truncated: "size",
+	},
+	{
+		name:      "Long Line",
+		data:      makeTwtxt(2) + "2019-06-02T00:00:00Z\t" + strings.Repeat("a", 200) + "\n" + makeTwtxt(1),
+		limits:    Limits{MaxLineLength: 100},
+		statuses:  2,
+		truncated: "line length",
+	},
+	{
+		name:     "Opted Out",
+		data:     "# noindex = true\n" + makeTwtxt(1),
+		statuses: 1,
+		optedOut: true,
+	},
+	{
+		name:     "Unlimited",
+		data:     makeTwtxt(10),
+		limits:   Limits{MaxBodySize: -1, MaxStatuses: -1, MaxLineLength: -1},
+		statuses: 10,
+	},
+}
+
+func Test_ReadUserTwtxt(t *testing.T) {
+	for _, tt := range readUserTwtxtCases {
+		t.Run(tt.name, func(t *testing.T) {
+			feed, err := ReadUserTwtxt(strings.NewReader(tt.data), "foo", "https://example.com/twtxt.txt", tt.limits)
+			if err != nil {
+				t.Fatalf("%v\n", err)
+			}
+			if len(feed.Statuses) != tt.statuses {
+				t.Errorf("Expected %v statuses, got %v\n", tt.statuses, len(feed.Statuses))
+			}
+			if feed.OptedOut != tt.optedOut {
+				t.Errorf("Expected opted out to be %v\n", tt.optedOut)
+			}
+
+			if tt.truncated == "" {
+				if feed.Truncated != nil {
+					t.Errorf("Unexpected truncation: %v\n", feed.Truncated)
+				}
+				return
+			}
+			terr, ok := feed.Truncated.(*TruncatedError)
+			if !ok || terr.Limit != tt.truncated {
+				t.Errorf("Expected truncation by %v, got %v\n", tt.truncated, feed.Truncated)
+			}
+		})
+	}
+}
+
+// Only the first "# prev" line is taken.
+func Test_ReadUserTwtxt_Prev(t *testing.T) {
+	data := "# nick = foo\n# prev = abc1234 https://example.com/twtxt-1.txt\n" + makeTwtxt(2) + "# prev = def5678 https://example.com/twtxt-2.txt\n"
+	feed, err := ReadUserTwtxt(strings.NewReader(data), "foo", "https://example.com/twtxt.txt", Limits{})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if want := "abc1234 https://example.com/twtxt-1.txt"; feed.Prev != want {
+		t.Errorf("Expected prev %q, got %q\n", want, feed.Prev)
+	}
+}
+
+// When too many statuses are present, the newest are kept.
+func Test_ReadUserTwtxt_KeepsNewest(t *testing.T) {
+	feed, err := ReadUserTwtxt(strings.NewReader(makeTwtxt(10)), "foo", "https://example.com/twtxt.txt", Limits{MaxStatuses: 3})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	oldest := time.Date(2019, 6, 1, 0, 7, 0, 0, time.UTC)
+	for k := range feed.Statuses {
+		if k.Before(oldest) {
+			t.Errorf("Kept status from %v, expected only those from %v onward\n", k, oldest)
+		}
+	}
+}
+
+func Test_Registry_FetchUser(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(makeTwtxt(50)))
+	}))
+	defer srv.Close()
+
+	registry := New(srv.Client())
+	registry.Limits = Limits{MaxBodySize: 1024}
+
+	feed, err := registry.FetchUser(srv.URL+"/twtxt.txt", "foo")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if feed.Truncated == nil {
+		t.Fatalf("Expected file to be truncated\n")
+	}
+	if len(feed.Statuses) == 0 || len(feed.Statuses) >= 50 {
+		t.Errorf("Expected some but not all statuses, got %v\n", len(feed.Statuses))
+	}
+}
+
+func Benchmark_ReadUserTwtxt(b *testing.B) {
+	data := makeTwtxt(1000)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := ReadUserTwtxt(strings.NewReader(data), "foo", "https://example.com/twtxt.txt", Limits{})
+		if err != nil {
+			b.Errorf("%v\n", err)
+		}
+	}
+}
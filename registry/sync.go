@@ -0,0 +1,55 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import "time"
+
+// Returns the times of the user's statuses that are missing
+// from their freshly fetched twtxt file, which are dropped
+// when the Registry's Sync is set. Nothing's dropped if the
+// file was truncated, as some statuses may not have been
+// read. If the file names an archived segment holding its
+// older statuses, with "# prev", statuses older than the
+// file's oldest are taken to be archived, and kept.
+func missingStatuses(current TimeMap, feed *Feed) []time.Time {
+	if feed == nil || feed.Truncated != nil {
+		return nil
+	}
+
+	var since time.Time
+	if feed.Prev != "" {
+		if len(feed.Statuses) == 0 {
+			return nil
+		}
+		for k := range feed.Statuses {
+			if since.IsZero() || k.Before(since) {
+				since = k
+			}
+		}
+	}
+
+	out := make([]time.Time, 0)
+	for k := range current {
+		if _, ok := feed.Statuses[k]; !ok && !k.Before(since) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
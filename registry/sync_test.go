@@ -0,0 +1,138 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func syncTimes(days ...int) TimeMap {
+	tm := NewTimeMap()
+	for _, e := range days {
+		k := time.Date(2019, 9, e, 0, 0, 0, 0, time.UTC)
+		tm[k] = NewStatus("foo", "https://example.com/twtxt.txt", k, "hello")
+	}
+	return tm
+}
+
+var missingStatusesCases = []struct {
+	name    string
+	current TimeMap
+	feed    *Feed
+	missing int
+}{
+	{
+		name:    "Nothing Missing",
+		current: syncTimes(1, 2),
+		feed:    &Feed{Statuses: syncTimes(1, 2, 3)},
+		missing: 0,
+	},
+	{
+		name:    "Deleted",
+		current: syncTimes(1, 2, 3),
+		feed:    &Feed{Statuses: syncTimes(2)},
+		missing: 2,
+	},
+	{
+		name:    "Emptied",
+		current: syncTimes(1, 2, 3),
+		feed:    &Feed{Statuses: NewTimeMap()},
+		missing: 3,
+	},
+	{
+		name:    "Archived",
+		current: syncTimes(1, 2, 3, 4),
+		feed:    &Feed{Statuses: syncTimes(3), Prev: "abc1234 twtxt-old.txt"},
+		missing: 1,
+	},
+	{
+		name:    "Archived Emptied",
+		current: syncTimes(1, 2),
+		feed:    &Feed{Statuses: NewTimeMap(), Prev: "abc1234 twtxt-old.txt"},
+		missing: 0,
+	},
+	{
+		name:    "Truncated",
+		current: syncTimes(1, 2, 3),
+		feed:    &Feed{Statuses: syncTimes(3), Truncated: &TruncatedError{Limit: "statuses", Max: 1}},
+		missing: 0,
+	},
+}
+
+func Test_missingStatuses(t *testing.T) {
+	for _, tt := range missingStatusesCases {
+		t.Run(tt.name, func(t *testing.T) {
+			missing := missingStatuses(tt.current, tt.feed)
+			if len(missing) != tt.missing {
+				t.Errorf("Expected %v missing, got %v\n", tt.missing, missing)
+			}
+			for _, e := range missing {
+				if _, ok := tt.feed.Statuses[e]; ok {
+					t.Errorf("Status at %v is in the feed\n", e)
+				}
+			}
+		})
+	}
+}
+
+func Test_Registry_UpdateUser_Sync(t *testing.T) {
+	body := "2019-09-02T00:00:00Z\tedited\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	urlKey := srv.URL + "/twtxt.txt"
+
+	for _, sync := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Sync %v", sync), func(t *testing.T) {
+			registry := New(srv.Client())
+			registry.Sync = sync
+			registry.AddUser("foo", urlKey, nil, syncTimes(1, 2))
+			registry.changes.take()
+
+			if err := registry.UpdateUser(urlKey); err != nil {
+				t.Fatalf("%v\n", err)
+			}
+
+			statuses, _ := registry.GetUserStatuses(urlKey)
+			edited := time.Date(2019, 9, 2, 0, 0, 0, 0, time.UTC)
+			if e, ok := statuses[edited]; !ok || !strings.Contains(e.String(), "edited") {
+				t.Errorf("Expected the edited status, got %v\n", statuses)
+			}
+
+			deleted := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+			if _, ok := statuses[deleted]; ok == sync {
+				t.Errorf("Deleted status kept: %v, expected %v\n", ok, !sync)
+			}
+			if all, _ := registry.GetStatuses(); len(all) != len(statuses) {
+				t.Errorf("Index holds %v statuses, user holds %v\n", len(all), len(statuses))
+			}
+			if uc := registry.changes.take().users[urlKey]; uc == nil || uc.removed[deleted] != sync {
+				t.Errorf("Expected removal recorded: %v\n", sync)
+			}
+		})
+	}
+}
@@ -22,6 +22,7 @@ along with Registry.  If not, see <https://www.gnu.org/licenses/>.
 package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"sync"
@@ -36,7 +37,20 @@ type Registrar interface {
 	DelUser(urlKey string) error
 	UpdateUser(urlKey string) error
 	GetUserStatuses(urlKey string) (TimeMap, error)
-	GetStatuses() (TimeMap, error)
+	GetStatuses() (StatusMap, error)
+}
+
+// ContextRegistrar is a Registrar whose methods also
+// accept a context.Context, so that cancellation and
+// deadlines reach any requests they make.
+type ContextRegistrar interface {
+	Registrar
+	PutContext(ctx context.Context, user *User) error
+	GetContext(ctx context.Context, urlKey string) (*User, error)
+	DelUserContext(ctx context.Context, urlKey string) error
+	UpdateUserContext(ctx context.Context, urlKey string) error
+	GetUserStatusesContext(ctx context.Context, urlKey string) (TimeMap, error)
+	GetStatusesContext(ctx context.Context) (StatusMap, error)
 }
 
 // User holds a given user's information
@@ -68,11 +82,45 @@ type User struct {
 	// reflecting when the user was added.
 	Date string
 
+	// The URL of the remote registry the user
+	// was obtained from via CrawlRemoteRegistry.
+	// Empty if the user was added directly.
+	RemoteRegistry string
+
+	// The outcome of the most recent
+	// fetch of the user's twtxt file.
+	Fetch FetchState
+
 	// A TimeMap of the user's statuses
 	// from their twtxt file.
 	Status TimeMap
 }
 
+// FetchState describes the most recent attempt
+// to fetch a user's twtxt file.
+type FetchState struct {
+	// When the fetch was attempted.
+	Time time.Time
+
+	// The error encountered, if any.
+	Err string
+
+	// Set if the twtxt file exceeded the
+	// Registry's Limits.
+	Truncated bool
+
+	// Number of lines skipped because
+	// they couldn't be parsed.
+	BadLines int
+
+	// The media type and charset the twtxt
+	// file was served as, and whether it
+	// began with a byte order mark.
+	ContentType string
+	Charset     string
+	BOM         bool
+}
+
 // Registry enables the bulk of a registry's
 // user data storage and access.
 type Registry struct {
@@ -84,20 +132,61 @@ type Registry struct {
 	// The registry's user data is contained
 	// in this map. The functions within this
 	// library expect the key to be the URL of
-	// a given user's twtxt file.
+	// a given user's twtxt file. Call Reindex()
+	// after adding users or statuses directly,
+	// and save them with SaveAll().
 	Users map[string]*User
 
+	// Old URLs of users whose twtxt files have
+	// permanently moved, mapped to the URL they
+	// moved to. See MoveUser().
+	Aliases map[string]string
+
 	// The client to use for HTTP requests.
 	// If nil is passed to NewIndex(), a
 	// client with a 10 second timeout
 	// and all other values as default is
 	// used.
 	HTTPClient *http.Client
+
+	// Bounds applied when fetching and parsing
+	// users' twtxt files. The zero value uses
+	// the defaults.
+	Limits Limits
+
+	// Which responses are accepted as users'
+	// twtxt files, and how they're decoded.
+	// The zero value uses the defaults.
+	Content ContentRules
+
+	// If set, a complete fetch of a user's twtxt
+	// file replaces their statuses, so those the
+	// user has deleted or re-dated are dropped.
+	// Otherwise statuses are only ever added.
+	// See UpdateUser().
+	Sync bool
+
+	// How many statuses are kept for each user,
+	// and for how long. The zero value keeps
+	// everything. See Prune().
+	Retention Retention
+
+	// Cached robots.txt rules for the hosts
+	// of users found via remote registries.
+	robots *robotsCache
+
+	// Every user's statuses, newest first.
+	// See Reindex().
+	index *statusIndex
+
+	// What's changed since the Registry
+	// was last saved. See Save().
+	changes *changes
 }
 
-// TimeMap holds extracted and processed user data as a
-// string. A time.Time value is used as the key.
-type TimeMap map[time.Time]string
+// TimeMap holds a user's statuses, keyed
+// by the time each was posted.
+type TimeMap map[time.Time]*Status
 
 // TimeSlice is a slice of time.Time used for sorting
 // a TimeMap by timestamp.
@@ -116,7 +205,11 @@ func New(client *http.Client) *Registry {
 	return &Registry{
 		Mu:         sync.RWMutex{},
 		Users:      make(map[string]*User),
+		Aliases:    make(map[string]string),
 		HTTPClient: client,
+		robots:     newRobotsCache(),
+		index:      newStatusIndex(),
+		changes:    newChanges(),
 	}
 }
 
@@ -125,6 +218,16 @@ func NewTimeMap() TimeMap {
 	return make(TimeMap)
 }
 
+// Returns the times the statuses
+// in the TimeMap were posted.
+func (tm TimeMap) times() []time.Time {
+	out := make([]time.Time, 0, len(tm))
+	for k := range tm {
+		out = append(out, k)
+	}
+	return out
+}
+
 // Len returns the length of the TimeSlice to be sorted.
 // This helps satisfy sort.Interface.
 func (t TimeSlice) Len() int {
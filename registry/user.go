@@ -20,6 +20,8 @@ along with Registry.  If not, see <https://www.gnu.org/licenses/>.
 package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -27,6 +29,10 @@ import (
 	"time"
 )
 
+// ErrNotModified is returned by UpdateUser when the remote
+// twtxt file hasn't changed since it was last fetched.
+var ErrNotModified = errors.New("no new statuses available")
+
 // AddUser inserts a new user into the Registry.
 func (registry *Registry) AddUser(nickname, urlKey string, ipAddress net.IP, statuses TimeMap) error {
 
@@ -46,6 +52,9 @@ func (registry *Registry) AddUser(nickname, urlKey string, ipAddress net.IP, sta
 	if _, ok := registry.Users[urlKey]; ok {
 		return fmt.Errorf("user %v already exists", urlKey)
 	}
+	if to, ok := registry.Aliases[urlKey]; ok {
+		return fmt.Errorf("user %v has moved to %v", urlKey, to)
+	}
 
 	registry.Users[urlKey] = &User{
 		Mu:           sync.RWMutex{},
@@ -55,6 +64,8 @@ func (registry *Registry) AddUser(nickname, urlKey string, ipAddress net.IP, sta
 		IP:           ipAddress,
 		Date:         time.Now().Format(time.RFC3339),
 		Status:       statuses}
+	registry.index.insert(urlKey, statuses)
+	registry.changes.addUser(urlKey)
 
 	return nil
 }
@@ -66,6 +77,15 @@ func (registry *Registry) AddUser(nickname, urlKey string, ipAddress net.IP, sta
 // Registry will be overwritten if its User.URL is the
 // same as the User.URL being pushed.
 func (registry *Registry) Put(user *User) error {
+	return registry.PutContext(context.Background(), user)
+}
+
+// PutContext is Put, returning the context's
+// error instead if it has already ended.
+func (registry *Registry) PutContext(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if user == nil {
 		return fmt.Errorf("can't push nil data to registry")
 	}
@@ -78,10 +98,14 @@ func (registry *Registry) Put(user *User) error {
 		return fmt.Errorf("can't push data to registry: missing URL for key")
 	}
 	urlKey := user.URL
+	statuses := snapshot(user.Status)
+	user.Mu.RUnlock()
+
 	registry.Mu.Lock()
 	registry.Users[urlKey] = user
+	registry.index.insert(urlKey, statuses)
 	registry.Mu.Unlock()
-	user.Mu.RUnlock()
+	registry.changes.addUser(urlKey)
 
 	return nil
 }
@@ -89,6 +113,15 @@ func (registry *Registry) Put(user *User) error {
 // Get returns the User associated with the
 // provided URL key in the Registry.
 func (registry *Registry) Get(urlKey string) (*User, error) {
+	return registry.GetContext(context.Background(), urlKey)
+}
+
+// GetContext is Get, returning the context's
+// error instead if it has already ended.
+func (registry *Registry) GetContext(ctx context.Context, urlKey string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if registry == nil {
 		return nil, fmt.Errorf("can't pop from nil registry")
 	}
@@ -113,6 +146,15 @@ func (registry *Registry) Get(urlKey string) (*User, error) {
 // DelUser removes a user and all associated data from
 // the Registry.
 func (registry *Registry) DelUser(urlKey string) error {
+	return registry.DelUserContext(context.Background(), urlKey)
+}
+
+// DelUserContext is DelUser, returning the context's
+// error instead if it has already ended.
+func (registry *Registry) DelUserContext(ctx context.Context, urlKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	if registry == nil {
 		return fmt.Errorf("can't delete user from empty registry")
@@ -127,73 +169,296 @@ func (registry *Registry) DelUser(urlKey string) error {
 	registry.Mu.Lock()
 	defer registry.Mu.Unlock()
 
-	if _, ok := registry.Users[urlKey]; !ok {
+	user, ok := registry.Users[urlKey]
+	if !ok {
 		return fmt.Errorf("can't delete user %v, user doesn't exist", urlKey)
 	}
 
+	user.Mu.RLock()
+	statuses := snapshot(user.Status)
+	user.Mu.RUnlock()
+	registry.index.remove(statuses)
 	delete(registry.Users, urlKey)
+	registry.changes.delUser(urlKey)
+
+	return nil
+}
+
+// SetNick changes the nickname of the user at the URL,
+// along with the nickname given in each of their statuses.
+func (registry *Registry) SetNick(urlKey, nickname string) error {
+	if registry == nil {
+		return fmt.Errorf("can't rename user in empty registry")
+	} else if nickname == "" {
+		return fmt.Errorf("can't set blank nickname")
+	}
+
+	registry.Mu.RLock()
+	user, ok := registry.Users[urlKey]
+	registry.Mu.RUnlock()
+	if !ok || user == nil {
+		return fmt.Errorf("can't rename user %v, user doesn't exist", urlKey)
+	}
 
+	// Statuses are shared with readers of the
+	// Registry, so they're replaced with copies.
+	renamed := NewTimeMap()
+	user.Mu.Lock()
+	user.Nick = nickname
+	for k, v := range user.Status {
+		status := *v
+		status.Nick = nickname
+		renamed[k] = &status
+		user.Status[k] = &status
+	}
+	user.Mu.Unlock()
+
+	registry.index.insert(urlKey, renamed)
+	registry.changes.setInfo(urlKey)
+	registry.changes.addStatuses(urlKey, renamed.times())
 	return nil
 }
 
+// PurgeStatuses removes every status held for the user
+// at the URL, leaving the user in place, and returns how
+// many were removed. Statuses still in the user's twtxt
+// file come back once it's next modified.
+func (registry *Registry) PurgeStatuses(urlKey string) (int, error) {
+	if registry == nil {
+		return 0, fmt.Errorf("can't purge statuses from empty registry")
+	}
+
+	registry.Mu.RLock()
+	user, ok := registry.Users[urlKey]
+	registry.Mu.RUnlock()
+	if !ok || user == nil {
+		return 0, fmt.Errorf("can't purge statuses of %v, user doesn't exist", urlKey)
+	}
+
+	user.Mu.Lock()
+	purged := user.Status
+	user.Status = NewTimeMap()
+	user.Mu.Unlock()
+
+	if len(purged) == 0 {
+		return 0, nil
+	}
+	registry.index.remove(purged)
+	registry.changes.delStatuses(urlKey, purged.times())
+	return len(purged), nil
+}
+
 // UpdateUser scrapes an existing user's remote twtxt.txt
 // file. Any new statuses are added to the user's entry
-// in the Registry. If the remote twtxt data's reported
-// Content-Length does not differ from what is stored,
-// an error is returned.
+// in the Registry, and edited statuses replaced, keeping
+// their earlier text as Edits. If the Registry's Sync is
+// set, statuses missing from the file are dropped, as
+// described by Sync. Statuses beyond the Registry's
+// Retention are then pruned. If the remote twtxt data
+// has not been modified since the last fetch,
+// ErrNotModified is returned.
+// For users found via a remote registry, the host's robots.txt
+// is consulted first, and ErrDisallowed is returned if it
+// forbids the fetch. If the twtxt file has opted out of
+// registries, ErrOptedOut is returned. In both cases, the
+// user is left in place for the caller to remove.
+// If the twtxt file exceeds the Registry's Limits, the
+// statuses that could be parsed are added and a
+// *TruncatedError is returned. If the file has moved
+// permanently, the user is moved to the new URL with
+// MoveUser and a *MovedError is returned. The outcome
+// is recorded in the user's FetchState.
 func (registry *Registry) UpdateUser(urlKey string) error {
+	return registry.UpdateUserContext(context.Background(), urlKey)
+}
+
+// UpdateUserContext is UpdateUser, with each request bound
+// to the provided context. If the context ends, the user is
+// left as it was and the context's error is returned.
+func (registry *Registry) UpdateUserContext(ctx context.Context, urlKey string) error {
+	return registry.updateUser(ctx, urlKey, false)
+}
+
+// ForceUpdateUser is UpdateUser, fetching the twtxt
+// file whether or not it's been modified since the
+// last fetch.
+func (registry *Registry) ForceUpdateUser(urlKey string) error {
+	return registry.ForceUpdateUserContext(context.Background(), urlKey)
+}
+
+// ForceUpdateUserContext is ForceUpdateUser, with each
+// request bound to the provided context, as with
+// UpdateUserContext.
+func (registry *Registry) ForceUpdateUserContext(ctx context.Context, urlKey string) error {
+	return registry.updateUser(ctx, urlKey, true)
+}
+
+func (registry *Registry) updateUser(ctx context.Context, urlKey string, force bool) (err error) {
 	if urlKey == "" || !strings.HasPrefix(urlKey, "http") {
 		return fmt.Errorf("invalid URL: %v", urlKey)
 	}
+	if IsRemoteRegistry(urlKey) {
+		return fmt.Errorf("attempting to update registry URL - users should be updated individually")
+	}
 
-	diff, err := registry.DiffTwtxt(urlKey)
-	if err != nil {
-		return err
-	} else if !diff {
-		return fmt.Errorf("no new statuses available for %v", urlKey)
+	registry.Mu.RLock()
+	user, ok := registry.Users[urlKey]
+	registry.Mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("user not in registry")
 	}
 
-	out, isRemoteRegistry, err := GetTwtxt(urlKey, registry.HTTPClient)
+	user.Mu.RLock()
+	nick := user.Nick
+	crawled := user.RemoteRegistry != ""
+	lastModified := user.LastModified
+	user.Mu.RUnlock()
+
+	var feed *Feed
+	defer func() {
+		if ctxErr := ctx.Err(); ctxErr != nil && err == ctxErr {
+			// fetch it again next time
+			user.Mu.Lock()
+			user.LastModified = lastModified
+			user.Mu.Unlock()
+			return
+		}
+		user.RecordFetch(feed, err)
+	}()
+
+	if crawled {
+		allowed, err := registry.RobotsAllowedContext(ctx, urlKey)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err == nil && !allowed {
+			return ErrDisallowed
+		}
+	}
+
+	if !force {
+		diff, err := registry.DiffTwtxtContext(ctx, urlKey)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			return err
+		} else if !diff {
+			return ErrNotModified
+		}
+	}
+
+	feed, err = registry.FetchUserContext(ctx, urlKey, nick)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// the file may have been cut short
+		return ctxErr
+	}
 	if err != nil {
 		return err
 	}
 
-	if isRemoteRegistry {
-		return fmt.Errorf("attempting to update registry URL - users should be updated individually")
+	if feed.OptedOut {
+		return ErrOptedOut
 	}
 
-	registry.Mu.Lock()
-	defer registry.Mu.Unlock()
-	user := registry.Users[urlKey]
+	registry.Mu.RLock()
+	retention := registry.Retention
+	sync := registry.Sync
+	registry.Mu.RUnlock()
+
+	// only new or edited statuses need saving
+	changed := make([]time.Time, 0)
+	var missing []time.Time
+	removed := NewTimeMap()
+	now := time.Now()
+	user.Mu.Lock()
+	for i, e := range feed.Statuses {
+		old, ok := user.Status[i]
+		if !ok || old.String() != e.String() {
+			changed = append(changed, i)
+		}
+		// edits are kept along with the new text
+		e = withHistory(old, e, now)
+		feed.Statuses[i] = e
+		user.Status[i] = e
+	}
+	if sync {
+		missing = missingStatuses(user.Status, feed)
+		for _, e := range missing {
+			removed[e] = user.Status[e]
+			delete(user.Status, e)
+		}
+	}
+	user.Mu.Unlock()
+	registry.index.insert(urlKey, feed.Statuses)
+	registry.changes.addStatuses(urlKey, changed)
+	if len(removed) > 0 {
+		registry.index.remove(removed)
+		registry.changes.delStatuses(urlKey, missing)
+	}
+
+	registry.pruneUser(urlKey, user, retention, now)
+
+	if feed.MovedTo != "" {
+		if err := registry.MoveUser(urlKey, feed.MovedTo); err != nil {
+			return err
+		}
+		return &MovedError{From: urlKey, To: feed.MovedTo}
+	}
+
+	return feed.Truncated
+}
 
+// RecordFetch notes the outcome of fetching the
+// user's twtxt file in the user's FetchState,
+// including how it was served if feed is non-nil.
+// ErrNotModified and *MovedError count as
+// a success.
+func (user *User) RecordFetch(feed *Feed, err error) {
 	user.Mu.Lock()
 	defer user.Mu.Unlock()
-	nick := user.Nick
 
-	data, err := ParseUserTwtxt(out, nick, urlKey)
-	if err != nil {
-		return err
+	user.Fetch = FetchState{Time: time.Now()}
+	if feed != nil {
+		user.Fetch.ContentType = feed.ContentType
+		user.Fetch.Charset = feed.Charset
+		user.Fetch.BOM = feed.BOM
+		user.Fetch.Truncated = feed.Truncated != nil
+		user.Fetch.BadLines = len(feed.Errors)
 	}
-
-	for i, e := range data {
-		user.Status[i] = e
+	if _, ok := err.(*MovedError); ok || err == nil || err == ErrNotModified {
+		return
 	}
 
-	registry.Users[urlKey] = user
-
-	return nil
+	user.Fetch.Err = err.Error()
+	if _, ok := err.(*TruncatedError); ok {
+		user.Fetch.Truncated = true
+	}
 }
 
 // CrawlRemoteRegistry scrapes all nicknames and user URLs
 // from a provided registry. The urlKey passed to this function
 // must be in the form of https://registry.example.com/api/plain/users
+// Users whose hosts disallow getwtxt via robots.txt are skipped.
 func (registry *Registry) CrawlRemoteRegistry(urlKey string) error {
+	return registry.CrawlRemoteRegistryContext(context.Background(), urlKey)
+}
+
+// CrawlRemoteRegistryContext is CrawlRemoteRegistry, with each
+// request bound to the provided context. If the context ends,
+// no users are added and the context's error is returned.
+func (registry *Registry) CrawlRemoteRegistryContext(ctx context.Context, urlKey string) error {
 	if urlKey == "" || !strings.HasPrefix(urlKey, "http") {
 		return fmt.Errorf("invalid URL: %v", urlKey)
 	}
 
-	out, isRemoteRegistry, err := GetTwtxt(urlKey, registry.HTTPClient)
-	if err != nil {
+	// a truncated registry dump still
+	// gives us the users it lists
+	out, isRemoteRegistry, err := GetTwtxtContext(ctx, urlKey, registry.HTTPClient)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if _, ok := err.(*TruncatedError); err != nil && !ok {
 		return err
 	}
 
@@ -206,13 +471,29 @@ func (registry *Registry) CrawlRemoteRegistry(urlKey string) error {
 		return err
 	}
 
+	// skip users whose hosts don't want us
+	// fetching their twtxt files
+	allowed := make([]*User, 0, len(users))
+	for _, e := range users {
+		if ok, err := registry.RobotsAllowedContext(ctx, e.URL); err != nil || !ok {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			continue
+		}
+		e.RemoteRegistry = urlKey
+		allowed = append(allowed, e)
+	}
+
 	// only add new users so we don't overwrite data
 	// we already have (and lose statuses, etc)
 	registry.Mu.Lock()
 	defer registry.Mu.Unlock()
-	for _, e := range users {
+	for _, e := range allowed {
 		if _, ok := registry.Users[e.URL]; !ok {
 			registry.Users[e.URL] = e
+			registry.index.insert(e.URL, e.Status)
+			registry.changes.addUser(e.URL)
 		}
 	}
 
@@ -221,6 +502,15 @@ func (registry *Registry) CrawlRemoteRegistry(urlKey string) error {
 
 // GetUserStatuses returns a TimeMap containing single user's statuses
 func (registry *Registry) GetUserStatuses(urlKey string) (TimeMap, error) {
+	return registry.GetUserStatusesContext(context.Background(), urlKey)
+}
+
+// GetUserStatusesContext is GetUserStatuses, returning the
+// context's error instead if it has already ended.
+func (registry *Registry) GetUserStatusesContext(ctx context.Context, urlKey string) (TimeMap, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if registry == nil {
 		return nil, fmt.Errorf("can't get statuses from an empty registry")
 	} else if urlKey == "" || !strings.HasPrefix(urlKey, "http") {
@@ -240,31 +530,57 @@ func (registry *Registry) GetUserStatuses(urlKey string) (TimeMap, error) {
 	return status, nil
 }
 
-// GetStatuses returns a TimeMap containing all statuses
+// GetStatuses returns a StatusMap containing all statuses
 // from all users in the Registry.
-func (registry *Registry) GetStatuses() (TimeMap, error) {
+func (registry *Registry) GetStatuses() (StatusMap, error) {
+	return registry.GetStatusesContext(context.Background())
+}
+
+// GetStatusesContext is GetStatuses, stopping with the
+// context's error if it ends while statuses are gathered.
+func (registry *Registry) GetStatusesContext(ctx context.Context) (StatusMap, error) {
 	if registry == nil {
 		return nil, fmt.Errorf("can't get statuses from an empty registry")
 	}
 
-	statuses := NewTimeMap()
+	statuses := NewStatusMap()
 
 	registry.Mu.RLock()
 	defer registry.Mu.RUnlock()
 
 	for _, v := range registry.Users {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		v.Mu.RLock()
 		if v.Status == nil || len(v.Status) == 0 {
 			v.Mu.RUnlock()
 			continue
 		}
-		for a, b := range v.Status {
-			if _, ok := v.Status[a]; ok {
-				statuses[a] = b
-			}
-		}
+		statuses.Add(v.Status)
 		v.Mu.RUnlock()
 	}
 
 	return statuses, nil
 }
+
+// Reindex rebuilds the Registry's ordering of statuses used
+// by its queries. Statuses added through the Registry's methods
+// are indexed as they arrive; Reindex need only be called after
+// adding users or statuses by modifying Registry.Users or
+// User.Status directly, such as when loading them in bulk.
+func (registry *Registry) Reindex() {
+	registry.Mu.RLock()
+	defer registry.Mu.RUnlock()
+
+	registry.index.reset()
+	for k, v := range registry.Users {
+		if v == nil {
+			continue
+		}
+		v.Mu.RLock()
+		statuses := snapshot(v.Status)
+		v.Mu.RUnlock()
+		registry.index.insert(k, statuses)
+	}
+}
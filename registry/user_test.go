@@ -21,11 +21,14 @@ package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 var addUserCases = []struct {
@@ -83,7 +86,7 @@ func Test_Registry_AddUser(t *testing.T) {
 	addUserCases[3].nick = string(buf)
 	addUserCases[3].url = string(buf)
 
-	statuses, err := registry.GetStatuses()
+	statuses, err := registry.GetUserStatuses("https://example.com/twtxt.txt")
 	if err != nil {
 		t.Errorf("Error setting up test: %v\n", err)
 	}
@@ -124,7 +127,7 @@ func Test_Registry_AddUser(t *testing.T) {
 }
 func Benchmark_Registry_AddUser(b *testing.B) {
 	registry := initTestEnv()
-	statuses, err := registry.GetStatuses()
+	statuses, err := registry.GetUserStatuses("https://example.com/twtxt.txt")
 	if err != nil {
 		b.Errorf("Error setting up test: %v\n", err)
 	}
@@ -325,10 +328,10 @@ func Test_Registry_GetStatuses(t *testing.T) {
 
 		// Now do the same query manually to see
 		// if we get the same result
-		unionmap := NewTimeMap()
+		unionmap := NewStatusMap()
 		for _, v := range registry.Users {
-			for i, e := range v.Status {
-				unionmap[i] = e
+			for _, e := range v.Status {
+				unionmap[e.Key()] = e
 			}
 		}
 		if !reflect.DeepEqual(statuses, unionmap) {
@@ -336,6 +339,29 @@ func Test_Registry_GetStatuses(t *testing.T) {
 		}
 	})
 }
+
+// Statuses posted at the same time by
+// different users must all be kept
+func Test_Registry_GetStatuses_SameTime(t *testing.T) {
+	registry := New(nil)
+	then := time.Date(2020, 2, 4, 21, 28, 21, 0, time.UTC)
+	for _, e := range []string{"foo", "bar"} {
+		url := "https://" + e + ".example.com/twtxt.txt"
+		err := registry.AddUser(e, url, nil, TimeMap{then: NewStatus(e, url, then, "hi")})
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+
+	statuses, err := registry.QueryAllStatuses()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(statuses) != 2 {
+		t.Errorf("Expected both statuses, got %v\n", FormatStatuses(statuses))
+	}
+}
+
 func Benchmark_Registry_GetStatuses(b *testing.B) {
 	registry := initTestEnv()
 	b.ResetTimer()
@@ -347,3 +373,153 @@ func Benchmark_Registry_GetStatuses(b *testing.B) {
 		}
 	}
 }
+
+var _ ContextRegistrar = New(nil)
+
+// An update cut short by its context shouldn't be
+// recorded, and the file should be fetched in full
+// next time.
+func Test_Registry_UpdateUserContext_Cancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Last-Modified", "Wed, 05 Feb 2020 10:00:00 GMT")
+			return
+		}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	registry := New(srv.Client())
+	urlKey := srv.URL + "/twtxt.txt"
+	if err := registry.AddUser("foo", urlKey, nil, NewTimeMap()); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	registry.Users[urlKey].LastModified = "Tue, 04 Feb 2020 10:00:00 GMT"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := registry.UpdateUserContext(ctx, urlKey); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v\n", context.DeadlineExceeded, err)
+	}
+
+	user := registry.Users[urlKey]
+	if user.LastModified != "Tue, 04 Feb 2020 10:00:00 GMT" {
+		t.Errorf("LastModified changed to %v\n", user.LastModified)
+	}
+	if !user.Fetch.Time.IsZero() {
+		t.Errorf("Cancelled fetch was recorded: %v\n", user.Fetch)
+	}
+}
+
+func Test_Registry_Context_Cancelled(t *testing.T) {
+	registry := initTestEnv()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := registry.CrawlRemoteRegistryContext(ctx, "https://example.com/api/plain/tweets"); err != context.Canceled {
+		t.Errorf("Crawl: expected %v, got %v\n", context.Canceled, err)
+	}
+	if _, err := registry.QueryAllStatusesContext(ctx); err != context.Canceled {
+		t.Errorf("Query: expected %v, got %v\n", context.Canceled, err)
+	}
+	if _, err := registry.GetStatusesContext(ctx); err != context.Canceled {
+		t.Errorf("GetStatuses: expected %v, got %v\n", context.Canceled, err)
+	}
+}
+
+func Test_Registry_ForceUpdateUser(t *testing.T) {
+	body := "2019-09-01T00:00:00Z\thello\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	urlKey := srv.URL + "/twtxt.txt"
+
+	registry := New(srv.Client())
+	if err := registry.AddUser("foo", urlKey, nil, NewTimeMap()); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	registry.Users[urlKey].LastModified = "Sun, 01 Sep 2019 00:00:00 GMT"
+
+	if err := registry.UpdateUser(urlKey); err != ErrNotModified {
+		t.Errorf("Expected ErrNotModified, got %v\n", err)
+	}
+	if err := registry.ForceUpdateUser(urlKey); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if statuses, _ := registry.GetUserStatuses(urlKey); len(statuses) != 1 {
+		t.Errorf("Expected the status fetched, got %v\n", statuses)
+	}
+}
+
+func Test_Registry_SetNick(t *testing.T) {
+	registry := New(nil)
+	urlKey := "https://example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	original := NewStatus("foo", urlKey, then, "hello")
+	if err := registry.AddUser("foo", urlKey, nil, TimeMap{then: original}); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	registry.changes.take()
+
+	if err := registry.SetNick(urlKey, "bar"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	user, _ := registry.Get(urlKey)
+	if user.Nick != "bar" || user.Status[then].Nick != "bar" {
+		t.Errorf("Nickname not changed: %v %v\n", user.Nick, user.Status[then])
+	}
+	if original.Nick != "foo" {
+		t.Errorf("Status modified in place\n")
+	}
+	if all, _ := registry.GetStatuses(); all[original.Key()].Nick != "bar" {
+		t.Errorf("Index not updated: %v\n", all)
+	}
+	if uc := registry.changes.take().users[urlKey]; uc == nil || !uc.info || !uc.statuses[then] {
+		t.Errorf("Rename not marked to be saved\n")
+	}
+
+	if err := registry.SetNick(urlKey, ""); err == nil {
+		t.Errorf("Expected an error for a blank nickname\n")
+	}
+	if err := registry.SetNick("https://example.org/twtxt.txt", "bar"); err == nil {
+		t.Errorf("Expected an error for a missing user\n")
+	}
+}
+
+func Test_Registry_PurgeStatuses(t *testing.T) {
+	registry := New(nil)
+	urlKey := "https://example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	statuses := TimeMap{
+		then:                NewStatus("foo", urlKey, then, "hello"),
+		then.Add(time.Hour): NewStatus("foo", urlKey, then.Add(time.Hour), "again"),
+	}
+	if err := registry.AddUser("foo", urlKey, nil, statuses); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	registry.changes.take()
+
+	n, err := registry.PurgeStatuses(urlKey)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 statuses purged, got %v, %v\n", n, err)
+	}
+	if user, err := registry.Get(urlKey); err != nil || len(user.Status) != 0 {
+		t.Errorf("Expected the user kept without statuses: %v\n", err)
+	}
+	if all, _ := registry.GetStatuses(); len(all) != 0 {
+		t.Errorf("Statuses left in index: %v\n", all)
+	}
+	if uc := registry.changes.take().users[urlKey]; uc == nil || len(uc.removed) != 2 {
+		t.Errorf("Purge not marked to be saved\n")
+	}
+
+	if _, err := registry.PurgeStatuses("https://example.org/twtxt.txt"); err == nil {
+		t.Errorf("Expected an error for a missing user\n")
+	}
+}
@@ -0,0 +1,274 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry // import "git.sr.ht/~gbmor/getwtxt/registry"
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Severity levels of a Finding. A file with any
+// findings of SeverityError isn't valid.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// ErrNoStatuses is returned when a submitted twtxt file has
+// no statuses that would be indexed, such as when every line
+// was skipped. ValidateTwtxt reports such files as invalid.
+var ErrNoStatuses = errors.New("no statuses would be indexed")
+
+// Statuses dated further than this into the
+// future are reported by ValidateTwtxt.
+const futureSkew = 5 * time.Minute
+
+// Finding is a single problem found
+// while validating a twtxt file.
+type Finding struct {
+	// Line and column the finding applies to,
+	// starting from 1. Both are zero if it
+	// applies to the whole file.
+	Line   int
+	Column int
+
+	Severity string
+	Message  string
+}
+
+// Report is the result of validating a twtxt file.
+type Report struct {
+	// How the file was served, if it was fetched.
+	ContentType string
+	Charset     string
+
+	Findings []Finding
+
+	// The statuses that would be indexed,
+	// newest first.
+	Preview []*Status
+}
+
+// Valid reports whether the validated file
+// has no findings of SeverityError.
+func (report *Report) Valid() bool {
+	for _, e := range report.Findings {
+		if e.Severity == SeverityError {
+			return false
+		}
+	}
+	return true
+}
+
+func (report *Report) add(line, column int, severity, format string, args ...interface{}) {
+	report.Findings = append(report.Findings, Finding{
+		Line:     line,
+		Column:   column,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// ValidateURL fetches a twtxt file the same way as FetchUser,
+// without adding it to the Registry, and validates it with
+// ValidateTwtxt. Problems fetching the file are reported as
+// findings rather than errors, as are responses that the
+// Registry's ContentRules wouldn't accept.
+func (registry *Registry) ValidateURL(urlKey, nickname string) *Report {
+	return registry.ValidateURLContext(context.Background(), urlKey, nickname)
+}
+
+// ValidateURLContext is ValidateURL, with the request
+// bound to the provided context.
+func (registry *Registry) ValidateURLContext(ctx context.Context, urlKey, nickname string) *Report {
+	report := &Report{}
+	if IsRemoteRegistry(urlKey) {
+		report.add(0, 0, SeverityError, "URL is another registry's output, not a twtxt file")
+		return report
+	}
+
+	registry.Mu.RLock()
+	limits := registry.Limits
+	rules := registry.Content
+	registry.Mu.RUnlock()
+
+	// Accept anything, so the content type can be
+	// reported along with everything else.
+	lenient := ContentRules{AcceptTypes: []string{"*/*"}, DefaultCharset: rules.DefaultCharset}
+	res, decoded, info, err := openTwtxt(ctx, urlKey, registry.HTTPClient, lenient)
+	if err != nil {
+		report.add(0, 0, SeverityError, "couldn't fetch twtxt file: %v", err)
+		return report
+	}
+	defer res.Body.Close()
+
+	report.ContentType = info.mediaType
+	report.Charset = info.charset
+	if _, _, ok := rules.accepts(res.Header); !ok {
+		report.add(0, 0, SeverityError, "content type %v isn't accepted, serve the file as %v",
+			info.mediaType, strings.Join(acceptedTypes(rules), " or "))
+	}
+	if info.bom {
+		report.add(0, 0, SeverityWarning, "file begins with a byte order mark, which is ignored")
+	}
+	if loc := permanentLocation(res); loc != "" && loc != urlKey {
+		report.add(0, 0, SeverityWarning, "URL permanently redirects, the user would be kept under %v", loc)
+	}
+
+	lint, err := ValidateTwtxt(decoded, nickname, urlKey, limits)
+	if err != nil {
+		report.add(0, 0, SeverityError, "%v", err)
+		return report
+	}
+	report.Findings = append(report.Findings, lint.Findings...)
+	report.Preview = lint.Preview
+
+	return report
+}
+
+// ValidateTwtxt reads twtxt data from r, within the provided
+// Limits, and reports any problems with it along with a preview
+// of the statuses that would be indexed. If nickname is empty,
+// the nick declared in the file's metadata is used for the
+// preview. An error is returned only if r couldn't be read.
+func ValidateTwtxt(r io.Reader, nickname, urlKey string, limits Limits) (*Report, error) {
+	limits = limits.withDefaults()
+	body := &boundedReader{r: r, n: limits.MaxBodySize}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading twtxt file: %v", err)
+	}
+
+	report := &Report{}
+	meta := lintLines(report, data, limits)
+
+	if nickname == "" {
+		nickname = meta["nick"]
+	}
+	if nickname == "" {
+		nickname = "unknown"
+	}
+	if declared := meta["url"]; declared != "" && urlKey != "" && declared != urlKey {
+		report.add(0, 0, SeverityWarning, "metadata declares URL %v, but the file is at %v", declared, urlKey)
+	}
+
+	feed, err := ReadUserTwtxt(bytes.NewReader(data), nickname, urlKey, limits)
+	if err != nil {
+		report.add(0, 0, SeverityError, "%v", err)
+		return report, nil
+	}
+
+	for _, e := range feed.Errors {
+		report.add(e.Line, e.Column, SeverityWarning, "%v, line would be skipped", e.Reason)
+	}
+	if body.exceeded && feed.Truncated == nil {
+		feed.Truncated = &TruncatedError{Limit: "size", Max: limits.MaxBodySize}
+	}
+	if feed.Truncated != nil {
+		report.add(0, 0, SeverityWarning, "%v", feed.Truncated)
+	}
+	if feed.OptedOut {
+		report.add(0, 0, SeverityError, "file has opted out of registries with a noindex metadata line, and would be refused")
+	}
+	if len(feed.Statuses) == 0 {
+		report.add(0, 0, SeverityError, "%v", ErrNoStatuses)
+	}
+
+	report.Preview, err = SortByTime(feed.Statuses)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Checks each line for problems the parser itself doesn't
+// report, returning the file's metadata fields.
+func lintLines(report *Report, data []byte, limits Limits) map[string]string {
+	meta := make(map[string]string)
+	seen := make(map[time.Time]int)
+	future := time.Now().Add(futureSkew)
+	lines := newLineReader(bytes.NewReader(data), limits.MaxLineLength)
+
+	for {
+		line, _, err := lines.next()
+		if err != nil {
+			break
+		}
+
+		if !utf8.ValidString(line) {
+			col := 1
+			for i := 0; i < len(line); col++ {
+				r, size := utf8.DecodeRuneInString(line[i:])
+				if r == utf8.RuneError && size <= 1 {
+					break
+				}
+				i += size
+			}
+			report.add(lines.num, col, SeverityWarning, "invalid UTF-8, declare the file's charset in its Content-Type")
+		}
+
+		nopadding, ok := trimLine(line)
+		if !ok {
+			if key, value, ok := metadataLine(nopadding); ok {
+				if _, ok := meta[key]; !ok {
+					meta[key] = value
+				}
+			}
+			continue
+		}
+
+		thetime, _, perr := parseStatusLine(nopadding)
+		if perr != nil {
+			continue
+		}
+		if first, ok := seen[thetime]; ok {
+			report.add(lines.num, 1, SeverityWarning, "duplicate timestamp, also used on line %v, only one of them would be kept", first)
+		} else {
+			seen[thetime] = lines.num
+		}
+		if thetime.After(future) {
+			report.add(lines.num, 1, SeverityWarning, "status is dated in the future")
+		}
+	}
+
+	if meta["nick"] == "" {
+		report.add(0, 0, SeverityWarning, "missing metadata line \"# nick = <your nickname>\"")
+	}
+	if meta["url"] == "" {
+		report.add(0, 0, SeverityWarning, "missing metadata line \"# url = <URL of this file>\"")
+	}
+
+	return meta
+}
+
+func acceptedTypes(rules ContentRules) []string {
+	if len(rules.AcceptTypes) == 0 {
+		return DefaultAcceptTypes
+	}
+	return rules.AcceptTypes
+}
@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Registry.
+
+Registry is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Registry is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Registry.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ValidateTwtxt(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	data := strings.Join([]string{
+		"# nick = foo",
+		"2020-02-04T21:28:21Z\tgood",
+		"2020-02-04T21:28:21Z\tsame time",
+		"yesterday\tbad timestamp",
+		"2020-02-04T21:29:21Z\tcaf\xe9",
+		future + "\tfrom the future",
+	}, "\n")
+
+	report, err := ValidateTwtxt(strings.NewReader(data), "", "https://example.com/twtxt.txt", Limits{})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	expected := []Finding{
+		{Line: 3, Column: 1, Severity: SeverityWarning},
+		{Line: 5, Column: 25, Severity: SeverityWarning},
+		{Line: 6, Column: 1, Severity: SeverityWarning},
+		{Line: 0, Column: 0, Severity: SeverityWarning},
+		{Line: 4, Column: 1, Severity: SeverityWarning},
+	}
+	if len(report.Findings) != len(expected) {
+		t.Fatalf("Expected %v findings, got %v: %v\n", len(expected), len(report.Findings), report.Findings)
+	}
+	for i, e := range expected {
+		got := report.Findings[i]
+		if got.Line != e.Line || got.Column != e.Column || got.Severity != e.Severity || got.Message == "" {
+			t.Errorf("Expected %v at %v:%v, got %v\n", e.Severity, e.Line, e.Column, got)
+		}
+	}
+	if !report.Valid() {
+		t.Errorf("Report with only warnings isn't valid\n")
+	}
+
+	// the duplicate is collapsed, and the
+	// nick is taken from the metadata
+	if len(report.Preview) != 3 {
+		t.Fatalf("Expected 3 statuses in preview, got %v\n", len(report.Preview))
+	}
+	if report.Preview[0].Nick != "foo" || report.Preview[0].URL != "https://example.com/twtxt.txt" {
+		t.Errorf("Unexpected preview: %q\n", report.Preview[0])
+	}
+}
+
+// Files that would be refused when submitted
+// shouldn't pass validation.
+func Test_ValidateTwtxt_NoStatuses(t *testing.T) {
+	cases := map[string]string{
+		"Empty":         "",
+		"Metadata Only": "# nick = foo\n# url = https://example.com/twtxt.txt\n",
+		"All Lines Bad": "# nick = foo\nyesterday\tbad timestamp\nnot a status\n",
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			report, err := ValidateTwtxt(strings.NewReader(data), "", "https://example.com/twtxt.txt", Limits{})
+			if err != nil {
+				t.Fatalf("%v\n", err)
+			}
+			if report.Valid() {
+				t.Errorf("File with no statuses is valid: %v\n", report.Findings)
+			}
+		})
+	}
+}
+
+func Test_Registry_ValidateURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("# nick = foo\n# url = https://example.com/twtxt.txt\n2020-02-04T21:28:21Z\thello\n"))
+	}))
+	defer srv.Close()
+
+	registry := New(srv.Client())
+	report := registry.ValidateURL(srv.URL+"/twtxt.txt", "")
+
+	if report.Valid() {
+		t.Errorf("Expected text/html to be reported\n")
+	}
+	if report.ContentType != "text/html" {
+		t.Errorf("Expected content type text/html, got %v\n", report.ContentType)
+	}
+	if len(report.Preview) != 1 {
+		t.Errorf("Expected 1 status in preview, got %v\n", len(report.Preview))
+	}
+	if len(registry.Users) != 0 {
+		t.Errorf("Validation added a user\n")
+	}
+
+	// the declared URL doesn't match
+	var mismatch bool
+	for _, e := range report.Findings {
+		if strings.Contains(e.Message, "metadata declares URL") {
+			mismatch = true
+		}
+	}
+	if !mismatch {
+		t.Errorf("Mismatched metadata URL not reported: %v\n", report.Findings)
+	}
+}
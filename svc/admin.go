@@ -0,0 +1,248 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+)
+
+// Functions in this file serve the admin API's user
+// management: listing users with everything known about
+// them, renaming them, refreshing them on demand, purging
+// their statuses, and pushing the database. Every request
+// needs the administrator password in the X-Auth header.
+
+// The same nicknames accepted when adding a user.
+var nickRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Reads the user's URL from the request, checking
+// they're in the registry. A bad request or missing
+// user has already been answered if it returns false.
+func adminUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userURL := strings.TrimSpace(r.FormValue("url"))
+	if userURL == "" {
+		errHTTP(w, r, errors.New("missing URL"), http.StatusBadRequest)
+		return "", false
+	}
+	if _, err := twtxtCache.Get(userURL); err != nil {
+		errHTTP(w, r, err, http.StatusNotFound)
+		return "", false
+	}
+	return userURL, true
+}
+
+// Lists every user, or the one given by ?url=,
+// along with their metadata and fetch state.
+func handleUserList(w http.ResponseWriter, r *http.Request) {
+	if err := checkAdmin(r); err != nil {
+		errHTTP(w, r, err, http.StatusUnauthorized)
+		return
+	}
+	errLog("Error when parsing query values: ", r.ParseForm())
+
+	users := make(map[string]*registry.User)
+	if r.FormValue("url") != "" {
+		userURL, ok := adminUser(w, r)
+		if !ok {
+			return
+		}
+		users[userURL], _ = twtxtCache.Get(userURL)
+	} else {
+		twtxtCache.Mu.RLock()
+		for k, v := range twtxtCache.Users {
+			users[k] = v
+		}
+		twtxtCache.Mu.RUnlock()
+	}
+
+	data := parseUserList(users)
+	w.Header().Set("Content-Type", txtutf8)
+	if _, err := w.Write(data); err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log200(r)
+}
+
+// Changes the nickname of the user at ?url=
+// to ?nickname=, storing it right away.
+func handleUserNick(w http.ResponseWriter, r *http.Request) {
+	if err := checkAdmin(r); err != nil {
+		errHTTP(w, r, err, http.StatusUnauthorized)
+		return
+	}
+	errLog("Error when parsing query values: ", r.ParseForm())
+
+	userURL, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+	nick := strings.TrimSpace(r.FormValue("nickname"))
+	if !nickRegex.MatchString(nick) {
+		errHTTP(w, r, fmt.Errorf("invalid nickname: %#v", nick), http.StatusBadRequest)
+		return
+	}
+
+	if err := twtxtCache.SetNick(userURL, nick); err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if err := pushDB(); err != nil {
+		errHTTP(w, r, fmt.Errorf("couldn't store nickname: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write([]byte(fmt.Sprintf("200 OK\nRenamed %v to %v\n", userURL, nick))); err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log200(r)
+}
+
+// Fetches the twtxt file of the user at ?url= right away,
+// whether or not it's been modified, unless it's being
+// fetched already. Without ?url=, every user is refreshed
+// in the background, as the periodic refresh would.
+func handleUserRefresh(w http.ResponseWriter, r *http.Request) {
+	if err := checkAdmin(r); err != nil {
+		errHTTP(w, r, err, http.StatusUnauthorized)
+		return
+	}
+	errLog("Error when parsing query values: ", r.ParseForm())
+
+	if r.FormValue("url") == "" {
+		go refreshAll()
+		w.WriteHeader(http.StatusAccepted)
+		if _, err := w.Write([]byte("202 Accepted\nRefreshing all users\n")); err != nil {
+			errHTTP(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		log200(r)
+		return
+	}
+
+	userURL, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+	if !fetching.start(userURL) {
+		errHTTP(w, r, fmt.Errorf("%v is already being refreshed", userURL), http.StatusConflict)
+		return
+	}
+	err := twtxtCache.ForceUpdateUserContext(r.Context(), userURL)
+	afterUpdate(userURL, err)
+	fetching.done(userURL)
+
+	var msg string
+	switch e := err.(type) {
+	case nil:
+		msg = fmt.Sprintf("Refreshed %v", userURL)
+	case *registry.TruncatedError:
+		msg = fmt.Sprintf("Refreshed %v, but %v", userURL, e)
+	case *registry.MovedError:
+		msg = fmt.Sprintf("Moved %v to %v", e.From, e.To)
+	default:
+		if err != registry.ErrOptedOut && err != registry.ErrDisallowed {
+			errHTTP(w, r, fmt.Errorf("couldn't refresh %v: %v", userURL, err), http.StatusBadGateway)
+			return
+		}
+		msg = fmt.Sprintf("Removed %v: %v", userURL, err)
+	}
+	if err := pushDB(); err != nil {
+		errHTTP(w, r, fmt.Errorf("couldn't store refresh: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write([]byte("200 OK\n" + msg + "\n")); err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log200(r)
+}
+
+// Refreshes every user, then stores the result. Waits
+// for a periodic refresh in progress to finish first.
+func refreshAll() {
+	start := time.Now()
+	if cacheUpdate(shutdownCtx, true, 0) {
+		health.setRefreshed(time.Now())
+	}
+	errLog("", pushDB())
+	log.Printf("Requested cache update took: %v\n", time.Since(start))
+}
+
+// Removes every status of the user at ?url=, leaving
+// the user in place, and stores the result right away.
+func handleUserPurge(w http.ResponseWriter, r *http.Request) {
+	if err := checkAdmin(r); err != nil {
+		errHTTP(w, r, err, http.StatusUnauthorized)
+		return
+	}
+	errLog("Error when parsing query values: ", r.ParseForm())
+
+	userURL, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+	n, err := twtxtCache.PurgeStatuses(userURL)
+	if err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if err := pushDB(); err != nil {
+		errHTTP(w, r, fmt.Errorf("couldn't store purge: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write([]byte(fmt.Sprintf("200 OK\nPurged %v statuses from %v\n", n, userURL))); err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log200(r)
+}
+
+// Pushes the registry's changes to
+// the database without waiting.
+func handlePush(w http.ResponseWriter, r *http.Request) {
+	if err := checkAdmin(r); err != nil {
+		errHTTP(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	start := time.Now()
+	if err := pushDB(); err != nil {
+		errHTTP(w, r, fmt.Errorf("couldn't push database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write([]byte(fmt.Sprintf("200 OK\nPushed database in %v\n", time.Since(start)))); err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log200(r)
+}
@@ -0,0 +1,281 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	"github.com/gorilla/mux"
+)
+
+// Sends an admin request through the router, so
+// the routes are checked along with the handlers.
+func adminRequest(t *testing.T, method, path string, params url.Values) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	setEndpointRouting(router.PathPrefix("/api").Subrouter())
+
+	if params != nil {
+		path += "?" + params.Encode()
+	}
+	req := httptest.NewRequest(method, "http://localhost"+testport+path, nil)
+	req.Header.Set("X-Auth", "correct horse")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// Reads the user at the URL back from the database.
+func storedUser(t *testing.T, urlKey string) *registry.User {
+	db := <-dbChan
+	users, _, err := db.LoadAll()
+	dbChan <- db
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	return users[urlKey]
+}
+
+func Test_adminUnauthorized(t *testing.T) {
+	initTestConf()
+	setTestAdminPass(t)
+
+	router := mux.NewRouter()
+	setEndpointRouting(router.PathPrefix("/api").Subrouter())
+
+	for _, e := range []string{
+		"GET /api/admin/users",
+		"POST /api/admin/users/nick",
+		"POST /api/admin/users/refresh",
+		"POST /api/admin/users/purge",
+		"POST /api/admin/push",
+	} {
+		parts := strings.Fields(e)
+		req := httptest.NewRequest(parts[0], "http://localhost"+testport+parts[1], nil)
+		req.Header.Set("X-Auth", "wrong")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%v: expected 401, got %v\n", e, w.Code)
+		}
+	}
+}
+
+func Test_handleUserList(t *testing.T) {
+	initTestConf()
+	setTestAdminPass(t)
+
+	twtxtCache = registry.New(nil)
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	first := "https://a.example.com/twtxt.txt"
+	second := "https://b.example.com/twtxt.txt"
+	twtxtCache.AddUser("bee", second, nil, registry.NewTimeMap())
+	twtxtCache.AddUser("ay", first, nil, registry.TimeMap{then: registry.NewStatus("ay", first, then, "hi")})
+	twtxtCache.Users[first].RecordFetch(nil, registry.ErrOptedOut)
+
+	t.Run("All", func(t *testing.T) {
+		w := adminRequest(t, "GET", "/api/admin/users", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %v\n", w.Code)
+		}
+		body := w.Body.String()
+		if !strings.HasPrefix(body, "url\t"+first+"\nnick\tay\n") || !strings.Contains(body, "\n\nurl\t"+second+"\n") {
+			t.Errorf("Users not listed in order:\n%v\n", body)
+		}
+		if !strings.Contains(body, "statuses\t1\n") || !strings.Contains(body, "fetch_error\t"+registry.ErrOptedOut.Error()+"\n") {
+			t.Errorf("User details missing:\n%v\n", body)
+		}
+	})
+
+	t.Run("One", func(t *testing.T) {
+		w := adminRequest(t, "GET", "/api/admin/users", url.Values{"url": {second}})
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), first) {
+			t.Errorf("Expected only %v, got %v:\n%v\n", second, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		w := adminRequest(t, "GET", "/api/admin/users", url.Values{"url": {"https://c.example.com/twtxt.txt"}})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %v\n", w.Code)
+		}
+	})
+}
+
+func Test_handleUserNick(t *testing.T) {
+	initTestConf()
+	initTestDB()
+	setTestAdminPass(t)
+
+	urlKey := "https://nick.example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	twtxtCache = registry.New(nil)
+	twtxtCache.AddUser("before", urlKey, nil, registry.TimeMap{then: registry.NewStatus("before", urlKey, then, "hi")})
+	defer delUser(urlKey)
+
+	cases := []struct {
+		name   string
+		url    string
+		nick   string
+		status int
+	}{
+		{name: "Renamed", url: urlKey, nick: "after", status: http.StatusOK},
+		{name: "Bad Nickname", url: urlKey, nick: "no spaces", status: http.StatusBadRequest},
+		{name: "Missing Nickname", url: urlKey, status: http.StatusBadRequest},
+		{name: "Unknown User", url: "https://nobody.example.com/twtxt.txt", nick: "after", status: http.StatusNotFound},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := adminRequest(t, "POST", "/api/admin/users/nick", url.Values{"url": {tt.url}, "nickname": {tt.nick}})
+			if w.Code != tt.status {
+				t.Errorf("Expected %v, got %v: %v\n", tt.status, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	user := storedUser(t, urlKey)
+	if user == nil || user.Nick != "after" || user.Status[then] == nil || user.Status[then].Nick != "after" {
+		t.Errorf("Nickname not stored: %v\n", user)
+	}
+}
+
+func Test_handleUserPurge(t *testing.T) {
+	initTestConf()
+	initTestDB()
+	setTestAdminPass(t)
+
+	urlKey := "https://purge.example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	twtxtCache = registry.New(nil)
+	twtxtCache.AddUser("purge", urlKey, nil, registry.TimeMap{
+		then:                registry.NewStatus("purge", urlKey, then, "one"),
+		then.Add(time.Hour): registry.NewStatus("purge", urlKey, then.Add(time.Hour), "two"),
+	})
+	errLog("", pushDB())
+	defer delUser(urlKey)
+
+	w := adminRequest(t, "POST", "/api/admin/users/purge", url.Values{"url": {urlKey}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Purged 2 statuses") {
+		t.Fatalf("Unexpected response %v: %v\n", w.Code, w.Body.String())
+	}
+	if user := storedUser(t, urlKey); user == nil || len(user.Status) != 0 {
+		t.Errorf("Expected the user stored without statuses: %v\n", user)
+	}
+
+	w = adminRequest(t, "POST", "/api/admin/users/purge", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a URL, got %v\n", w.Code)
+	}
+}
+
+func Test_handleUserRefresh(t *testing.T) {
+	initTestConf()
+	initTestDB()
+	setTestAdminPass(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("2019-09-01T00:00:00Z\thello\n"))
+	}))
+	defer srv.Close()
+	urlKey := srv.URL + "/twtxt.txt"
+
+	twtxtCache = registry.New(srv.Client())
+	twtxtCache.AddUser("refresh", urlKey, nil, registry.NewTimeMap())
+	twtxtCache.Users[urlKey].LastModified = "Sun, 01 Sep 2019 00:00:00 GMT"
+	defer delUser(urlKey)
+
+	t.Run("One", func(t *testing.T) {
+		w := adminRequest(t, "POST", "/api/admin/users/refresh", url.Values{"url": {urlKey}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %v: %v\n", w.Code, w.Body.String())
+		}
+		if user := storedUser(t, urlKey); user == nil || len(user.Status) != 1 {
+			t.Errorf("Refreshed status not stored: %v\n", user)
+		}
+	})
+
+	t.Run("During Refresh", func(t *testing.T) {
+		// a refresh cycle in progress doesn't hold it up
+		refreshMu.Lock()
+		defer refreshMu.Unlock()
+		if w := adminRequest(t, "POST", "/api/admin/users/refresh", url.Values{"url": {urlKey}}); w.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %v: %v\n", w.Code, w.Body.String())
+		}
+
+		// but a fetch of the same user does
+		fetching.start(urlKey)
+		defer fetching.done(urlKey)
+		if w := adminRequest(t, "POST", "/api/admin/users/refresh", url.Values{"url": {urlKey}}); w.Code != http.StatusConflict {
+			t.Errorf("Expected 409, got %v\n", w.Code)
+		}
+	})
+
+	t.Run("All", func(t *testing.T) {
+		twtxtCache.PurgeStatuses(urlKey)
+		errLog("", pushDB())
+		w := adminRequest(t, "POST", "/api/admin/users/refresh", nil)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Expected 202, got %v\n", w.Code)
+		}
+
+		// The refresh runs in the background, and
+		// is done once the result is stored.
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			if user := storedUser(t, urlKey); user != nil && len(user.Status) > 0 {
+				return
+			}
+		}
+		t.Errorf("Users not refreshed\n")
+	})
+}
+
+func Test_handlePush(t *testing.T) {
+	initTestConf()
+	initTestDB()
+	setTestAdminPass(t)
+
+	urlKey := "https://push.example.com/twtxt.txt"
+	twtxtCache = registry.New(nil)
+	twtxtCache.AddUser("push", urlKey, nil, registry.NewTimeMap())
+	defer delUser(urlKey)
+
+	w := adminRequest(t, "POST", "/api/admin/push", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v: %v\n", w.Code, w.Body.String())
+	}
+	if twtxtCache.Dirty() {
+		t.Errorf("Changes left unpushed\n")
+	}
+	if storedUser(t, urlKey) == nil {
+		t.Errorf("User not stored\n")
+	}
+}
@@ -0,0 +1,398 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	"git.sr.ht/~gbmor/getwtxt/registry/archive"
+	"github.com/spf13/pflag"
+)
+
+// Functions in this file export the registry to,
+// and import it from, the archives described in
+// registry/archive, both over the admin API and
+// from the command line, and write periodic backups.
+
+const ndjsonutf8 = "application/x-ndjson; charset=utf-8"
+
+// Backups are named after when they were written,
+// so they sort from oldest to newest.
+const backupPrefix = "getwtxt-"
+const backupSuffix = ".jsonl"
+const backupTimeFormat = "20060102T150405Z"
+
+// Returns an empty archive noting which
+// getwtxt and instance it came from.
+func newArchive() *archive.Archive {
+	arc := archive.New()
+	if Vers != "" {
+		arc.Meta["getwtxt"] = Vers
+	}
+	confObj.Mu.RLock()
+	if confObj.Instance.URL != "" {
+		arc.Meta["instance"] = confObj.Instance.URL
+	}
+	confObj.Mu.RUnlock()
+	return arc
+}
+
+// Copies the cache and the remote
+// registries into an archive.
+func exportCache() (*archive.Archive, error) {
+	arc := newArchive()
+	if err := twtxtCache.Export(arc); err != nil {
+		return nil, err
+	}
+	for _, e := range remoteRegistries.list() {
+		arc.PutRemoteRegistry(e)
+	}
+	return arc, nil
+}
+
+// Merges the archive into the cache, or replaces the
+// cache's users and aliases with it, then stores the
+// result. Remote registries are always merged.
+func importCache(arc *archive.Archive, replace bool) error {
+	if err := twtxtCache.Import(arc, replace); err != nil {
+		return err
+	}
+	remotes, err := arc.RemoteRegistries()
+	if err != nil {
+		return err
+	}
+	for _, e := range remotes {
+		if err := addRemoteRegistry(e); err != nil {
+			return fmt.Errorf("couldn't store remote registry %v: %v", e, err)
+		}
+	}
+	return pushDB()
+}
+
+// Serves the whole registry as an archive.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if err := checkAdmin(r); err != nil {
+		errHTTP(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	arc, err := exportCache()
+	if err != nil {
+		errHTTP(w, r, fmt.Errorf("error exporting registry: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ndjsonutf8)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", backupName(time.Now())))
+	if err := arc.Write(w); err != nil {
+		errLog("Error writing export: ", err)
+		return
+	}
+	log200(r)
+}
+
+// Reads an archive from the request body into the
+// registry. It's merged with the registry's users
+// unless ?mode=replace is passed.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if err := checkAdmin(r); err != nil {
+		errHTTP(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	var replace bool
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "merge":
+	case "replace":
+		replace = true
+	default:
+		errHTTP(w, r, fmt.Errorf("unknown import mode: %v", mode), http.StatusBadRequest)
+		return
+	}
+
+	arc, err := archive.Read(r.Body)
+	if err != nil {
+		errHTTP(w, r, fmt.Errorf("error reading archive: %v", err), http.StatusBadRequest)
+		return
+	}
+	users, aliases, err := arc.LoadAll()
+	if err != nil {
+		errHTTP(w, r, fmt.Errorf("error reading archive: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := importCache(arc, replace); err != nil {
+		errHTTP(w, r, fmt.Errorf("error importing archive: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", txtutf8)
+	fmt.Fprintf(w, "200 OK\nImported %v users and %v aliases\n", len(users), len(aliases))
+	log200(r)
+}
+
+// Export writes the registry held by a database to a file
+// as an archive. It's run as
+//
+//	getwtxt export --db leveldb:getwtxt.db --out backup.jsonl
+//
+// while getwtxt isn't running. Use /api/admin/export to
+// export from a running instance.
+func Export(args []string) {
+	flags := pflag.NewFlagSet("export", pflag.ExitOnError)
+	db := flags.String("db", "", "The database to export, as type:path.")
+	out := flags.String("out", "", "The file to write the archive to. Defaults to stdout.")
+	flags.Parse(args)
+
+	if *db == "" {
+		fmt.Fprintf(os.Stderr, "Usage: getwtxt export --db type:path [--out file]\n")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := exportDB(*db, w); err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Import reads an archive into the registry held by a
+// database. It's run as
+//
+//	getwtxt import --db leveldb:getwtxt.db --in backup.jsonl [--replace]
+//
+// while getwtxt isn't running. Use /api/admin/import to
+// import into a running instance.
+func Import(args []string) {
+	flags := pflag.NewFlagSet("import", pflag.ExitOnError)
+	db := flags.String("db", "", "The database to import into, as type:path.")
+	in := flags.String("in", "", "The archive to import. Defaults to stdin.")
+	replace := flags.Bool("replace", false, "Replace the database's users and aliases, rather than merging.")
+	flags.Parse(args)
+
+	if *db == "" {
+		fmt.Fprintf(os.Stderr, "Usage: getwtxt import --db type:path [--in file] [--replace]\n")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	r := io.Reader(os.Stdin)
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if err := importDB(*db, r, *replace); err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func exportDB(spec string, w io.Writer) error {
+	db, err := openDBSpec(spec)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	reg := registry.New(nil)
+	if err := reg.Load(db); err != nil {
+		return fmt.Errorf("couldn't read %v: %v", spec, err)
+	}
+	remotes, err := db.RemoteRegistries()
+	if err != nil {
+		return fmt.Errorf("couldn't read remote registries from %v: %v", spec, err)
+	}
+
+	arc := newArchive()
+	if err := reg.Export(arc); err != nil {
+		return err
+	}
+	for _, e := range remotes {
+		arc.PutRemoteRegistry(e)
+	}
+	return arc.Write(w)
+}
+
+func importDB(spec string, r io.Reader, replace bool) error {
+	arc, err := archive.Read(r)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDBSpec(spec)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	reg := registry.New(nil)
+	if err := reg.Load(db); err != nil {
+		return fmt.Errorf("couldn't read %v: %v", spec, err)
+	}
+	if err := reg.Import(arc, replace); err != nil {
+		return err
+	}
+	if err := reg.Save(db); err != nil {
+		return fmt.Errorf("couldn't write %v: %v", spec, err)
+	}
+
+	remotes, _ := arc.RemoteRegistries()
+	for _, e := range remotes {
+		if err := db.PutRemoteRegistry(e); err != nil {
+			return fmt.Errorf("couldn't write remote registry %v: %v", e, err)
+		}
+	}
+	return nil
+}
+
+func backupName(t time.Time) string {
+	return backupPrefix + t.UTC().Format(backupTimeFormat) + backupSuffix
+}
+
+// Lists the backups in the directory, oldest first.
+func listBackups(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix)
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Writes a backup if the configured interval has passed
+// since the newest one in the backup directory, then
+// removes the oldest beyond the number to keep. Called
+// after each database push.
+func backupIfDue(now time.Time) error {
+	confObj.Mu.RLock()
+	conf := confObj.Backups
+	confObj.Mu.RUnlock()
+
+	if conf.Interval <= 0 {
+		return nil
+	}
+
+	backups, err := listBackups(conf.Dir)
+	if err != nil {
+		return err
+	}
+	if len(backups) > 0 {
+		newest := backups[len(backups)-1]
+		stamp := strings.TrimSuffix(strings.TrimPrefix(newest, backupPrefix), backupSuffix)
+		last, _ := time.Parse(backupTimeFormat, stamp)
+		if now.Sub(last) < conf.Interval {
+			return nil
+		}
+	}
+
+	if err := writeBackup(conf.Dir, now); err != nil {
+		return err
+	}
+	return rotateBackups(conf.Dir, conf.Keep)
+}
+
+// Writes the cache to the backup directory as an archive.
+// It's written to a temporary file first, so a partial
+// backup is never mistaken for a complete one.
+func writeBackup(dir string, now time.Time) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	arc, err := exportCache()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := arc.Write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, backupName(now)))
+}
+
+// Removes all but the newest backups. A
+// keep of zero or less keeps them all.
+func rotateBackups(dir string, keep int) error {
+	if keep < 1 {
+		return nil
+	}
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
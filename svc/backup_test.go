@@ -0,0 +1,213 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	"git.sr.ht/~gbmor/getwtxt/registry/archive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Uses the lowest bcrypt cost, so the
+// tests don't spend long checking it.
+func setTestAdminPass(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	confObj.Mu.Lock()
+	confObj.AdminPassHash = string(hash)
+	confObj.Mu.Unlock()
+}
+
+func Test_handleExport_Import(t *testing.T) {
+	initTestConf()
+	initTestDB()
+	setTestAdminPass(t)
+
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	exported := "https://example.com/exported.txt"
+	twtxtCache = registry.New(nil)
+	twtxtCache.AddUser("foo", exported, nil, registry.TimeMap{then: registry.NewStatus("foo", exported, then, "hi")})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		for _, e := range []*http.Request{
+			httptest.NewRequest("GET", "/api/admin/export", nil),
+			httptest.NewRequest("POST", "/api/admin/import", strings.NewReader("")),
+		} {
+			e.Header.Set("X-Auth", "wrong")
+			w := httptest.NewRecorder()
+			if e.Method == "GET" {
+				handleExport(w, e)
+			} else {
+				handleImport(w, e)
+			}
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("%v %v: expected 401, got %v\n", e.Method, e.URL, w.Code)
+			}
+		}
+	})
+
+	var body []byte
+	t.Run("Export", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/admin/export", nil)
+		req.Header.Set("X-Auth", "correct horse")
+		w := httptest.NewRecorder()
+		handleExport(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %v: %v\n", w.Code, w.Body.String())
+		}
+		body = w.Body.Bytes()
+
+		arc, err := archive.Read(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if users, _, _ := arc.LoadAll(); len(users[exported].Status) != 1 {
+			t.Errorf("User missing from export: %v\n", users)
+		}
+	})
+
+	t.Run("Import Replace", func(t *testing.T) {
+		other := "https://example.com/other.txt"
+		twtxtCache.AddUser("bar", other, nil, registry.NewTimeMap())
+
+		req := httptest.NewRequest("POST", "/api/admin/import?mode=replace", bytes.NewReader(body))
+		req.Header.Set("X-Auth", "correct horse")
+		w := httptest.NewRecorder()
+		handleImport(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %v: %v\n", w.Code, w.Body.String())
+		}
+		if _, err := twtxtCache.Get(other); err == nil {
+			t.Errorf("User not in the archive was kept\n")
+		}
+		if _, err := twtxtCache.Get(exported); err != nil {
+			t.Errorf("Imported user missing: %v\n", err)
+		}
+	})
+
+	t.Run("Bad Requests", func(t *testing.T) {
+		for _, e := range []string{"/api/admin/import?mode=sideways", "/api/admin/import"} {
+			req := httptest.NewRequest("POST", e, strings.NewReader("not an archive"))
+			req.Header.Set("X-Auth", "correct horse")
+			w := httptest.NewRecorder()
+			handleImport(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%v: expected 400, got %v\n", e, w.Code)
+			}
+		}
+	})
+}
+
+func Test_exportImportDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	mockMigrationSource(t, filepath.Join(dir, "from.db"))
+
+	var buf bytes.Buffer
+	if err := exportDB("leveldb:"+filepath.Join(dir, "from.db"), &buf); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	to := "sqlite:" + filepath.Join(dir, "to.sqlite")
+	if err := importDB(to, &buf, false); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	db, err := openDBSpec(to)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer db.Close()
+	got, err := readContents(db)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(got.users) != 1 || got.statusCount() != 3 || len(got.aliases) != 1 || len(got.remotes) != 1 {
+		t.Errorf("Incomplete import: %v users, %v statuses, %v aliases, %v remotes\n",
+			len(got.users), got.statusCount(), len(got.aliases), len(got.remotes))
+	}
+}
+
+func Test_backupIfDue(t *testing.T) {
+	initTestConf()
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	confObj.Mu.Lock()
+	saved := confObj.Backups
+	confObj.Backups = Backups{Interval: time.Hour, Dir: filepath.Join(dir, "backups"), Keep: 2}
+	confObj.Mu.Unlock()
+	defer func() {
+		confObj.Mu.Lock()
+		confObj.Backups = saved
+		confObj.Mu.Unlock()
+	}()
+
+	start := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		after time.Duration
+		want  []string
+	}{
+		{0, []string{backupName(start)}},
+		{30 * time.Minute, []string{backupName(start)}},
+		{time.Hour, []string{backupName(start), backupName(start.Add(time.Hour))}},
+		{2 * time.Hour, []string{backupName(start.Add(time.Hour)), backupName(start.Add(2 * time.Hour))}},
+	}
+
+	for _, tt := range cases {
+		if err := backupIfDue(start.Add(tt.after)); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		got, err := listBackups(filepath.Join(dir, "backups"))
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("After %v, expected %v, got %v\n", tt.after, tt.want, got)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "backups", backupName(start.Add(2*time.Hour))))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer f.Close()
+	if _, err := archive.Read(f); err != nil {
+		t.Errorf("Backup isn't a readable archive: %v\n", err)
+	}
+}
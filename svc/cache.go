@@ -21,11 +21,17 @@ package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
 
 import (
 	"bytes"
+	"context"
 	"html/template"
 	"io/ioutil"
+	"log"
+	"math/rand"
 	"os"
+	"sort"
 	"sync"
 	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
 )
 
 // These functions and types pertain to the
@@ -39,9 +45,28 @@ import (
 // periodically scrape for new users. The remote registries
 // must have been added via POST like a user.
 type RemoteRegistries struct {
+	Mu   sync.RWMutex
 	List []string
 }
 
+// Adds the URLs to the list, skipping
+// any that are already on it.
+func (r *RemoteRegistries) add(urls ...string) {
+	r.Mu.Lock()
+	r.List = dedupe(append(r.List, urls...))
+	r.Mu.Unlock()
+}
+
+// Returns a copy of the list, so it can be
+// read without holding the lock.
+func (r *RemoteRegistries) list() []string {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+	out := make([]string, len(r.List))
+	copy(out, r.List)
+	return out
+}
+
 // staticAssets holda the rendered landing page
 // as a byte slice, its on-disk mod time, the
 // assets/style.css file as a byte slice, and
@@ -63,22 +88,193 @@ func initTemplates() *template.Template {
 	return template.Must(template.ParseFiles(confObj.AssetsDir + "/tmpl/index.html"))
 }
 
-func cacheUpdate() {
-	// This clusterfuck of mutex read locks is
-	// necessary to avoid deadlock. This mess
-	// also avoids a panic that would occur
-	// should twtxtCache be written to during
-	// this loop.
+// Held while refreshing users, so a refresh requested
+// through the admin API doesn't overlap a periodic one.
+var refreshMu sync.Mutex
+
+// The users whose twtxt files are being fetched right
+// now, so a refresh of a single user through the admin
+// API and a refresh cycle don't fetch one at once.
+var fetching = &fetchingUsers{users: make(map[string]bool)}
+
+type fetchingUsers struct {
+	mu    sync.Mutex
+	users map[string]bool
+}
+
+// Marks the user as being fetched. Returns
+// false if they already were.
+func (f *fetchingUsers) start(urlKey string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.users[urlKey] {
+		return false
+	}
+	f.users[urlKey] = true
+	return true
+}
+
+func (f *fetchingUsers) done(urlKey string) {
+	f.mu.Lock()
+	delete(f.users, urlKey)
+	f.mu.Unlock()
+}
+
+// Refreshes every user's statuses and the users of each
+// remote registry, then prunes statuses past their
+// retention. If force is set, twtxt files are fetched
+// whether or not they've been modified. Each user's file
+// is fetched at a random offset of up to jitter from the
+// start, so users on the same host aren't fetched back
+// to back. Users already being fetched are skipped.
+// Stops early, leaving the remaining users for
+// the next refresh, if ctx ends. Returns whether
+// the refresh finished.
+func cacheUpdate(ctx context.Context, force bool, jitter time.Duration) bool {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
 	twtxtCache.Mu.RLock()
+	users := make([]string, 0, len(twtxtCache.Users))
 	for k := range twtxtCache.Users {
-		twtxtCache.Mu.RUnlock()
-		errLog("", twtxtCache.UpdateUser(k))
-		twtxtCache.Mu.RLock()
+		users = append(users, k)
 	}
 	twtxtCache.Mu.RUnlock()
 
-	for _, v := range remoteRegistries.List {
-		errLog("Error refreshing local copy of remote registry data: ", twtxtCache.CrawlRemoteRegistry(v))
+	start := time.Now()
+	for _, f := range scheduleFetches(users, jitter) {
+		if !waitUntil(ctx, start.Add(f.offset)) {
+			log.Printf("Cache update stopped early: %v\n", ctx.Err())
+			return false
+		}
+
+		// they may have been removed while waiting
+		twtxtCache.Mu.RLock()
+		_, ok := twtxtCache.Users[f.urlKey]
+		twtxtCache.Mu.RUnlock()
+		if !ok || !fetching.start(f.urlKey) {
+			continue
+		}
+
+		var err error
+		if force {
+			err = twtxtCache.ForceUpdateUserContext(ctx, f.urlKey)
+		} else {
+			err = twtxtCache.UpdateUserContext(ctx, f.urlKey)
+		}
+		if ctx.Err() != nil {
+			fetching.done(f.urlKey)
+			log.Printf("Cache update stopped early: %v\n", ctx.Err())
+			return false
+		}
+		afterUpdate(f.urlKey, err)
+		fetching.done(f.urlKey)
+	}
+
+	for _, v := range remoteRegistries.list() {
+		err := twtxtCache.CrawlRemoteRegistryContext(ctx, v)
+		if ctx.Err() != nil {
+			log.Printf("Cache update stopped early: %v\n", ctx.Err())
+			return false
+		}
+		countFetch(err)
+		errLog("Error refreshing local copy of remote registry data: ", err)
+	}
+
+	// Users whose files haven't changed
+	// still have statuses that age out.
+	if n := twtxtCache.Prune(); n > 0 {
+		log.Printf("Pruned %v statuses past their retention\n", n)
+	}
+	return true
+}
+
+// A user's fetch within a refresh cycle, made
+// offset from the start of the cycle.
+type scheduledFetch struct {
+	urlKey string
+	offset time.Duration
+}
+
+// Gives each user a random offset of up to jitter,
+// returning them in the order they're to be fetched.
+func scheduleFetches(users []string, jitter time.Duration) []scheduledFetch {
+	fetches := make([]scheduledFetch, len(users))
+	for i, e := range users {
+		fetches[i].urlKey = e
+		if jitter > 0 {
+			fetches[i].offset = time.Duration(rand.Int63n(int64(jitter)))
+		}
+	}
+	sort.Slice(fetches, func(i, j int) bool {
+		return fetches[i].offset < fetches[j].offset
+	})
+	return fetches
+}
+
+// Sleeps until the given time. Returns false
+// if ctx ended first.
+func waitUntil(ctx context.Context, t time.Time) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	wait := time.Until(t)
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Acts on the outcome of refreshing a user: users who've
+// opted out, or whose hosts disallow fetching them, are
+// removed, and users whose files have moved are stored
+// under their new URL.
+func afterUpdate(urlKey string, err error) {
+	countFetch(err)
+	if err == registry.ErrOptedOut || err == registry.ErrDisallowed {
+		log.Printf("Removing %v: %v\n", urlKey, err)
+		errLog("Error removing user: ", delUser(urlKey))
+	}
+	if moved, ok := err.(*registry.MovedError); ok {
+		log.Printf("Moving %v to %v\n", moved.From, moved.To)
+		errLog("Error moving user: ", moveUserDB(moved.From))
+	}
+}
+
+// Records the outcome of a single fetch during
+// a refresh cycle. Feeds that have opted out or
+// are disallowed by robots.txt are "excluded".
+// Feeds that exceeded the fetch limits are
+// "truncated", and those that permanently
+// redirected are "moved", though in both
+// cases their statuses were still updated.
+func countFetch(err error) {
+	switch err.(type) {
+	case *registry.TruncatedError:
+		fetchOutcomes.inc("truncated")
+		return
+	case *registry.MovedError:
+		fetchOutcomes.inc("moved")
+		return
+	}
+
+	switch err {
+	case nil:
+		fetchOutcomes.inc("updated")
+	case registry.ErrNotModified:
+		fetchOutcomes.inc("not_modified")
+	case registry.ErrOptedOut, registry.ErrDisallowed:
+		fetchOutcomes.inc("excluded")
+	default:
+		fetchOutcomes.inc("error")
 	}
 }
 
@@ -21,11 +21,16 @@ package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
 
 import (
 	"bytes"
+	"context"
 	"html/template"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"git.sr.ht/~gbmor/getwtxt/registry"
 )
@@ -48,7 +53,7 @@ func Test_cacheUpdate(t *testing.T) {
 	mockRegistry()
 	killStatuses()
 
-	cacheUpdate()
+	cacheUpdate(context.Background(), false, 0)
 	urls := testTwtxtURL
 	newStatus := twtxtCache.Users[urls].Status
 
@@ -73,13 +78,186 @@ func Test_cacheUpdate(t *testing.T) {
 	})
 }
 
+func Test_cacheUpdate_Cancelled(t *testing.T) {
+	initTestConf()
+	mockRegistry()
+	killStatuses()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if cacheUpdate(ctx, false, 0) {
+		t.Errorf("Cancelled update reported that it finished\n")
+	}
+
+	if n := len(twtxtCache.Users[testTwtxtURL].Status); n != 0 {
+		t.Errorf("Cancelled update still pulled %v statuses\n", n)
+	}
+}
+
+// Statuses past their retention should be pruned
+// even when the user's file can't be fetched.
+func Test_cacheUpdate_Prune(t *testing.T) {
+	initTestConf()
+
+	urlKey := "http://127.0.0.1:1/twtxt.txt"
+	then := time.Now().Add(-2 * time.Hour)
+	twtxtCache = registry.New(nil)
+	twtxtCache.AddUser("foo", urlKey, nil, registry.TimeMap{then: registry.NewStatus("foo", urlKey, then, "hi")})
+	twtxtCache.Retention.Local.MaxAge = time.Hour
+
+	saved := remoteRegistries.list()
+	remoteRegistries.List = []string{}
+	defer func() { remoteRegistries.List = saved }()
+
+	if !cacheUpdate(context.Background(), false, 0) {
+		t.Errorf("Update didn't report that it finished\n")
+	}
+
+	if n := len(twtxtCache.Users[urlKey].Status); n != 0 {
+		t.Errorf("Expected statuses past retention pruned, %v left\n", n)
+	}
+}
+
+// Users being fetched through the admin API
+// should be left alone by the refresh cycle.
+func Test_cacheUpdate_Fetching(t *testing.T) {
+	initTestConf()
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("2019-09-01T00:00:00Z\thello\n"))
+	}))
+	defer srv.Close()
+	urlKey := srv.URL + "/twtxt.txt"
+
+	savedCache := twtxtCache
+	saved := remoteRegistries.list()
+	defer func() {
+		twtxtCache = savedCache
+		remoteRegistries.List = saved
+	}()
+	twtxtCache = registry.New(srv.Client())
+	twtxtCache.AddUser("foo", urlKey, nil, registry.NewTimeMap())
+	remoteRegistries.List = []string{}
+
+	fetching.start(urlKey)
+	cacheUpdate(context.Background(), true, 0)
+	fetching.done(urlKey)
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("User being fetched was fetched again %v times\n", n)
+	}
+
+	cacheUpdate(context.Background(), true, 0)
+	if n := atomic.LoadInt32(&hits); n == 0 {
+		t.Errorf("User not fetched once free\n")
+	}
+}
+
+func Test_scheduleFetches(t *testing.T) {
+	users := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	t.Run("Spread Within Jitter", func(t *testing.T) {
+		fetches := scheduleFetches(users, time.Minute)
+		if len(fetches) != len(users) {
+			t.Fatalf("Expected %v fetches, got %v\n", len(users), len(fetches))
+		}
+		seen := make(map[time.Duration]bool)
+		for i, e := range fetches {
+			if e.offset < 0 || e.offset >= time.Minute {
+				t.Errorf("Offset out of range: %v\n", e.offset)
+			}
+			if i > 0 && e.offset < fetches[i-1].offset {
+				t.Errorf("Fetches out of order: %v before %v\n", fetches[i-1].offset, e.offset)
+			}
+			seen[e.offset] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("Every fetch got the same offset\n")
+		}
+	})
+
+	t.Run("No Jitter", func(t *testing.T) {
+		for _, e := range scheduleFetches(users, 0) {
+			if e.offset != 0 {
+				t.Errorf("Expected no offset, got %v\n", e.offset)
+			}
+		}
+	})
+}
+
+func Test_RemoteRegistries(t *testing.T) {
+	r := &RemoteRegistries{}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			r.add("https://example.com/api/plain/tweets")
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		for range r.list() {
+		}
+	}
+	<-done
+
+	r.add("https://example.org/api/plain/tweets", "https://example.com/api/plain/tweets")
+	if list := r.list(); len(list) != 2 {
+		t.Errorf("Expected 2 deduplicated registries, got %v\n", list)
+	}
+}
+
+// The refresh ticker shouldn't fire
+// until the database is loaded.
+func Test_dataTimer_Loading(t *testing.T) {
+	initTestConf()
+	savedLoaded, savedHealth, savedCache := dbLoaded, health, twtxtCache
+	saved := remoteRegistries.list()
+	defer func() {
+		dbLoaded, health, twtxtCache = savedLoaded, savedHealth, savedCache
+		remoteRegistries.List = saved
+	}()
+	dbLoaded = make(chan struct{})
+	health = &healthState{}
+	twtxtCache = registry.New(nil)
+	remoteRegistries.List = []string{}
+
+	tkr := initTicker(false, 10*time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		dataTimer(tkr)
+		close(done)
+	}()
+	defer func() {
+		tkr.exit <- struct{}{}
+		<-done
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	health.mu.RLock()
+	refreshed := health.lastRefresh
+	health.mu.RUnlock()
+	if !refreshed.IsZero() {
+		t.Errorf("Refreshed before the database was loaded\n")
+	}
+
+	close(dbLoaded)
+	time.Sleep(100 * time.Millisecond)
+	health.mu.RLock()
+	refreshed = health.lastRefresh
+	health.mu.RUnlock()
+	if refreshed.IsZero() {
+		t.Errorf("Didn't refresh once the database was loaded\n")
+	}
+}
+
 func Benchmark_cacheUpdate(b *testing.B) {
 	initTestConf()
 	mockRegistry()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		cacheUpdate()
+		cacheUpdate(context.Background(), false, 0)
 
 		// make sure it's pulling new statuses
 		// half the time so we get a good idea
@@ -28,6 +28,7 @@ import (
 	"sync"
 	"time"
 
+	"git.sr.ht/~gbmor/getwtxt/registry"
 	"github.com/spf13/viper"
 )
 
@@ -48,9 +49,52 @@ type Configuration struct {
 	StdoutLogging bool          `yaml:"StdoutLogging"`
 	CacheInterval time.Duration `yaml:"StatusFetchInterval"`
 	DBInterval    time.Duration `yaml:"DatabasePushInterval"`
+	FetchLimits   `yaml:"FetchLimits"`
+	Feeds         `yaml:"Feeds"`
+	Backups       `yaml:"Backups"`
+	Retention     `yaml:"Retention"`
 	Instance      `yaml:"Instance"`
 }
 
+// FetchLimits controls how quickly getwtxt
+// will request users' twtxt files, and how
+// much of each it will read
+type FetchLimits struct {
+	HostRate      float64       `yaml:"FetchLimits.PerHostRate"`
+	HostBurst     int           `yaml:"FetchLimits.PerHostBurst"`
+	GlobalRate    float64       `yaml:"FetchLimits.GlobalRate"`
+	Jitter        time.Duration `yaml:"FetchLimits.Jitter"`
+	MaxBodySize   int64         `yaml:"FetchLimits.MaxBodySize"`
+	MaxStatuses   int           `yaml:"FetchLimits.MaxStatuses"`
+	MaxLineLength int           `yaml:"FetchLimits.MaxLineLength"`
+}
+
+// Feeds controls which responses are accepted
+// as twtxt files, how they're decoded, and
+// whether they replace the statuses cached
+type Feeds struct {
+	AcceptTypes    []string `yaml:"Feeds.AcceptContentTypes"`
+	DefaultCharset string   `yaml:"Feeds.DefaultCharset"`
+	Sync           bool     `yaml:"Feeds.Sync"`
+}
+
+// Backups controls the archives of the
+// registry getwtxt writes periodically
+type Backups struct {
+	Interval time.Duration `yaml:"Backups.Interval"`
+	Dir      string        `yaml:"Backups.Directory"`
+	Keep     int           `yaml:"Backups.Keep"`
+}
+
+// Retention controls how many statuses are
+// kept for each user, and for how long
+type Retention struct {
+	MaxAge            time.Duration `yaml:"Retention.MaxAge"`
+	MaxStatuses       int           `yaml:"Retention.MaxStatuses"`
+	RemoteMaxAge      time.Duration `yaml:"Retention.RemoteMaxAge"`
+	RemoteMaxStatuses int           `yaml:"Retention.RemoteMaxStatuses"`
+}
+
 // Instance refers to meta data about
 // this specific instance of getwtxt
 type Instance struct {
@@ -130,6 +174,24 @@ func setConfigDefaults() {
 	viper.SetDefault("DatabasePushInterval", "5m")
 	viper.SetDefault("AdminPassword", "please_change_me")
 
+	viper.SetDefault("FetchLimits.PerHostRate", 1)
+	viper.SetDefault("FetchLimits.PerHostBurst", 2)
+	viper.SetDefault("FetchLimits.GlobalRate", 10)
+	viper.SetDefault("FetchLimits.Jitter", "30s")
+	viper.SetDefault("FetchLimits.MaxBodySize", registry.DefaultMaxBodySize)
+	viper.SetDefault("FetchLimits.MaxStatuses", registry.DefaultMaxStatuses)
+	viper.SetDefault("FetchLimits.MaxLineLength", registry.DefaultMaxLineLength)
+	viper.SetDefault("Feeds.AcceptContentTypes", registry.DefaultAcceptTypes)
+	viper.SetDefault("Feeds.DefaultCharset", "utf-8")
+	viper.SetDefault("Feeds.Sync", false)
+	viper.SetDefault("Retention.MaxAge", 0)
+	viper.SetDefault("Retention.MaxStatuses", 0)
+	viper.SetDefault("Retention.RemoteMaxAge", 0)
+	viper.SetDefault("Retention.RemoteMaxStatuses", 0)
+	viper.SetDefault("Backups.Interval", 0)
+	viper.SetDefault("Backups.Directory", "/usr/local/getwtxt/backups")
+	viper.SetDefault("Backups.Keep", 7)
+
 	viper.SetDefault("Instance.SiteName", "getwtxt")
 	viper.SetDefault("Instance.OwnerName", "Anonymous Microblogger")
 	viper.SetDefault("Instance.Email", "nobody@knows")
@@ -187,6 +249,51 @@ func bindConfig() {
 	}
 	confObj.AdminPassHash = passHash
 
+	confObj.FetchLimits.HostRate = viper.GetFloat64("FetchLimits.PerHostRate")
+	confObj.FetchLimits.HostBurst = viper.GetInt("FetchLimits.PerHostBurst")
+	confObj.FetchLimits.GlobalRate = viper.GetFloat64("FetchLimits.GlobalRate")
+	confObj.FetchLimits.Jitter = viper.GetDuration("FetchLimits.Jitter")
+	confObj.FetchLimits.MaxBodySize = viper.GetInt64("FetchLimits.MaxBodySize")
+	confObj.FetchLimits.MaxStatuses = viper.GetInt("FetchLimits.MaxStatuses")
+	confObj.FetchLimits.MaxLineLength = viper.GetInt("FetchLimits.MaxLineLength")
+	fetchLimiter.SetLimits(confObj.FetchLimits.HostRate, confObj.FetchLimits.HostBurst, confObj.FetchLimits.GlobalRate)
+
+	confObj.Feeds.AcceptTypes = viper.GetStringSlice("Feeds.AcceptContentTypes")
+	confObj.Feeds.DefaultCharset = viper.GetString("Feeds.DefaultCharset")
+	confObj.Feeds.Sync = viper.GetBool("Feeds.Sync")
+
+	confObj.Retention.MaxAge = viper.GetDuration("Retention.MaxAge")
+	confObj.Retention.MaxStatuses = viper.GetInt("Retention.MaxStatuses")
+	confObj.Retention.RemoteMaxAge = viper.GetDuration("Retention.RemoteMaxAge")
+	confObj.Retention.RemoteMaxStatuses = viper.GetInt("Retention.RemoteMaxStatuses")
+
+	confObj.Backups.Interval = viper.GetDuration("Backups.Interval")
+	confObj.Backups.Dir = viper.GetString("Backups.Directory")
+	confObj.Backups.Keep = viper.GetInt("Backups.Keep")
+
+	twtxtCache.Mu.Lock()
+	twtxtCache.Limits = registry.Limits{
+		MaxBodySize:   confObj.FetchLimits.MaxBodySize,
+		MaxStatuses:   confObj.FetchLimits.MaxStatuses,
+		MaxLineLength: confObj.FetchLimits.MaxLineLength,
+	}
+	twtxtCache.Content = registry.ContentRules{
+		AcceptTypes:    confObj.Feeds.AcceptTypes,
+		DefaultCharset: confObj.Feeds.DefaultCharset,
+	}
+	twtxtCache.Sync = confObj.Feeds.Sync
+	twtxtCache.Retention = registry.Retention{
+		Local: registry.RetentionPolicy{
+			MaxAge:      confObj.Retention.MaxAge,
+			MaxStatuses: confObj.Retention.MaxStatuses,
+		},
+		Remote: registry.RetentionPolicy{
+			MaxAge:      confObj.Retention.RemoteMaxAge,
+			MaxStatuses: confObj.Retention.RemoteMaxStatuses,
+		},
+	}
+	twtxtCache.Mu.Unlock()
+
 	confObj.Instance.Vers = Vers
 	confObj.Instance.Name = viper.GetString("Instance.SiteName")
 	confObj.Instance.URL = viper.GetString("Instance.URL")
@@ -223,5 +330,18 @@ func announceConfig() {
 	log.Printf("Using %v database: %v\n", confObj.DBType, confObj.DBPath)
 	log.Printf("Database push interval: %v\n", confObj.DBInterval)
 	log.Printf("User status fetch interval: %v\n", confObj.CacheInterval)
+	log.Printf("Fetch limits: %v/s per host (burst %v), %v/s total, up to %v jitter\n",
+		confObj.FetchLimits.HostRate, confObj.FetchLimits.HostBurst, confObj.FetchLimits.GlobalRate, confObj.FetchLimits.Jitter)
+	log.Printf("Twtxt file limits: %v bytes, %v statuses, %v bytes per line\n",
+		confObj.FetchLimits.MaxBodySize, confObj.FetchLimits.MaxStatuses, confObj.FetchLimits.MaxLineLength)
+	log.Printf("Accepting twtxt files served as: %v (default charset %v)\n",
+		strings.Join(confObj.Feeds.AcceptTypes, ", "), confObj.Feeds.DefaultCharset)
+	if confObj.Retention != (Retention{}) {
+		log.Printf("Status retention: up to %v old and %v per user, or %v and %v for users from remote registries\n",
+			confObj.Retention.MaxAge, confObj.Retention.MaxStatuses, confObj.Retention.RemoteMaxAge, confObj.Retention.RemoteMaxStatuses)
+	}
+	if confObj.Backups.Interval > 0 {
+		log.Printf("Backing up every %v to %v, keeping %v\n", confObj.Backups.Interval, confObj.Backups.Dir, confObj.Backups.Keep)
+	}
 	log.Printf("Static files directory: %v", confObj.StaticDir)
 }
@@ -20,72 +20,133 @@ along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
 package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
 
 import (
+	"fmt"
 	"log"
 	"time"
 
-	"github.com/syndtr/goleveldb/leveldb"
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	"git.sr.ht/~gbmor/getwtxt/registry/bolt"
+	"git.sr.ht/~gbmor/getwtxt/registry/leveldb"
+	"git.sr.ht/~gbmor/getwtxt/registry/sqlite"
 	"golang.org/x/sys/unix"
 )
 
 // Everything in this file is database-agnostic.
-// Functions and types related to specific kinds
-// of databases will be in their own respective
-// files, such as:
-//  - leveldb.go
-//  - sqlite.go
-
-// Abstraction to allow several different
-// databases to be used interchangeably.
-type dbase interface {
-	push() error
-	pull()
-	delUser(string) error
-}
+// The databases themselves are implemented as
+// registry.Storage in the registry/leveldb,
+// registry/sqlite and registry/bolt packages.
 
 // Opens a new connection to the specified
-// database, then reads it into memory.
+// database, then begins reading it into memory.
 func initDatabase() {
-	var db dbase
 	confObj.Mu.RLock()
 	dbpath := confObj.DBPath
+	dbtype := confObj.DBType
 	confObj.Mu.RUnlock()
 
-	switch confObj.DBType {
+	db, err := openDB(dbtype, dbpath)
+	errFatal("", err)
+
+	dbChan <- db
+
+	// Reading a large database into memory can take
+	// a while, so it's done in the background. Until
+	// it finishes, /readyz will report as much, and
+	// the cache isn't refreshed.
+	go func() {
+		pullDB()
+		health.setLoaded()
+		close(dbLoaded)
+	}()
+}
+
+// Opens the database of the given type at the path.
+func openDB(dbtype, dbpath string) (registry.Storage, error) {
+	var db registry.Storage
+	var err error
+
+	switch dbtype {
 
 	case "leveldb":
-		lvl, err := leveldb.OpenFile(dbpath, nil)
-		errFatal("", err)
-		db = &dbLevel{db: lvl}
+		db, err = leveldb.Open(dbpath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening LevelDB: %v", err)
+		}
 
 	case "sqlite":
-		db = initSqlite()
+		db, err = sqlite.Open(dbpath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening sqlite3 DB: %v", err)
+		}
+
+	case "bolt":
+		db, err = bolt.Open(dbpath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening bolt DB: %v", err)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown database type: %v", dbtype)
 
 	}
 
-	dbChan <- db
-	pullDB()
+	return db, nil
+}
+
+// Opens an existing database without writing to it, for
+// reading from when it mustn't be changed. Databases made
+// by earlier versions are refused rather than upgraded.
+func openDBReadOnly(dbtype, dbpath string) (registry.Storage, error) {
+	switch dbtype {
+	case "leveldb":
+		db, err := leveldb.OpenReadOnly(dbpath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening LevelDB: %v", err)
+		}
+		return db, nil
+	case "sqlite":
+		db, err := sqlite.OpenReadOnly(dbpath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening sqlite3 DB: %v", err)
+		}
+		return db, nil
+	case "bolt":
+		db, err := bolt.OpenReadOnly(dbpath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening bolt DB: %v", err)
+		}
+		return db, nil
+	}
+	return nil, fmt.Errorf("unknown database type: %v", dbtype)
 }
 
 // Close the database connection.
 func killDB() {
 	db := <-dbChan
-	switch dbType := db.(type) {
-	case *dbLevel:
-		errLog("", dbType.db.Close())
-	case *dbSqlite:
-		errLog("", dbType.db.Close())
-	}
+	errLog("", db.Close())
 }
 
-// Pushes the registry's cache data
-// to a local database for safe keeping.
+// Pushes the changes made to the registry's cache
+// since the last push to a local database for safe
+// keeping. Called periodically, and right away
+// when users are added, moved or removed.
 func pushDB() error {
+	start := time.Now()
 	db := <-dbChan
-	err := db.push()
+	dirty := twtxtCache.Dirty()
+	err := twtxtCache.Save(db)
 	dbChan <- db
 
-	unix.Sync()
+	// nothing written, so nothing to flush
+	if dirty {
+		unix.Sync()
+	}
 
+	dbDuration.since(start, "push")
+	health.setPushed(err)
+	if err != nil {
+		dbErrors.inc("push")
+	}
 	return err
 }
 
@@ -93,17 +154,65 @@ func pushDB() error {
 func pullDB() {
 	start := time.Now()
 	db := <-dbChan
-	db.pull()
+	errLog("Error while pulling DB into registry cache: ", twtxtCache.Load(db))
+	remotes, err := db.RemoteRegistries()
+	errLog("Error while pulling remote registries from DB: ", err)
+	logQuarantined(db)
 	dbChan <- db
+
+	remoteRegistries.add(remotes...)
+	dbDuration.since(start, "pull")
 	log.Printf("Database pull took: %v\n", time.Since(start))
 }
 
+// Implemented by databases that set aside
+// records they can't read when loading.
+type quarantiner interface {
+	Quarantined() (map[string][]byte, error)
+}
+
+// Reports how many records the database has set
+// aside, so they aren't lost without notice.
+func logQuarantined(db registry.Storage) {
+	q, ok := db.(quarantiner)
+	if !ok {
+		return
+	}
+	bad, err := q.Quarantined()
+	errLog("Error while listing quarantined records: ", err)
+	if len(bad) > 0 {
+		log.Printf("%v unreadable records in the database have been quarantined\n", len(bad))
+	}
+}
+
+// Removes a user's records from the database after
+// the cache has moved them to a new URL, so they're
+// stored under the new URL along with the alias
+// for the old one.
+func moveUserDB(from string) error {
+	if err := pushDB(); err != nil {
+		return fmt.Errorf("couldn't store move of %v: %v", from, err)
+	}
+	return nil
+}
+
 func delUser(userURL string) error {
 	db := <-dbChan
-	err := db.delUser(userURL)
+	err := db.DelUser(userURL)
 	dbChan <- db
 	if err != nil {
 		return err
 	}
 	return twtxtCache.DelUser(userURL)
 }
+
+// Adds a remote registry to be crawled, storing
+// it in the database right away.
+func addRemoteRegistry(urlKey string) error {
+	remoteRegistries.add(urlKey)
+
+	db := <-dbChan
+	err := db.PutRemoteRegistry(urlKey)
+	dbChan <- db
+	return err
+}
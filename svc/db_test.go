@@ -22,6 +22,7 @@ package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
 import (
 	"net"
 	"testing"
+	"time"
 
 	"git.sr.ht/~gbmor/getwtxt/registry"
 )
@@ -105,3 +106,40 @@ func Benchmark_pullDatabase(b *testing.B) {
 		pullDB()
 	}
 }
+
+func Test_moveUserDB(t *testing.T) {
+	initTestConf()
+	initTestDB()
+
+	oldURL := "https://old.example.com/twtxt.txt"
+	newURL := "https://new.example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	twtxtCache.AddUser("mover", oldURL, nil, registry.TimeMap{
+		then: registry.NewStatus("mover", oldURL, then, "hi"),
+	})
+	if err := pushDB(); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	if err := twtxtCache.MoveUser(oldURL, newURL); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := moveUserDB(oldURL); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	// Pull into an empty cache to see
+	// what the database holds.
+	twtxtCache = registry.New(nil)
+	pullDB()
+
+	if _, err := twtxtCache.Get(oldURL); err == nil {
+		t.Errorf("User still stored under old URL\n")
+	}
+	if _, err := twtxtCache.Get(newURL); err != nil {
+		t.Errorf("User not stored under new URL: %v\n", err)
+	}
+	if got := twtxtCache.Resolve(oldURL); got != newURL {
+		t.Errorf("Alias not stored, old URL resolves to %v\n", got)
+	}
+}
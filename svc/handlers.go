@@ -106,12 +106,12 @@ func apiFormatHandler(w http.ResponseWriter, r *http.Request) {
 
 // Serves all tweets without pagination.
 func apiAllTweetsHandler(w http.ResponseWriter, r *http.Request) {
-	out, err := twtxtCache.QueryAllStatuses()
+	out, err := twtxtCache.QueryAllStatusesContext(r.Context())
 	if err != nil {
 		errHTTP(w, r, err, http.StatusInternalServerError)
 	}
 
-	data := parseQueryOut(out)
+	data := parseQueryOut(registry.FormatStatuses(out))
 	etag := getEtag(data)
 
 	w.Header().Set("ETag", etag)
@@ -158,12 +158,14 @@ func apiEndpointHandler(w http.ResponseWriter, r *http.Request) {
 		out = registry.ReduceToPage(page, out)
 
 	case "/api/plain/mentions":
-		out, err = twtxtCache.QueryInStatus("@<")
-		out = registry.ReduceToPage(page, out)
+		var statuses []*registry.Status
+		statuses, err = twtxtCache.QueryStatusesContext(r.Context(), nil, registry.StatusQuery{Substring: "@<", Limit: pageLimit(page)})
+		out = registry.FormatStatuses(registry.ReduceStatusesToPage(page, statuses))
 
 	case "/api/plain/tweets":
-		out, err = twtxtCache.QueryAllStatuses()
-		out = registry.ReduceToPage(page, out)
+		var statuses []*registry.Status
+		statuses, err = twtxtCache.QueryStatusesContext(r.Context(), nil, registry.StatusQuery{Limit: pageLimit(page)})
+		out = registry.FormatStatuses(registry.ReduceStatusesToPage(page, statuses))
 
 	case "/api/plain/version":
 		etag := getEtag([]byte(Vers))
@@ -204,13 +206,13 @@ func apiEndpointPOSTHandler(w http.ResponseWriter, r *http.Request) {
 
 // handles "/api/plain/tags"
 func apiTagsBaseHandler(w http.ResponseWriter, r *http.Request) {
-	out, err := twtxtCache.QueryInStatus("#")
+	statuses, err := twtxtCache.QueryStatusesContext(r.Context(), nil, registry.StatusQuery{Substring: "#", Limit: pageLimit(1)})
 	if err != nil {
 		errHTTP(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
-	out = registry.ReduceToPage(1, out)
+	out := registry.FormatStatuses(registry.ReduceStatusesToPage(1, statuses))
 	data := parseQueryOut(out)
 	etag := getEtag(data)
 
@@ -230,7 +232,7 @@ func apiTagsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	tags := vars["tags"]
 
-	out := compositeStatusQuery("#"+tags, r)
+	out := compositeStatusQuery("#"+tags, pageLimit(1), r)
 	out = registry.ReduceToPage(1, out)
 	data := parseQueryOut(out)
 	etag := getEtag(data)
@@ -246,18 +248,94 @@ func apiTagsHandler(w http.ResponseWriter, r *http.Request) {
 	log200(r)
 }
 
-func handleUserDelete(w http.ResponseWriter, r *http.Request) {
+// handles "/api/plain/users/stats"
+func apiUserStatsHandler(w http.ResponseWriter, r *http.Request) {
+	errLog("Error when parsing query values: ", r.ParseForm())
+
+	userURL := strings.TrimSpace(r.FormValue("url"))
+	if userURL == "" {
+		errHTTP(w, r, fmt.Errorf("missing URL in stats query"), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := twtxtCache.UserStats(userURL)
+	if err != nil {
+		errHTTP(w, r, err, http.StatusNotFound)
+		return
+	}
+
+	data := parseUserStats(stats)
+	etag := getEtag(data)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", txtutf8)
+
+	_, err = w.Write(data)
+	if err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log200(r)
+}
+
+// Serves a single status, identified by its author's
+// URL and timestamp, with the text it had before each
+// edit and when the edit was seen.
+func apiStatusDetailHandler(w http.ResponseWriter, r *http.Request) {
+	errLog("Error when parsing query values: ", r.ParseForm())
+
+	userURL := strings.TrimSpace(r.FormValue("url"))
+	stamp := strings.TrimSpace(r.FormValue("time"))
+	if userURL == "" || stamp == "" {
+		errHTTP(w, r, fmt.Errorf("missing URL or time in status query"), http.StatusBadRequest)
+		return
+	}
+	posted, err := time.Parse(time.RFC3339Nano, stamp)
+	if err != nil {
+		errHTTP(w, r, fmt.Errorf("invalid time in status query: %v", stamp), http.StatusBadRequest)
+		return
+	}
+
+	status, err := twtxtCache.GetStatus(userURL, posted)
+	if err != nil {
+		errHTTP(w, r, err, http.StatusNotFound)
+		return
+	}
+
+	data := parseStatusDetail(status)
+	etag := getEtag(data)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", txtutf8)
+
+	_, err = w.Write(data)
+	if err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log200(r)
+}
+
+// Checks the administrator password
+// passed in the X-Auth header.
+func checkAdmin(r *http.Request) error {
 	pass := r.Header.Get("X-Auth")
 	if pass == "" {
-		errHTTP(w, r, errors.New("unauthorized"), http.StatusUnauthorized)
-		return
+		return errors.New("unauthorized")
 	}
 	confObj.Mu.RLock()
 	adminHash := []byte(confObj.AdminPassHash)
 	confObj.Mu.RUnlock()
 
 	if err := bcrypt.CompareHashAndPassword(adminHash, []byte(pass)); err != nil {
-		errHTTP(w, r, errors.New("unauthorized"), http.StatusUnauthorized)
+		return errors.New("unauthorized")
+	}
+	return nil
+}
+
+func handleUserDelete(w http.ResponseWriter, r *http.Request) {
+	if err := checkAdmin(r); err != nil {
+		errHTTP(w, r, err, http.StatusUnauthorized)
 		return
 	}
 
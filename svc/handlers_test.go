@@ -26,7 +26,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	"github.com/gorilla/mux"
 )
 
 // The first few are testing whether the landing page is
@@ -258,3 +263,136 @@ func Test_cssHandler(t *testing.T) {
 		}
 	})
 }
+
+func Test_apiUserStatsHandler(t *testing.T) {
+	initTestConf()
+	twtxtCache = registry.New(nil)
+	now := time.Now().UTC().Truncate(time.Second)
+	statuses := registry.TimeMap{
+		now: registry.NewStatus("stats", "https://stats.example.com/twtxt.txt", now, "Hello #getwtxt"),
+	}
+	if err := twtxtCache.AddUser("stats", "https://stats.example.com/twtxt.txt", nil, statuses); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	cases := []struct {
+		name   string
+		url    string
+		status int
+	}{
+		{
+			name:   "Known User",
+			url:    "https://stats.example.com/twtxt.txt",
+			status: http.StatusOK,
+		},
+		{
+			name:   "Unknown User",
+			url:    "https://doesnt.exist/twtxt.txt",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "Missing URL",
+			url:    "",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	// go through the router to make sure
+	// the route is registered
+	router := mux.NewRouter()
+	setEndpointRouting(router.PathPrefix("/api").Subrouter())
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://localhost"+testport+"/api/plain/users/stats?url="+tt.url, nil)
+
+			router.ServeHTTP(w, req)
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf(fmt.Sprintf("%v", resp.StatusCode))
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("%v\n", err)
+			}
+			if !strings.Contains(string(data), "twts\t1\n") || !strings.Contains(string(data), "tag\t#getwtxt\t1\n") {
+				t.Errorf("Incorrect stats: %s\n", data)
+			}
+		})
+	}
+}
+
+func Test_apiStatusDetailHandler(t *testing.T) {
+	initTestConf()
+	twtxtCache = registry.New(nil)
+	urlKey := "https://detail.example.com/twtxt.txt"
+	posted := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	status := registry.NewStatus("detail", urlKey, posted, "hello")
+	status.Edits = []registry.Edit{{Text: "helo", Seen: posted.Add(time.Hour)}}
+	if err := twtxtCache.AddUser("detail", urlKey, nil, registry.TimeMap{posted: status}); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+
+	cases := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{
+			name:   "Known Status",
+			query:  "?url=" + urlKey + "&time=2019-09-01T00:00:00Z",
+			status: http.StatusOK,
+		},
+		{
+			name:   "Unknown Status",
+			query:  "?url=" + urlKey + "&time=2019-09-02T00:00:00Z",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "Bad Time",
+			query:  "?url=" + urlKey + "&time=yesterday",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "Missing Time",
+			query:  "?url=" + urlKey,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	router := mux.NewRouter()
+	setEndpointRouting(router.PathPrefix("/api").Subrouter())
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://localhost"+testport+"/api/plain/tweets/detail"+tt.query, nil)
+
+			router.ServeHTTP(w, req)
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected %v, got %v\n", tt.status, resp.StatusCode)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("%v\n", err)
+			}
+			if !strings.Contains(string(data), "text\thello\n") || !strings.Contains(string(data), "edit\t2019-09-01T01:00:00Z\thelo\n") {
+				t.Errorf("Incorrect detail: %s\n", data)
+			}
+		})
+	}
+}
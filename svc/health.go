@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracks the state of the database, the
+// in-memory cache, and the fetcher, for
+// reporting via /readyz
+type healthState struct {
+	mu          sync.RWMutex
+	loaded      bool
+	loadedAt    time.Time
+	lastRefresh time.Time
+	pushErr     error
+}
+
+var health = &healthState{}
+
+// Called once the database has been read
+// into the in-memory cache.
+func (h *healthState) setLoaded() {
+	h.mu.Lock()
+	h.loaded = true
+	h.loadedAt = time.Now()
+	h.mu.Unlock()
+}
+
+// Called after each refresh cycle completes.
+func (h *healthState) setRefreshed(t time.Time) {
+	h.mu.Lock()
+	h.lastRefresh = t
+	h.mu.Unlock()
+}
+
+// Called after each database push with
+// its result.
+func (h *healthState) setPushed(err error) {
+	h.mu.Lock()
+	h.pushErr = err
+	h.mu.Unlock()
+}
+
+// Reports whether the cache has been loaded, and
+// any reasons the instance should be considered
+// degraded. A refresh cycle is considered overdue
+// if none has completed within twice the fetch
+// interval, counting from when loading finished.
+func (h *healthState) check(interval time.Duration) (bool, []string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if !h.loaded {
+		return false, nil
+	}
+
+	var problems []string
+	if h.pushErr != nil {
+		problems = append(problems, fmt.Sprintf("last database push failed: %v", h.pushErr))
+	}
+
+	last := h.lastRefresh
+	if last.IsZero() {
+		last = h.loadedAt
+	}
+	if interval > 0 && time.Since(last) > 2*interval {
+		problems = append(problems, fmt.Sprintf("no refresh cycle completed since %v", last.Format(time.RFC3339)))
+	}
+
+	return true, problems
+}
+
+// handles "/healthz"
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", txtutf8)
+	if _, err := w.Write([]byte("ok\n")); err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log200(r)
+}
+
+// handles "/readyz"
+// Responds with 503 until the database has been
+// loaded. Once loaded, a degraded instance still
+// responds with 200, listing what's wrong.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	confObj.Mu.RLock()
+	interval := confObj.CacheInterval
+	confObj.Mu.RUnlock()
+
+	ready, problems := health.check(interval)
+	w.Header().Set("Content-Type", txtutf8)
+
+	if !ready {
+		errHTTP(w, r, fmt.Errorf("loading database"), http.StatusServiceUnavailable)
+		return
+	}
+
+	body := "ok\n"
+	if len(problems) > 0 {
+		body = "degraded\n" + strings.Join(problems, "\n") + "\n"
+	}
+
+	if _, err := w.Write([]byte(body)); err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log200(r)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_healthState(t *testing.T) {
+	h := &healthState{}
+
+	t.Run("Loading", func(t *testing.T) {
+		if ready, _ := h.check(time.Hour); ready {
+			t.Errorf("Reported ready before loading\n")
+		}
+	})
+
+	h.setLoaded()
+	t.Run("Loaded", func(t *testing.T) {
+		ready, problems := h.check(time.Hour)
+		if !ready || len(problems) != 0 {
+			t.Errorf("Expected healthy, got: %v %v\n", ready, problems)
+		}
+	})
+
+	t.Run("Failed Push", func(t *testing.T) {
+		h.setPushed(fmt.Errorf("disk full"))
+		ready, problems := h.check(time.Hour)
+		if !ready || len(problems) != 1 || !strings.Contains(problems[0], "disk full") {
+			t.Errorf("Expected push failure, got: %v %v\n", ready, problems)
+		}
+		h.setPushed(nil)
+	})
+
+	t.Run("Overdue Refresh", func(t *testing.T) {
+		h.setRefreshed(time.Now().Add(-3 * time.Hour))
+		_, problems := h.check(time.Hour)
+		if len(problems) != 1 || !strings.Contains(problems[0], "refresh") {
+			t.Errorf("Expected overdue refresh, got: %v\n", problems)
+		}
+		h.setRefreshed(time.Now())
+		if _, problems = h.check(time.Hour); len(problems) != 0 {
+			t.Errorf("Expected healthy after refresh, got: %v\n", problems)
+		}
+	})
+}
+
+func Test_readyzHandler(t *testing.T) {
+	initTestConf()
+	saved := health
+	defer func() { health = saved }()
+
+	cases := []struct {
+		name   string
+		setup  func()
+		status int
+		body   string
+	}{
+		{
+			name:   "Loading",
+			setup:  func() { health = &healthState{} },
+			status: http.StatusServiceUnavailable,
+			body:   "loading",
+		},
+		{
+			name:   "Ready",
+			setup:  func() { health.setLoaded() },
+			status: http.StatusOK,
+			body:   "ok\n",
+		},
+		{
+			name:   "Degraded",
+			setup:  func() { health.setPushed(fmt.Errorf("disk full")) },
+			status: http.StatusOK,
+			body:   "degraded\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			w := httptest.NewRecorder()
+			readyzHandler(w, httptest.NewRequest("GET", "http://localhost"+testport+"/readyz", nil))
+
+			resp := w.Result()
+			defer resp.Body.Close()
+			data, _ := ioutil.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status {
+				t.Errorf(fmt.Sprintf("%v", resp.StatusCode))
+			}
+			if !strings.Contains(string(data), tt.body) {
+				t.Errorf("Expected %#v in body, got: %s\n", tt.body, data)
+			}
+		})
+	}
+}
+
+func Test_healthzHandler(t *testing.T) {
+	initTestConf()
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest("GET", "http://localhost"+testport+"/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf(fmt.Sprintf("%v", w.Code))
+	}
+}
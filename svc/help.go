@@ -58,6 +58,32 @@ func helpScreen() {
     -t [--dbtype]    Type of database to use.
                        Options: leveldb (default)
                                 sqlite
+                                bolt
+
+                    :: Migrating Databases ::
+
+    To move the registry to a different type of database, stop
+ getwtxt, then copy it into a new, empty database:
+
+    ./getwtxt migrate --from leveldb:getwtxt.db --to sqlite:getwtxt.sqlite
+
+    The old database is only read, so one last used by an earlier
+ version of getwtxt must be opened by this one first. Both databases
+ are read back once the copy is made, and any users, statuses,
+ aliases or remote registries that differ are listed. Afterwards, update DatabaseType and DatabasePath in the
+ configuration file to point to the new database.
+
+                  :: Exporting and Importing ::
+
+    The registry can be written to, and read from, a portable
+ archive. While getwtxt isn't running:
+
+    ./getwtxt export --db leveldb:getwtxt.db --out backup.jsonl
+    ./getwtxt import --db leveldb:getwtxt.db --in backup.jsonl
+
+    Imported users are merged with those already in the database,
+ unless --replace is passed. While getwtxt is running, use the
+ /api/admin/export and /api/admin/import endpoints instead.
 
 `)
 }
@@ -138,6 +164,7 @@ func manualScreen() {
         to store registry data. The available types of
         databases are: leveldb
                        sqlite
+                       bolt
         Default: leveldb
 
     DatabasePath: The location of the LevelDB structure
@@ -180,6 +207,115 @@ func manualScreen() {
         DatabasePushInterval may be used.
         Default: 1h
 
+    FetchLimits: Signifies the start of options that limit
+        how quickly getwtxt requests users' twtxt files.
+        Like Instance below, the following must be
+        indented as sub-options.
+
+    PerHostRate: Requests per second allowed to any
+        single host.
+        Default: 1
+
+    PerHostBurst: Requests that may be made to a single
+        host in a burst, before PerHostRate applies.
+        Default: 2
+
+    GlobalRate: Requests per second allowed to all hosts
+        combined. Set to 0 to disable.
+        Default: 10
+
+    Jitter: During each refresh of users' statuses,
+        each user's file is fetched after a random delay
+        of up to this long, so users sharing a host aren't
+        fetched all at once. The same time suffixes as
+        DatabasePushInterval may be used.
+        Default: 30s
+
+    MaxBodySize: The most bytes read from a single
+        twtxt file. Anything past this is ignored.
+        Default: 8388608
+
+    MaxStatuses: The most statuses kept from a single
+        twtxt file. When exceeded, the newest are kept.
+        Default: 20000
+
+    MaxLineLength: Lines of a twtxt file longer than
+        this many bytes are skipped.
+        Default: 16384
+
+        When a twtxt file exceeds any of these limits,
+        the submitter is warned, and the fetch is
+        counted as "truncated" in /metrics.
+
+    Feeds: Signifies the start of options that decide
+        which responses are accepted as twtxt files.
+        Like Instance below, the following must be
+        indented as sub-options.
+
+    AcceptContentTypes: A list of media types accepted
+        as twtxt files. A subtype of "*", such as
+        "text/*", accepts any subtype, and "*/*"
+        accepts anything. Responses without a
+        Content-Type are treated as
+        application/octet-stream.
+        Default: ["text/plain", "application/octet-stream"]
+
+    DefaultCharset: The charset assumed for twtxt files
+        that don't declare one. Files are transcoded to
+        UTF-8 as needed. A byte order mark, if present,
+        takes precedence and is stripped.
+        Default: utf-8
+
+    Sync: If true, each complete fetch of a twtxt file
+        replaces the statuses cached for it, so statuses
+        deleted from the file are dropped from the
+        registry, and from the database at the next
+        push. Fetches cut short by FetchLimits never
+        drop statuses. If the file names an archived
+        segment with a "# prev" line, statuses older
+        than those in the file are kept.
+        Default: false
+
+    Retention: Signifies the start of options that bound
+        the statuses kept for each user. Statuses past
+        them are pruned after each refresh of users'
+        statuses, and removed from the database at the
+        next push. Like Instance below, the following
+        must be indented as sub-options.
+
+    MaxAge: Statuses older than this are pruned. The same
+        time suffixes as DatabasePushInterval may be used.
+        Set to 0 to keep statuses of any age.
+        Default: 0
+
+    MaxStatuses: The most statuses kept for each user.
+        The newest are kept. Set to 0 for no limit.
+        Default: 0
+
+    RemoteMaxAge, RemoteMaxStatuses: The same, for users
+        found via remote registries. Set to 0 to use the
+        values above, or -1 to keep everything.
+        Default: 0
+
+    Backups: Signifies the start of options for the
+        archives of the registry getwtxt writes
+        periodically. Like Instance below, the
+        following must be indented as sub-options.
+
+    Interval: How often to write a backup. Checked
+        after each database push. Set to 0 to disable.
+        The same time suffixes as DatabasePushInterval
+        may be used.
+        Default: 0
+
+    Directory: Where backups are written. Each is named
+        after the time it was written, in UTC.
+        Default: backups
+
+    Keep: The number of backups kept. Older ones are
+        removed. Set to 0 to keep them all.
+        Default: 7
+
     Instance: Signifies the start of instance-specific
         meta information. The following are used only
         for the summary and use information displayed
@@ -286,6 +422,21 @@ func manualScreen() {
     curl -X POST 'http://localhost:9001/api/plain/users\
         ?url=https://example.org/twtxt.txt&nickname=somebody'
 
+    Lines that can't be parsed are skipped, and listed in the
+ response by line and column. Timestamps may use a space
+ instead of 'T', a lowercase 'z', or omit the timezone, in
+ which case UTC is assumed.
+
+    twtxt files containing the metadata line '# noindex = true'
+ are refused, and are removed from the registry on the next
+ refresh if already present. Users found by crawling other
+ registries are only fetched if the host's robots.txt allows
+ the 'getwtxt' user-agent to do so.
+
+    If a twtxt file permanently redirects (301 or 308), the
+ user is moved to the new URL. Mentions of the old URL are
+ still included in mention queries for the new one.
+
  Retrieve user list:
     curl 'http://localhost:9001/api/plain/users'
 
@@ -305,6 +456,23 @@ func manualScreen() {
     curl 'http://localhost:9001/api/plain/users\
         ?url=https://gbmor.dev/twtxt.txt'
 
+ Retrieve posting statistics for a user:
+    curl 'http://localhost:9001/api/plain/users/stats\
+        ?url=https://gbmor.dev/twtxt.txt'
+
+ Retrieve a status and its earlier versions:
+    curl 'http://localhost:9001/api/plain/tweets/detail\
+        ?url=https://gbmor.dev/twtxt.txt\
+        &time=2019-05-09T08:42:23Z'
+
+ Check a twtxt file without adding it:
+    curl 'http://localhost:9001/api/plain/validate\
+        ?url=https://gbmor.dev/twtxt.txt'
+
+ Check a local twtxt file without publishing it:
+    curl --data-binary @twtxt.txt \
+        'http://localhost:9001/api/plain/validate'
+
  Query for statuses by substring:
     curl 'http://localhost:9001/api/plain/tweets\
         ?q=SUBSTRING'
@@ -316,5 +484,17 @@ func manualScreen() {
  Query for statuses with a given tag:
     curl 'http://localhost:9001/api/plain/tags/myTagHere'
 
+ Check whether the process is alive:
+    curl 'http://localhost:9001/healthz'
+
+ Check whether the instance is ready to serve requests.
+ Responds with 503 until the database has been loaded.
+ Once loaded, responds with 200 and either "ok" or
+ "degraded" followed by the reasons why:
+    curl 'http://localhost:9001/readyz'
+
+ Retrieve metrics in the Prometheus text format:
+    curl 'http://localhost:9001/metrics'
+
 `)
 }
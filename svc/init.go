@@ -20,8 +20,11 @@ along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
 package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
 
 import (
+	"context"
 	"html/template"
 	"log"
+	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
 	"time"
@@ -49,7 +52,7 @@ var confObj = &Configuration{}
 var closeLog = make(chan struct{}, 1)
 
 // Used to transmit database pointer
-var dbChan = make(chan dbase, 1)
+var dbChan = make(chan registry.Storage, 1)
 
 // Used to transmit the wrapped tickers
 // corresponding to the in-memory cache
@@ -57,11 +60,25 @@ var dbChan = make(chan dbase, 1)
 var dbTickC = make(chan *tick, 1)
 var cTickC = make(chan *tick, 1)
 
+// Cancelled when getwtxt begins shutting down,
+// so in-flight fetches are abandoned.
+var shutdownCtx, cancelShutdown = context.WithCancel(context.Background())
+
 // Used to manage the landing page template
 var tmpls *template.Template
 
+// Paces requests for users' twtxt files. The
+// limits are set from the configuration file.
+var fetchLimiter = registry.NewLimiter(nil, 0, 0, 0)
+
 // Holds the registry data in-memory
-var twtxtCache = registry.New(nil)
+var twtxtCache = registry.New(&http.Client{
+	Transport: fetchLimiter,
+	Timeout:   10 * time.Second,
+})
+
+// Closed once the database has been read into the cache.
+var dbLoaded = make(chan struct{})
 
 // List of other registries submitted to this registry
 var remoteRegistries = &RemoteRegistries{
@@ -91,6 +108,7 @@ func errLog(context string, err error) {
 // even during testing and was causing
 // problems.
 func initSvc() {
+	rand.Seed(time.Now().UnixNano())
 	checkFlags()
 	titleScreen()
 
@@ -133,6 +151,7 @@ func watchForInterrupt() {
 	go func() {
 		for sigint := range c {
 			log.Printf("Caught %v\n", sigint)
+			cancelShutdown()
 
 			log.Printf("Pushing to database ...\n")
 			pushDB()
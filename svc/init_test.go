@@ -28,6 +28,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"git.sr.ht/~gbmor/getwtxt/registry"
 	"github.com/spf13/viper"
@@ -58,6 +59,12 @@ func initTestConf() {
 func initTestDB() {
 	initDBOnce.Do(func() {
 		initDatabase()
+		for {
+			if ready, _ := health.check(0); ready {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
 	})
 }
 
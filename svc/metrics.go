@@ -0,0 +1,349 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Functions and types in this file expose
+// internal counters and timings in the
+// Prometheus text exposition format.
+
+const promContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Histogram buckets, in seconds, for the
+// various kinds of durations we observe.
+var (
+	reqBuckets     = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	dbBuckets      = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+	refreshBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+)
+
+var (
+	httpRequests = newCounterVec("getwtxt_http_requests_total",
+		"Number of HTTP requests served, by route and status code.", "route", "code")
+	httpDuration = newHistogramVec("getwtxt_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by route and status code.", reqBuckets, "route", "code")
+	fetchOutcomes = newCounterVec("getwtxt_fetches_total",
+		"Number of twtxt file fetches during refresh cycles, by outcome.", "outcome")
+	refreshDuration = newHistogramVec("getwtxt_refresh_duration_seconds",
+		"Time taken by each refresh cycle of the cached user data.", refreshBuckets)
+	dbDuration = newHistogramVec("getwtxt_db_duration_seconds",
+		"Time taken to push the cache to, or pull the cache from, the database.", dbBuckets, "op")
+	dbErrors = newCounterVec("getwtxt_db_errors_total",
+		"Number of failed database operations.", "op")
+)
+
+// A monotonically increasing value, partitioned by
+// a set of labels. The map is keyed by the rendered
+// label pairs.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	vals   map[string]float64
+}
+
+// A set of cumulative bucket counts, partitioned by
+// a set of labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	vals    map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		vals:   make(map[string]float64),
+	}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		vals:    make(map[string]*histogram),
+	}
+}
+
+// Increments the counter for the given label values,
+// which must be in the same order as the label names.
+func (c *counterVec) inc(values ...string) {
+	key := renderLabels(c.labels, values)
+	c.mu.Lock()
+	c.vals[key]++
+	c.mu.Unlock()
+}
+
+// Returns the current value of the counter for
+// the given label values.
+func (c *counterVec) get(values ...string) float64 {
+	key := renderLabels(c.labels, values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.vals[key]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.vals))
+	for k := range c.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%v%v %v\n", c.name, wrapLabels(k), formatFloat(c.vals[k]))
+	}
+}
+
+// Records a single observation for the given label values.
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := renderLabels(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.vals[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.vals[key] = hist
+	}
+	for i, e := range h.buckets {
+		if v <= e {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+// Convenience wrapper to observe the time
+// elapsed since the provided start time.
+func (h *histogramVec) since(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.vals))
+	for k := range h.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, k := range keys {
+		hist := h.vals[k]
+		for i, e := range h.buckets {
+			le := "le=\"" + formatFloat(e) + "\""
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, wrapLabels(k, le), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, wrapLabels(k, "le=\"+Inf\""), hist.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, wrapLabels(k), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, wrapLabels(k), hist.count)
+	}
+}
+
+// Writes a single gauge with no labels.
+func writeGauge(w io.Writer, name, help string, val float64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%v %v\n", name, formatFloat(val))
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+}
+
+// Renders label names and values as name="value" pairs
+// separated by commas, without the surrounding braces.
+func renderLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, e := range names {
+		var val string
+		if i < len(values) {
+			val = values[i]
+		}
+		pairs[i] = e + "=\"" + escapeLabel(val) + "\""
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Surrounds rendered labels with braces, adding any
+// extra pairs. Returns an empty string if there are
+// no labels at all.
+func wrapLabels(rendered string, extra ...string) string {
+	pairs := make([]string, 0, len(extra)+1)
+	if rendered != "" {
+		pairs = append(pairs, rendered)
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Wraps a http.ResponseWriter to record
+// the status code sent to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Route label for requests that match no route,
+// such as 404s and scanners' probes.
+const unmatchedRoute = "unmatched"
+
+// Counts requests to the router. mux only runs middleware
+// for requests that match a route, so the handlers for
+// those that don't are wrapped as well.
+func countRequests(index *mux.Router) {
+	index.Use(metricsMiddleware)
+	index.NotFoundHandler = metricsMiddleware(http.NotFoundHandler())
+	index.MethodNotAllowedHandler = metricsMiddleware(http.HandlerFunc(methodNotAllowed))
+}
+
+// Stands in for mux's own response when a route
+// matches the path, but not the method.
+func methodNotAllowed(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// Records request counts and latencies. The route label
+// is the matched path template rather than the request
+// path, to keep the number of label values bounded.
+func metricsMiddleware(hop http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		hop.ServeHTTP(rec, r)
+
+		route := unmatchedRoute
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tmpl, err := cur.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		code := strconv.Itoa(rec.code)
+
+		httpRequests.inc(route, code)
+		httpDuration.since(start, route, code)
+	})
+}
+
+// Gathers the current size of the in-memory cache.
+func cacheSizes() (users, statuses, remotes int) {
+	twtxtCache.Mu.RLock()
+	users = len(twtxtCache.Users)
+	for _, v := range twtxtCache.Users {
+		v.Mu.RLock()
+		statuses += len(v.Status)
+		v.Mu.RUnlock()
+	}
+	twtxtCache.Mu.RUnlock()
+
+	remoteRegistries.Mu.RLock()
+	remotes = len(remoteRegistries.List)
+	remoteRegistries.Mu.RUnlock()
+	return
+}
+
+// handles "/metrics"
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	users, statuses, remotes := cacheSizes()
+
+	staticCache.mu.RLock()
+	staticBytes := len(staticCache.index) + len(staticCache.css)
+	staticCache.mu.RUnlock()
+
+	writeGauge(&buf, "getwtxt_users", "Number of users in the registry.", float64(users))
+	writeGauge(&buf, "getwtxt_statuses", "Number of statuses in the registry.", float64(statuses))
+	writeGauge(&buf, "getwtxt_remote_registries", "Number of remote registries being crawled.", float64(remotes))
+	writeGauge(&buf, "getwtxt_static_cache_bytes", "Size of the cached landing page and stylesheet.", float64(staticBytes))
+
+	httpRequests.write(&buf)
+	httpDuration.write(&buf)
+	fetchOutcomes.write(&buf)
+	refreshDuration.write(&buf)
+	dbDuration.write(&buf)
+	dbErrors.write(&buf)
+
+	w.Header().Set("Content-Type", promContentType)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log200(r)
+}
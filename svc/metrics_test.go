@@ -0,0 +1,178 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	"github.com/gorilla/mux"
+)
+
+func Test_counterVec(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "route", "code")
+	c.inc("/api", "200")
+	c.inc("/api", "200")
+	c.inc("/a\"b", "404")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	out := buf.String()
+
+	expect := []string{
+		"# TYPE test_total counter\n",
+		"test_total{route=\"/api\",code=\"200\"} 2\n",
+		"test_total{route=\"/a\\\"b\",code=\"404\"} 1\n",
+	}
+	for _, e := range expect {
+		if !strings.Contains(out, e) {
+			t.Errorf("Missing %#v in output:\n%v\n", e, out)
+		}
+	}
+	if c.get("/api", "200") != 2 {
+		t.Errorf("Incorrect counter value: %v\n", c.get("/api", "200"))
+	}
+}
+
+func Test_histogramVec(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test histogram.", []float64{1, 5})
+	h.observe(0.5)
+	h.observe(3)
+	h.observe(10)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	out := buf.String()
+
+	expect := []string{
+		"# TYPE test_seconds histogram\n",
+		"test_seconds_bucket{le=\"1\"} 1\n",
+		"test_seconds_bucket{le=\"5\"} 2\n",
+		"test_seconds_bucket{le=\"+Inf\"} 3\n",
+		"test_seconds_sum 13.5\n",
+		"test_seconds_count 3\n",
+	}
+	for _, e := range expect {
+		if !strings.Contains(out, e) {
+			t.Errorf("Missing %#v in output:\n%v\n", e, out)
+		}
+	}
+}
+
+func Test_metricsHandler(t *testing.T) {
+	initTestConf()
+	twtxtCache = registry.New(nil)
+	_ = twtxtCache.AddUser("foo", "https://example.com/twtxt.txt", nil, registry.NewTimeMap())
+
+	index := mux.NewRouter()
+	countRequests(index)
+	setIndexRouting(index)
+
+	t.Run("Request Counted", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		index.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+testport+"/api", nil))
+		if httpRequests.get("/api", "200") < 1 {
+			t.Errorf("Request to /api wasn't counted\n")
+		}
+	})
+
+	t.Run("Unmatched Requests Counted", func(t *testing.T) {
+		before := httpRequests.get(unmatchedRoute, "404")
+		w := httptest.NewRecorder()
+		index.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+testport+"/wp-login.php", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %v\n", w.Code)
+		}
+		if httpRequests.get(unmatchedRoute, "404") != before+1 {
+			t.Errorf("Unmatched request wasn't counted\n")
+		}
+		if httpRequests.get("/wp-login.php", "404") != 0 {
+			t.Errorf("Unmatched request counted under its path\n")
+		}
+	})
+
+	t.Run("Wrong Method Counted", func(t *testing.T) {
+		before := httpRequests.get(unmatchedRoute, "405")
+		w := httptest.NewRecorder()
+		index.ServeHTTP(w, httptest.NewRequest("DELETE", "http://localhost"+testport+"/api", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %v\n", w.Code)
+		}
+		if httpRequests.get(unmatchedRoute, "405") != before+1 {
+			t.Errorf("Request with the wrong method wasn't counted\n")
+		}
+	})
+
+	t.Run("Exposition", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		index.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+testport+"/metrics", nil))
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf(fmt.Sprintf("%v", resp.StatusCode))
+		}
+		if resp.Header.Get("Content-Type") != promContentType {
+			t.Errorf("Incorrect Content-Type: %v\n", resp.Header.Get("Content-Type"))
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("%v\n", err)
+		}
+		if !strings.Contains(string(data), "getwtxt_users 1\n") {
+			t.Errorf("Missing user count:\n%s\n", data)
+		}
+		if !strings.Contains(string(data), "getwtxt_http_requests_total{route=\"/api\",code=\"200\"}") {
+			t.Errorf("Missing request count:\n%s\n", data)
+		}
+	})
+}
+
+func Test_countFetch(t *testing.T) {
+	before := fetchOutcomes.get("not_modified")
+	countFetch(registry.ErrNotModified)
+	if fetchOutcomes.get("not_modified") != before+1 {
+		t.Errorf("Unmodified fetch wasn't counted\n")
+	}
+
+	before = fetchOutcomes.get("error")
+	countFetch(fmt.Errorf("test error"))
+	if fetchOutcomes.get("error") != before+1 {
+		t.Errorf("Failed fetch wasn't counted\n")
+	}
+}
+
+func Benchmark_metricsHandler(b *testing.B) {
+	initTestConf()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://localhost"+testport+"/metrics", nil)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		metricsHandler(w, r)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	"github.com/spf13/pflag"
+)
+
+// Migrate copies the registry from one database to another,
+// then checks the copy against the original. It's run as
+//
+//	getwtxt migrate --from leveldb:getwtxt.db --to sqlite:getwtxt.sqlite
+//
+// while getwtxt isn't running, as both databases are opened
+// directly.
+func Migrate(args []string) {
+	flags := pflag.NewFlagSet("migrate", pflag.ExitOnError)
+	from := flags.String("from", "", "The database to copy, as type:path.")
+	to := flags.String("to", "", "The empty database to copy it into, as type:path.")
+	flags.Parse(args)
+
+	if *from == "" || *to == "" {
+		fmt.Fprintf(os.Stderr, "Usage: getwtxt migrate --from type:path --to type:path\n")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	if err := migrateDB(*from, *to, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// What a database holds, for comparing
+// the copy to the original.
+type dbContents struct {
+	users   map[string]*registry.User
+	aliases map[string]string
+	remotes []string
+}
+
+// Splits a database given as type:path.
+func parseDBSpec(spec string) (string, string, error) {
+	split := strings.SplitN(spec, ":", 2)
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return "", "", fmt.Errorf("expected type:path, got %q", spec)
+	}
+	return strings.ToLower(split[0]), split[1], nil
+}
+
+func openDBSpec(spec string) (registry.Storage, error) {
+	dbtype, dbpath, err := parseDBSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return openDB(dbtype, dbpath)
+}
+
+func readContents(db registry.Storage) (*dbContents, error) {
+	users, aliases, err := db.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := db.RemoteRegistries()
+	if err != nil {
+		return nil, err
+	}
+	return &dbContents{
+		users:   users,
+		aliases: aliases,
+		remotes: remotes,
+	}, nil
+}
+
+func (c *dbContents) statusCount() int {
+	n := 0
+	for _, v := range c.users {
+		n += len(v.Status)
+	}
+	return n
+}
+
+// Copies everything held by the first database into
+// the second, which must be empty, then reads both
+// back and reports any differences. The first isn't
+// written to, so it must already be up to date.
+func migrateDB(from, to string, out io.Writer) error {
+	if from == to {
+		return fmt.Errorf("can't migrate %v into itself", from)
+	}
+
+	// Opening the source would otherwise
+	// create an empty one.
+	if _, path, err := parseDBSpec(from); err != nil {
+		return err
+	} else if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	// the source is left as it was, so the
+	// version using it can still go back to it
+	srctype, srcpath, _ := parseDBSpec(from)
+	src, err := openDBReadOnly(srctype, srcpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := openDBSpec(to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	existing, err := readContents(dst)
+	if err != nil {
+		return fmt.Errorf("couldn't read %v: %v", to, err)
+	}
+	if len(existing.users) > 0 || len(existing.aliases) > 0 || len(existing.remotes) > 0 {
+		return fmt.Errorf("%v already holds %v users; migrate into an empty database", to, len(existing.users))
+	}
+
+	reg := registry.New(nil)
+	if err := reg.Load(src); err != nil {
+		return fmt.Errorf("couldn't read %v: %v", from, err)
+	}
+	remotes, err := src.RemoteRegistries()
+	if err != nil {
+		return fmt.Errorf("couldn't read remote registries from %v: %v", from, err)
+	}
+
+	if err := reg.SaveAll(dst); err != nil {
+		return fmt.Errorf("couldn't write %v: %v", to, err)
+	}
+	for _, e := range remotes {
+		if err := dst.PutRemoteRegistry(e); err != nil {
+			return fmt.Errorf("couldn't write remote registry %v: %v", e, err)
+		}
+	}
+
+	want, err := readContents(src)
+	if err != nil {
+		return fmt.Errorf("couldn't re-read %v: %v", from, err)
+	}
+	got, err := readContents(dst)
+	if err != nil {
+		return fmt.Errorf("couldn't read back %v: %v", to, err)
+	}
+
+	fmt.Fprintf(out, "Copied %v to %v\n", from, to)
+	fmt.Fprintf(out, "    users:             %v -> %v\n", len(want.users), len(got.users))
+	fmt.Fprintf(out, "    statuses:          %v -> %v\n", want.statusCount(), got.statusCount())
+	fmt.Fprintf(out, "    aliases:           %v -> %v\n", len(want.aliases), len(got.aliases))
+	fmt.Fprintf(out, "    remote registries: %v -> %v\n", len(want.remotes), len(got.remotes))
+
+	diffs := diffContents(want, got)
+	for _, e := range diffs {
+		fmt.Fprintf(out, "    %v\n", e)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("found %v differences between the databases", len(diffs))
+	}
+	return nil
+}
+
+// Lists what's missing from, extra in, or
+// different about the copy, sorted so the
+// report reads the same each time.
+func diffContents(want, got *dbContents) []string {
+	out := make([]string, 0)
+
+	for k, v := range want.users {
+		user, ok := got.users[k]
+		if !ok {
+			out = append(out, fmt.Sprintf("missing user: %v", k))
+			continue
+		}
+		if len(user.Status) != len(v.Status) {
+			out = append(out, fmt.Sprintf("user %v has %v statuses, copied %v", k, len(v.Status), len(user.Status)))
+		}
+	}
+	for k := range got.users {
+		if _, ok := want.users[k]; !ok {
+			out = append(out, fmt.Sprintf("unexpected user: %v", k))
+		}
+	}
+
+	for k, v := range want.aliases {
+		if to, ok := got.aliases[k]; !ok {
+			out = append(out, fmt.Sprintf("missing alias: %v", k))
+		} else if to != v {
+			out = append(out, fmt.Sprintf("alias %v points to %v, copied as %v", k, v, to))
+		}
+	}
+	for k := range got.aliases {
+		if _, ok := want.aliases[k]; !ok {
+			out = append(out, fmt.Sprintf("unexpected alias: %v", k))
+		}
+	}
+
+	remotes := make(map[string]bool)
+	for _, e := range got.remotes {
+		remotes[e] = true
+	}
+	for _, e := range want.remotes {
+		if !remotes[e] {
+			out = append(out, fmt.Sprintf("missing remote registry: %v", e))
+		}
+		delete(remotes, e)
+	}
+	for k := range remotes {
+		out = append(out, fmt.Sprintf("unexpected remote registry: %v", k))
+	}
+
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,172 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+)
+
+// Fills a LevelDB database with a user, their
+// statuses, an alias and a remote registry.
+func mockMigrationSource(t *testing.T, path string) {
+	db, err := openDB("leveldb", path)
+	if err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	defer db.Close()
+
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	urlKey := "https://example.com/twtxt.txt"
+	reg := registry.New(nil)
+	reg.AddUser("foo", urlKey, nil, registry.TimeMap{
+		then:                      registry.NewStatus("foo", urlKey, then, "hello"),
+		then.Add(time.Hour):       registry.NewStatus("foo", urlKey, then.Add(time.Hour), "again"),
+		then.Add(time.Nanosecond): registry.NewStatus("foo", urlKey, then.Add(time.Nanosecond), "quickly"),
+	})
+	reg.Aliases["https://example.com/old.txt"] = urlKey
+
+	if err := reg.SaveAll(db); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+	if err := db.PutRemoteRegistry("https://twtxt.example.net/api/plain/users"); err != nil {
+		t.Fatalf("Couldn't set up test: %v\n", err)
+	}
+}
+
+// Reads every file making up the database at the
+// path, which may be a file or a directory.
+func readDBFiles(t *testing.T, path string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(name)
+		files[name] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	return files
+}
+
+func Test_migrateDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	from := "leveldb:" + filepath.Join(dir, "from.db")
+	mockMigrationSource(t, filepath.Join(dir, "from.db"))
+	before := readDBFiles(t, filepath.Join(dir, "from.db"))
+
+	for _, dbtype := range []string{"sqlite", "bolt"} {
+		t.Run(dbtype, func(t *testing.T) {
+			to := dbtype + ":" + filepath.Join(dir, "to."+dbtype)
+			if err := migrateDB(from, to, ioutil.Discard); err != nil {
+				t.Fatalf("%v\n", err)
+			}
+
+			db, err := openDBSpec(to)
+			if err != nil {
+				t.Fatalf("%v\n", err)
+			}
+			defer db.Close()
+			got, err := readContents(db)
+			if err != nil {
+				t.Fatalf("%v\n", err)
+			}
+			if len(got.users) != 1 || got.statusCount() != 3 || len(got.aliases) != 1 || len(got.remotes) != 1 {
+				t.Errorf("Incomplete copy: %v users, %v statuses, %v aliases, %v remotes\n",
+					len(got.users), got.statusCount(), len(got.aliases), len(got.remotes))
+			}
+		})
+	}
+
+	t.Run("Source Unchanged", func(t *testing.T) {
+		if after := readDBFiles(t, filepath.Join(dir, "from.db")); !reflect.DeepEqual(before, after) {
+			t.Errorf("Source database was written to\n")
+		}
+		for _, dbtype := range []string{"sqlite", "bolt"} {
+			path := filepath.Join(dir, "to."+dbtype)
+			before := readDBFiles(t, path)
+			if err := migrateDB(dbtype+":"+path, "leveldb:"+filepath.Join(dir, "again-"+dbtype+".db"), ioutil.Discard); err != nil {
+				t.Fatalf("%v\n", err)
+			}
+			if after := readDBFiles(t, path); !reflect.DeepEqual(before, after) {
+				t.Errorf("Source %v database was written to\n", dbtype)
+			}
+		}
+	})
+
+	t.Run("Non-Empty Destination", func(t *testing.T) {
+		if err := migrateDB(from, "sqlite:"+filepath.Join(dir, "to.sqlite"), ioutil.Discard); err == nil {
+			t.Errorf("Expected error migrating into a database already holding users\n")
+		}
+	})
+
+	t.Run("Bad Specs", func(t *testing.T) {
+		for _, e := range []string{"leveldb", ":" + dir, "leveldb:", "mongodb:" + filepath.Join(dir, "mongo")} {
+			if err := migrateDB(from, e, ioutil.Discard); err == nil {
+				t.Errorf("Expected error migrating to %q\n", e)
+			}
+		}
+		if err := migrateDB("leveldb:"+filepath.Join(dir, "nothing.db"), "sqlite:"+filepath.Join(dir, "nothing.sqlite"), ioutil.Discard); err == nil {
+			t.Errorf("Expected error migrating from a database that doesn't exist\n")
+		}
+		if err := migrateDB(from, from, ioutil.Discard); err == nil {
+			t.Errorf("Expected error migrating a database into itself\n")
+		}
+	})
+}
+
+func Test_diffContents(t *testing.T) {
+	then := time.Now()
+	user := registry.NewUser()
+	user.Status[then] = registry.NewStatus("foo", "https://example.com/twtxt.txt", then, "hi")
+
+	want := &dbContents{
+		users:   map[string]*registry.User{"https://example.com/twtxt.txt": user},
+		aliases: map[string]string{"https://example.com/old.txt": "https://example.com/twtxt.txt"},
+		remotes: []string{"https://twtxt.example.net/api"},
+	}
+
+	if diffs := diffContents(want, want); len(diffs) != 0 {
+		t.Errorf("Expected no differences, got %v\n", diffs)
+	}
+
+	got := &dbContents{
+		users:   map[string]*registry.User{"https://example.com/twtxt.txt": registry.NewUser()},
+		aliases: map[string]string{"https://example.com/old.txt": "https://example.com/elsewhere.txt"},
+		remotes: []string{"https://twtxt.example.org/api"},
+	}
+	if diffs := diffContents(want, got); len(diffs) != 4 {
+		t.Errorf("Expected 4 differences, got %v\n", diffs)
+	}
+}
@@ -20,6 +20,7 @@ along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
 package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -33,19 +34,27 @@ import (
 // that adds another channel. It's used
 // to signal to the ticker goroutines
 // that they should stop the tickers
-// and exit.
+// and exit. Cancelling ctx abandons
+// any refresh in progress.
 type tick struct {
-	isDB bool
-	t    *time.Ticker
-	exit chan struct{}
+	isDB     bool
+	t        *time.Ticker
+	interval time.Duration
+	exit     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
 // Creates a new instance of a tick
 func initTicker(db bool, interval time.Duration) *tick {
+	ctx, cancel := context.WithCancel(shutdownCtx)
 	return &tick{
-		isDB: db,
-		t:    time.NewTicker(interval),
-		exit: make(chan struct{}, 1),
+		isDB:     db,
+		t:        time.NewTicker(interval),
+		interval: interval,
+		exit:     make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
 	}
 }
 
@@ -55,6 +64,8 @@ func initTicker(db bool, interval time.Duration) *tick {
 func killTickers() {
 	ct := <-cTickC
 	dt := <-dbTickC
+	ct.cancel()
+	dt.cancel()
 	ct.exit <- struct{}{}
 	dt.exit <- struct{}{}
 }
@@ -64,16 +75,43 @@ func killTickers() {
 // kills the goroutine or it will
 // update cache / push the DB to disk
 func dataTimer(tkr *tick) {
+	// The cache isn't refreshed until the
+	// database has been read into it.
+	if !tkr.isDB {
+		select {
+		case <-dbLoaded:
+		case <-tkr.exit:
+			tkr.t.Stop()
+			return
+		}
+		// start counting the interval from here
+		tkr.t.Stop()
+		tkr.t = time.NewTicker(tkr.interval)
+	}
+
 	for {
 		select {
 		case signal := <-tkr.t.C:
 			if tkr.isDB {
 				errLog("", pushDB())
 				log.Printf("Database push took: %v\n", time.Since(signal))
+				errLog("Error writing backup: ", backupIfDue(time.Now()))
 				continue
 			}
-			cacheUpdate()
-			log.Printf("Cache update took: %v\n", time.Since(signal))
+			// A refresh shouldn't run into the next one, though
+			// time spent waiting on jitter doesn't count.
+			start := time.Now()
+			jitter := fetchJitter()
+			ctx, cancel := context.WithTimeout(tkr.ctx, tkr.interval+jitter)
+			finished := cacheUpdate(ctx, false, jitter)
+			cancel()
+			// A cycle that stopped early leaves
+			// /readyz to report it as overdue.
+			if finished {
+				refreshDuration.since(start)
+				health.setRefreshed(time.Now())
+			}
+			log.Printf("Cache update took: %v\n", time.Since(start))
 		case <-tkr.exit:
 			tkr.t.Stop()
 			return
@@ -81,6 +119,15 @@ func dataTimer(tkr *tick) {
 	}
 }
 
+// Returns the configured jitter: the most each
+// user's fetch is delayed within a refresh cycle,
+// so they don't all hit remote hosts at once.
+func fetchJitter() time.Duration {
+	confObj.Mu.RLock()
+	defer confObj.Mu.RUnlock()
+	return confObj.FetchLimits.Jitter
+}
+
 // Called when a change is detected in the
 // configuration file. Closes log file,
 // closes database connection, stops all
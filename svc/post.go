@@ -27,6 +27,10 @@ import (
 	"git.sr.ht/~gbmor/getwtxt/registry"
 )
 
+// The most unparseable lines listed individually
+// in the response to a submission.
+const maxReportedErrors = 10
+
 // Requests to apiEndpointPOSTHandler are passed off to this
 // function. apiPostUser then fetches the twtxt data, then if
 // it's an individual user's file, adds it. If it's registry
@@ -47,36 +51,93 @@ func apiPostUser(w http.ResponseWriter, r *http.Request) {
 
 	uip := getIPFromCtx(r.Context())
 
-	out, remoteRegistry, err := registry.GetTwtxt(urls, twtxtCache.HTTPClient)
-	if err != nil {
-		errHTTP(w, r, fmt.Errorf("error fetching twtxt Data: %v", err.Error()), http.StatusBadRequest)
-		return
-	}
-
-	switch remoteRegistry {
+	switch registry.IsRemoteRegistry(urls) {
 	case true:
 		if strings.Contains(urls, confObj.Instance.URL) {
 			errHTTP(w, r, fmt.Errorf("can't submit this registry to itself"), http.StatusBadRequest)
 			break
 		}
-		remoteRegistries.List = append(remoteRegistries.List, urls)
+		if _, _, err := registry.GetTwtxtContext(r.Context(), urls, twtxtCache.HTTPClient); err != nil {
+			if _, ok := err.(*registry.TruncatedError); !ok {
+				errHTTP(w, r, fmt.Errorf("error fetching twtxt Data: %v", err.Error()), http.StatusBadRequest)
+				break
+			}
+		}
+		errLog("Error storing remote registry: ", addRemoteRegistry(urls))
 
-		if err := twtxtCache.CrawlRemoteRegistry(urls); err != nil {
+		if err := twtxtCache.CrawlRemoteRegistryContext(r.Context(), urls); err != nil {
 			errHTTP(w, r, fmt.Errorf("error crawling remote registry: %v", err.Error()), http.StatusInternalServerError)
-		} else {
-			log200(r)
+			break
+		}
+		if err := pushDB(); err != nil {
+			errHTTP(w, r, fmt.Errorf("error storing users from remote registry: %v", err.Error()), http.StatusInternalServerError)
+			break
 		}
+		log200(r)
 
 	case false:
-		statuses, err := registry.ParseUserTwtxt(out, nick, urls)
-		errLog("Error Parsing User Data: ", err)
+		feed, err := twtxtCache.FetchUserContext(r.Context(), urls, nick)
+		if err != nil {
+			errHTTP(w, r, fmt.Errorf("error fetching twtxt Data: %v", err.Error()), http.StatusBadRequest)
+			break
+		}
+
+		if feed.OptedOut {
+			errHTTP(w, r, registry.ErrOptedOut, http.StatusBadRequest)
+			break
+		}
 
-		if err := twtxtCache.AddUser(nick, urls, uip, statuses); err != nil {
+		// Lines that can't be parsed are skipped, but a file
+		// with no statuses left is refused, the same as it's
+		// reported by the validation endpoint.
+		if len(feed.Statuses) == 0 {
+			err := registry.ErrNoStatuses
+			if len(feed.Errors) > 0 {
+				err = fmt.Errorf("%v, first error at %v", err, feed.Errors[0])
+			}
+			errHTTP(w, r, err, http.StatusBadRequest)
+			break
+		}
+
+		if err := twtxtCache.AddUser(nick, urls, uip, feed.Statuses); err != nil {
 			errHTTP(w, r, fmt.Errorf("error adding user to cache: %v", err.Error()), http.StatusBadRequest)
 			break
 		}
+		if user, err := twtxtCache.Get(urls); err == nil {
+			user.RecordFetch(feed, feed.Truncated)
+		}
+
+		// The submitted URL permanently redirects,
+		// so keep the user under its new home.
+		if feed.MovedTo != "" {
+			if err := twtxtCache.MoveUser(urls, feed.MovedTo); err != nil {
+				errHTTP(w, r, fmt.Errorf("error moving user to %v: %v", feed.MovedTo, err.Error()), http.StatusInternalServerError)
+				break
+			}
+		}
+
+		// Store the new user now, rather than
+		// waiting for the next push.
+		if err := pushDB(); err != nil {
+			errHTTP(w, r, fmt.Errorf("error storing user: %v", err.Error()), http.StatusInternalServerError)
+			break
+		}
+
+		// Let the submitter know not all of
+		// their statuses were accepted.
+		resp := "200 OK\n"
+		if feed.Truncated != nil {
+			resp += fmt.Sprintf("Warning: %v\n", feed.Truncated)
+		}
+		for i, e := range feed.Errors {
+			if i == maxReportedErrors {
+				resp += fmt.Sprintf("Warning: %v more lines skipped\n", len(feed.Errors)-i)
+				break
+			}
+			resp += fmt.Sprintf("Warning: skipped %v\n", e)
+		}
 
-		_, err = w.Write([]byte(fmt.Sprintf("200 OK\n")))
+		_, err = w.Write([]byte(resp))
 		if err != nil {
 			errHTTP(w, r, err, http.StatusInternalServerError)
 		} else {
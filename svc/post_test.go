@@ -64,6 +64,7 @@ var apiPostUserCases = []struct {
 
 func Test_apiPostUser(t *testing.T) {
 	initTestConf()
+	initTestDB()
 	portnum := fmt.Sprintf(":%v", confObj.Port)
 	twtxtCache = registry.New(nil)
 
@@ -96,6 +97,7 @@ func Test_apiPostUser(t *testing.T) {
 }
 func Benchmark_apiPostUser(b *testing.B) {
 	initTestConf()
+	initTestDB()
 	portnum := fmt.Sprintf(":%v", confObj.Port)
 	twtxtCache = registry.New(nil)
 
@@ -114,3 +116,152 @@ func Benchmark_apiPostUser(b *testing.B) {
 		b.StartTimer()
 	}
 }
+
+func Test_apiPostUser_OptedOut(t *testing.T) {
+	initTestConf()
+	twtxtCache = registry.New(nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("# noindex = true\n2019-09-05T15:19:28Z\thi\n"))
+	}))
+	defer srv.Close()
+
+	params := url.Values{}
+	params.Set("url", srv.URL+"/twtxt.txt")
+	params.Set("nickname", "optout")
+	req := httptest.NewRequest("POST", "http://localhost"+testport+"/api/plain/users?"+params.Encode(), nil)
+	rr := httptest.NewRecorder()
+	apiEndpointPOSTHandler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 Bad Request, but received: %v\n", rr.Code)
+	}
+	if _, err := twtxtCache.Get(srv.URL + "/twtxt.txt"); err == nil {
+		t.Errorf("Opted-out user was added to the registry\n")
+	}
+}
+
+func Test_apiPostUser_Truncated(t *testing.T) {
+	initTestConf()
+	initTestDB()
+	twtxtCache = registry.New(nil)
+	twtxtCache.Limits = registry.Limits{MaxStatuses: 1}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("2019-09-05T15:19:28Z\thi\n2019-09-06T15:19:28Z\thi again\n"))
+	}))
+	defer srv.Close()
+
+	params := url.Values{}
+	params.Set("url", srv.URL+"/twtxt.txt")
+	params.Set("nickname", "chatty")
+	req := httptest.NewRequest("POST", "http://localhost"+testport+"/api/plain/users?"+params.Encode(), nil)
+	rr := httptest.NewRecorder()
+	apiEndpointPOSTHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, but received: %v\n", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "Warning: twtxt file truncated") {
+		t.Errorf("Expected truncation warning, got: %v\n", rr.Body.String())
+	}
+
+	user, err := twtxtCache.Get(srv.URL + "/twtxt.txt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	user.Mu.RLock()
+	defer user.Mu.RUnlock()
+	if len(user.Status) != 1 || !user.Fetch.Truncated {
+		t.Errorf("Expected 1 status and truncated fetch state, got %v, %+v\n", len(user.Status), user.Fetch)
+	}
+}
+
+func Test_apiPostUser_BadLines(t *testing.T) {
+	initTestConf()
+	initTestDB()
+	twtxtCache = registry.New(nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("2019-09-05T15:19:28Z\thi\nnot a status\n"))
+	}))
+	defer srv.Close()
+
+	params := url.Values{}
+	params.Set("url", srv.URL+"/twtxt.txt")
+	params.Set("nickname", "sloppy")
+	req := httptest.NewRequest("POST", "http://localhost"+testport+"/api/plain/users?"+params.Encode(), nil)
+	rr := httptest.NewRecorder()
+	apiEndpointPOSTHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, but received: %v\n", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "Warning: skipped line 2, column 13") {
+		t.Errorf("Expected warning about line 2, got: %v\n", rr.Body.String())
+	}
+}
+
+func Test_apiPostUser_AllBadLines(t *testing.T) {
+	initTestConf()
+	initTestDB()
+	twtxtCache = registry.New(nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("not a status\nnor this\n"))
+	}))
+	defer srv.Close()
+
+	params := url.Values{}
+	params.Set("url", srv.URL+"/twtxt.txt")
+	params.Set("nickname", "garbled")
+	req := httptest.NewRequest("POST", "http://localhost"+testport+"/api/plain/users?"+params.Encode(), nil)
+	rr := httptest.NewRecorder()
+	apiEndpointPOSTHandler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 Bad Request, but received: %v\n", rr.Code)
+	}
+	if _, err := twtxtCache.Get(srv.URL + "/twtxt.txt"); err == nil {
+		t.Errorf("User with no parseable lines was added to the registry\n")
+	}
+}
+
+// A new user should be in the database as soon
+// as the submission succeeds.
+func Test_apiPostUser_WriteThrough(t *testing.T) {
+	initTestConf()
+	initTestDB()
+	twtxtCache = registry.New(nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("2019-09-05T15:19:28Z\thi\n"))
+	}))
+	defer srv.Close()
+
+	urls := srv.URL + "/twtxt.txt"
+	params := url.Values{}
+	params.Set("url", urls)
+	params.Set("nickname", "durable")
+	req := httptest.NewRequest("POST", "http://localhost"+testport+"/api/plain/users?"+params.Encode(), nil)
+	rr := httptest.NewRecorder()
+	apiEndpointPOSTHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, but received: %v\n", rr.Code)
+	}
+	if twtxtCache.Dirty() {
+		t.Errorf("New user left unsaved\n")
+	}
+
+	db := <-dbChan
+	users, _, err := db.LoadAll()
+	dbChan <- db
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if user, ok := users[urls]; !ok || len(user.Status) != 1 {
+		t.Errorf("New user not stored: %v\n", user)
+	}
+	errLog("", delUser(urls))
+}
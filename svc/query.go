@@ -20,13 +20,17 @@ along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
 package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"git.sr.ht/~gbmor/getwtxt/registry"
 	"github.com/gorilla/mux"
@@ -73,6 +77,137 @@ func parseQueryOut(out []string) []byte {
 	return data
 }
 
+// Formats a user's statistics for an HTTP response.
+// Each line is a tab-separated key and value. Ranked
+// tags and mentions get one line per entry, with
+// the number of occurrences in the third column.
+func parseUserStats(stats *registry.UserStats) []byte {
+	var buf bytes.Buffer
+	var first, last string
+	if !stats.First.IsZero() {
+		first = stats.First.Format(time.RFC3339)
+		last = stats.Last.Format(time.RFC3339)
+	}
+
+	fmt.Fprintf(&buf, "nick\t%v\n", stats.Nick)
+	fmt.Fprintf(&buf, "url\t%v\n", stats.URL)
+	fmt.Fprintf(&buf, "twts\t%v\n", stats.Twts)
+	fmt.Fprintf(&buf, "first\t%v\n", first)
+	fmt.Fprintf(&buf, "last\t%v\n", last)
+	fmt.Fprintf(&buf, "per_day\t%.2f\n", stats.PerDay)
+	fmt.Fprintf(&buf, "per_week\t%.2f\n", stats.PerWeek)
+	fmt.Fprintf(&buf, "mentions_received\t%v\n", stats.MentionsReceived)
+
+	for _, e := range stats.TopTags {
+		fmt.Fprintf(&buf, "tag\t%v\t%v\n", e.Key, e.N)
+	}
+	for _, e := range stats.TopMentions {
+		fmt.Fprintf(&buf, "mention\t%v\t%v\n", e.Key, e.N)
+	}
+
+	return buf.Bytes()
+}
+
+// Formats the users for the admin API, in order of URL.
+// Each user is a block of tab-separated lines, giving
+// their metadata and the outcome of the last fetch of
+// their twtxt file, and blocks are separated by a
+// blank line.
+func parseUserList(users map[string]*registry.User) []byte {
+	var buf bytes.Buffer
+
+	keys := make([]string, 0, len(users))
+	for k := range users {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		user := users[k]
+		user.Mu.RLock()
+		var ip, fetched string
+		if user.IP != nil {
+			ip = user.IP.String()
+		}
+		if !user.Fetch.Time.IsZero() {
+			fetched = user.Fetch.Time.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(&buf, "url\t%v\n", k)
+		fmt.Fprintf(&buf, "nick\t%v\n", user.Nick)
+		fmt.Fprintf(&buf, "ip\t%v\n", ip)
+		fmt.Fprintf(&buf, "date\t%v\n", user.Date)
+		fmt.Fprintf(&buf, "last_modified\t%v\n", user.LastModified)
+		fmt.Fprintf(&buf, "remote_registry\t%v\n", user.RemoteRegistry)
+		fmt.Fprintf(&buf, "statuses\t%v\n", len(user.Status))
+		fmt.Fprintf(&buf, "fetched\t%v\n", fetched)
+		fmt.Fprintf(&buf, "fetch_error\t%v\n", user.Fetch.Err)
+		fmt.Fprintf(&buf, "truncated\t%v\n", user.Fetch.Truncated)
+		fmt.Fprintf(&buf, "bad_lines\t%v\n", user.Fetch.BadLines)
+		fmt.Fprintf(&buf, "content_type\t%v\n", user.Fetch.ContentType)
+		fmt.Fprintf(&buf, "charset\t%v\n", user.Fetch.Charset)
+		user.Mu.RUnlock()
+	}
+
+	return buf.Bytes()
+}
+
+// Formats a single status for an HTTP response, as
+// tab-separated lines, followed by an edit line for each
+// earlier version, oldest first, giving when the change
+// was seen and the text before it.
+func parseStatusDetail(status *registry.Status) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "nick\t%v\n", status.Nick)
+	fmt.Fprintf(&buf, "url\t%v\n", status.URL)
+	fmt.Fprintf(&buf, "time\t%v\n", status.Time.Format(time.RFC3339Nano))
+	fmt.Fprintf(&buf, "text\t%v\n", status.Text)
+	fmt.Fprintf(&buf, "edits\t%v\n", len(status.Edits))
+
+	for _, e := range status.Edits {
+		fmt.Fprintf(&buf, "edit\t%v\t%v\n", e.Seen.Format(time.RFC3339), e.Text)
+	}
+
+	return buf.Bytes()
+}
+
+// Formats a validation report for an HTTP response. The
+// summary and each finding are tab-separated lines. Findings
+// give the severity, then line:column, or "-" if they apply
+// to the whole file, then the message. After a blank line
+// follows the requested page of the statuses that would
+// be indexed.
+func parseReport(report *registry.Report, page int) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "valid\t%v\n", report.Valid())
+	if report.ContentType != "" {
+		fmt.Fprintf(&buf, "content_type\t%v\n", report.ContentType)
+		fmt.Fprintf(&buf, "charset\t%v\n", report.Charset)
+	}
+	fmt.Fprintf(&buf, "statuses\t%v\n", len(report.Preview))
+
+	for _, e := range report.Findings {
+		pos := "-"
+		if e.Line > 0 {
+			pos = fmt.Sprintf("%v:%v", e.Line, e.Column)
+		}
+		fmt.Fprintf(&buf, "%v\t%v\t%v\n", e.Severity, pos, e.Message)
+	}
+
+	if len(report.Preview) > 0 {
+		buf.WriteString("\n")
+		buf.Write(parseQueryOut(registry.FormatStatuses(registry.ReduceStatusesToPage(page, report.Preview))))
+		buf.WriteString("\n")
+	}
+
+	return buf.Bytes()
+}
+
 // apiEndpointQuery is called via apiEndpointHandler when
 // the endpoint is "users" and r.FormValue("q") is not empty.
 // It queries the registry cache for users or user URLs
@@ -115,12 +250,12 @@ func apiEndpointQuery(w http.ResponseWriter, r *http.Request) error {
 		if urls == "" {
 			return fmt.Errorf("missing URL in mention query")
 		}
-		urls += ">"
-		out, err = twtxtCache.QueryInStatus(urls)
+		statuses, err := queryStatuses(r.Context(), registry.StatusQuery{Mentions: []string{urls}, Limit: pageLimit(page)})
 		apiErrCheck(err, r)
+		out = registry.FormatStatuses(statuses)
 
 	case "tweets":
-		out = compositeStatusQuery(query, r)
+		out = compositeStatusQuery(query, pageLimit(page), r)
 
 	default:
 		return fmt.Errorf("endpoint query, no cases match")
@@ -147,29 +282,35 @@ func joinQueryOuts(data ...[]string) []string {
 	return dedupe(single)
 }
 
-// Performs a composite query against the statuses.
-func compositeStatusQuery(query string, r *http.Request) []string {
+// Performs a composite query against the statuses,
+// returning at most limit of them unless it's zero.
+func compositeStatusQuery(query string, limit int, r *http.Request) []string {
 	var wg sync.WaitGroup
 	var out, out2, out3 []string
 	var err, err2, err3 error
 
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+
 	wg.Add(3)
 
 	query = strings.ToLower(query)
 	go func(query string) {
-		out, err = twtxtCache.QueryInStatus(query)
+		out, err = queryInStatusLines(ctx, query, limit)
 		wg.Done()
 	}(query)
 
 	query = strings.Title(query)
 	go func(query string) {
-		out2, err2 = twtxtCache.QueryInStatus(query)
+		out2, err2 = queryInStatusLines(ctx, query, limit)
 		wg.Done()
 	}(query)
 
 	query = strings.ToUpper(query)
 	go func(query string) {
-		out3, err3 = twtxtCache.QueryInStatus(query)
+		out3, err3 = queryInStatusLines(ctx, query, limit)
 		wg.Done()
 	}(query)
 
@@ -181,3 +322,44 @@ func compositeStatusQuery(query string, r *http.Request) []string {
 
 	return joinQueryOuts(out, out2, out3)
 }
+
+// Queries the statuses for a substring,
+// formatting them for the plain API.
+func queryInStatusLines(ctx context.Context, substring string, limit int) ([]string, error) {
+	if substring == "" {
+		return nil, fmt.Errorf("cannot query for empty tag")
+	}
+	statuses, err := queryStatuses(ctx, registry.StatusQuery{Substring: substring, Limit: limit})
+	return registry.FormatStatuses(statuses), err
+}
+
+// The number of statuses needed to fill the requested
+// page. Pages before the first are served as the last
+// page, so every status is needed to find them.
+func pageLimit(page int) int {
+	if page < 1 {
+		return 0
+	}
+	return 20 * page
+}
+
+// Runs a status query in the database if it can answer it
+// itself and isn't in use, or over the cache otherwise. See
+// registry.QueryStatuses for how the results can differ.
+// The database is handed back before the query runs, so
+// pushes aren't held up; the databases that can answer
+// queries can be read while they're written to.
+func queryStatuses(ctx context.Context, q registry.StatusQuery) ([]*registry.Status, error) {
+	var store registry.Storage
+	select {
+	case db, ok := <-dbChan:
+		if ok {
+			if _, ok := db.(registry.QueryStorage); ok {
+				store = db
+			}
+			dbChan <- db
+		}
+	default:
+	}
+	return twtxtCache.QueryStatusesContext(ctx, store, q)
+}
@@ -20,10 +20,15 @@ along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
 package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
 
 import (
+	"context"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"git.sr.ht/~gbmor/getwtxt/registry"
 )
@@ -77,11 +82,12 @@ func Test_parseQueryOut(t *testing.T) {
 	twtxtCache.AddUser(nick, urls, net.ParseIP("127.0.0.1"), statusmap)
 
 	t.Run("Parsing Status Query", func(t *testing.T) {
-		data, err := twtxtCache.QueryAllStatuses()
+		statuses, err := twtxtCache.QueryAllStatuses()
 		if err != nil {
 			t.Errorf("%v\n", err)
 		}
 
+		data := registry.FormatStatuses(statuses)
 		out := parseQueryOut(data)
 
 		conv := strings.Split(string(out), "\n")
@@ -110,10 +116,11 @@ func Benchmark_parseQueryOut(b *testing.B) {
 
 	twtxtCache.AddUser(nick, urls, net.ParseIP("127.0.0.1"), statusmap)
 
-	data, err := twtxtCache.QueryAllStatuses()
+	statuses, err := twtxtCache.QueryAllStatuses()
 	if err != nil {
 		b.Errorf("%v\n", err)
 	}
+	data := registry.FormatStatuses(statuses)
 
 	b.ResetTimer()
 
@@ -188,12 +195,12 @@ func Test_compositeStatusQuery(t *testing.T) {
 		}
 
 		outro := make([]string, 0)
-		outro = append(outro, out1...)
-		outro = append(outro, out2...)
-		outro = append(outro, out3...)
+		outro = append(outro, registry.FormatStatuses(out1)...)
+		outro = append(outro, registry.FormatStatuses(out2)...)
+		outro = append(outro, registry.FormatStatuses(out3)...)
 		out := dedupe(outro)
 
-		data := compositeStatusQuery("sqlite", nil)
+		data := compositeStatusQuery("sqlite", 0, nil)
 
 		if !reflect.DeepEqual(out, data) {
 			t.Errorf("Returning different data.\nManual: %v\nCompositeQuery: %v\n", out, data)
@@ -209,7 +216,70 @@ func Benchmark_compositeStatusQuery(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		compositeStatusQuery("sqlite", nil)
+		compositeStatusQuery("sqlite", 0, nil)
 	}
 
 }
+
+// Queries pushed down to the database should
+// give the same results as the cache.
+func Test_queryStatuses(t *testing.T) {
+	initTestConf()
+	initTestDB()
+	dir, err := ioutil.TempDir("", "getwtxt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := openDB("sqlite", filepath.Join(dir, "getwtxt.db"))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	held := <-dbChan
+	dbChan <- store
+	defer func() {
+		<-dbChan
+		dbChan <- held
+		store.Close()
+	}()
+
+	urlKey := "https://example.com/twtxt.txt"
+	then := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+	statuses := registry.NewTimeMap()
+	for i := 0; i < 3; i++ {
+		at := then.Add(time.Duration(i) * time.Hour)
+		statuses[at] = registry.NewStatus("foo", urlKey, at, "hi @<bar https://bar.example.com/twtxt.txt>")
+	}
+	twtxtCache = registry.New(nil)
+	twtxtCache.AddUser("foo", urlKey, nil, statuses)
+
+	q := registry.StatusQuery{Mentions: []string{"https://bar.example.com/twtxt.txt"}}
+	fromCache, err := queryStatuses(context.Background(), q)
+	if err != nil || len(fromCache) != 3 {
+		t.Fatalf("Unexpected result: %v, %v\n", fromCache, err)
+	}
+
+	if err := twtxtCache.Save(store); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	fromDB, err := queryStatuses(context.Background(), q)
+	if err != nil || len(fromDB) != len(fromCache) {
+		t.Fatalf("Unexpected result: %v, %v\n", fromDB, err)
+	}
+	for i := range fromDB {
+		if fromDB[i].Key() != fromCache[i].Key() {
+			t.Errorf("Status %v differs: %v != %v\n", i, fromDB[i], fromCache[i])
+		}
+	}
+
+	// a status only on disk shows the query was pushed down
+	later := then.Add(time.Hour * 5)
+	extra := registry.TimeMap{later: registry.NewStatus("foo", urlKey, later, "hi @<bar https://bar.example.com/twtxt.txt>")}
+	if err := store.PutStatuses(urlKey, extra); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if out, _ := queryStatuses(context.Background(), q); len(out) != 4 {
+		t.Errorf("Expected query to run in the database, got %v statuses\n", len(out))
+	}
+}
@@ -38,6 +38,7 @@ func Start() {
 	// to serve the same content without duplicating
 	// handlers/paths
 	index := mux.NewRouter().StrictSlash(true)
+	countRequests(index)
 	setIndexRouting(index)
 
 	// Serve the raw contents of this directory so users can
@@ -88,12 +89,42 @@ func setIndexRouting(index *mux.Router) {
 	index.Path("/api").
 		Methods("GET", "HEAD").
 		HandlerFunc(apiBaseHandler)
+	index.Path("/healthz").
+		Methods("GET", "HEAD").
+		HandlerFunc(healthzHandler)
+	index.Path("/readyz").
+		Methods("GET", "HEAD").
+		HandlerFunc(readyzHandler)
+	index.Path("/metrics").
+		Methods("GET", "HEAD").
+		HandlerFunc(metricsHandler)
 }
 
 func setEndpointRouting(api *mux.Router) {
+	api.Path("/admin/users").
+		Methods("GET").
+		HandlerFunc(handleUserList)
 	api.Path("/admin/users").
 		Methods("DELETE").
 		HandlerFunc(handleUserDelete)
+	api.Path("/admin/users/nick").
+		Methods("POST").
+		HandlerFunc(handleUserNick)
+	api.Path("/admin/users/refresh").
+		Methods("POST").
+		HandlerFunc(handleUserRefresh)
+	api.Path("/admin/users/purge").
+		Methods("POST").
+		HandlerFunc(handleUserPurge)
+	api.Path("/admin/push").
+		Methods("POST").
+		HandlerFunc(handlePush)
+	api.Path("/admin/export").
+		Methods("GET").
+		HandlerFunc(handleExport)
+	api.Path("/admin/import").
+		Methods("POST").
+		HandlerFunc(handleImport)
 
 	// May add support for other formats later.
 	// Making this future-proof.
@@ -107,6 +138,11 @@ func setEndpointRouting(api *mux.Router) {
 		Methods("GET", "HEAD").
 		HandlerFunc(apiAllTweetsHandler)
 
+	// A single status, along with its earlier versions.
+	api.Path("/{format:(?:plain)}/tweets/detail").
+		Methods("GET", "HEAD").
+		HandlerFunc(apiStatusDetailHandler)
+
 	// Specifying the endpoint with and without query information.
 	// Will return 404 on empty queries otherwise.
 	api.Path("/{format:(?:plain)}/{endpoint:(?:mentions|users|tweets|version)}").
@@ -117,6 +153,23 @@ func setEndpointRouting(api *mux.Router) {
 		Methods("GET", "HEAD").
 		HandlerFunc(apiEndpointHandler)
 
+	// Statistics for a single user
+	api.Path("/{format:(?:plain)}/users/stats").
+		Queries("url", "{url}").
+		Methods("GET", "HEAD").
+		HandlerFunc(apiUserStatsHandler)
+	api.Path("/{format:(?:plain)}/users/stats").
+		Methods("GET", "HEAD").
+		HandlerFunc(apiUserStatsHandler)
+
+	// Checks a twtxt file without adding it
+	api.Path("/{format:(?:plain)}/validate").
+		Methods("GET", "HEAD").
+		HandlerFunc(apiValidateHandler)
+	api.Path("/{format:(?:plain)}/validate").
+		Methods("POST").
+		HandlerFunc(apiValidatePOSTHandler)
+
 	// This is for submitting new users. Both query variables must exist
 	// in the request for this to match.
 	api.Path("/{format:(?:plain)}/{endpoint:users}").
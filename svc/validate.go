@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+)
+
+// handles "/api/plain/validate?url="
+// Fetches and parses a twtxt file the same way as
+// adding a user, without storing anything, and
+// responds with what was found.
+func apiValidateHandler(w http.ResponseWriter, r *http.Request) {
+	errLog("Error when parsing query values: ", r.ParseForm())
+
+	urls := strings.TrimSpace(r.FormValue("url"))
+	if urls == "" {
+		errHTTP(w, r, fmt.Errorf("missing URL to validate"), http.StatusBadRequest)
+		return
+	}
+
+	report := twtxtCache.ValidateURLContext(r.Context(), urls, r.FormValue("nickname"))
+	writeReport(w, r, report)
+}
+
+// handles POST "/api/plain/validate"
+// Validates a twtxt file sent as the request body,
+// which is expected to be UTF-8.
+func apiValidatePOSTHandler(w http.ResponseWriter, r *http.Request) {
+	twtxtCache.Mu.RLock()
+	limits := twtxtCache.Limits
+	twtxtCache.Mu.RUnlock()
+
+	query := r.URL.Query()
+	report, err := registry.ValidateTwtxt(r.Body, query.Get("nickname"), query.Get("url"), limits)
+	if err != nil {
+		errHTTP(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	writeReport(w, r, report)
+}
+
+func writeReport(w http.ResponseWriter, r *http.Request, report *registry.Report) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil {
+		page = 1
+	}
+
+	data := parseReport(report, page)
+	w.Header().Set("Content-Type", txtutf8)
+	if _, err := w.Write(data); err != nil {
+		errHTTP(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log200(r)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2019 Ben Morrison (gbmor)
+
+This file is part of Getwtxt.
+
+Getwtxt is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Getwtxt is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Getwtxt.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package svc // import "git.sr.ht/~gbmor/getwtxt/svc"
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~gbmor/getwtxt/registry"
+	"github.com/gorilla/mux"
+)
+
+func Test_apiValidateHandler(t *testing.T) {
+	initTestConf()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("# nick = foo\n2020-02-04T21:28:21Z\thello\nnot a status\n"))
+	}))
+	defer srv.Close()
+	twtxtCache = registry.New(srv.Client())
+
+	router := mux.NewRouter()
+	setEndpointRouting(router.PathPrefix("/api").Subrouter())
+
+	t.Run("Missing URL", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://localhost"+testport+"/api/plain/validate", nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %v\n", w.Code)
+		}
+	})
+
+	t.Run("GET", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://localhost"+testport+"/api/plain/validate?url="+srv.URL+"/twtxt.txt", nil)
+		router.ServeHTTP(w, req)
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200, got %v\n", resp.StatusCode)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		for _, e := range []string{"valid\ttrue\n", "content_type\ttext/plain\n", "statuses\t1\n", "warning\t3:13\t", "\nfoo\t" + srv.URL} {
+			if !strings.Contains(string(data), e) {
+				t.Errorf("Expected %q in report:\n%s\n", e, data)
+			}
+		}
+		if len(twtxtCache.Users) != 0 {
+			t.Errorf("Validation added a user\n")
+		}
+	})
+
+	t.Run("POST", func(t *testing.T) {
+		body := strings.NewReader("# nick = bar\n# url = https://example.com/twtxt.txt\n2020-02-04T21:28:21Z\thello\n")
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://localhost"+testport+"/api/plain/validate?url=https://example.com/twtxt.txt", body)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %v\n", w.Code)
+		}
+		data := w.Body.String()
+		if !strings.HasPrefix(data, "valid\ttrue\nstatuses\t1\n") || !strings.Contains(data, "bar\thttps://example.com/twtxt.txt\t") {
+			t.Errorf("Unexpected report:\n%s\n", data)
+		}
+	})
+
+	// Validation should agree with submitting the file.
+	t.Run("Matches Registration", func(t *testing.T) {
+		initTestDB()
+		files := map[string]string{
+			"/good.txt":     "# nick = foo\n2020-02-04T21:28:21Z\thello\nnot a status\n",
+			"/bad.txt":      "# nick = foo\nnot a status\n",
+			"/metadata.txt": "# nick = foo\n",
+		}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(files[r.URL.Path]))
+		}))
+		defer srv.Close()
+		twtxtCache = registry.New(srv.Client())
+
+		for path := range files {
+			urlKey := srv.URL + path
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+testport+"/api/plain/validate?url="+urlKey, nil))
+			valid := strings.HasPrefix(w.Body.String(), "valid\ttrue\n")
+
+			params := url.Values{}
+			params.Set("url", urlKey)
+			params.Set("nickname", "foo")
+			w = httptest.NewRecorder()
+			apiEndpointPOSTHandler(w, httptest.NewRequest("POST", "http://localhost"+testport+"/api/plain/users?"+params.Encode(), nil))
+			accepted := w.Code == http.StatusOK
+
+			if valid != accepted {
+				t.Errorf("%v: valid %v, but accepted %v\n", path, valid, accepted)
+			}
+			if want := path == "/good.txt"; accepted != want {
+				t.Errorf("%v: expected accepted %v, got %v\n", path, want, accepted)
+			}
+		}
+	})
+}